@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/config"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+)
+
+const catalogUsage = `usage:
+  ad-normalizer export <file>
+  ad-normalizer import [-mode merge|overwrite] <file>
+  ad-normalizer migrate-keys`
+
+// Runs the export, import or migrate-keys subcommand against the configured store. The export is written
+// to a file, since the logs go to stdout.
+func runCatalogCommand(config *config.AdNormalizerConfig, dataStore store.Store, args []string) error {
+	switch args[0] {
+	case "export":
+		if len(args) != 2 {
+			return errors.New(catalogUsage)
+		}
+		return exportCatalog(dataStore, args[1])
+	case "import":
+		flags := flag.NewFlagSet("import", flag.ContinueOnError)
+		mode := flags.String("mode", store.IMPORT_MERGE, "merge keeps existing records, overwrite replaces them")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New(catalogUsage)
+		}
+		return importCatalog(config, dataStore, flags.Arg(0), *mode)
+	case "migrate-keys":
+		if len(args) != 1 {
+			return errors.New(catalogUsage)
+		}
+		valkeyStore, ok := dataStore.(*store.ValkeyStore)
+		if !ok {
+			return errors.New("migrate-keys only applies to the Valkey store")
+		}
+		return valkeyStore.MigrateKeys(context.Background())
+	default:
+		return fmt.Errorf("unknown command %s\n%s", args[0], catalogUsage)
+	}
+}
+
+func exportCatalog(dataStore store.Store, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	if err := store.Export(context.Background(), dataStore, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	logger.Info("Exported store", slog.String("file", path))
+	return nil
+}
+
+func importCatalog(config *config.AdNormalizerConfig, dataStore store.Store, path string, mode string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+	result, err := store.Import(dataStore, file, store.ImportOptions{
+		Mode:             mode,
+		PackagingQueue:   config.PackagingQueueName,
+		PackagingTimeout: time.Duration(config.PackagingTimeout) * time.Second,
+		OutputBucket:     config.BucketUrl.String(),
+	})
+	logger.Info("Imported into store",
+		slog.String("file", path),
+		slog.String("mode", mode),
+		slog.Int("creatives", result.Creatives),
+		slog.Int("blacklist", result.Blacklist),
+		slog.Int("packagingJobs", result.PackagingJobs),
+		slog.Int("skipped", result.Skipped),
+	)
+	// The records before an invalid line are imported, so they are snapshotted also on errors
+	if memoryStore, ok := dataStore.(*store.MemoryStore); ok && config.StoreSnapshotFile != "" {
+		err = errors.Join(err, memoryStore.Snapshot())
+	}
+	return err
+}
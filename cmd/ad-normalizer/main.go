@@ -20,7 +20,9 @@ import (
 	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
 	"github.com/Eyevinn/ad-normalizer/internal/osaas"
 	"github.com/Eyevinn/ad-normalizer/internal/serve"
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
 	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	osaasclient "github.com/EyevinnOSC/client-go"
 	"github.com/joho/godotenv"
 	"github.com/klauspost/compress/gzhttp"
@@ -60,21 +62,68 @@ func main() {
 		logger.Error("Failed to read configuration", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
-	api, err := setupApi(&config, reportKpi)
+	dataStore, err := setupStore(&config)
+	if err != nil {
+		logger.Error("Failed to set up store", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 {
+		if err := runCatalogCommand(&config, dataStore, os.Args[1:]); err != nil {
+			logger.Error("Command failed", slog.String("command", os.Args[1]), slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+	memoryStore, snapshots := dataStore.(*store.MemoryStore)
+	if snapshots {
+		go memoryStore.RunExpirySweeps(ctx, time.Minute)
+	}
+	snapshots = snapshots && config.StoreSnapshotFile != ""
+	if snapshots {
+		go memoryStore.RunSnapshots(ctx, time.Duration(config.StoreSnapshotInterval)*time.Second)
+	}
+	if valkeyStore, ok := dataStore.(*store.ValkeyStore); ok {
+		if config.TimeIndexPruneInterval > 0 {
+			go valkeyStore.RunTimeIndexPruner(ctx, time.Duration(config.TimeIndexPruneInterval)*time.Second)
+		}
+		go valkeyStore.RunCacheInvalidation(ctx)
+	}
+	api, err := setupApi(&config, dataStore, reportKpi)
+	if err != nil {
+		logger.Error("Failed to set up API", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if !config.JitPackage && config.PackagingMode == "queue" {
+		go api.RunPackagingWatchdog(ctx, time.Minute)
+	}
+	if config.StorageCleanup && config.OrphanSweepInterval > 0 {
+		go api.RunOrphanSweeper(ctx, time.Duration(config.OrphanSweepInterval)*time.Second)
+	}
+	go api.RunWebhookDelivery(ctx, 5*time.Second)
+	go api.RunEventSubscription(ctx)
 
 	apiMux := http.NewServeMux()
 	apiMux.HandleFunc("/vmap", api.HandleVmap)
 	apiMux.HandleFunc("/vast", api.HandleVast)
 	apiMux.HandleFunc("/blacklist", api.HandleBlackList)
 	apiMux.HandleFunc("/jobs", api.HandleJobList)
+	// Only GET, since /jobs/events would otherwise conflict with DELETE /jobs/{id}
+	apiMux.HandleFunc("GET /jobs/events", api.HandleJobEvents)
+	apiMux.HandleFunc("GET /jobs/{id}", api.HandleGetJob)
+	apiMux.HandleFunc("DELETE /jobs/{id}", api.HandleDeleteJob)
+	apiMux.HandleFunc("POST /jobs/{id}/retranscode", api.HandleRetranscode)
+	apiMux.HandleFunc("GET /jobs/{id}/history", api.HandleJobHistory)
 	apiMux.HandleFunc("/preingest", api.HandlePreIngestCreatives)
+	apiMux.HandleFunc("/webhooks", api.HandleWebhooks)
+	apiMux.HandleFunc("/export", api.HandleExport)
+	apiMux.HandleFunc("/import", api.HandleImport)
 
 	packagerMux := http.NewServeMux()
 	packagerMux.HandleFunc("/success", api.HandlePackagingSuccess)
 	packagerMux.HandleFunc("/failure", api.HandlePackagingFailure)
 
 	apiMuxChain := setupMiddleWare(apiMux, "api", otelEnabled)
-	packagerMuxChain := setupMiddleWare(packagerMux, "packager", otelEnabled)
+	packagerMuxChain := setupMiddleWare(api.VerifyPackagerCallback(packagerMux), "packager", otelEnabled)
 	mainmux := http.NewServeMux()
 
 	mainmux.HandleFunc("/encoreCallback", api.HandleEncoreCallback)
@@ -113,6 +162,11 @@ func main() {
 	} else {
 		logger.Info("Server gracefully stopped")
 	}
+	if snapshots {
+		if err := memoryStore.Snapshot(); err != nil {
+			logger.Error("Failed to snapshot memory store", slog.String("error", err.Error()))
+		}
+	}
 }
 
 func healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -178,12 +232,48 @@ func setupKpiReporting(config *config.AdNormalizerConfig) (func(normalizerMetric
 	return reportKpi, cancelKpi
 }
 
+func setupStore(config *config.AdNormalizerConfig) (store.Store, error) {
+	if config.Store == "sqlite" || config.Store == "postgres" {
+		logger.Info("Using the SQL store", slog.String("dialect", config.Store))
+		return store.NewSqlStore(config.Store, config.StoreDsn)
+	}
+	if config.Store == "memory" {
+		var storeOpts []store.MemoryStoreOption
+		if config.StoreSnapshotFile != "" {
+			storeOpts = append(storeOpts, store.WithSnapshotFile(config.StoreSnapshotFile))
+		}
+		logger.Info("Using the in-memory store", slog.String("snapshotFile", config.StoreSnapshotFile))
+		return store.NewMemoryStore(storeOpts...)
+	}
+	storeOpts := []store.ValkeyStoreOption{
+		store.WithKeyPrefix(config.ValkeyKeyPrefix),
+		store.WithTenant(config.ValkeyTenant),
+	}
+	if config.ValkeyCluster {
+		storeOpts = append(storeOpts, store.WithCluster())
+	}
+	if config.ValkeyCacheSize > 0 {
+		cacheTtl := time.Duration(config.ValkeyCacheTtl) * time.Second
+		storeOpts = append(storeOpts, store.WithCache(config.ValkeyCacheSize, cacheTtl))
+	}
+	if config.PackagingQueueType == "stream" {
+		storeOpts = append(storeOpts, store.WithStreamPackagingQueue(config.PackagingQueueGroup))
+	}
+	valkeyStore, err := store.NewValkeyStore(config.ValkeyUrl, storeOpts...)
+	if err != nil {
+		logger.Error("Failed to create Valkey store", slog.String("error", err.Error()))
+		return nil, err
+	}
+	logger.Debug("Valkey store created successfully")
+	return valkeyStore, nil
+}
+
 func setupApi(
 	config *config.AdNormalizerConfig,
+	valkeyStore store.Store,
 	kpiReportFunc func(normalizerMetrics.AdsHandledEventArguments),
 ) (*serve.API, error) {
-
-	valkeyStore, err := store.NewValkeyStore(config.ValkeyUrl)
+	var err error
 	var oscCtx *osaasclient.Context
 	if config.OscToken != "" {
 		oscCtx, err = osaas.SetupOsc(config)
@@ -193,6 +283,40 @@ func setupApi(
 		}
 	}
 	client := &http.Client{}
+
+	var objectStore storage.ObjectStore
+	if config.S3Endpoint.Host != "" {
+		objectStore, err = storage.NewS3ObjectStore(
+			config.S3Endpoint,
+			config.S3AccessKey,
+			config.S3SecretKey,
+			config.S3Region,
+			config.Bucket,
+		)
+		if err != nil {
+			logger.Error("Failed to create S3 object store", slog.String("error", err.Error()))
+			return nil, err
+		}
+	}
+
+	if config.Transcoder == "ffmpeg" {
+		outputStore := objectStore
+		if config.FfmpegOutputDir != "" {
+			outputStore = storage.NewLocalObjectStore(config.FfmpegOutputDir)
+		}
+		ffmpegBackend := transcoder.NewFfmpegBackend(
+			config.FfmpegPath,
+			config.FfprobePath,
+			outputStore,
+			config.BucketUrl.Path,
+			config.FfmpegConcurrency,
+		)
+		logger.Info("Using the ffmpeg transcoder", slog.Int("concurrency", config.FfmpegConcurrency))
+		api := serve.NewAPI(valkeyStore, *config, ffmpegBackend, client, kpiReportFunc, outputStore)
+		ffmpegBackend.SetUpdateHandler(api.HandleJobUpdate)
+		return api, nil
+	}
+
 	encoreHandler := encore.NewHttpEncoreHandler(
 		http.DefaultClient,
 		config.EncoreUrl,
@@ -200,13 +324,8 @@ func setupApi(
 		oscCtx,
 		config.BucketUrl,
 		config.RootUrl,
+		config.CallbackSecret,
 	)
-
-	if err != nil {
-		logger.Error("Failed to create Valkey store", slog.String("error", err.Error()))
-		return nil, err
-	}
-	logger.Debug("Valkey store created successfully")
-	api := serve.NewAPI(valkeyStore, *config, encoreHandler, client, kpiReportFunc)
+	api := serve.NewAPI(valkeyStore, *config, encoreHandler, client, kpiReportFunc, objectStore)
 	return api, nil
 }
@@ -5,7 +5,6 @@ import (
 	"log/slog"
 	"net/url"
 	"os"
-	"path"
 	"strconv"
 	"strings"
 
@@ -14,13 +13,23 @@ import (
 )
 
 type AdNormalizerConfig struct {
-	EncoreUrl          url.URL
-	Bucket             string
-	AdServerUrl        url.URL
-	ValkeyUrl          string
-	ValkeyCluster      bool
+	// "encore" or "ffmpeg"
+	Transcoder  string
+	EncoreUrl   url.URL
+	Bucket      string
+	AdServerUrl url.URL
+	// "valkey", "memory", "sqlite" or "postgres"
+	Store string
+	// Database file of the sqlite store or connection URL of the postgres store
+	StoreDsn      string
+	ValkeyUrl     string
+	ValkeyCluster bool
+	// Namespace of the keys in Valkey, <prefix>:<tenant>:
+	ValkeyKeyPrefix    string
+	ValkeyTenant       string
 	OscToken           string
 	InFlightTtl        int
+	FailedTtl          int
 	KeyField           string
 	KeyRegex           string
 	EncoreProfile      string
@@ -34,15 +43,68 @@ type AdNormalizerConfig struct {
 	Environment        string
 	Port               int
 	KpiPostUrl         string
+	SourceValidation   bool
+	SourceMaxSize      int64
+	SourceCacheTtl     int
+	S3Endpoint         url.URL
+	S3AccessKey        string
+	S3SecretKey        string
+	S3Region           string
+	MirrorSources      bool
+	CallbackSecret     string
+	// "sortedset" or "stream"
+	PackagingQueueType  string
+	PackagingQueueGroup string
+	PackagingTimeout    int
+	PackagingMaxRetries int
+	// "queue" for an external packager or "builtin"
+	PackagingMode string
+	// Webhooks receiving events for all creatives, in addition to the registered ones
+	WebhookUrls        []string
+	WebhookSecret      string
+	WebhookMaxAttempts int
+	FfmpegPath         string
+	FfprobePath        string
+	FfmpegConcurrency  int
+	// Local directory receiving the ffmpeg output, instead of the S3 bucket
+	FfmpegOutputDir string
+	// Remove assets from the bucket when creatives fail or are deleted
+	StorageCleanup      bool
+	OrphanSweepInterval int
+	OrphanMinAge        int
+	// Local file the memory store is snapshotted to, if empty the state is lost on restart
+	StoreSnapshotFile     string
+	StoreSnapshotInterval int
+
+	// Interval of the removal of expired creatives from the Valkey time index, 0 disables it
+	TimeIndexPruneInterval int
+	// Number of entries in the in-process cache of the Valkey store, 0 disables it
+	ValkeyCacheSize int
+	ValkeyCacheTtl  int
+	// Hosts that pre-ingest ad tags may be fetched from, "*" allows any host
+	AdTagHosts []string
 }
 
 func ReadConfig() (AdNormalizerConfig, error) {
 	conf := AdNormalizerConfig{}
-	encoreUrl, found := os.LookupEnv("ENCORE_URL")
 	var err error
+	transcoder, found := os.LookupEnv("TRANSCODER")
+	switch {
+	case !found:
+		conf.Transcoder = "encore"
+	case transcoder == "encore" || transcoder == "ffmpeg":
+		conf.Transcoder = transcoder
+	default:
+		logger.Error("Invalid TRANSCODER", slog.String("value", transcoder))
+		err = errors.Join(err, errors.New("invalid TRANSCODER, must be one of encore, ffmpeg"))
+	}
+
+	encoreUrl, found := os.LookupEnv("ENCORE_URL")
 	if !found {
-		logger.Error("No environment variable ENCORE_URL was found")
-		err = errors.Join(err, errors.New("missing ENCORE_URL environment variable"))
+		if conf.Transcoder == "encore" {
+			logger.Error("No environment variable ENCORE_URL was found")
+			err = errors.Join(err, errors.New("missing ENCORE_URL environment variable"))
+		}
 	} else {
 		parsed, err := url.Parse(strings.TrimSuffix(encoreUrl, "/"))
 		if err != nil {
@@ -53,16 +115,92 @@ func ReadConfig() (AdNormalizerConfig, error) {
 		conf.EncoreUrl = *parsed
 	}
 
+	storeType, found := os.LookupEnv("STORE")
+	switch {
+	case !found:
+		conf.Store = "valkey"
+	case storeType == "valkey" || storeType == "memory" || storeType == "sqlite" || storeType == "postgres":
+		conf.Store = storeType
+	default:
+		logger.Error("Invalid STORE", slog.String("value", storeType))
+		err = errors.Join(err, errors.New("invalid STORE, must be one of valkey, memory, sqlite, postgres"))
+	}
+
+	conf.StoreDsn, _ = os.LookupEnv("STORE_DSN")
+	if (conf.Store == "sqlite" || conf.Store == "postgres") && conf.StoreDsn == "" {
+		logger.Error("No environment variable STORE_DSN was found", slog.String("store", conf.Store))
+		err = errors.Join(err, errors.New("missing STORE_DSN environment variable, required by the SQL stores"))
+	}
+
 	valkeyUrl, found := os.LookupEnv("REDIS_URL")
 	if !found {
-		logger.Error("No environment variable VALKEY_URL was found")
-		err = errors.Join(err, errors.New("missing VALKEY_URL environment variable"))
+		if conf.Store == "valkey" {
+			logger.Error("No environment variable VALKEY_URL was found")
+			err = errors.Join(err, errors.New("missing VALKEY_URL environment variable"))
+		}
 	} else {
 		conf.ValkeyUrl = valkeyUrl
 	}
 
+	conf.StoreSnapshotFile, _ = os.LookupEnv("STORE_SNAPSHOT_FILE")
+	storeSnapshotInterval, found := os.LookupEnv("STORE_SNAPSHOT_INTERVAL")
+	if !found {
+		conf.StoreSnapshotInterval = 60
+	} else {
+		storeSnapshotIntervalInt, parseErr := strconv.Atoi(storeSnapshotInterval)
+		if parseErr != nil || storeSnapshotIntervalInt < 1 {
+			logger.Error("Failed to parse STORE_SNAPSHOT_INTERVAL", slog.String("value", storeSnapshotInterval))
+			err = errors.Join(err, errors.New("invalid STORE_SNAPSHOT_INTERVAL format"))
+		} else {
+			conf.StoreSnapshotInterval = storeSnapshotIntervalInt
+		}
+	}
+
 	valkeyCluster, _ := os.LookupEnv("REDIS_CLUSTER")
 	conf.ValkeyCluster = valkeyCluster == "true"
+	// Without prefix and tenant, the unprefixed key layout of earlier versions is used
+	conf.ValkeyKeyPrefix, _ = os.LookupEnv("REDIS_KEY_PREFIX")
+	conf.ValkeyTenant, _ = os.LookupEnv("REDIS_TENANT")
+	if conf.ValkeyCluster && conf.ValkeyKeyPrefix == "" && conf.ValkeyTenant == "" {
+		logger.Error("REDIS_CLUSTER requires REDIS_KEY_PREFIX or REDIS_TENANT")
+		err = errors.Join(err, errors.New("the unprefixed key layout does not support REDIS_CLUSTER"))
+	}
+	valkeyCacheSize, found := os.LookupEnv("REDIS_CACHE_SIZE")
+	if !found {
+		conf.ValkeyCacheSize = 10000
+	} else {
+		valkeyCacheSizeInt, parseErr := strconv.Atoi(valkeyCacheSize)
+		if parseErr != nil || valkeyCacheSizeInt < 0 {
+			logger.Error("Failed to parse REDIS_CACHE_SIZE", slog.String("value", valkeyCacheSize))
+			err = errors.Join(err, errors.New("invalid REDIS_CACHE_SIZE format"))
+		} else {
+			conf.ValkeyCacheSize = valkeyCacheSizeInt
+		}
+	}
+	valkeyCacheTtl, found := os.LookupEnv("REDIS_CACHE_TTL")
+	if !found {
+		conf.ValkeyCacheTtl = 5 * 60 // Default to 5 minutes
+	} else {
+		valkeyCacheTtlInt, parseErr := strconv.Atoi(valkeyCacheTtl)
+		if parseErr != nil || valkeyCacheTtlInt < 1 {
+			logger.Error("Failed to parse REDIS_CACHE_TTL", slog.String("value", valkeyCacheTtl))
+			err = errors.Join(err, errors.New("invalid REDIS_CACHE_TTL format"))
+		} else {
+			conf.ValkeyCacheTtl = valkeyCacheTtlInt
+		}
+	}
+	timeIndexPruneInterval, found := os.LookupEnv("TIME_INDEX_PRUNE_INTERVAL")
+	if !found {
+		conf.TimeIndexPruneInterval = 5 * 60 // Default to 5 minutes
+	} else {
+		timeIndexPruneIntervalInt, parseErr := strconv.Atoi(timeIndexPruneInterval)
+		if parseErr != nil || timeIndexPruneIntervalInt < 0 {
+			logger.Error("Failed to parse TIME_INDEX_PRUNE_INTERVAL", slog.String("value", timeIndexPruneInterval))
+			err = errors.Join(err, errors.New("invalid TIME_INDEX_PRUNE_INTERVAL format"))
+		} else {
+			conf.TimeIndexPruneInterval = timeIndexPruneIntervalInt
+		}
+	}
 
 	adServerUrl, found := os.LookupEnv("AD_SERVER_URL")
 	if !found {
@@ -77,6 +215,16 @@ func ReadConfig() (AdNormalizerConfig, error) {
 		conf.AdServerUrl = *parsedUrl
 	}
 
+	adTagHosts, found := os.LookupEnv("AD_TAG_HOSTS")
+	if !found {
+		adTagHosts = conf.AdServerUrl.Host
+	}
+	for _, host := range strings.Split(adTagHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			conf.AdTagHosts = append(conf.AdTagHosts, host)
+		}
+	}
+
 	port, found := os.LookupEnv("PORT")
 	if !found {
 		logger.Info("No environment variable PORT was found, using default 8000")
@@ -103,13 +251,8 @@ func ReadConfig() (AdNormalizerConfig, error) {
 			//nolint:staticcheck // err is returned, linter is dumb
 			err = errors.Join(err, errors.New("invalid OUTPUT_BUCKET_URL format"))
 		} else {
-			var bucketPath string
-			if bucket.Path == "" {
-				path.Join(bucket.Hostname(), bucket.Path)
-			} else {
-				bucketPath = bucket.Hostname()
-			}
-			conf.Bucket = bucketPath
+			// Name of the bucket, used by the object store of MIRROR_SOURCES and the ffmpeg backend
+			conf.Bucket = bucket.Hostname()
 			conf.BucketUrl = *bucket
 		}
 	}
@@ -161,6 +304,11 @@ func ReadConfig() (AdNormalizerConfig, error) {
 	jitPackage, _ := os.LookupEnv("JIT_PACKAGE")
 
 	conf.JitPackage = jitPackage == "true"
+	if conf.Transcoder == "ffmpeg" && !conf.JitPackage {
+		// The ffmpeg backend produces HLS directly, there is nothing to package
+		logger.Info("JIT packaging is always enabled with the ffmpeg transcoder")
+		conf.JitPackage = true
+	}
 	logger.Debug("JIT packaging enabled", slog.Bool("enabled", conf.JitPackage))
 
 	rootUrl, found := os.LookupEnv("ROOT_URL")
@@ -185,6 +333,61 @@ func ReadConfig() (AdNormalizerConfig, error) {
 		conf.PackagingQueueName = packagingQueueName
 	}
 
+	packagingQueueType, found := os.LookupEnv("PACKAGING_QUEUE_TYPE")
+	switch {
+	case !found:
+		conf.PackagingQueueType = "sortedset"
+	case packagingQueueType == "sortedset" || packagingQueueType == "stream":
+		conf.PackagingQueueType = packagingQueueType
+	default:
+		logger.Error("Invalid PACKAGING_QUEUE_TYPE", slog.String("value", packagingQueueType))
+		err = errors.Join(err, errors.New("invalid PACKAGING_QUEUE_TYPE, must be one of sortedset, stream"))
+	}
+
+	packagingMode, found := os.LookupEnv("PACKAGING_MODE")
+	switch {
+	case !found:
+		conf.PackagingMode = "queue"
+	case packagingMode == "queue" || packagingMode == "builtin":
+		conf.PackagingMode = packagingMode
+	default:
+		logger.Error("Invalid PACKAGING_MODE", slog.String("value", packagingMode))
+		err = errors.Join(err, errors.New("invalid PACKAGING_MODE, must be one of queue, builtin"))
+	}
+
+	packagingQueueGroup, found := os.LookupEnv("PACKAGING_QUEUE_GROUP")
+	if !found {
+		conf.PackagingQueueGroup = "encore-packager"
+	} else {
+		conf.PackagingQueueGroup = packagingQueueGroup
+	}
+
+	packagingTimeout, found := os.LookupEnv("PACKAGING_TIMEOUT")
+	if !found {
+		conf.PackagingTimeout = 30 * 60 // Default to 30 minutes
+	} else {
+		packagingTimeoutInt, parseErr := strconv.Atoi(packagingTimeout)
+		if parseErr != nil || packagingTimeoutInt < 1 {
+			logger.Error("Failed to parse PACKAGING_TIMEOUT", slog.String("value", packagingTimeout))
+			err = errors.Join(err, errors.New("invalid PACKAGING_TIMEOUT format"))
+		} else {
+			conf.PackagingTimeout = packagingTimeoutInt
+		}
+	}
+
+	packagingMaxRetries, found := os.LookupEnv("PACKAGING_MAX_RETRIES")
+	if !found {
+		conf.PackagingMaxRetries = 2
+	} else {
+		packagingMaxRetriesInt, parseErr := strconv.Atoi(packagingMaxRetries)
+		if parseErr != nil || packagingMaxRetriesInt < 0 {
+			logger.Error("Failed to parse PACKAGING_MAX_RETRIES", slog.String("value", packagingMaxRetries))
+			err = errors.Join(err, errors.New("invalid PACKAGING_MAX_RETRIES format"))
+		} else {
+			conf.PackagingMaxRetries = packagingMaxRetriesInt
+		}
+	}
+
 	inFlightTtl, found := os.LookupEnv("IN_FLIGHT_TTL")
 	if !found {
 		logger.Info("No environment variable IN_FLIGHT_TTL was found, using default")
@@ -199,6 +402,182 @@ func ReadConfig() (AdNormalizerConfig, error) {
 		}
 	}
 
+	failedTtl, found := os.LookupEnv("FAILED_TTL")
+	if !found {
+		conf.FailedTtl = 60 * 60 // Default to 1 hour
+	} else {
+		failedTtlInt, parseErr := strconv.Atoi(failedTtl)
+		if parseErr != nil || failedTtlInt < 1 {
+			logger.Error("Failed to parse FAILED_TTL", slog.String("value", failedTtl))
+			err = errors.Join(err, errors.New("invalid FAILED_TTL format"))
+		} else {
+			conf.FailedTtl = failedTtlInt
+		}
+	}
+
+	sourceValidation, _ := os.LookupEnv("SOURCE_VALIDATION")
+	conf.SourceValidation = sourceValidation == "true"
+	logger.Debug("Source validation enabled", slog.Bool("enabled", conf.SourceValidation))
+
+	sourceMaxSize, found := os.LookupEnv("SOURCE_MAX_SIZE")
+	if found {
+		sourceMaxSizeInt, parseErr := strconv.ParseInt(sourceMaxSize, 10, 64)
+		if parseErr != nil {
+			logger.Error("Failed to parse SOURCE_MAX_SIZE", slog.String("error", parseErr.Error()))
+			err = errors.Join(err, errors.New("invalid SOURCE_MAX_SIZE format"))
+		} else {
+			conf.SourceMaxSize = sourceMaxSizeInt
+		}
+	}
+
+	sourceCacheTtl, found := os.LookupEnv("SOURCE_VALIDATION_TTL")
+	if !found {
+		conf.SourceCacheTtl = 5 * 60 // Default to 5 minutes
+	} else {
+		sourceCacheTtlInt, parseErr := strconv.Atoi(sourceCacheTtl)
+		if parseErr != nil {
+			logger.Error("Failed to parse SOURCE_VALIDATION_TTL", slog.String("error", parseErr.Error()))
+			err = errors.Join(err, errors.New("invalid SOURCE_VALIDATION_TTL format"))
+		} else {
+			conf.SourceCacheTtl = sourceCacheTtlInt
+		}
+	}
+
+	s3Endpoint, found := os.LookupEnv("S3_ENDPOINT")
+	if found {
+		parsedUrl, parseErr := url.Parse(strings.TrimSuffix(s3Endpoint, "/"))
+		if parseErr != nil {
+			logger.Error("Failed to parse S3_ENDPOINT", slog.String("error", parseErr.Error()))
+			err = errors.Join(err, errors.New("invalid S3_ENDPOINT format"))
+		} else {
+			conf.S3Endpoint = *parsedUrl
+		}
+	}
+	conf.S3AccessKey, _ = os.LookupEnv("S3_ACCESS_KEY_ID")
+	conf.S3SecretKey, _ = os.LookupEnv("S3_SECRET_ACCESS_KEY")
+	conf.S3Region, _ = os.LookupEnv("S3_REGION")
+
+	mirrorSources, _ := os.LookupEnv("MIRROR_SOURCES")
+	conf.MirrorSources = mirrorSources == "true"
+	if conf.MirrorSources && conf.S3Endpoint.Host == "" {
+		logger.Error("MIRROR_SOURCES is enabled but no S3_ENDPOINT was found")
+		err = errors.Join(err, errors.New("missing S3_ENDPOINT environment variable, required by MIRROR_SOURCES"))
+	}
+
+	if conf.PackagingMode == "builtin" && !conf.JitPackage && conf.S3Endpoint.Host == "" {
+		logger.Error("PACKAGING_MODE is builtin but no S3_ENDPOINT was found")
+		err = errors.Join(err, errors.New("missing S3_ENDPOINT environment variable, required by builtin packaging"))
+	}
+
+	if conf.Store != "valkey" && conf.PackagingMode == "queue" && !conf.JitPackage {
+		// The external packager only reads its queue from Valkey
+		logger.Error("Stores other than valkey require JIT_PACKAGE or PACKAGING_MODE=builtin")
+		err = errors.Join(err, errors.New("the "+conf.Store+" store requires JIT_PACKAGE or PACKAGING_MODE=builtin"))
+	}
+
+	callbackSecret, found := os.LookupEnv("CALLBACK_SECRET")
+	if !found {
+		logger.Warn("No environment variable CALLBACK_SECRET was found, callbacks will not be verified")
+	}
+	conf.CallbackSecret = callbackSecret
+
+	webhookUrls, _ := os.LookupEnv("WEBHOOK_URLS")
+	for _, webhookUrl := range strings.Split(webhookUrls, ",") {
+		webhookUrl = strings.TrimSpace(webhookUrl)
+		if webhookUrl == "" {
+			continue
+		}
+		if _, parseErr := url.ParseRequestURI(webhookUrl); parseErr != nil {
+			logger.Error("Failed to parse WEBHOOK_URLS", slog.String("error", parseErr.Error()))
+			err = errors.Join(err, errors.New("invalid WEBHOOK_URLS format"))
+			continue
+		}
+		conf.WebhookUrls = append(conf.WebhookUrls, webhookUrl)
+	}
+	conf.WebhookSecret, _ = os.LookupEnv("WEBHOOK_SECRET")
+
+	webhookMaxAttempts, found := os.LookupEnv("WEBHOOK_MAX_ATTEMPTS")
+	if !found {
+		conf.WebhookMaxAttempts = 8
+	} else {
+		webhookMaxAttemptsInt, parseErr := strconv.Atoi(webhookMaxAttempts)
+		if parseErr != nil || webhookMaxAttemptsInt < 1 {
+			logger.Error("Failed to parse WEBHOOK_MAX_ATTEMPTS", slog.String("value", webhookMaxAttempts))
+			err = errors.Join(err, errors.New("invalid WEBHOOK_MAX_ATTEMPTS format"))
+		} else {
+			conf.WebhookMaxAttempts = webhookMaxAttemptsInt
+		}
+	}
+
+	conf.FfmpegPath, found = os.LookupEnv("FFMPEG_PATH")
+	if !found {
+		conf.FfmpegPath = "ffmpeg"
+	}
+	conf.FfprobePath, found = os.LookupEnv("FFPROBE_PATH")
+	if !found {
+		conf.FfprobePath = "ffprobe"
+	}
+
+	ffmpegConcurrency, found := os.LookupEnv("FFMPEG_CONCURRENCY")
+	if !found {
+		conf.FfmpegConcurrency = 2
+	} else {
+		ffmpegConcurrencyInt, parseErr := strconv.Atoi(ffmpegConcurrency)
+		if parseErr != nil || ffmpegConcurrencyInt < 1 {
+			logger.Error("Failed to parse FFMPEG_CONCURRENCY", slog.String("value", ffmpegConcurrency))
+			err = errors.Join(err, errors.New("invalid FFMPEG_CONCURRENCY format"))
+		} else {
+			conf.FfmpegConcurrency = ffmpegConcurrencyInt
+		}
+	}
+
+	conf.FfmpegOutputDir, _ = os.LookupEnv("FFMPEG_OUTPUT_DIR")
+	if conf.Transcoder == "ffmpeg" {
+		if conf.FfmpegOutputDir == "" && conf.S3Endpoint.Host == "" {
+			logger.Error("The ffmpeg transcoder requires FFMPEG_OUTPUT_DIR or S3_ENDPOINT")
+			err = errors.Join(err, errors.New(
+				"missing FFMPEG_OUTPUT_DIR or S3_ENDPOINT environment variable, required by the ffmpeg transcoder",
+			))
+		}
+		if conf.MirrorSources {
+			logger.Error("MIRROR_SOURCES is not supported by the ffmpeg transcoder")
+			err = errors.Join(err, errors.New("MIRROR_SOURCES is not supported by the ffmpeg transcoder"))
+		}
+	}
+
+	storageCleanup, _ := os.LookupEnv("STORAGE_CLEANUP")
+	conf.StorageCleanup = storageCleanup == "true"
+	if conf.StorageCleanup && conf.S3Endpoint.Host == "" && conf.FfmpegOutputDir == "" {
+		logger.Error("STORAGE_CLEANUP is enabled but no S3_ENDPOINT was found")
+		err = errors.Join(err, errors.New("missing S3_ENDPOINT environment variable, required by STORAGE_CLEANUP"))
+	}
+
+	orphanSweepInterval, found := os.LookupEnv("ORPHAN_SWEEP_INTERVAL")
+	if !found {
+		conf.OrphanSweepInterval = 60 * 60 // Default to 1 hour
+	} else {
+		orphanSweepIntervalInt, parseErr := strconv.Atoi(orphanSweepInterval)
+		if parseErr != nil || orphanSweepIntervalInt < 0 {
+			logger.Error("Failed to parse ORPHAN_SWEEP_INTERVAL", slog.String("value", orphanSweepInterval))
+			err = errors.Join(err, errors.New("invalid ORPHAN_SWEEP_INTERVAL format"))
+		} else {
+			conf.OrphanSweepInterval = orphanSweepIntervalInt
+		}
+	}
+
+	orphanMinAge, found := os.LookupEnv("ORPHAN_MIN_AGE")
+	if !found {
+		conf.OrphanMinAge = 24 * 60 * 60 // Default to 1 day
+	} else {
+		orphanMinAgeInt, parseErr := strconv.Atoi(orphanMinAge)
+		if parseErr != nil || orphanMinAgeInt < 0 {
+			logger.Error("Failed to parse ORPHAN_MIN_AGE", slog.String("value", orphanMinAge))
+			err = errors.Join(err, errors.New("invalid ORPHAN_MIN_AGE format"))
+		} else {
+			conf.OrphanMinAge = orphanMinAgeInt
+		}
+	}
+
 	postUrl, found := os.LookupEnv("KPI_POST_URL")
 	if !found {
 		logger.Info("No environment variable KPI_POST_URL was found, KPIs will not be posted")
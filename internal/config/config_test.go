@@ -15,6 +15,7 @@ func TestReadConfig(t *testing.T) {
 		{"ENCORE_URL", "http://demo-encore.osaas.io"},
 		{"REDIS_URL", "redis://demo-valkey.osaas.io"},
 		{"REDIS_CLUSTER", "true"},
+		{"REDIS_TENANT", "acme"},
 		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
 		{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io"},
 		{"KEY_FIELD", "url"},
@@ -25,6 +26,20 @@ func TestReadConfig(t *testing.T) {
 		{"ROOT_URL", "http://ad-normalizer.osaas.io"},
 		{"PACKAGING_QUEUE", "normalizer-package"},
 		{"IN_FLIGHT_TTL", "10"},
+		{"SOURCE_VALIDATION", "true"},
+		{"SOURCE_MAX_SIZE", "104857600"},
+		{"S3_ENDPOINT", "https://minio.osaas.io/"},
+		{"MIRROR_SOURCES", "true"},
+		{"CALLBACK_SECRET", "callback-secret"},
+		{"PACKAGING_QUEUE_TYPE", "stream"},
+		{"PACKAGING_TIMEOUT", "600"},
+		{"PACKAGING_MODE", "builtin"},
+		{"STORAGE_CLEANUP", "true"},
+		{"ORPHAN_MIN_AGE", "7200"},
+		{"WEBHOOK_URLS", "https://hooks.example.com/ads, https://trafficking.example.com/events"},
+		{"WEBHOOK_SECRET", "webhook-secret"},
+		{"TIME_INDEX_PRUNE_INTERVAL", "0"},
+		{"REDIS_CACHE_SIZE", "0"},
 	}
 	for _, v := range configVars {
 		t.Setenv(v.name, v.value)
@@ -36,8 +51,156 @@ func TestReadConfig(t *testing.T) {
 	is.Equal(config.AdServerUrl.String(), "http://test-ad-server.osaas.io")
 	is.Equal(config.BucketUrl.String(), "s3://test-bucket.osaas.io")
 	is.Equal(config.InFlightTtl, 10)
+	is.Equal(config.FailedTtl, 3600)
 	is.Equal(config.KeyField, "url")
 	is.Equal(config.KeyRegex, "^[^a-zA-Z0-9]")
 	is.Equal(config.EncoreProfile, "ad-profile")
 	is.Equal(config.ValkeyCluster, true)
+	is.Equal(config.ValkeyKeyPrefix, "")
+	is.Equal(config.ValkeyTenant, "acme")
+	is.Equal(config.SourceValidation, true)
+	is.Equal(config.SourceMaxSize, int64(104857600))
+	is.Equal(config.SourceCacheTtl, 300)
+	is.Equal(config.Bucket, "test-bucket.osaas.io")
+	is.Equal(config.S3Endpoint.String(), "https://minio.osaas.io")
+	is.Equal(config.MirrorSources, true)
+	is.Equal(config.CallbackSecret, "callback-secret")
+	is.Equal(config.PackagingQueueType, "stream")
+	is.Equal(config.PackagingQueueGroup, "encore-packager")
+	is.Equal(config.PackagingTimeout, 600)
+	is.Equal(config.PackagingMaxRetries, 2)
+	is.Equal(config.PackagingMode, "builtin")
+	is.Equal(config.StorageCleanup, true)
+	is.Equal(config.OrphanSweepInterval, 3600)
+	is.Equal(config.OrphanMinAge, 7200)
+	is.Equal(config.TimeIndexPruneInterval, 0)
+	is.Equal(config.ValkeyCacheSize, 0)
+	is.Equal(config.ValkeyCacheTtl, 300)
+	is.Equal(config.WebhookUrls, []string{"https://hooks.example.com/ads", "https://trafficking.example.com/events"})
+	is.Equal(config.WebhookSecret, "webhook-secret")
+	is.Equal(config.WebhookMaxAttempts, 8)
+	is.Equal(config.Transcoder, "encore")
+	is.Equal(config.Store, "valkey")
+	// Ad tags are fetched from the ad server by default
+	is.Equal(config.AdTagHosts, []string{"test-ad-server.osaas.io"})
+
+	t.Setenv("FAILED_TTL", "0")
+	_, err = ReadConfig()
+	is.True(err != nil)
+	t.Setenv("FAILED_TTL", "86400")
+	config, err = ReadConfig()
+	is.NoErr(err)
+	is.Equal(config.FailedTtl, 86400)
+
+	t.Setenv("PACKAGING_TIMEOUT", "0")
+	_, err = ReadConfig()
+	is.True(err != nil)
+	t.Setenv("PACKAGING_TIMEOUT", "600")
+	t.Setenv("PACKAGING_MAX_RETRIES", "-1")
+	_, err = ReadConfig()
+	is.True(err != nil)
+	// Without retries, a timed out packaging job fails the creative right away
+	t.Setenv("PACKAGING_MAX_RETRIES", "0")
+	config, err = ReadConfig()
+	is.NoErr(err)
+	is.Equal(config.PackagingMaxRetries, 0)
+
+	// Clusters require a namespace
+	t.Setenv("REDIS_TENANT", "")
+	_, err = ReadConfig()
+	is.True(err != nil)
+	t.Setenv("REDIS_KEY_PREFIX", "staging")
+	config, err = ReadConfig()
+	is.NoErr(err)
+	is.Equal(config.ValkeyKeyPrefix, "staging")
+}
+
+func TestReadConfigFfmpeg(t *testing.T) {
+	is := is.New(t)
+	configVars := []struct {
+		name  string
+		value string
+	}{
+		{"TRANSCODER", "ffmpeg"},
+		{"REDIS_URL", "redis://demo-valkey.osaas.io"},
+		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
+		{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io/ads"},
+		{"ASSET_SERVER_URL", "http://test-asset-server.osaas.io"},
+		{"ROOT_URL", "http://ad-normalizer.osaas.io"},
+		{"FFMPEG_OUTPUT_DIR", "/var/www/ads"},
+		{"FFMPEG_CONCURRENCY", "4"},
+		{"AD_TAG_HOSTS", "ads.example.com, vmap.example.com:8080"},
+	}
+	for _, v := range configVars {
+		t.Setenv(v.name, v.value)
+	}
+	config, err := ReadConfig()
+	// ENCORE_URL is not required by the ffmpeg transcoder
+	is.NoErr(err)
+	is.Equal(config.Transcoder, "ffmpeg")
+	is.Equal(config.JitPackage, true)
+	is.Equal(config.FfmpegPath, "ffmpeg")
+	is.Equal(config.FfprobePath, "ffprobe")
+	is.Equal(config.FfmpegConcurrency, 4)
+	is.Equal(config.FfmpegOutputDir, "/var/www/ads")
+	is.Equal(config.PackagingMode, "queue")
+	is.Equal(config.AdTagHosts, []string{"ads.example.com", "vmap.example.com:8080"})
+
+	t.Setenv("FFMPEG_OUTPUT_DIR", "")
+	_, err = ReadConfig()
+	is.True(err != nil) // neither an output directory nor S3
+
+	t.Setenv("TRANSCODER", "handbrake")
+	_, err = ReadConfig()
+	is.True(err != nil)
+}
+
+func TestReadConfigMemoryStore(t *testing.T) {
+	is := is.New(t)
+	configVars := []struct {
+		name  string
+		value string
+	}{
+		{"STORE", "memory"},
+		{"ENCORE_URL", "http://demo-encore.osaas.io"},
+		{"AD_SERVER_URL", "http://test-ad-server.osaas.io"},
+		{"OUTPUT_BUCKET_URL", "s3://test-bucket.osaas.io"},
+		{"ASSET_SERVER_URL", "http://test-asset-server.osaas.io"},
+		{"ROOT_URL", "http://ad-normalizer.osaas.io"},
+		{"JIT_PACKAGE", "true"},
+		{"STORE_SNAPSHOT_FILE", "/var/lib/ad-normalizer/store.json"},
+	}
+	for _, v := range configVars {
+		t.Setenv(v.name, v.value)
+	}
+	config, err := ReadConfig()
+	// REDIS_URL is not required by the memory store
+	is.NoErr(err)
+	is.Equal(config.Store, "memory")
+	is.Equal(config.StoreSnapshotFile, "/var/lib/ad-normalizer/store.json")
+	is.Equal(config.StoreSnapshotInterval, 60)
+	is.Equal(config.TimeIndexPruneInterval, 300)
+	is.Equal(config.ValkeyCacheSize, 10000)
+
+	t.Setenv("JIT_PACKAGE", "false")
+	_, err = ReadConfig()
+	is.True(err != nil) // nothing would consume the packaging queue
+
+	t.Setenv("PACKAGING_MODE", "builtin")
+	t.Setenv("S3_ENDPOINT", "https://minio.osaas.io")
+	_, err = ReadConfig()
+	is.NoErr(err)
+
+	t.Setenv("STORE", "sqlite")
+	_, err = ReadConfig()
+	is.True(err != nil) // no database file
+
+	t.Setenv("STORE_DSN", "/var/lib/ad-normalizer/normalizer.db")
+	config, err = ReadConfig()
+	is.NoErr(err)
+	is.Equal(config.StoreDsn, "/var/lib/ad-normalizer/normalizer.db")
+
+	t.Setenv("STORE", "etcd")
+	_, err = ReadConfig()
+	is.True(err != nil)
 }
@@ -10,15 +10,18 @@ import (
 	"net/url"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/signature"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	"github.com/Eyevinn/ad-normalizer/internal/util"
 	osaasclient "github.com/EyevinnOSC/client-go"
+	"github.com/google/uuid"
 )
 
-type EncoreHandler interface {
-	CreateJob(creative *structure.ManifestAsset) (structure.EncoreJob, error)
-	GetEncoreJob(jobId string) (structure.EncoreJob, error)
-}
+// Query parameter holding the callback token in the progress callback URL
+const CallbackTokenParam = "token"
+
+var _ transcoder.Backend = (*HttpEncoreHandler)(nil)
 
 type HttpEncoreHandler struct {
 	Client             *http.Client
@@ -27,6 +30,7 @@ type HttpEncoreHandler struct {
 	oscContext         *osaasclient.Context
 	outputBucket       url.URL
 	rootUrl            url.URL
+	callbackSecret     string
 }
 
 func NewHttpEncoreHandler(
@@ -36,6 +40,7 @@ func NewHttpEncoreHandler(
 	oscContext *osaasclient.Context,
 	outputBucket url.URL,
 	rootUrl url.URL,
+	callbackSecret string,
 ) *HttpEncoreHandler {
 	return &HttpEncoreHandler{
 		Client:             client,
@@ -44,6 +49,7 @@ func NewHttpEncoreHandler(
 		oscContext:         oscContext,
 		outputBucket:       outputBucket,
 		rootUrl:            rootUrl,
+		callbackSecret:     callbackSecret,
 	}
 }
 
@@ -52,10 +58,17 @@ func (eh *HttpEncoreHandler) CreateJob(creative *structure.ManifestAsset) (struc
 		eh.outputBucket,
 		creative.CreativeId,
 	)
-	callbackUrl := eh.rootUrl.JoinPath("/encoreCallback").String()
+	// The ID is chosen here, so that the callback token can be bound to the job
+	jobId := uuid.NewString()
+	callbackUrl := eh.callbackUrl(creative.CreativeId, jobId)
+	profile := eh.transcodingProfile
+	if creative.Profile != "" {
+		profile = creative.Profile
+	}
 	job := structure.EncoreJob{
+		Id:                  jobId,
 		ExternalId:          creative.CreativeId,
-		Profile:             eh.transcodingProfile,
+		Profile:             profile,
 		OutputFolder:        outputFolder,
 		BaseName:            creative.CreativeId,
 		ProgressCallbackUri: callbackUrl,
@@ -73,10 +86,46 @@ func (eh *HttpEncoreHandler) CreateJob(creative *structure.ManifestAsset) (struc
 	if err != nil {
 		logger.Error("Failed to submit Encore job", slog.String("error", err.Error()))
 	}
+	if submitted.Id != "" && submitted.Id != jobId {
+		// The callbacks of the job would be rejected
+		return structure.EncoreJob{}, fmt.Errorf("encore created job %s instead of %s", submitted.Id, jobId)
+	}
 	return submitted, nil
 }
 
-func (eh *HttpEncoreHandler) GetEncoreJob(jobId string) (structure.EncoreJob, error) {
+// Returns the progress callback URL for the job of the creative.
+// If a callback secret is configured, a per job token is added so that
+// the callback can be verified when Encore reports progress.
+func (eh *HttpEncoreHandler) callbackUrl(creativeId string, jobId string) string {
+	callbackUrl := eh.rootUrl.JoinPath("/encoreCallback")
+	if eh.callbackSecret != "" {
+		query := callbackUrl.Query()
+		query.Set(CallbackTokenParam, CallbackToken(eh.callbackSecret, creativeId, jobId))
+		callbackUrl.RawQuery = query.Encode()
+	}
+	return callbackUrl.String()
+}
+
+// CallbackToken returns the token of the progress callback URL of the job. It is bound to both
+// the creative and the job, so that it can not be used for the callbacks of other jobs.
+func CallbackToken(secret string, creativeId string, jobId string) string {
+	return signature.Token(secret, callbackTokenSubject(creativeId, jobId))
+}
+
+// VerifyCallbackToken checks the token of a progress callback of the job in constant time
+func VerifyCallbackToken(secret string, creativeId string, jobId string, token string) bool {
+	if jobId == "" {
+		return false
+	}
+	return signature.VerifyToken(secret, callbackTokenSubject(creativeId, jobId), token)
+}
+
+// Job IDs are UUIDs, so the separator can not be part of them
+func callbackTokenSubject(creativeId string, jobId string) string {
+	return jobId + ":" + creativeId
+}
+
+func (eh *HttpEncoreHandler) GetJob(jobId string) (structure.EncoreJob, error) {
 	logger.Debug("Getting Encore job", slog.String("jobId", jobId))
 	job := structure.EncoreJob{} // init zero value
 	jobRequest, err := http.NewRequest("GET", eh.encoreUrl.JoinPath("/encoreJobs", jobId).String(), nil)
@@ -114,6 +163,47 @@ func (eh *HttpEncoreHandler) GetEncoreJob(jobId string) (structure.EncoreJob, er
 	return job, nil
 }
 
+// StartJob does nothing, Encore queues jobs when they are submitted. Encore reports progress
+// through HTTP callbacks, which arrive well after the job has been stored.
+func (eh *HttpEncoreHandler) StartJob(jobId string) error {
+	return nil
+}
+
+func (eh *HttpEncoreHandler) CancelJob(jobId string) error {
+	logger.Debug("Cancelling Encore job", slog.String("jobId", jobId))
+	cancelRequest, err := http.NewRequest("POST", eh.encoreUrl.JoinPath("/encoreJobs", jobId, "cancel").String(), nil)
+	if err != nil {
+		logger.Error("Failed to create Encore cancel request", slog.String("error", err.Error()))
+		return err
+	}
+	cancelRequest.Header.Set("Accept", "application/hal+json")
+	if eh.oscContext != nil && eh.oscContext.PersonalAccessToken != "" {
+		sat, err := eh.oscContext.GetServiceAccessToken("encore")
+		if err != nil {
+			logger.Error("Failed to get Service Access Token for Encore", slog.String("error", err.Error()))
+			return fmt.Errorf("failed to get Service Access Token for Encore: %w", err)
+		}
+		cancelRequest.Header.Set("x-jwt", "Bearer "+sat)
+	}
+	res, err := eh.Client.Do(cancelRequest)
+	if err != nil {
+		logger.Error("Failed to cancel Encore job", slog.String("error", err.Error()))
+		return err
+	}
+	defer res.Body.Close()
+	// Encore answers 409 Conflict for jobs that have already finished
+	if res.StatusCode == http.StatusConflict {
+		logger.Debug("Encore job already finished", slog.String("jobId", jobId))
+		return nil
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		logger.Error("Failed to cancel Encore job", slog.Int("statusCode", res.StatusCode))
+		return fmt.Errorf("failed to cancel Encore job, status code: %d", res.StatusCode)
+	}
+	logger.Info("Cancelled Encore job", slog.String("jobId", jobId))
+	return nil
+}
+
 func (eh *HttpEncoreHandler) submitJob(job structure.EncoreJob) (structure.EncoreJob, error) {
 	serialized, err := json.Marshal(job)
 	if err != nil {
@@ -11,19 +11,23 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Eyevinn/ad-normalizer/internal/signature"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/google/uuid"
 	"github.com/matryer/is"
 )
 
-var encoreHandler EncoreHandler
+var encoreHandler *HttpEncoreHandler
 var capturedJWT string
+var cancelledJobs []string
+var testServerUrl string
 
 func TestMain(m *testing.M) {
 	testServer := setupTestServer()
 	defer testServer.Close()
 	client := &http.Client{}
 	testUrl, _ := url.Parse(testServer.URL)
+	testServerUrl = testServer.URL
 	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
 	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
 	encoreHandler = NewHttpEncoreHandler(
@@ -33,6 +37,7 @@ func TestMain(m *testing.M) {
 		nil,
 		*bucketUrl,
 		*rootUrl,
+		"",
 	)
 
 	exitCode := m.Run()
@@ -55,13 +60,59 @@ func TestCreateJob(t *testing.T) {
 	is.Equal(len(created.Inputs), 1)
 }
 
+func TestCreateJobWithProfile(t *testing.T) {
+	is := is.New(t)
+	created, err := encoreHandler.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "test-creative-id",
+		MasterPlaylistUrl: "http://example.com/test.mp4",
+		Profile:           "other-profile",
+	})
+	is.NoErr(err)
+	is.Equal(created.Profile, "other-profile")
+}
+
+func TestCreateJobWithCallbackSecret(t *testing.T) {
+	is := is.New(t)
+	testUrl, _ := url.Parse(testServerUrl)
+	bucketUrl, _ := url.Parse("s3://example.com/transcoding-output/")
+	rootUrl, _ := url.Parse("https://ad-normalizer.osaas.io")
+	handler := NewHttpEncoreHandler(&http.Client{}, *testUrl, "test-profile", nil, *bucketUrl, *rootUrl, "secret")
+	asset := &structure.ManifestAsset{
+		CreativeId:        "test-creative-id",
+		MasterPlaylistUrl: "http://example.com/test.mp4",
+	}
+	created, err := handler.CreateJob(asset)
+	is.NoErr(err)
+	callbackUrl, err := url.Parse(created.ProgressCallbackUri)
+	is.NoErr(err)
+	is.Equal(callbackUrl.Path, "/encoreCallback")
+	token := callbackUrl.Query().Get(CallbackTokenParam)
+	is.True(VerifyCallbackToken("secret", "test-creative-id", created.Id, token))
+	// The token is bound to the job
+	is.True(!VerifyCallbackToken("secret", "test-creative-id", uuid.NewString(), token))
+	is.True(!VerifyCallbackToken("secret", "test-creative-id", "", token))
+	is.True(!signature.VerifyToken("secret", "test-creative-id", token))
+}
+
 func TestGetJob(t *testing.T) {
 	is := is.New(t)
 	jobId := uuid.New().String()
-	_, err := encoreHandler.GetEncoreJob(jobId)
+	_, err := encoreHandler.GetJob(jobId)
 	is.NoErr(err)
 }
 
+func TestCancelJob(t *testing.T) {
+	is := is.New(t)
+	cancelledJobs = nil
+	jobId := uuid.New().String()
+	is.NoErr(encoreHandler.CancelJob(jobId))
+	is.Equal(cancelledJobs, []string{jobId})
+
+	// Jobs that have finished can not be cancelled, nothing to do
+	is.NoErr(encoreHandler.CancelJob("finished-job"))
+	is.Equal(len(cancelledJobs), 1)
+}
+
 func TestGetJobWithoutOSCContext(t *testing.T) {
 	is := is.New(t)
 	
@@ -69,7 +120,7 @@ func TestGetJobWithoutOSCContext(t *testing.T) {
 	capturedJWT = ""
 	
 	jobId := uuid.New().String()
-	_, err := encoreHandler.GetEncoreJob(jobId)
+	_, err := encoreHandler.GetJob(jobId)
 	is.NoErr(err)
 	
 	// Verify no JWT header is set when OSC context is nil
@@ -125,6 +176,15 @@ func setupTestServer() *httptest.Server {
 		
 		switch r.Method {
 		case http.MethodPost:
+			if jobId, found := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/encoreJobs/"), "/cancel"); found {
+				if jobId == "finished-job" {
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+				cancelledJobs = append(cancelledJobs, jobId)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 			validRequest := validateRequest(r)
 			if !validRequest {
 				http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -147,7 +207,10 @@ func setupTestServer() *httptest.Server {
 				return
 			}
 			time.Sleep(time.Millisecond * 10) // Simulate round-trip delay
-			postedJob.Id = uuid.New().String()
+			// Encore keeps the ID of the posted job
+			if postedJob.Id == "" {
+				postedJob.Id = uuid.New().String()
+			}
 
 			resbod, err := json.Marshal(postedJob)
 			if err != nil {
@@ -0,0 +1,249 @@
+package packaging
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Name of the multivariant playlist, the same as the one written by encore-packager
+const MultivariantName = "index"
+
+const (
+	audioGroup          = "audio"
+	playlistContentType = "application/x-mpegURL"
+)
+
+// HlsPackager writes HLS playlists for the outputs of a transcoding job next to the outputs,
+// replacing the external encore-packager.
+// The outputs must be MPEG-TS or fragmented MP4 (CMAF) files, each file is referenced as a single segment.
+// The init segment and the codecs of fragmented MP4 outputs are read from the files.
+type HlsPackager struct {
+	objectStore storage.ReadableStore
+}
+
+func NewHlsPackager(objectStore storage.ReadableStore) *HlsPackager {
+	return &HlsPackager{objectStore: objectStore}
+}
+
+// Package writes the playlists for the job to its output folder,
+// and returns the output path relative to the bucket.
+func (hp *HlsPackager) Package(job *structure.EncoreJob) (string, error) {
+	outputPath, err := OutputPath(job.OutputFolder)
+	if err != nil {
+		return "", err
+	}
+	mp4s := map[string]Mp4Info{}
+	for _, output := range job.Outputs {
+		file := path.Base(output.File)
+		if !isFmp4(file) {
+			continue
+		}
+		info, err := InspectMp4(hp.objectStore, path.Join(outputPath, file))
+		if err != nil {
+			return "", err
+		}
+		mp4s[file] = info
+	}
+	playlists, err := Playlists(job, mp4s)
+	if err != nil {
+		return "", err
+	}
+	for name, playlist := range playlists {
+		key := path.Join(outputPath, name)
+		err := hp.objectStore.Put(key, strings.NewReader(playlist), int64(len(playlist)), playlistContentType)
+		if err != nil {
+			return "", fmt.Errorf("failed to write playlist %s: %w", key, err)
+		}
+	}
+	logger.Debug("Packaged job",
+		slog.String("jobId", job.Id),
+		slog.String("outputPath", outputPath),
+		slog.Int("playlists", len(playlists)),
+	)
+	return outputPath, nil
+}
+
+// OutputPath returns the path of an output folder relative to the bucket,
+// f.ex. prefix/creative/job for s3://bucket/prefix/creative/job/
+func OutputPath(outputFolder string) (string, error) {
+	parsed, err := url.Parse(outputFolder)
+	if err != nil {
+		return "", fmt.Errorf("invalid output folder %s: %w", outputFolder, err)
+	}
+	return strings.Trim(parsed.Path, "/"), nil
+}
+
+type rendition struct {
+	output   structure.EncoreOutput
+	file     string
+	playlist string
+	// Set for fragmented MP4 outputs
+	mp4 *Mp4Info
+}
+
+func isFmp4(file string) bool {
+	switch path.Ext(file) {
+	case ".mp4", ".m4s", ".m4a", ".m4v", ".cmfv", ".cmfa":
+		return true
+	default:
+		return false
+	}
+}
+
+// Playlists returns the multivariant playlist and one media playlist per output, by file name.
+// Outputs with video become variants, audio only outputs become an alternative audio group.
+// mp4s has the init segments and codecs of the fragmented MP4 outputs by file name.
+// CODECS are only advertised if they are known for all outputs of a variant,
+// i.e. not for MPEG-TS outputs.
+func Playlists(job *structure.EncoreJob, mp4s map[string]Mp4Info) (map[string]string, error) {
+	var videos, audios []rendition
+	for _, output := range job.Outputs {
+		file := path.Base(output.File)
+		ext := path.Ext(file)
+		r := rendition{
+			output:   output,
+			file:     file,
+			playlist: strings.TrimSuffix(file, ext) + ".m3u8",
+		}
+		switch {
+		case ext == ".ts":
+		case isFmp4(file):
+			info, found := mp4s[file]
+			if !found {
+				return nil, fmt.Errorf("missing init segment of output %s", file)
+			}
+			r.mp4 = &info
+		default:
+			// Thumbnails and other side files
+			continue
+		}
+		if output.Duration <= 0 {
+			return nil, fmt.Errorf("missing duration of output %s", file)
+		}
+		switch {
+		case len(output.VideoStreams) > 0:
+			videos = append(videos, r)
+		case len(output.AudioStreams) > 0:
+			audios = append(audios, r)
+		}
+	}
+	if len(videos) == 0 {
+		return nil, errors.New("no video outputs to package")
+	}
+
+	playlists := make(map[string]string, len(videos)+len(audios)+1)
+	version := 3
+	for _, r := range append(videos, audios...) {
+		playlists[r.playlist] = mediaPlaylist(r)
+		if r.mp4 != nil {
+			version = 7
+		}
+	}
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&master, "#EXT-X-VERSION:%d\n", version)
+	master.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	var audioBandwidth int64
+	var audioCodecs []string
+	for i, r := range audios {
+		isDefault := "NO"
+		if i == 0 {
+			isDefault = "YES"
+			audioBandwidth = bandwidth(r.output)
+			audioCodecs = r.codecs()
+		}
+		fmt.Fprintf(&master,
+			"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"\n",
+			audioGroup, strings.TrimSuffix(r.playlist, ".m3u8"), isDefault, r.playlist,
+		)
+	}
+	for _, r := range videos {
+		video := r.output.VideoStreams[0]
+		attributes := []string{fmt.Sprintf("BANDWIDTH=%d", bandwidth(r.output)+audioBandwidth)}
+		if video.Width > 0 && video.Height > 0 {
+			attributes = append(attributes, fmt.Sprintf("RESOLUTION=%dx%d", video.Width, video.Height))
+		}
+		codecs := r.codecs()
+		if len(audios) > 0 {
+			if audioCodecs == nil {
+				codecs = nil
+			} else {
+				codecs = append(codecs, audioCodecs...)
+			}
+		}
+		if len(codecs) > 0 {
+			attributes = append(attributes, fmt.Sprintf("CODECS=\"%s\"", strings.Join(codecs, ",")))
+		}
+		if frameRate := structure.ParseFrameRate(video.FrameRate); frameRate > 0 {
+			attributes = append(attributes, fmt.Sprintf("FRAME-RATE=%.3f", frameRate))
+		}
+		if len(audios) > 0 {
+			attributes = append(attributes, fmt.Sprintf("AUDIO=\"%s\"", audioGroup))
+		}
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attributes, ","), r.playlist)
+	}
+	playlists[MultivariantName+".m3u8"] = master.String()
+	return playlists, nil
+}
+
+// Returns the codecs of the output, video first, or nil if they are not known
+func (r rendition) codecs() []string {
+	if r.mp4 == nil {
+		return nil
+	}
+	codecs := slices.Clone(r.mp4.Codecs)
+	slices.SortStableFunc(codecs, func(a string, b string) int {
+		switch {
+		case isVideoCodec(a) == isVideoCodec(b):
+			return 0
+		case isVideoCodec(a):
+			return -1
+		default:
+			return 1
+		}
+	})
+	return codecs
+}
+
+func mediaPlaylist(r rendition) string {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	if r.mp4 != nil {
+		playlist.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		playlist.WriteString("#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(r.output.Duration)))
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	if r.mp4 != nil {
+		// The init segment is at the start of the file, followed by the fragments
+		fmt.Fprintf(&playlist, "#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n", r.file, r.mp4.InitSize)
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n", r.output.Duration)
+		fmt.Fprintf(&playlist, "#EXT-X-BYTERANGE:%d@%d\n", r.mp4.Size-r.mp4.InitSize, r.mp4.InitSize)
+		fmt.Fprintf(&playlist, "%s\n", r.file)
+	} else {
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s\n", r.output.Duration, r.file)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	return playlist.String()
+}
+
+// Returns the bitrate of the output, estimated from the file size if not reported
+func bandwidth(output structure.EncoreOutput) int64 {
+	if output.OverallBitrate > 0 {
+		return output.OverallBitrate
+	}
+	return int64(float64(output.FileSize*8) / output.Duration)
+}
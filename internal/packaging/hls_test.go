@@ -0,0 +1,195 @@
+package packaging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+type memoryObjectStore struct {
+	objects map[string]string
+}
+
+func (m *memoryObjectStore) Put(key string, body io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.objects[key] = string(data)
+	return nil
+}
+
+func (m *memoryObjectStore) ReadRange(key string, offset int64, length int64) ([]byte, error) {
+	object, found := m.objects[key]
+	if !found {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	end := min(offset+length, int64(len(object)))
+	return []byte(object[min(offset, end):end]), nil
+}
+
+func (m *memoryObjectStore) Size(key string) (int64, error) {
+	object, found := m.objects[key]
+	if !found {
+		return 0, fmt.Errorf("object %s not found", key)
+	}
+	return int64(len(object)), nil
+}
+
+func (m *memoryObjectStore) Url(key string) string {
+	return "memory://" + key
+}
+
+func encoreJob() *structure.EncoreJob {
+	return &structure.EncoreJob{
+		Id:           "job-id",
+		ExternalId:   "creative",
+		OutputFolder: "s3://bucket/ads/creative/job-id/",
+		BaseName:     "creative",
+		Outputs: []structure.EncoreOutput{
+			{
+				MediaType:      "Video",
+				Format:         "mp4",
+				File:           "/data/out/creative_x264_3100.mp4",
+				OverallBitrate: 3100000,
+				Duration:       10.0,
+				VideoStreams: []structure.EncoreVideoStream{
+					{Codec: "h264", Width: 1920, Height: 1080, FrameRate: "25/1"},
+				},
+			},
+			{
+				MediaType:      "Video",
+				Format:         "mp4",
+				File:           "/data/out/creative_x264_1200.mp4",
+				OverallBitrate: 1200000,
+				Duration:       10.0,
+				VideoStreams: []structure.EncoreVideoStream{
+					{Codec: "h264", Width: 1280, Height: 720, FrameRate: "25/1"},
+				},
+			},
+			{
+				MediaType: "Audio",
+				Format:    "mp4",
+				File:      "/data/out/creative_STEREO.mp4",
+				FileSize:  160000,
+				Duration:  10.0,
+				AudioStreams: []structure.EncoreAudioStream{
+					{Codec: "aac", Channels: 2},
+				},
+			},
+			{
+				MediaType: "Image",
+				Format:    "jpg",
+				File:      "/data/out/creative_thumb.jpg",
+			},
+		},
+	}
+}
+
+// Init segments and codecs of the outputs of encoreJob
+func encoreJobMp4s() map[string]Mp4Info {
+	return map[string]Mp4Info{
+		"creative_x264_3100.mp4": {InitSize: 800, Size: 3875800, Codecs: []string{"avc1.640028"}},
+		"creative_x264_1200.mp4": {InitSize: 790, Size: 1500790, Codecs: []string{"avc1.64001F"}},
+		"creative_STEREO.mp4":    {InitSize: 600, Size: 160600, Codecs: []string{"mp4a.40.2"}},
+	}
+}
+
+func TestPlaylists(t *testing.T) {
+	is := is.New(t)
+	playlists, err := Playlists(encoreJob(), encoreJobMp4s())
+	is.NoErr(err)
+	is.Equal(len(playlists), 4) // index and three media playlists
+
+	is.Equal(playlists["index.m3u8"], `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="creative_STEREO",DEFAULT=YES,AUTOSELECT=YES,URI="creative_STEREO.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=3228000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2",FRAME-RATE=25.000,AUDIO="audio"
+creative_x264_3100.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1328000,RESOLUTION=1280x720,CODECS="avc1.64001F,mp4a.40.2",FRAME-RATE=25.000,AUDIO="audio"
+creative_x264_1200.m3u8
+`)
+	is.Equal(playlists["creative_x264_1200.m3u8"], `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="creative_x264_1200.mp4",BYTERANGE="790@0"
+#EXTINF:10.000,
+#EXT-X-BYTERANGE:1500000@790
+creative_x264_1200.mp4
+#EXT-X-ENDLIST
+`)
+}
+
+func TestPlaylistsTs(t *testing.T) {
+	is := is.New(t)
+	job := &structure.EncoreJob{
+		Outputs: []structure.EncoreOutput{
+			{
+				File:           "s3://bucket/ads/creative_720.ts",
+				OverallBitrate: 2000000,
+				Duration:       15.2,
+				VideoStreams:   []structure.EncoreVideoStream{{Codec: "vp9", Width: 1280, Height: 720}},
+				AudioStreams:   []structure.EncoreAudioStream{{Codec: "aac"}},
+			},
+		},
+	}
+	playlists, err := Playlists(job, nil)
+	is.NoErr(err)
+	// The codecs of MPEG-TS outputs are not known
+	is.Equal(playlists["index.m3u8"], `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720
+creative_720.m3u8
+`)
+	is.True(strings.Contains(playlists["creative_720.m3u8"], "#EXT-X-TARGETDURATION:16\n"))
+	is.True(!strings.Contains(playlists["creative_720.m3u8"], "#EXT-X-MAP"))
+}
+
+func TestPlaylistsInvalid(t *testing.T) {
+	is := is.New(t)
+	job := encoreJob()
+	job.Outputs = job.Outputs[2:]
+	_, err := Playlists(job, encoreJobMp4s())
+	is.True(err != nil) // no video
+
+	job = encoreJob()
+	job.Outputs[0].Duration = 0
+	_, err = Playlists(job, encoreJobMp4s())
+	is.True(err != nil)
+
+	// Fragmented MP4 outputs need their init segment
+	_, err = Playlists(encoreJob(), nil)
+	is.True(err != nil)
+}
+
+func TestPackage(t *testing.T) {
+	is := is.New(t)
+	video := string(fragmentedMp4(moovBox(hevcEntry())))
+	audio := string(fragmentedMp4(moovBox(ac3Entry())))
+	objectStore := &memoryObjectStore{objects: map[string]string{
+		"ads/creative/job-id/creative_x264_3100.mp4": video,
+		"ads/creative/job-id/creative_x264_1200.mp4": video,
+		"ads/creative/job-id/creative_STEREO.mp4":    audio,
+	}}
+	packager := NewHlsPackager(objectStore)
+	outputPath, err := packager.Package(encoreJob())
+	is.NoErr(err)
+	is.Equal(outputPath, "ads/creative/job-id")
+	is.Equal(len(objectStore.objects), 7)
+	is.True(strings.Contains(objectStore.objects["ads/creative/job-id/index.m3u8"], `CODECS="hvc1.1.6.L120.90,ac-3"`))
+	is.True(strings.HasPrefix(objectStore.objects["ads/creative/job-id/creative_STEREO.m3u8"], "#EXTM3U\n"))
+
+	// Progressive MP4 outputs can not be packaged
+	objectStore.objects["ads/creative/job-id/creative_STEREO.mp4"] = string(append(moovBox(ac3Entry()), mp4Box("mdat")...))
+	_, err = packager.Package(encoreJob())
+	is.True(errors.Is(err, ErrNotFragmented))
+}
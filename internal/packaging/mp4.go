@@ -0,0 +1,336 @@
+package packaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
+)
+
+const (
+	boxHeaderSize = 8
+	// Max number of top level boxes read before the first fragment
+	maxTopLevelBoxes = 16
+	// Max size of the moov box, the init segment of an output
+	maxMoovSize = 1 << 20
+)
+
+var ErrNotFragmented = errors.New("output is not a fragmented MP4")
+
+// Mp4Info describes a fragmented MP4 output. The init segment is at the start of the file,
+// the fragments follow it.
+type Mp4Info struct {
+	InitSize int64
+	Size     int64
+	// RFC 6381 codec strings of the tracks, f.ex. avc1.64001F
+	Codecs []string
+}
+
+type box struct {
+	boxType    string
+	headerSize int64
+	// Size including the header, 0 if the box extends to the end of the file
+	size int64
+}
+
+func parseBoxHeader(data []byte) (box, error) {
+	if len(data) < boxHeaderSize {
+		return box{}, errors.New("truncated box header")
+	}
+	b := box{
+		boxType:    string(data[4:8]),
+		headerSize: boxHeaderSize,
+		size:       int64(binary.BigEndian.Uint32(data[0:4])),
+	}
+	if b.size == 1 {
+		if len(data) < 16 {
+			return box{}, errors.New("truncated box header")
+		}
+		b.headerSize = 16
+		b.size = int64(binary.BigEndian.Uint64(data[8:16]))
+	}
+	if b.size != 0 && b.size < b.headerSize {
+		return box{}, fmt.Errorf("invalid size %d of box %s", b.size, b.boxType)
+	}
+	return b, nil
+}
+
+// InspectMp4 reads the top level boxes of the object, and returns the size of its init segment
+// and the codecs of its tracks. Returns ErrNotFragmented for progressive MP4 files,
+// whose samples are in a single mdat box that can not be referenced as a segment.
+func InspectMp4(store storage.ReadableStore, key string) (Mp4Info, error) {
+	size, err := store.Size(key)
+	if err != nil {
+		return Mp4Info{}, err
+	}
+	info := Mp4Info{Size: size}
+	var offset int64
+	for range maxTopLevelBoxes {
+		if offset >= size {
+			break
+		}
+		header, err := store.ReadRange(key, offset, 16)
+		if err != nil {
+			return Mp4Info{}, err
+		}
+		b, err := parseBoxHeader(header)
+		if err != nil {
+			return Mp4Info{}, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if b.size == 0 {
+			b.size = size - offset
+		}
+		switch b.boxType {
+		case "moov":
+			if b.size > maxMoovSize {
+				return Mp4Info{}, fmt.Errorf("moov box of %s is too large: %d bytes", key, b.size)
+			}
+			moov, err := store.ReadRange(key, offset+b.headerSize, b.size-b.headerSize)
+			if err != nil {
+				return Mp4Info{}, err
+			}
+			info.Codecs, err = trackCodecs(moov)
+			if err != nil {
+				return Mp4Info{}, fmt.Errorf("failed to read codecs of %s: %w", key, err)
+			}
+			info.InitSize = offset + b.size
+		case "moof", "styp", "sidx":
+			if info.InitSize == 0 {
+				return Mp4Info{}, fmt.Errorf("%s has no moov box before its fragments", key)
+			}
+			return info, nil
+		case "mdat":
+			return Mp4Info{}, fmt.Errorf("%s: %w", key, ErrNotFragmented)
+		}
+		offset += b.size
+	}
+	return Mp4Info{}, fmt.Errorf("%s: %w", key, ErrNotFragmented)
+}
+
+// Returns the children of the box payload
+func childBoxes(data []byte) (map[string][][]byte, error) {
+	children := map[string][][]byte{}
+	for len(data) > 0 {
+		b, err := parseBoxHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if b.size == 0 {
+			b.size = int64(len(data))
+		}
+		if b.size > int64(len(data)) {
+			return nil, fmt.Errorf("box %s exceeds its parent", b.boxType)
+		}
+		children[b.boxType] = append(children[b.boxType], data[b.headerSize:b.size])
+		data = data[b.size:]
+	}
+	return children, nil
+}
+
+// Finds the first box on the path below the payload
+func findBox(data []byte, path ...string) ([]byte, error) {
+	for _, boxType := range path {
+		children, err := childBoxes(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(children[boxType]) == 0 {
+			return nil, fmt.Errorf("missing %s box", boxType)
+		}
+		data = children[boxType][0]
+	}
+	return data, nil
+}
+
+// Returns the codecs of the sample entries of the tracks in the moov payload
+func trackCodecs(moov []byte) ([]string, error) {
+	children, err := childBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	codecs := []string{}
+	for _, trak := range children["trak"] {
+		stsd, err := findBox(trak, "mdia", "minf", "stbl", "stsd")
+		if err != nil {
+			return nil, err
+		}
+		// Version, flags and entry count precede the sample entries
+		if len(stsd) < 8+boxHeaderSize {
+			return nil, errors.New("truncated stsd box")
+		}
+		entry, err := parseBoxHeader(stsd[8:])
+		if err != nil {
+			return nil, err
+		}
+		if entry.size == 0 || 8+entry.size > int64(len(stsd)) {
+			return nil, fmt.Errorf("invalid sample entry %s", entry.boxType)
+		}
+		codec, err := sampleEntryCodec(entry.boxType, stsd[8+entry.headerSize:8+entry.size])
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, codec)
+	}
+	if len(codecs) == 0 {
+		return nil, errors.New("no tracks")
+	}
+	return codecs, nil
+}
+
+const (
+	// Sample entry fields before the child boxes
+	visualSampleEntrySize = 78
+	audioSampleEntrySize  = 28
+)
+
+func sampleEntryCodec(entryType string, entry []byte) (string, error) {
+	switch entryType {
+	case "avc1", "avc3":
+		config, err := sampleEntryBox(entry, visualSampleEntrySize, "avcC")
+		if err != nil {
+			return "", err
+		}
+		if len(config) < 4 {
+			return "", errors.New("truncated avcC box")
+		}
+		return fmt.Sprintf("%s.%02X%02X%02X", entryType, config[1], config[2], config[3]), nil
+	case "hvc1", "hev1":
+		config, err := sampleEntryBox(entry, visualSampleEntrySize, "hvcC")
+		if err != nil {
+			return "", err
+		}
+		return hevcCodec(entryType, config)
+	case "mp4a":
+		esds, err := sampleEntryBox(entry, audioSampleEntrySize, "esds")
+		if err != nil {
+			return "", err
+		}
+		return aacCodec(esds)
+	case "ac-3", "ec-3", "Opus", "fLaC":
+		return entryType, nil
+	default:
+		return "", fmt.Errorf("unsupported sample entry %s", entryType)
+	}
+}
+
+func sampleEntryBox(entry []byte, fieldsSize int, boxType string) ([]byte, error) {
+	if len(entry) < fieldsSize {
+		return nil, errors.New("truncated sample entry")
+	}
+	return findBox(entry[fieldsSize:], boxType)
+}
+
+// Codec string of an HEVC track, as defined in ISO/IEC 14496-15 annex E
+func hevcCodec(entryType string, config []byte) (string, error) {
+	if len(config) < 13 {
+		return "", errors.New("truncated hvcC box")
+	}
+	profileSpace := []string{"", "A", "B", "C"}[config[1]>>6]
+	tier := "L"
+	if config[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profile := config[1] & 0x1f
+	// The compatibility flags are written in reverse bit order
+	var compatibility uint32
+	flags := binary.BigEndian.Uint32(config[2:6])
+	for i := range 32 {
+		if flags&(1<<i) != 0 {
+			compatibility |= 1 << (31 - i)
+		}
+	}
+	codec := fmt.Sprintf("%s.%s%d.%X.%s%d", entryType, profileSpace, profile, compatibility, tier, config[12])
+	// Constraint flags, without trailing zero bytes
+	constraints := config[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, constraint := range constraints {
+		codec += fmt.Sprintf(".%X", constraint)
+	}
+	return codec, nil
+}
+
+// Codec string of an MPEG-4 audio track, from the decoder config of its ES descriptor
+func aacCodec(esds []byte) (string, error) {
+	// Version and flags precede the descriptors
+	if len(esds) < 4 {
+		return "", errors.New("truncated esds box")
+	}
+	data := esds[4:]
+	var objectType byte
+	for len(data) > 0 {
+		tag := data[0]
+		length, headerSize := descriptorLength(data[1:])
+		data = data[1+headerSize:]
+		switch tag {
+		case 0x03: // ES descriptor, ES ID and flags precede its children
+			if len(data) < 3 {
+				return "", errors.New("truncated ES descriptor")
+			}
+			flags := data[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(data) > skip {
+				skip += 1 + int(data[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if len(data) < skip {
+				return "", errors.New("truncated ES descriptor")
+			}
+			data = data[skip:]
+		case 0x04: // Decoder config descriptor, its fields precede the decoder specific info
+			if len(data) < 13 {
+				return "", errors.New("truncated decoder config descriptor")
+			}
+			objectType = data[0]
+			data = data[13:]
+		case 0x05: // Decoder specific info, the audio specific config
+			if objectType == 0 || length < 1 || len(data) < 1 {
+				return "", errors.New("invalid decoder specific info")
+			}
+			audioObjectType := int(data[0] >> 3)
+			if audioObjectType == 31 && len(data) >= 2 {
+				audioObjectType = 32 + (int(data[0]&0x07)<<3 | int(data[1]>>5))
+			}
+			return fmt.Sprintf("mp4a.%x.%d", objectType, audioObjectType), nil
+		default:
+			if length > len(data) {
+				return "", fmt.Errorf("truncated descriptor %d", tag)
+			}
+			data = data[length:]
+		}
+	}
+	if objectType != 0 {
+		return fmt.Sprintf("mp4a.%x", objectType), nil
+	}
+	return "", errors.New("missing decoder config descriptor")
+}
+
+// Reads the variable length size of a descriptor, and returns it and the number of bytes it takes
+func descriptorLength(data []byte) (int, int) {
+	length := 0
+	for i := 0; i < 4 && i < len(data); i++ {
+		length = length<<7 | int(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			return length, i + 1
+		}
+	}
+	return length, min(4, len(data))
+}
+
+// Whether the codec is a video codec
+func isVideoCodec(codec string) bool {
+	for _, prefix := range []string{"avc1", "avc3", "hvc1", "hev1"} {
+		if strings.HasPrefix(codec, prefix) {
+			return true
+		}
+	}
+	return false
+}
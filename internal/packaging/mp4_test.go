@@ -0,0 +1,78 @@
+package packaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func mp4Box(boxType string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+	data := binary.BigEndian.AppendUint32(nil, uint32(size))
+	data = append(data, boxType...)
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	return data
+}
+
+// A moov box with one track per sample entry
+func moovBox(entries ...[]byte) []byte {
+	traks := [][]byte{}
+	for _, entry := range entries {
+		// Version, flags and entry count of the stsd box
+		stsd := mp4Box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, entry)
+		traks = append(traks, mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", stsd)))))
+	}
+	return mp4Box("moov", traks...)
+}
+
+func hevcEntry() []byte {
+	config := []byte{1, 0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 120}
+	return mp4Box("hvc1", make([]byte, visualSampleEntrySize), mp4Box("hvcC", config))
+}
+
+func ac3Entry() []byte {
+	return mp4Box("ac-3", make([]byte, audioSampleEntrySize), mp4Box("dac3", []byte{0x10, 0x3d, 0xe0}))
+}
+
+func fragmentedMp4(moov []byte) []byte {
+	data := mp4Box("ftyp", []byte("cmfc\x00\x00\x00\x00"))
+	data = append(data, moov...)
+	data = append(data, mp4Box("moof", mp4Box("mfhd", []byte{0, 0, 0, 0, 0, 0, 0, 1}))...)
+	return append(data, mp4Box("mdat", make([]byte, 32))...)
+}
+
+func TestInspectMp4(t *testing.T) {
+	is := is.New(t)
+	fixture, err := os.ReadFile("../test_data/fragmented.mp4")
+	is.NoErr(err)
+	objectStore := &memoryObjectStore{objects: map[string]string{
+		"muxed.mp4": string(fixture),
+		"hevc.mp4":  string(fragmentedMp4(moovBox(hevcEntry(), ac3Entry()))),
+		// Samples in a single mdat, like the outputs of the default Encore profiles
+		"progressive.mp4": string(append(mp4Box("ftyp"), append(moovBox(ac3Entry()), mp4Box("mdat")...)...)),
+		"no-moov.mp4":     string(append(mp4Box("ftyp"), mp4Box("moof")...)),
+	}}
+
+	info, err := InspectMp4(objectStore, "muxed.mp4")
+	is.NoErr(err)
+	is.Equal(info, Mp4Info{InitSize: 412, Size: 508, Codecs: []string{"avc1.64001F", "mp4a.40.2"}})
+
+	info, err = InspectMp4(objectStore, "hevc.mp4")
+	is.NoErr(err)
+	is.Equal(info.Codecs, []string{"hvc1.1.6.L120.90", "ac-3"})
+
+	_, err = InspectMp4(objectStore, "progressive.mp4")
+	is.True(errors.Is(err, ErrNotFragmented))
+	_, err = InspectMp4(objectStore, "no-moov.mp4")
+	is.True(err != nil)
+	_, err = InspectMp4(objectStore, "missing.mp4")
+	is.True(err != nil)
+}
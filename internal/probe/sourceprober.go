@@ -0,0 +1,204 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+)
+
+// Content types that are accepted as transcodable media.
+// Generic binary types are accepted as well, since a lot of
+// object storages serve uploaded files without a proper type.
+var acceptedContentTypePrefixes = []string{
+	"video/",
+	"audio/",
+	"application/octet-stream",
+	"binary/octet-stream",
+}
+
+type SourceProber interface {
+	Probe(sourceUrl string) ProbeResult
+}
+
+type ProbeResult struct {
+	Valid       bool
+	Reason      string
+	ContentType string
+	Size        int64
+	// Retryable is set when the source could not be validated due to
+	// a transient problem, i.e. a timeout or a server error.
+	// Such sources should not be blacklisted.
+	Retryable bool
+}
+
+type cachedResult struct {
+	result  ProbeResult
+	expires time.Time
+}
+
+type HttpSourceProber struct {
+	client   *http.Client
+	maxSize  int64
+	cacheTtl time.Duration
+	mutex    sync.Mutex
+	cache    map[string]cachedResult
+}
+
+func NewHttpSourceProber(client *http.Client, maxSize int64, cacheTtl time.Duration) *HttpSourceProber {
+	return &HttpSourceProber{
+		client:   client,
+		maxSize:  maxSize,
+		cacheTtl: cacheTtl,
+		cache:    make(map[string]cachedResult),
+	}
+}
+
+// Probe checks that the source URL is reachable, serves media and is within the size limit.
+// A HEAD request is attempted first, falling back to a ranged GET since
+// signed CDN URLs are often only valid for GET requests.
+// Definitive results are cached per URL, retryable results are not.
+func (p *HttpSourceProber) Probe(sourceUrl string) ProbeResult {
+	if result, found := p.fromCache(sourceUrl); found {
+		return result
+	}
+	result := p.probe(sourceUrl)
+	if !result.Retryable {
+		p.toCache(sourceUrl, result)
+	}
+	logger.Debug("Probed source",
+		slog.String("url", sourceUrl),
+		slog.Bool("valid", result.Valid),
+		slog.String("reason", result.Reason),
+	)
+	return result
+}
+
+func (p *HttpSourceProber) probe(sourceUrl string) ProbeResult {
+	parsed, err := url.Parse(sourceUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ProbeResult{Reason: "invalid source URL"}
+	}
+	res, err := p.do(http.MethodHead, sourceUrl)
+	if err != nil {
+		return unreachable(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res, err = p.do(http.MethodGet, sourceUrl)
+		if err != nil {
+			return unreachable(err)
+		}
+		_ = res.Body.Close()
+	}
+	return p.evaluate(res)
+}
+
+func (p *HttpSourceProber) do(method string, sourceUrl string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, sourceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "eyevinn/ad-normalizer")
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return p.client.Do(req)
+}
+
+func (p *HttpSourceProber) evaluate(res *http.Response) ProbeResult {
+	result := ProbeResult{
+		ContentType: res.Header.Get("Content-Type"),
+		Size:        contentSize(res),
+	}
+	switch {
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		result.Retryable = true
+		result.Reason = "source responded with status " + strconv.Itoa(res.StatusCode)
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		result.Reason = "source responded with status " + strconv.Itoa(res.StatusCode)
+	case !acceptedContentType(result.ContentType):
+		result.Reason = fmt.Sprintf("unsupported content type %q", result.ContentType)
+	case p.maxSize > 0 && result.Size > p.maxSize:
+		result.Reason = fmt.Sprintf("source size %d exceeds limit of %d bytes", result.Size, p.maxSize)
+	default:
+		result.Valid = true
+	}
+	return result
+}
+
+func (p *HttpSourceProber) fromCache(sourceUrl string) (ProbeResult, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	cached, found := p.cache[sourceUrl]
+	if !found {
+		return ProbeResult{}, false
+	}
+	if time.Now().After(cached.expires) {
+		delete(p.cache, sourceUrl)
+		return ProbeResult{}, false
+	}
+	return cached.result, true
+}
+
+func (p *HttpSourceProber) toCache(sourceUrl string, result ProbeResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	// Drop expired entries so the cache does not grow without bounds
+	for key, cached := range p.cache {
+		if now.After(cached.expires) {
+			delete(p.cache, key)
+		}
+	}
+	p.cache[sourceUrl] = cachedResult{
+		result:  result,
+		expires: now.Add(p.cacheTtl),
+	}
+}
+
+// Network errors are considered retryable, except for hosts that do not resolve
+func unreachable(err error) ProbeResult {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return ProbeResult{Reason: "source host not found"}
+	}
+	return ProbeResult{
+		Reason:    "source unreachable: " + err.Error(),
+		Retryable: true,
+	}
+}
+
+func acceptedContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, prefix := range acceptedContentTypePrefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the full size of the source, using Content-Range for partial responses
+func contentSize(res *http.Response) int64 {
+	if contentRange := res.Header.Get("Content-Range"); contentRange != "" {
+		if idx := strings.LastIndex(contentRange, "/"); idx >= 0 {
+			size, err := strconv.ParseInt(contentRange[idx+1:], 10, 64)
+			if err == nil {
+				return size
+			}
+		}
+	}
+	return res.ContentLength
+}
@@ -0,0 +1,97 @@
+package probe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func setupSourceServer(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		switch r.URL.Path {
+		case "/ad.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Length", "1000")
+			w.WriteHeader(http.StatusOK)
+		case "/signed.mp4":
+			// Signed URLs are often only valid for GET
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Range", "bytes 0-0/5000")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte{0})
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusOK)
+		case "/broken.mp4":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestProbe(t *testing.T) {
+	is := is.New(t)
+	requests := 0
+	ts := setupSourceServer(&requests)
+	defer ts.Close()
+	prober := NewHttpSourceProber(&http.Client{}, 2000, time.Minute)
+	cases := []struct {
+		name      string
+		path      string
+		valid     bool
+		retryable bool
+		size      int64
+	}{
+		{name: "valid source", path: "/ad.mp4", valid: true, size: 1000},
+		{name: "HEAD not allowed", path: "/signed.mp4", valid: false, size: 5000},
+		{name: "expired link", path: "/missing.mp4", valid: false},
+		{name: "not media", path: "/page.html", valid: false},
+		{name: "server error", path: "/broken.mp4", valid: false, retryable: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := prober.Probe(ts.URL + c.path)
+			is.Equal(res.Valid, c.valid)
+			is.Equal(res.Retryable, c.retryable)
+			if c.size > 0 {
+				is.Equal(res.Size, c.size)
+			}
+			if !c.valid {
+				is.True(res.Reason != "")
+			}
+		})
+	}
+}
+
+func TestProbeCache(t *testing.T) {
+	is := is.New(t)
+	requests := 0
+	ts := setupSourceServer(&requests)
+	defer ts.Close()
+	prober := NewHttpSourceProber(&http.Client{}, 0, time.Minute)
+
+	is.True(prober.Probe(ts.URL + "/ad.mp4").Valid)
+	is.True(prober.Probe(ts.URL + "/ad.mp4").Valid)
+	is.Equal(requests, 1) // second probe is served from cache
+
+	_ = prober.Probe(ts.URL + "/broken.mp4")
+	_ = prober.Probe(ts.URL + "/broken.mp4")
+	is.Equal(requests, 5) // transient failures are not cached
+}
+
+func TestProbeInvalidUrl(t *testing.T) {
+	is := is.New(t)
+	prober := NewHttpSourceProber(&http.Client{}, 0, time.Minute)
+	res := prober.Probe("ftp://example.com/ad.mp4")
+	is.True(!res.Valid)
+	is.True(!res.Retryable)
+}
@@ -6,24 +6,30 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/Eyevinn/VMAP/vmap"
 	"github.com/Eyevinn/ad-normalizer/internal/config"
-	"github.com/Eyevinn/ad-normalizer/internal/encore"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/packaging"
+	"github.com/Eyevinn/ad-normalizer/internal/probe"
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
 	"github.com/Eyevinn/ad-normalizer/internal/store"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	"github.com/Eyevinn/ad-normalizer/internal/util"
+	"github.com/Eyevinn/ad-normalizer/internal/webhook"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 )
 
 const userAgentHeader = "X-Device-User-Agent"
@@ -37,33 +43,112 @@ type API struct {
 	assetServerUrl url.URL
 	keyField       string
 	keyRegex       string
-	encoreHandler  encore.EncoreHandler
+	transcoder     transcoder.Backend
 	client         *http.Client
 	jitPackage     bool
 	packageQueue   string
 	encoreUrl      url.URL
-	reportKpi      func(normalizerMetrics.AdsHandledEventArguments)
+	// Output bucket of the transcoding jobs, f.ex. s3://bucket/ads
+	outputBucket string
+	reportKpi    func(normalizerMetrics.AdsHandledEventArguments)
+	sourceProber probe.SourceProber
+	sourceMirror *storage.SourceMirror
+	// Packages completed jobs in process, nil when an external packager is used
+	hlsPackager *packaging.HlsPackager
+	// Removes assets from the bucket, nil when storage cleanup is disabled
+	assetCleaner   *storage.AssetCleaner
+	orphanMinAge   time.Duration
+	callbackSecret string
+	inFlightTtl    int
+	failedTtl      int
+
+	packagingTimeout    time.Duration
+	packagingMaxRetries int
+	notifier            *webhook.Notifier
+	events              *eventBroker
+	// Counts callbacks rejected due to failed verification
+	callbackRejections metric.Int64Counter
+
+	// Hosts that pre-ingest ad tags may be fetched from, "*" allows any host
+	adTagHosts []string
+	// Transcoding jobs created before responding to a pre-ingest request
+	preIngestMaxDispatch int
+	// Limits of a pre-ingest request, larger requests are rejected
+	preIngestMaxAdTags  int
+	preIngestMaxPending int
 }
 
 func NewAPI(
 	valkeyStore store.Store,
 	config config.AdNormalizerConfig,
-	encoreHandler encore.EncoreHandler,
+	backend transcoder.Backend,
 	client *http.Client,
 	kpiReportFunc func(normalizerMetrics.AdsHandledEventArguments),
+	objectStore storage.ObjectStore,
 ) *API {
+	var sourceProber probe.SourceProber
+	if config.SourceValidation {
+		sourceProber = probe.NewHttpSourceProber(
+			client,
+			config.SourceMaxSize,
+			time.Duration(config.SourceCacheTtl)*time.Second,
+		)
+	}
+	var sourceMirror *storage.SourceMirror
+	if config.MirrorSources && objectStore != nil {
+		sourceMirror = storage.NewSourceMirror(client, objectStore, config.BucketUrl)
+	}
+	var hlsPackager *packaging.HlsPackager
+	if readableStore, ok := objectStore.(storage.ReadableStore); ok && config.PackagingMode == "builtin" {
+		hlsPackager = packaging.NewHlsPackager(readableStore)
+	}
+	var assetCleaner *storage.AssetCleaner
+	if prefixStore, ok := objectStore.(storage.PrefixStore); ok && config.StorageCleanup {
+		assetCleaner = storage.NewAssetCleaner(prefixStore, config.BucketUrl)
+	}
+	staticWebhooks := make([]structure.Webhook, 0, len(config.WebhookUrls))
+	for _, webhookUrl := range config.WebhookUrls {
+		staticWebhooks = append(staticWebhooks, structure.Webhook{Url: webhookUrl})
+	}
 	return &API{
 		valkeyStore:    valkeyStore,
 		adServerUrl:    config.AdServerUrl,
 		assetServerUrl: config.AssetServerUrl,
 		keyField:       config.KeyField,
 		keyRegex:       config.KeyRegex,
-		encoreHandler:  encoreHandler,
+		transcoder:     backend,
 		client:         client,
 		jitPackage:     config.JitPackage,
 		packageQueue:   config.PackagingQueueName,
 		encoreUrl:      config.EncoreUrl,
+		outputBucket:   config.BucketUrl.String(),
 		reportKpi:      kpiReportFunc,
+		sourceProber:   sourceProber,
+		sourceMirror:   sourceMirror,
+		hlsPackager:    hlsPackager,
+		assetCleaner:   assetCleaner,
+		orphanMinAge:   time.Duration(config.OrphanMinAge) * time.Second,
+		callbackSecret: config.CallbackSecret,
+		inFlightTtl:    config.InFlightTtl,
+		failedTtl:      config.FailedTtl,
+
+		packagingTimeout:    time.Duration(config.PackagingTimeout) * time.Second,
+		packagingMaxRetries: config.PackagingMaxRetries,
+		notifier: webhook.NewNotifier(
+			valkeyStore,
+			client,
+			config.WebhookSecret,
+			config.WebhookMaxAttempts,
+			staticWebhooks,
+		),
+		events: newEventBroker(),
+
+		callbackRejections: newCallbackRejectionCounter(),
+
+		adTagHosts:           config.AdTagHosts,
+		preIngestMaxDispatch: preIngestMaxDispatch,
+		preIngestMaxAdTags:   preIngestMaxAdTags,
+		preIngestMaxPending:  preIngestMaxPending,
 	}
 }
 
@@ -76,6 +161,21 @@ type statusResponse struct {
 	TotalAmount int64                     `json:"totalAmount"`
 }
 
+// Query parameters that select the cursor based listing of jobs
+var jobQueryParameters = []string{"status", "source", "subdomain", "from", "to", "order", "cursor"}
+
+// Page of the cursor based listing of jobs
+type jobQueryResponse struct {
+	Jobs []structure.TranscodeInfo `json:"jobs"`
+	Size int                       `json:"size"`
+	// Link to the next page, and the cursor in it. Empty on the last page.
+	Next   string `json:"next,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// HandleJobList lists the creatives, most recently updated first. With any of the filter, order
+// or cursor parameters, the creatives are listed by the time they were created, in pages that continue
+// from a cursor on that time. Otherwise pages are selected by offset.
 func (api *API) HandleJobList(w http.ResponseWriter, r *http.Request) {
 	_, span := otel.Tracer("api").Start(r.Context(), "HandleStatus")
 	defer span.End()
@@ -85,6 +185,12 @@ func (api *API) HandleJobList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	query := r.URL.Query()
+	for _, parameter := range jobQueryParameters {
+		if query.Has(parameter) {
+			api.handleJobQuery(w, query)
+			return
+		}
+	}
 	page := 0
 	size := 10
 	if p := query.Get("page"); p != "" {
@@ -137,17 +243,104 @@ func (api *API) HandleJobList(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(ret)
 }
 
+func (api *API) handleJobQuery(w http.ResponseWriter, query url.Values) {
+	if query.Has("page") {
+		http.Error(w, "The page parameter can not be combined with filters, use the cursor", http.StatusBadRequest)
+		return
+	}
+	jobQuery, invalid := readJobQuery(query)
+	if invalid != "" {
+		http.Error(w, "Invalid "+invalid+" parameter", http.StatusBadRequest)
+		return
+	}
+	results, cursor, err := api.valkeyStore.ListJobs(jobQuery)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		http.Error(w, "Invalid cursor parameter", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to list jobs", slog.String("error", err.Error()))
+		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+	resp := jobQueryResponse{
+		Jobs:   results,
+		Size:   len(results),
+		Cursor: cursor,
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+		resp.Next = jobPath + "?" + query.Encode()
+	}
+	ret, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("failed to marshal jobs", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal jobs", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(ret)
+}
+
+// Reads the query of the cursor based listing of jobs, and the name of the first invalid parameter, if any
+func readJobQuery(query url.Values) (store.JobQuery, string) {
+	jobQuery := store.JobQuery{
+		Statuses:  splitList(strings.ToUpper(query.Get("status"))),
+		Source:    query.Get("source"),
+		Subdomain: query.Get("subdomain"),
+		Order:     query.Get("order"),
+		Cursor:    query.Get("cursor"),
+		Size:      10,
+	}
+	if jobQuery.Order != "" && jobQuery.Order != store.ORDER_NEWEST && jobQuery.Order != store.ORDER_OLDEST {
+		return jobQuery, "order"
+	}
+	if s := query.Get("size"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size <= 0 || size > 100 {
+			return jobQuery, "size"
+		}
+		jobQuery.Size = size
+	}
+	var err error
+	if jobQuery.UpdatedFrom, err = parseQueryTime(query.Get("from")); err != nil {
+		return jobQuery, "from"
+	}
+	if jobQuery.UpdatedTo, err = parseQueryTime(query.Get("to")); err != nil {
+		return jobQuery, "to"
+	}
+	return jobQuery, ""
+}
+
+// Parses a time given as RFC 3339 or unix milliseconds, to unix milliseconds. Empty is 0.
+func parseQueryTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil && millis >= 0 {
+		return millis, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
 type blacklistRequest struct {
 	MediaUrl string `json:"mediaUrl"`
+	Reason   string `json:"reason,omitempty"`
 }
 
 type blacklistResponse struct {
-	MediaUrls  []string `json:"mediaUrls"`
-	Page       int      `json:"page"`
-	Size       int      `json:"size"`
-	Next       string   `json:"next,omitempty"`
-	Prev       string   `json:"prev,omitempty"`
-	TotalCount int64    `json:"totalCount"`
+	MediaUrls  []string                   `json:"mediaUrls"`
+	Entries    []structure.BlacklistEntry `json:"entries"`
+	Page       int                        `json:"page"`
+	Size       int                        `json:"size"`
+	Next       string                     `json:"next,omitempty"`
+	Prev       string                     `json:"prev,omitempty"`
+	TotalCount int64                      `json:"totalCount"`
 }
 
 func readBlacklistRequest(r *http.Request) (blacklistRequest, error) {
@@ -178,7 +371,7 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to read request body", http.StatusBadRequest)
 			return
 		}
-		err = api.valkeyStore.BlackList(blRequest.MediaUrl)
+		err = api.valkeyStore.BlackList(blRequest.MediaUrl, blRequest.Reason)
 		if err != nil {
 			logger.Error("failed to blacklist media URL",
 				slog.String("mediaUrl", blRequest.MediaUrl),
@@ -188,6 +381,7 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		logger.Info("blacklisted media URL", slog.String("mediaUrl", blRequest.MediaUrl))
+		api.cancelSourceJobs(blRequest.MediaUrl, blRequest.Reason)
 		w.WriteHeader(http.StatusNoContent)
 
 	case http.MethodDelete:
@@ -241,8 +435,13 @@ func (api *API) HandleBlackList(w http.ResponseWriter, r *http.Request) {
 		if len(results) == size {
 			next = blacklistPath + "?page=" + strconv.Itoa(page+1) + "&size=" + strconv.Itoa(size)
 		}
+		mediaUrls := make([]string, 0, len(results))
+		for _, entry := range results {
+			mediaUrls = append(mediaUrls, entry.MediaUrl)
+		}
 		resp := blacklistResponse{
-			MediaUrls:  results,
+			MediaUrls:  mediaUrls,
+			Entries:    results,
 			Page:       page,
 			Size:       len(results),
 			Next:       next,
@@ -443,58 +642,263 @@ func (api *API) processVmap(
 	vmapData *vmap.VMAP,
 	subdomain string,
 ) error {
-	breakWg := &sync.WaitGroup{}
+	// The creatives of all breaks are looked up in one batch
+	vasts := []*vmap.VAST{}
+	breakCreatives := []map[string]structure.ManifestAsset{}
 	for _, adBreak := range vmapData.AdBreaks {
 		logger.Debug("Processing ad break", slog.String("breakId", adBreak.Id))
 		if adBreak.AdSource.VASTData.VAST != nil {
-			breakWg.Add(1)
-			go func(vastData *vmap.VAST, subdomain string) {
-				defer breakWg.Done()
-				api.findMissingAndDispatchJobs(vastData, subdomain)
-			}(adBreak.AdSource.VASTData.VAST, subdomain)
+			vasts = append(vasts, adBreak.AdSource.VASTData.VAST)
+			creatives := util.GetCreatives(adBreak.AdSource.VASTData.VAST, api.keyField, api.keyRegex)
+			breakCreatives = append(breakCreatives, creatives)
 		}
 	}
-	breakWg.Wait()
+	lookup := api.lookupCreatives(breakCreatives...)
+	missing := make(map[string]structure.ManifestAsset)
+	for i, vast := range vasts {
+		// A creative in several breaks is only transcoded once
+		maps.Copy(missing, api.replaceFoundCreatives(vast, breakCreatives[i], lookup, subdomain))
+	}
+	api.dispatchJobs(missing, subdomain)
 	return nil
 }
 
-func (api *API) dispatchJobs(missingCreatives map[string]structure.ManifestAsset) {
+func (api *API) dispatchJobs(missingCreatives map[string]structure.ManifestAsset, subdomain string) {
 	// No need to wait for the goroutines to finish
 	// Since the creatives won't be used in this response anyway
 	for _, creative := range missingCreatives {
 		go func(creative *structure.ManifestAsset) {
-			encoreJob, err := api.encoreHandler.CreateJob(creative)
-			if err != nil {
-				logger.Error("failed to create encore job",
-					slog.String("error", err.Error()),
-					slog.String("creativeId", creative.CreativeId),
-				)
-				return
-			}
-			logger.Debug("created encore job",
-				slog.String("creativeId", creative.CreativeId),
-				slog.String("jobId", encoreJob.Id),
-			)
-			_ = api.valkeyStore.Set(creative.CreativeId, structure.TranscodeInfo{
-				Url:        creative.MasterPlaylistUrl,
-				Status:     "QUEUED",
-				Source:     creative.MasterPlaylistUrl,
-				LastUpdate: time.Now().Unix(),
-			})
+			_, _ = api.dispatchJob(creative, subdomain)
 		}(&creative)
 	}
 }
 
+var errSourceRejected = errors.New("source rejected")
+
+// Validates the source of the creative, creates its transcoding job and stores it as queued.
+// Returns errSourceRejected if the source is invalid or could not be validated.
+func (api *API) dispatchJob(creative *structure.ManifestAsset, subdomain string) (structure.TranscodeInfo, error) {
+	if !api.validateSource(creative, subdomain) {
+		return structure.TranscodeInfo{}, errSourceRejected
+	}
+	// The blacklist and the queued record refer to the URL in the VAST, before mirroring
+	source := creative.MasterPlaylistUrl
+	if creative.Source == "" {
+		creative.Source = creative.MasterPlaylistUrl
+	}
+	api.mirrorSource(creative)
+	encoreJob, err := api.transcoder.CreateJob(creative)
+	if err != nil {
+		logger.Error("failed to create transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creative.CreativeId),
+		)
+		if errors.Is(err, transcoder.ErrUnsupportedSource) {
+			return structure.TranscodeInfo{}, errSourceRejected
+		}
+		return structure.TranscodeInfo{}, err
+	}
+	logger.Debug("created transcoding job",
+		slog.String("creativeId", creative.CreativeId),
+		slog.String("jobId", encoreJob.Id),
+	)
+	transcodeInfo := structure.TranscodeInfo{
+		Url:          source,
+		Status:       "QUEUED",
+		Source:       creative.Source,
+		LastUpdate:   time.Now().Unix(),
+		JobId:        encoreJob.Id,
+		OutputFolder: encoreJob.OutputFolder,
+		Profile:      encoreJob.Profile,
+		Subdomain:    subdomain,
+
+		ReplacedOutputFolder: creative.ReplacedOutputFolder,
+	}
+	// Stored before the job is started, so that a job failing right away
+	// does not leave the creative queued forever
+	_ = api.valkeyStore.Set(creative.CreativeId, transcodeInfo)
+	api.indexJob(encoreJob.Id, creative.CreativeId, source)
+	api.recordStateChange(
+		creative.CreativeId,
+		structure.HistoryDispatched,
+		structure.HistorySourceNormalizer,
+		transcodeInfo,
+		structure.EventQueued,
+	)
+	if err := api.transcoder.StartJob(encoreJob.Id); err != nil {
+		logger.Error("failed to start transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creative.CreativeId),
+			slog.String("jobId", encoreJob.Id),
+		)
+		_ = api.HandleJobUpdate(transcoder.JobUpdate{
+			JobId:      encoreJob.Id,
+			CreativeId: creative.CreativeId,
+			Status:     transcoder.StatusFailed,
+			Message:    "failed to start transcoding job",
+		})
+		return structure.TranscodeInfo{}, err
+	}
+	return transcodeInfo, nil
+}
+
+// Stores the job ID -> creative ID mapping, so that callbacks can be resolved locally,
+// and the source -> creative ID mapping, so that jobs can be cancelled when the source is blacklisted.
+// The index lives long enough to cover transcoding and all packaging attempts.
+func (api *API) indexJob(jobId string, creativeId string, source string) {
+	if jobId == "" {
+		return
+	}
+	ttl := int64(api.inFlightTtl) + int64(api.packagingTimeout.Seconds())*int64(api.packagingMaxRetries+1)
+	if err := api.valkeyStore.SetJobCreative(jobId, creativeId, ttl); err != nil {
+		logger.Error("failed to index transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("jobId", jobId),
+			slog.String("creativeId", creativeId),
+		)
+	}
+	if err := api.valkeyStore.AddSourceCreative(source, creativeId, ttl); err != nil {
+		logger.Error("failed to index source of transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("source", source),
+			slog.String("creativeId", creativeId),
+		)
+	}
+}
+
+// Resolves the creative of a transcoding job, using the local index
+// and falling back to the external ID of the job in the transcoder backend.
+func (api *API) resolveCreative(jobId string) (string, error) {
+	creativeId, found, err := api.valkeyStore.GetJobCreative(jobId)
+	if err != nil {
+		logger.Warn("failed to look up creative for job, asking the transcoder",
+			slog.String("error", err.Error()),
+			slog.String("jobId", jobId),
+		)
+	}
+	if found {
+		return creativeId, nil
+	}
+	encoreJob, err := api.transcoder.GetJob(jobId)
+	if err != nil {
+		return "", err
+	}
+	if encoreJob.ExternalId == "" {
+		return "", fmt.Errorf("transcoding job %s does not have an external ID", jobId)
+	}
+	return encoreJob.ExternalId, nil
+}
+
+// Replaces the transcoding input of the creative with a copy in the output bucket,
+// if source mirroring is enabled. The original URL is kept as source of the creative.
+// If mirroring fails, the job falls back to the original URL.
+func (api *API) mirrorSource(creative *structure.ManifestAsset) {
+	if api.sourceMirror == nil {
+		return
+	}
+	mirroredUrl, err := api.sourceMirror.Mirror(creative.CreativeId, creative.Source)
+	if err != nil {
+		logger.Warn("failed to mirror source, using original URL",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creative.CreativeId),
+		)
+		return
+	}
+	creative.MasterPlaylistUrl = mirroredUrl
+}
+
+// Copies the fields that Encore does not know about from the stored creative: the subdomain,
+// the output folder of a replaced job, and the original source when sources are mirrored,
+// since the transcoding job only knows about the copy in the bucket.
+func (api *API) keepStoredFields(stored structure.TranscodeInfo, transcodeInfo *structure.TranscodeInfo) {
+	transcodeInfo.Subdomain = stored.Subdomain
+	transcodeInfo.ReplacedOutputFolder = stored.ReplacedOutputFolder
+	if api.sourceMirror != nil && stored.Source != "" {
+		transcodeInfo.Source = stored.Source
+	}
+}
+
+// Stores the failed creative if it still has the expected status, and removes the output of its job.
+// The failed creative is kept until the failed TTL expires, so that it can be listed,
+// and is transcoded again after that. Returns false if the creative changed in the meantime.
+func (api *API) failCreative(
+	creativeId string,
+	expectedStatus string,
+	transcodeInfo structure.TranscodeInfo,
+) (bool, error) {
+	set, err := api.valkeyStore.CompareAndSet(creativeId, expectedStatus, transcodeInfo, int64(api.failedTtl))
+	if err != nil || !set {
+		return false, err
+	}
+	api.removeJobAssets(creativeId, transcodeInfo)
+	return true, nil
+}
+
+// Probes the source of the creative, if source validation is enabled.
+// Sources that are definitively broken are blacklisted so that they are
+// filtered out of subsequent responses instead of failing in Encore.
+func (api *API) validateSource(creative *structure.ManifestAsset, subdomain string) bool {
+	if api.sourceProber == nil {
+		return true
+	}
+	result := api.sourceProber.Probe(creative.MasterPlaylistUrl)
+	if result.Valid {
+		return true
+	}
+	if result.Retryable {
+		logger.Warn("source could not be validated, skipping dispatch",
+			slog.String("creativeId", creative.CreativeId),
+			slog.String("source", creative.MasterPlaylistUrl),
+			slog.String("reason", result.Reason),
+		)
+		return false
+	}
+	logger.Info("source is invalid, adding to blacklist",
+		slog.String("creativeId", creative.CreativeId),
+		slog.String("source", creative.MasterPlaylistUrl),
+		slog.String("reason", result.Reason),
+	)
+	if err := api.valkeyStore.BlackList(creative.MasterPlaylistUrl, result.Reason); err != nil {
+		logger.Error("failed to blacklist invalid source",
+			slog.String("error", err.Error()),
+			slog.String("source", creative.MasterPlaylistUrl),
+		)
+	}
+	api.recordStateChange(
+		creative.CreativeId,
+		structure.HistoryBlacklisted,
+		structure.HistorySourceNormalizer,
+		structure.TranscodeInfo{
+			Source:    creative.MasterPlaylistUrl,
+			Error:     result.Reason,
+			Subdomain: subdomain,
+		},
+		structure.EventBlacklisted,
+	)
+	return false
+}
+
 func (api *API) findMissingAndDispatchJobs(
 	vast *vmap.VAST,
 	subdomain string,
 ) {
 	logger.Debug("Finding missing creatives in VAST", slog.Int("adCount", len(vast.Ad)))
 	creatives := util.GetCreatives(vast, api.keyField, api.keyRegex)
-	found, missing, filteredOut := api.partitionCreatives(creatives)
-	logger.Debug("partitioned creatives", slog.Int("found", len(found)), slog.Int("missing", len(missing)))
+	lookup := api.lookupCreatives(creatives)
+	missing := api.replaceFoundCreatives(vast, creatives, lookup, subdomain)
+	api.dispatchJobs(missing, subdomain)
+}
 
-	api.dispatchJobs(missing)
+// Replaces the media files of the VAST with the transcoded creatives that were found,
+// and returns the creatives that have to be transcoded.
+func (api *API) replaceFoundCreatives(
+	vast *vmap.VAST,
+	creatives map[string]structure.ManifestAsset,
+	lookup creativeLookup,
+	subdomain string,
+) map[string]structure.ManifestAsset {
+	found, missing, filteredOut := lookup.partition(creatives)
+	logger.Debug("partitioned creatives", slog.Int("found", len(found)), slog.Int("missing", len(missing)))
 
 	api.reportKpi(normalizerMetrics.AdsHandledEventArguments{
 		Subdomain:   subdomain,
@@ -510,39 +914,55 @@ func (api *API) findMissingAndDispatchJobs(
 		api.keyRegex,
 		api.keyField,
 	)
+	return missing
+}
 
+// Stored creatives and blacklisted sources of a batch of creatives
+type creativeLookup struct {
+	stored      map[string]structure.TranscodeInfo
+	blacklisted map[string]bool
+	// Set if the creatives could not be looked up, they are then neither found nor missing
+	err error
 }
 
-// Same as findMissingAndDispatchJobs but for JSON requests, since the original is built around VAST
-// Returns an int representing the number of missing creatives that jobs will be created for
-func (api *API) findMissingAndDispatchJobsJson(request *preIngestCreativeRequest) int {
-	logger.Debug("Finding missing creatives in pre-ingest request", slog.Int("mediaUrlCount", len(request.MediaUrls)))
-	// convert to ManifestAsset
-	creatives := util.MakeCreatives(request.MediaUrls, api.keyRegex)
-	found, missing, _ := api.partitionCreatives(creatives)
-	logger.Debug("partitioned creatives", slog.Int("found", len(found)), slog.Int("missing", len(missing)))
-	api.dispatchJobs(missing)
-	return len(missing)
+// Looks up the creatives in the store, and their sources in the blacklist, with one request each
+func (api *API) lookupCreatives(batches ...map[string]structure.ManifestAsset) creativeLookup {
+	creativeIds := []string{}
+	mediaUrls := []string{}
+	for _, creatives := range batches {
+		for _, creative := range creatives {
+			creativeIds = append(creativeIds, creative.CreativeId)
+			mediaUrls = append(mediaUrls, creative.MasterPlaylistUrl)
+		}
+	}
+	logger.Debug("looking up creatives", slog.Int("totalCreatives", len(creativeIds)))
+	stored, err := api.valkeyStore.GetMany(creativeIds)
+	if err != nil {
+		logger.Error("failed to get creatives from store",
+			slog.String("error", err.Error()),
+			slog.Int("totalCreatives", len(creativeIds)),
+		)
+		return creativeLookup{err: err}
+	}
+	blacklisted, err := api.valkeyStore.InBlackListMany(mediaUrls)
+	if err != nil {
+		// Serve the creatives rather than failing the request
+		logger.Error("failed to check creatives against the blacklist", slog.String("error", err.Error()))
+	}
+	return creativeLookup{stored: stored, blacklisted: blacklisted}
 }
 
-// TODO: Return amt blacklisted as well
-func (api *API) partitionCreatives(
+func (lookup creativeLookup) partition(
 	creatives map[string]structure.ManifestAsset,
 ) (map[string]structure.ManifestAsset, map[string]structure.ManifestAsset, int) {
 	found := make(map[string]structure.ManifestAsset, len(creatives))
 	missing := make(map[string]structure.ManifestAsset, len(creatives))
-	logger.Debug("partioning creatives", slog.Int("totalCreatives", len(creatives)))
 	filteredOut := 0
+	if lookup.err != nil {
+		return found, missing, filteredOut
+	}
 	for _, creative := range creatives {
-		transcodeInfo, urlFound, err := api.valkeyStore.Get(creative.CreativeId)
-		if err != nil {
-			logger.Error("failed to get creative from store",
-				slog.String("error", err.Error()),
-				slog.String("creativeId", creative.CreativeId),
-			)
-			continue
-		}
-		if blacklisted, _ := api.valkeyStore.InBlackList(creative.MasterPlaylistUrl); blacklisted {
+		if lookup.blacklisted[creative.MasterPlaylistUrl] {
 			logger.Debug("creative is in blacklist, skipping",
 				slog.String("creativeId", creative.CreativeId),
 				slog.String("masterPlaylistUrl", creative.MasterPlaylistUrl),
@@ -550,7 +970,7 @@ func (api *API) partitionCreatives(
 			filteredOut++
 			continue
 		}
-		if urlFound {
+		if transcodeInfo, urlFound := lookup.stored[creative.CreativeId]; urlFound {
 			if transcodeInfo.Status == "COMPLETED" {
 				found[creative.CreativeId] = structure.ManifestAsset{
 					CreativeId:        creative.CreativeId,
@@ -562,63 +982,13 @@ func (api *API) partitionCreatives(
 			missing[creative.CreativeId] = structure.ManifestAsset{
 				CreativeId:        creative.CreativeId,
 				MasterPlaylistUrl: creative.MasterPlaylistUrl,
-				Source:            transcodeInfo.Source,
+				Source:            creative.Source,
 			}
 		}
 	}
 	return found, missing, filteredOut
 }
 
-type preIngestCreativeRequest struct {
-	MediaUrls []string `json:"mediaUrls"`
-}
-
-type preIngestCreativeResponse struct {
-	NotYetProcessed int `json:"notYetProcessed"`
-}
-
-func (api *API) HandlePreIngestCreatives(w http.ResponseWriter, r *http.Request) {
-	_, span := otel.Tracer("api").Start(r.Context(), "PreIngestCreatives")
-	defer span.End()
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	piRequest, err := readPreIngestRequest(r)
-	if err != nil {
-		logger.Error("failed to read request body", slog.String("error", err.Error()))
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	amtMissing := api.findMissingAndDispatchJobsJson(&piRequest)
-	resp := preIngestCreativeResponse{
-		NotYetProcessed: amtMissing,
-	}
-	ret, err := json.Marshal(resp)
-	if err != nil {
-		logger.Error("failed to marshal response", slog.String("error", err.Error()))
-		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(ret)
-	span.End()
-}
-
-func readPreIngestRequest(r *http.Request) (preIngestCreativeRequest, error) {
-	bytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		return preIngestCreativeRequest{}, err
-	}
-	var piRequest preIngestCreativeRequest
-	if err := json.Unmarshal(bytes, &piRequest); err != nil {
-		return piRequest, err
-	}
-
-	return piRequest, nil
-}
-
 func decompressGzip(body io.Reader) ([]byte, error) {
 	zr, err := gzip.NewReader(body)
 	defer func() { _ = zr.Close() }()
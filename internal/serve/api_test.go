@@ -3,15 +3,21 @@ package serve
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,7 +25,11 @@ import (
 	"github.com/Eyevinn/ad-normalizer/internal/config"
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/normalizerMetrics"
+	"github.com/Eyevinn/ad-normalizer/internal/probe"
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	"github.com/google/uuid"
 	"github.com/matryer/is"
 )
@@ -29,8 +39,21 @@ type StoreStub struct {
 	sets      int
 	gets      int
 	deletes   int
-	blacklist []string
+	// Batched lookups of creatives
+	batches   int
+	blacklist []structure.BlacklistEntry
 	kpis      normalizerMetrics.NormalizerMetrics
+	enqueued  []structure.PackagingQueueMessage
+	tracked   map[string]structure.PackagingJobState
+	jobIndex  map[string]string
+	// Source URL -> creative IDs
+	sourceIndex map[string][]string
+	webhooks    []structure.Webhook
+	// Events queued for delivery to webhooks
+	deliveries []structure.WebhookDelivery
+	published  []structure.CreativeEvent
+	history    map[string][]structure.HistoryEvent
+	jobQueries []store.JobQuery
 }
 
 func (s *StoreStub) kpiReport(args normalizerMetrics.AdsHandledEventArguments) {
@@ -46,6 +69,11 @@ func (s *StoreStub) Delete(key string) error {
 	return nil
 }
 
+// DeleteFailed implements store.Store.
+func (s *StoreStub) DeleteFailed(key string, value structure.TranscodeInfo) error {
+	return s.Delete(key)
+}
+
 func (s *StoreStub) Get(key string) (structure.TranscodeInfo, bool, error) {
 	s.gets++
 	if value, exists := s.mockStore[key]; exists {
@@ -54,12 +82,42 @@ func (s *StoreStub) Get(key string) (structure.TranscodeInfo, bool, error) {
 	return structure.TranscodeInfo{}, false, nil
 }
 
+func (s *StoreStub) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	s.batches++
+	values := make(map[string]structure.TranscodeInfo, len(keys))
+	for _, key := range keys {
+		if value, exists := s.mockStore[key]; exists {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
 func (s *StoreStub) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
 	s.sets++
 	s.mockStore[key] = value
 	return nil
 }
 
+func (s *StoreStub) CompareAndSet(
+	key string,
+	expectedStatus string,
+	value structure.TranscodeInfo,
+	ttl ...int64,
+) (bool, error) {
+	if stored, exists := s.mockStore[key]; !exists || stored.Status != expectedStatus {
+		return false, nil
+	}
+	return true, s.Set(key, value, ttl...)
+}
+
+func (s *StoreStub) Ttl(key string) (int64, error) {
+	if _, found := s.mockStore[key]; !found {
+		return 0, errors.New("key does not exist")
+	}
+	return -1, nil
+}
+
 func (s *StoreStub) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
 	result := make([]structure.TranscodeInfo, 0, size)
 	for i := range size {
@@ -75,32 +133,83 @@ func (s *StoreStub) List(page int, size int) ([]structure.TranscodeInfo, int64,
 	return result, int64(size), nil
 }
 
+// ListJobs returns the stored creatives with the statuses of the query, ordered by key.
+// The cursor is the number of creatives on the previous pages.
+func (s *StoreStub) ListJobs(query store.JobQuery) ([]structure.TranscodeInfo, string, error) {
+	s.jobQueries = append(s.jobQueries, query)
+	offset := 0
+	if query.Cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(query.Cursor); err != nil {
+			return nil, "", store.ErrInvalidCursor
+		}
+	}
+	results := []structure.TranscodeInfo{}
+	for _, key := range slices.Sorted(maps.Keys(s.mockStore)) {
+		value := s.mockStore[key]
+		if len(query.Statuses) == 0 || slices.Contains(query.Statuses, value.Status) {
+			results = append(results, value)
+		}
+	}
+	results = results[min(offset, len(results)):]
+	if len(results) > query.Size {
+		return results[:query.Size], strconv.Itoa(offset + query.Size), nil
+	}
+	return results, "", nil
+}
+
 func (s *StoreStub) reset() {
 	s.mockStore = make(map[string]structure.TranscodeInfo)
 	s.sets = 0
 	s.gets = 0
+	s.batches = 0
 	s.deletes = 0
 	s.kpis = normalizerMetrics.NormalizerMetrics{}
-	s.blacklist = []string{} // Reset the blacklist
+	s.blacklist = []structure.BlacklistEntry{} // Reset the blacklist
+	s.enqueued = nil
+	s.tracked = make(map[string]structure.PackagingJobState)
+	s.jobIndex = make(map[string]string)
+	s.sourceIndex = nil
+	s.webhooks = nil
+	s.deliveries = nil
+	s.published = nil
+	s.history = nil
+	s.jobQueries = nil
 }
 
-func (s *StoreStub) BlackList(key string) error {
-	s.blacklist = append(s.blacklist, key)
+func (s *StoreStub) BlackList(key string, reason string) error {
+	return s.BlackListAt(key, reason, time.Now().UnixMilli())
+}
+
+func (s *StoreStub) BlackListAt(key string, reason string, timestamp int64) error {
+	s.blacklist = append(s.blacklist, structure.BlacklistEntry{
+		MediaUrl:  key,
+		Reason:    reason,
+		Timestamp: timestamp,
+	})
 	return nil
 }
 
 func (s *StoreStub) InBlackList(key string) (bool, error) {
-	for _, blacklistedKey := range s.blacklist {
-		if blacklistedKey == key {
+	for _, blacklisted := range s.blacklist {
+		if blacklisted.MediaUrl == key {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
+func (s *StoreStub) InBlackListMany(keys []string) (map[string]bool, error) {
+	blacklisted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		blacklisted[key], _ = s.InBlackList(key)
+	}
+	return blacklisted, nil
+}
+
 func (s *StoreStub) RemoveFromBlackList(key string) error {
-	for i, blacklistedKey := range s.blacklist {
-		if blacklistedKey == key {
+	for i, blacklisted := range s.blacklist {
+		if blacklisted.MediaUrl == key {
 			s.blacklist = append(s.blacklist[:i], s.blacklist[i+1:]...)
 			return nil
 		}
@@ -108,30 +217,68 @@ func (s *StoreStub) RemoveFromBlackList(key string) error {
 	return nil // Key not found in blacklist, nothing to remove
 }
 
-func (s *StoreStub) GetBlackList(page int, size int) ([]string, int64, error) {
+func (s *StoreStub) GetBlackList(page int, size int) ([]structure.BlacklistEntry, int64, error) {
 	return s.blacklist, int64(len(s.blacklist)), nil
 }
 
 func (s *StoreStub) EnqueuePackagingJob(queueName string, message structure.PackagingQueueMessage) error {
-	// This is a stub, in a real implementation this would enqueue the job to a queue
+	s.enqueued = append(s.enqueued, message)
 	return nil
 }
 
+func (s *StoreStub) TrackPackagingJob(state structure.PackagingJobState) error {
+	s.tracked[state.CreativeId] = state
+	return nil
+}
+
+func (s *StoreStub) GetPackagingJob(creativeId string) (structure.PackagingJobState, bool, error) {
+	state, found := s.tracked[creativeId]
+	return state, found, nil
+}
+
+func (s *StoreStub) UntrackPackagingJob(creativeId string) error {
+	delete(s.tracked, creativeId)
+	return nil
+}
+
+func (s *StoreStub) PopTimedOutPackagingJobs(now time.Time) ([]structure.PackagingJobState, error) {
+	timedOut := []structure.PackagingJobState{}
+	for creativeId, state := range s.tracked {
+		if state.Deadline <= now.UnixMilli() {
+			timedOut = append(timedOut, state)
+			delete(s.tracked, creativeId)
+		}
+	}
+	return timedOut, nil
+}
+
 type EncoreHandlerStub struct {
-	calls int
+	// Guards the jobs created and started by background dispatches
+	mu        sync.Mutex
+	calls     int
+	getCalls  int
+	cancelled []string
+	started   []string
+	// Called when a job is started, f.ex. to report a job that fails right away
+	onStart func(jobId string)
 }
 
-// GetEncoreJob implements encore.EncoreHandler.
-func (e *EncoreHandlerStub) GetEncoreJob(jobId string) (structure.EncoreJob, error) {
+// GetJob implements transcoder.Backend.
+func (e *EncoreHandlerStub) GetJob(jobId string) (structure.EncoreJob, error) {
+	e.getCalls += 1
 	return structure.EncoreJob{
-		Id:         uuid.NewString(),
-		ExternalId: jobId,
-		Profile:    "test-profile",
-		BaseName:   jobId,
-		Status:     "COMPLETED",
+		Id:           uuid.NewString(),
+		ExternalId:   jobId,
+		Profile:      "test-profile",
+		BaseName:     jobId,
+		Status:       "SUCCESSFUL",
+		OutputFolder: "s3://test-bucket/ads/" + jobId + "/",
 		Outputs: []structure.EncoreOutput{
 			{
-				MediaType: "Video",
+				MediaType:      "Video",
+				File:           "/out/" + jobId + "_x264_3100.mp4",
+				OverallBitrate: 3100000,
+				Duration:       10.0,
 				VideoStreams: []structure.EncoreVideoStream{
 					{
 						Codec:     "AVC",
@@ -150,22 +297,169 @@ func (e *EncoreHandlerStub) GetEncoreJob(jobId string) (structure.EncoreJob, err
 	}, nil
 }
 
+func (e *EncoreHandlerStub) CancelJob(jobId string) error {
+	e.cancelled = append(e.cancelled, jobId)
+	return nil
+}
+
 func (e *EncoreHandlerStub) reset() {
 	logger.Info("Resetting EncoreHandlerStub")
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.calls = 0
+	e.getCalls = 0
+	e.cancelled = nil
+	e.started = nil
+	e.onStart = nil
 }
 
 func (e *EncoreHandlerStub) CreateJob(creative *structure.ManifestAsset) (structure.EncoreJob, error) {
 	logger.Info("EncoreHandlerStub.createJob called")
-	newJob := structure.EncoreJob{}
+	if creative.Profile == "unsupported" {
+		return structure.EncoreJob{}, transcoder.ErrUnsupportedProfile
+	}
+	newJob := structure.EncoreJob{Id: uuid.NewString(), Profile: creative.Profile}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.calls += 1
 	return newJob, nil
 }
 
+func (e *EncoreHandlerStub) StartJob(jobId string) error {
+	e.mu.Lock()
+	e.started = append(e.started, jobId)
+	onStart := e.onStart
+	e.mu.Unlock()
+	if onStart != nil {
+		onStart(jobId)
+	}
+	return nil
+}
+
+func (s *StoreStub) SetJobCreative(jobId string, creativeId string, ttl int64) error {
+	s.jobIndex[jobId] = creativeId
+	return nil
+}
+
+func (s *StoreStub) GetJobCreative(jobId string) (string, bool, error) {
+	creativeId, found := s.jobIndex[jobId]
+	return creativeId, found, nil
+}
+
+func (s *StoreStub) AddSourceCreative(source string, creativeId string, ttl int64) error {
+	if s.sourceIndex == nil {
+		s.sourceIndex = make(map[string][]string)
+	}
+	s.sourceIndex[source] = append(s.sourceIndex[source], creativeId)
+	return nil
+}
+
+func (s *StoreStub) GetSourceCreatives(source string) ([]string, error) {
+	return s.sourceIndex[source], nil
+}
+
+func (s *StoreStub) AddWebhook(webhook structure.Webhook) error {
+	s.webhooks = append(s.webhooks, webhook)
+	return nil
+}
+
+func (s *StoreStub) RemoveWebhook(webhook structure.Webhook) error {
+	for i, registered := range s.webhooks {
+		if registered == webhook {
+			s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *StoreStub) GetWebhooks() ([]structure.Webhook, error) {
+	return s.webhooks, nil
+}
+
+func (s *StoreStub) EnqueueWebhookDelivery(delivery structure.WebhookDelivery, due time.Time) error {
+	s.deliveries = append(s.deliveries, delivery)
+	return nil
+}
+
+func (s *StoreStub) ClaimDueWebhookDeliveries(
+	now time.Time,
+	claimUntil time.Time,
+	limit int,
+) ([]structure.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (s *StoreStub) RemoveWebhookDelivery(id string) error {
+	return nil
+}
+
+func (s *StoreStub) PublishEvent(event structure.CreativeEvent) error {
+	s.published = append(s.published, event)
+	return nil
+}
+
+func (s *StoreStub) SubscribeEvents(ctx context.Context, handler func(structure.CreativeEvent)) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (s *StoreStub) AppendHistory(creativeId string, event structure.HistoryEvent) error {
+	if s.history == nil {
+		s.history = make(map[string][]structure.HistoryEvent)
+	}
+	s.history[creativeId] = append(s.history[creativeId], event)
+	return nil
+}
+
+func (s *StoreStub) GetHistory(creativeId string) ([]structure.HistoryEvent, error) {
+	return s.history[creativeId], nil
+}
+
+func (s *StoreStub) ExportCreatives(
+	_ context.Context,
+	fn func(key string, value structure.TranscodeInfo, expiresAt int64) error,
+) error {
+	for key, value := range s.mockStore {
+		if err := fn(key, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StoreStub) GetPackagingJobs() ([]structure.PackagingJobState, error) {
+	states := make([]structure.PackagingJobState, 0, len(s.tracked))
+	for _, state := range s.tracked {
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// Returns the history event kinds of the creative, in order
+func (s *StoreStub) historyEvents(creativeId string) []string {
+	events := make([]string, 0, len(s.history[creativeId]))
+	for _, event := range s.history[creativeId] {
+		events = append(events, event.Event)
+	}
+	return events
+}
+
+// Returns the event types queued for delivery, in order
+func (s *StoreStub) events() []string {
+	events := make([]string, 0, len(s.deliveries))
+	for _, delivery := range s.deliveries {
+		events = append(events, delivery.Event.Event)
+	}
+	return events
+}
+
 func setupApi() (*API, *httptest.Server, *StoreStub, *EncoreHandlerStub) {
 	storeStub := &StoreStub{
 		mockStore: make(map[string]structure.TranscodeInfo),
 		kpis:      normalizerMetrics.NormalizerMetrics{},
+		tracked:   make(map[string]structure.PackagingJobState),
+		jobIndex:  make(map[string]string),
 	}
 
 	testServer := setupTestServer()
@@ -179,6 +473,7 @@ func setupApi() (*API, *httptest.Server, *StoreStub, *EncoreHandlerStub) {
 		KeyField:       "url",
 		KeyRegex:       "[^a-zA-Z0-9]",
 		KpiPostUrl:     "http://kpi-post.example.com/metrics",
+		AdTagHosts:     []string{adserverUrl.Host},
 	}
 	// Initialize the API with the mock store
 	api := NewAPI(
@@ -187,6 +482,7 @@ func setupApi() (*API, *httptest.Server, *StoreStub, *EncoreHandlerStub) {
 		encoreHandler,
 		&http.Client{}, // Use nil for the client in tests, or you can create a mock client
 		storeStub.kpiReport,
+		nil,
 	)
 	return api, testServer, storeStub, encoreHandler
 }
@@ -272,7 +568,7 @@ func TestReplaceVastWithBlacklisted(t *testing.T) {
 		nil,
 	)
 	is.NoErr(err)
-	_ = storeStub.BlackList("https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4")
+	_ = storeStub.BlackList("https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4", "")
 	vastReq.Header.Set("User-Agent", "TestUserAgent")
 	vastReq.Header.Set("X-Forwarded-For", "123.123.123")
 	vastReq.Header.Set("X-Device-User-Agent", "TestDeviceUserAgent")
@@ -527,6 +823,41 @@ func TestReplaceVmap(t *testing.T) {
 	storeStub.reset()
 }
 
+func TestVmapBreaksLookedUpTogether(t *testing.T) {
+	is := is.New(t)
+	data, err := os.ReadFile("../test_data/testVmap.xml")
+	is.NoErr(err)
+	vmapData, err := vmap.DecodeVmap(data)
+	is.NoErr(err)
+	secondBreak, err := vmap.DecodeVmap(data)
+	is.NoErr(err)
+	vmapData.AdBreaks = append(vmapData.AdBreaks, secondBreak.AdBreaks...)
+
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	re := regexp.MustCompile("[^a-zA-Z0-9]")
+	adKey := re.ReplaceAllString("https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4", "")
+	_ = storeStub.Set(adKey, structure.TranscodeInfo{
+		Url:    "https://testcontent.eyevinn.technology/ads/alvedon-10s.m3u8",
+		Status: "COMPLETED",
+	})
+	storeStub.gets = 0
+
+	is.NoErr(api.processVmap(&vmapData, ""))
+	is.Equal(storeStub.batches, 1)
+	is.Equal(storeStub.gets, 0)
+	for _, adBreak := range vmapData.AdBreaks {
+		vast := adBreak.AdSource.VASTData.VAST
+		is.Equal(len(vast.Ad), 1)
+		mediaFile := vast.Ad[0].InLine.Creatives[0].Linear.MediaFiles[0]
+		is.Equal(mediaFile.Text, "https://testcontent.eyevinn.technology/ads/alvedon-10s.m3u8")
+	}
+	// Reported for each break
+	is.Equal(storeStub.kpis.IngestedAds, 2)
+	is.Equal(storeStub.kpis.ServedAds, 2)
+	storeStub.reset()
+}
+
 func TestBlacklist(t *testing.T) {
 	is := is.New(t)
 	api, ts, storeStub, _ := setupApi()
@@ -534,6 +865,7 @@ func TestBlacklist(t *testing.T) {
 	blacklistUrl := "https://adserver-assets.io/badfile.mp4"
 	reqBody := blacklistRequest{
 		MediaUrl: blacklistUrl,
+		Reason:   "broken asset",
 	}
 	serializedBody, err := json.Marshal(reqBody)
 	is.NoErr(err)
@@ -567,6 +899,8 @@ func TestBlacklist(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(len(blResponse.MediaUrls), 1)
 	is.Equal(blResponse.MediaUrls[0], blacklistUrl)
+	is.Equal(len(blResponse.Entries), 1)
+	is.Equal(blResponse.Entries[0].Reason, "broken asset")
 	is.Equal(blResponse.Page, 0)
 	is.Equal(blResponse.Size, 1)
 	is.Equal(blResponse.TotalCount, int64(1))
@@ -699,6 +1033,114 @@ func TestHandleJobListInvalidSizeParameterZero(t *testing.T) {
 	is.True(strings.Contains(string(body), "Invalid size parameter"))
 }
 
+func TestHandleJobListQuery(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	for i := range 3 {
+		_ = storeStub.Set("failed"+strconv.Itoa(i), structure.TranscodeInfo{Status: "FAILED"})
+	}
+	_ = storeStub.Set("completed", structure.TranscodeInfo{Status: "COMPLETED"})
+
+	req := httptest.NewRequest(
+		http.MethodGet,
+		"/jobs?status=failed&source=ad.mp4&subdomain=tenant&from=2026-10-17T00:00:00Z&to=1760745600000&order=oldest&size=2",
+		nil,
+	)
+	recorder := httptest.NewRecorder()
+	api.HandleJobList(recorder, req)
+	is.Equal(recorder.Code, http.StatusOK)
+	var response jobQueryResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(response.Size, 2)
+	is.Equal(response.Cursor, "2")
+	is.Equal(storeStub.jobQueries, []store.JobQuery{{
+		Statuses:    []string{"FAILED"},
+		Source:      "ad.mp4",
+		Subdomain:   "tenant",
+		UpdatedFrom: time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC).UnixMilli(),
+		UpdatedTo:   1760745600000,
+		Order:       store.ORDER_OLDEST,
+		Size:        2,
+	}})
+
+	// The next page keeps the filters
+	next, err := url.Parse(response.Next)
+	is.NoErr(err)
+	is.Equal(next.Path, "/jobs")
+	is.Equal(next.Query().Get("status"), "failed")
+	is.Equal(next.Query().Get("cursor"), "2")
+	recorder = httptest.NewRecorder()
+	api.HandleJobList(recorder, httptest.NewRequest(http.MethodGet, response.Next, nil))
+	is.Equal(recorder.Code, http.StatusOK)
+	response = jobQueryResponse{}
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(response.Size, 1)
+	is.Equal(response.Next, "")
+	is.Equal(response.Cursor, "")
+}
+
+func TestFailedJobsAreListed(t *testing.T) {
+	is := is.New(t)
+	api, ts, _, _ := setupApi()
+	defer ts.Close()
+	memoryStore, err := store.NewMemoryStore()
+	is.NoErr(err)
+	api.valkeyStore = memoryStore
+	api.failedTtl = 3600
+	is.NoErr(memoryStore.Set("failing", structure.TranscodeInfo{Status: "QUEUED", JobId: "job"}))
+	is.NoErr(memoryStore.Set("timed-out", structure.TranscodeInfo{Status: "PACKAGING", JobId: "other-job"}))
+
+	is.NoErr(api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      "job",
+		CreativeId: "failing",
+		Status:     transcoder.StatusFailed,
+	}))
+	api.handlePackagingTimeout(structure.PackagingJobState{
+		CreativeId: "timed-out",
+		Job:        structure.PackagingQueueMessage{JobId: "other-job"},
+		Attempts:   api.packagingMaxRetries,
+	})
+
+	// Failed creatives are kept until they expire, with the reason of the failure
+	recorder := httptest.NewRecorder()
+	api.HandleJobList(recorder, httptest.NewRequest(http.MethodGet, "/jobs?status=FAILED", nil))
+	is.Equal(recorder.Code, http.StatusOK)
+	var response jobQueryResponse
+	is.NoErr(json.NewDecoder(recorder.Body).Decode(&response))
+	is.Equal(len(response.Jobs), 2)
+	failures := map[string]string{}
+	for _, job := range response.Jobs {
+		failures[job.JobId] = job.Error
+	}
+	is.Equal(failures, map[string]string{"job": "transcoding failed", "other-job": "packaging timed out"})
+	ttl, err := memoryStore.Ttl("failing")
+	is.NoErr(err)
+	is.True(ttl > 0)
+}
+
+func TestHandleJobListQueryInvalidParameters(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	cases := map[string]string{
+		"/jobs?status=FAILED&page=1":   "page parameter",
+		"/jobs?order=random":           "Invalid order parameter",
+		"/jobs?from=yesterday":         "Invalid from parameter",
+		"/jobs?status=FAILED&to=-1":    "Invalid to parameter",
+		"/jobs?status=FAILED&size=101": "Invalid size parameter",
+		"/jobs?cursor=invalid":         "Invalid cursor parameter",
+	}
+	for target, message := range cases {
+		recorder := httptest.NewRecorder()
+		api.HandleJobList(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		is.Equal(recorder.Code, http.StatusBadRequest)
+		is.True(strings.Contains(recorder.Body.String(), message))
+	}
+}
+
 func TestHandlePreIngestCreatives(t *testing.T) {
 	is := is.New(t)
 	api, ts, storeStub, _ := setupApi()
@@ -768,6 +1210,137 @@ func TestHandlePreIngestCreativesMethodNotAllowed(t *testing.T) {
 	is.True(strings.Contains(string(body), "Method not allowed"))
 }
 
+type SourceProberStub struct {
+	result probe.ProbeResult
+}
+
+func (p *SourceProberStub) Probe(sourceUrl string) probe.ProbeResult {
+	return p.result
+}
+
+func TestValidateSource(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	creative := &structure.ManifestAsset{
+		CreativeId:        "expiredad",
+		MasterPlaylistUrl: "https://cdn.example.com/expired-ad.mp4",
+	}
+
+	// No prober configured, every source is considered valid
+	is.True(api.validateSource(creative, ""))
+
+	api.sourceProber = &SourceProberStub{result: probe.ProbeResult{Valid: true}}
+	is.True(api.validateSource(creative, "tenant"))
+	is.Equal(len(storeStub.blacklist), 0)
+
+	api.sourceProber = &SourceProberStub{result: probe.ProbeResult{Reason: "timeout", Retryable: true}}
+	is.True(!api.validateSource(creative, "tenant"))
+	is.Equal(len(storeStub.blacklist), 0) // transient failures are not blacklisted
+
+	api.sourceProber = &SourceProberStub{result: probe.ProbeResult{Reason: "source responded with status 403"}}
+	is.True(!api.validateSource(creative, "tenant"))
+	is.Equal(len(storeStub.blacklist), 1)
+	is.Equal(storeStub.blacklist[0].MediaUrl, creative.MasterPlaylistUrl)
+	is.Equal(storeStub.blacklist[0].Reason, "source responded with status 403")
+	is.Equal(len(storeStub.deliveries), 0) // no webhooks registered
+	_ = storeStub.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	api.invalidateWebhooks()
+	is.True(!api.validateSource(creative, "tenant"))
+	is.Equal(storeStub.events(), []string{structure.EventBlacklisted})
+	is.Equal(storeStub.deliveries[0].Event.Subdomain, "tenant")
+	is.Equal(storeStub.deliveries[0].Event.Error, "source responded with status 403")
+	storeStub.reset()
+}
+
+type ObjectStoreStub struct {
+	objects map[string][]byte
+}
+
+func (o *ObjectStoreStub) Put(key string, body io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	o.objects[key] = data
+	return nil
+}
+
+func (o *ObjectStoreStub) ReadRange(key string, offset int64, length int64) ([]byte, error) {
+	object, found := o.objects[key]
+	if !found {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	end := min(offset+length, int64(len(object)))
+	return object[min(offset, end):end], nil
+}
+
+func (o *ObjectStoreStub) Size(key string) (int64, error) {
+	object, found := o.objects[key]
+	if !found {
+		return 0, fmt.Errorf("object %s not found", key)
+	}
+	return int64(len(object)), nil
+}
+
+func (o *ObjectStoreStub) Url(key string) string {
+	return "s3://test-bucket/" + key
+}
+
+func TestMirrorSource(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ads/ad.mp4" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ad"))
+	}))
+	defer source.Close()
+	objectStore := &ObjectStoreStub{objects: make(map[string][]byte)}
+	bucketUrl, _ := url.Parse("s3://test-bucket/ads")
+	api.sourceMirror = storage.NewSourceMirror(&http.Client{}, objectStore, *bucketUrl)
+
+	creative := &structure.ManifestAsset{
+		CreativeId:        "ad",
+		MasterPlaylistUrl: source.URL + "/ads/ad.mp4",
+		Source:            source.URL + "/ads/ad.mp4",
+	}
+	api.mirrorSource(creative)
+	is.Equal(creative.MasterPlaylistUrl, "s3://test-bucket/ads/ad/source/ad.mp4")
+	is.Equal(creative.Source, source.URL+"/ads/ad.mp4")
+	is.Equal(string(objectStore.objects["ads/ad/source/ad.mp4"]), "ad")
+
+	// The original source is kept when the transcoding job only knows about the copy
+	stored := structure.TranscodeInfo{Status: "QUEUED", Source: creative.Source, Subdomain: "tenant"}
+	transcodeInfo := structure.TranscodeInfo{Source: creative.MasterPlaylistUrl}
+	api.keepStoredFields(stored, &transcodeInfo)
+	is.Equal(transcodeInfo.Source, creative.Source)
+	is.Equal(transcodeInfo.Subdomain, "tenant")
+
+	// Failing to mirror falls back to the original URL
+	missing := &structure.ManifestAsset{
+		CreativeId:        "missing",
+		MasterPlaylistUrl: source.URL + "/ads/missing.mp4",
+		Source:            source.URL + "/ads/missing.mp4",
+	}
+	api.mirrorSource(missing)
+	is.Equal(missing.MasterPlaylistUrl, source.URL+"/ads/missing.mp4")
+
+	// The queued record refers to the original source, not to the copy
+	queued, err := api.dispatchJob(&structure.ManifestAsset{
+		CreativeId:        "ad",
+		MasterPlaylistUrl: source.URL + "/ads/ad.mp4",
+	}, "")
+	is.NoErr(err)
+	is.Equal(queued.Url, source.URL+"/ads/ad.mp4")
+	is.Equal(queued.Source, source.URL+"/ads/ad.mp4")
+	is.Equal(storeStub.mockStore["ad"].Url, source.URL+"/ads/ad.mp4")
+	storeStub.reset()
+}
+
 func setupTestServer() *httptest.Server {
 	vastData, _ := os.ReadFile("../test_data/testVast.xml")
 	vmapData, _ := os.ReadFile("../test_data/testVmap.xml")
@@ -804,3 +1377,33 @@ func setupTestServer() *httptest.Server {
 			}
 		}))
 }
+
+func TestDispatchJobStoresQueuedBeforeStart(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	defer encoreHandler.reset()
+	// The job fails as soon as it is started, like an ffmpeg job with an unreadable source
+	encoreHandler.onStart = func(jobId string) {
+		stored, found, _ := storeStub.Get("ad")
+		is.True(found)
+		is.Equal(stored.Status, "QUEUED")
+		is.NoErr(api.HandleJobUpdate(transcoder.JobUpdate{
+			JobId:      jobId,
+			CreativeId: "ad",
+			Status:     transcoder.StatusFailed,
+		}))
+	}
+
+	transcodeInfo, err := api.dispatchJob(&structure.ManifestAsset{
+		CreativeId:        "ad",
+		MasterPlaylistUrl: "https://example.com/ad.mp4",
+	}, "")
+	is.NoErr(err)
+	is.Equal(encoreHandler.started, []string{transcodeInfo.JobId})
+	stored, _, _ := storeStub.Get("ad")
+	is.Equal(stored.Status, "FAILED")
+	is.Equal(len(storeStub.published), 2)
+	is.Equal(storeStub.published[1].Event, structure.EventFailed)
+}
@@ -0,0 +1,94 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/encore"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/signature"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const signatureHeader = "X-Signature"
+
+func newCallbackRejectionCounter() metric.Int64Counter {
+	counter, err := otel.Meter("api").Int64Counter(
+		"callback_verification_failures",
+		metric.WithDescription("Number of callbacks rejected due to a missing or invalid token or signature"),
+	)
+	if err != nil {
+		logger.Error("failed to create callback rejection counter", slog.String("error", err.Error()))
+	}
+	return counter
+}
+
+// Verifies the per job token that is added to the Encore progress callback URL
+// when the job is created. Always succeeds if no callback secret is configured.
+func (api *API) verifyEncoreCallback(r *http.Request, creativeId string, jobId string) bool {
+	if api.callbackSecret == "" {
+		return true
+	}
+	token := r.URL.Query().Get(encore.CallbackTokenParam)
+	if encore.VerifyCallbackToken(api.callbackSecret, creativeId, jobId, token) {
+		return true
+	}
+	api.countCallbackRejection("encore")
+	logger.Warn("rejected Encore callback with invalid token",
+		slog.String("creativeId", creativeId),
+		slog.String("jobId", jobId),
+		slog.String("remoteAddr", r.RemoteAddr),
+	)
+	return false
+}
+
+// VerifyPackagerCallback rejects packager callbacks that are not authenticated with the callback secret.
+// The secret can be provided as a bearer token, or used to sign the request body in the
+// X-Signature header (sha256=<hex encoded HMAC>). The secret is never accepted in the URL,
+// since URLs end up in access logs.
+func (api *API) VerifyPackagerCallback(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.callbackSecret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if found && subtle.ConstantTimeCompare([]byte(token), []byte(api.callbackSecret)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if sig := r.Header.Get(signatureHeader); sig != "" {
+			body, err := io.ReadAll(r.Body)
+			_ = r.Body.Close()
+			if err != nil {
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+			if signature.Verify(api.callbackSecret, body, sig) {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		api.countCallbackRejection("packager")
+		logger.Warn("rejected unauthenticated packager callback",
+			slog.String("path", r.URL.Path),
+			slog.String("remoteAddr", r.RemoteAddr),
+		)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (api *API) countCallbackRejection(source string) {
+	if api.callbackRejections == nil {
+		return
+	}
+	api.callbackRejections.Add(context.Background(), 1, metric.WithAttributes(attribute.String("source", source)))
+}
@@ -0,0 +1,224 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
+	"go.opentelemetry.io/otel"
+)
+
+// A creative with the state around it that is not stored in the record
+type creativeResponse struct {
+	CreativeId string                  `json:"creativeId"`
+	Job        structure.TranscodeInfo `json:"job"`
+	// Seconds until the creative expires, -1 if it does not expire
+	ExpiresIn int64 `json:"expiresIn"`
+	// Whether the source of the creative has been blacklisted since it was transcoded
+	SourceBlacklisted bool `json:"sourceBlacklisted"`
+	// Packaging job waiting for the packager, if any
+	PackagingJob *structure.PackagingJobState `json:"packagingJob,omitempty"`
+	// Path of the history of the creative
+	History string `json:"history"`
+}
+
+type retranscodeRequest struct {
+	// Transcoding profile to use instead of the default profile
+	Profile string `json:"profile"`
+}
+
+// HandleGetJob returns the creative with its expiry, whether its source is blacklisted,
+// and its packaging job
+func (api *API) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleGetJob")
+	defer span.End()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	creativeId := r.PathValue("id")
+	transcodeInfo, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		logger.Error("failed to get creative", slog.String("error", err.Error()), slog.String("creativeId", creativeId))
+		http.Error(w, "Failed to get creative", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Creative not found", http.StatusNotFound)
+		return
+	}
+	resp, err := api.describeCreative(creativeId, transcodeInfo)
+	if err != nil {
+		logger.Error("failed to describe creative",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+		)
+		http.Error(w, "Failed to get creative", http.StatusInternalServerError)
+		return
+	}
+	writeCreative(w, http.StatusOK, resp)
+}
+
+// HandleDeleteJob evicts the creative, so that it is transcoded again the next time it is requested
+func (api *API) HandleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleDeleteJob")
+	defer span.End()
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	creativeId := r.PathValue("id")
+	found, err := api.DeleteCreative(creativeId)
+	if err != nil {
+		logger.Error("failed to delete creative",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+		)
+		http.Error(w, "Failed to delete creative", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Creative not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRetranscode creates a new transcoding job for the creative, also if it has been completed.
+// Like a new creative, it is not served until the new job completes. The running job of the creative,
+// if any, is cancelled, and the callbacks of earlier jobs are ignored from then on. The output of the
+// last completed job is removed when the new job completes, if storage cleanup is enabled.
+func (api *API) HandleRetranscode(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleRetranscode")
+	defer span.End()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request retranscodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+	creativeId := r.PathValue("id")
+	stored, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		logger.Error("failed to get creative", slog.String("error", err.Error()), slog.String("creativeId", creativeId))
+		http.Error(w, "Failed to get creative", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Creative not found", http.StatusNotFound)
+		return
+	}
+	if stored.Source == "" {
+		http.Error(w, "Creative has no source to transcode", http.StatusConflict)
+		return
+	}
+	blacklisted, err := api.valkeyStore.InBlackList(stored.Source)
+	if err != nil {
+		logger.Error("failed to check blacklist",
+			slog.String("error", err.Error()),
+			slog.String("source", stored.Source),
+		)
+		http.Error(w, "Failed to check blacklist", http.StatusInternalServerError)
+		return
+	}
+	if blacklisted {
+		http.Error(w, "Source of the creative is blacklisted", http.StatusConflict)
+		return
+	}
+	creative := structure.ManifestAsset{
+		CreativeId:        creativeId,
+		MasterPlaylistUrl: stored.Source,
+		Source:            stored.Source,
+		Profile:           request.Profile,
+		// Removed when the new job completes, the creative may be served until then
+		ReplacedOutputFolder: stored.OutputFolder,
+	}
+	if stored.Status != "COMPLETED" {
+		// The output of the unfinished job is never served, the last completed job is replaced instead
+		creative.ReplacedOutputFolder = stored.ReplacedOutputFolder
+	}
+	transcodeInfo, err := api.dispatchJob(&creative, stored.Subdomain)
+	if errors.Is(err, errSourceRejected) {
+		http.Error(w, "Source of the creative is invalid", http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, transcoder.ErrUnsupportedProfile) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create transcoding job", http.StatusBadGateway)
+		return
+	}
+	// The new job is stored, so the cancellation of the running job is ignored
+	api.cancelJob(creativeId, stored)
+	if stored.Status != "COMPLETED" {
+		api.removeOutputFolder(creativeId, stored.OutputFolder)
+	}
+	if stored.Status == "PACKAGING" {
+		api.untrackPackagingJob(creativeId)
+	}
+	logger.Info("re-transcoding creative",
+		slog.String("creativeId", creativeId),
+		slog.String("previousJobId", stored.JobId),
+		slog.String("jobId", transcodeInfo.JobId),
+		slog.String("profile", transcodeInfo.Profile),
+	)
+	resp, err := api.describeCreative(creativeId, transcodeInfo)
+	if err != nil {
+		logger.Error("failed to describe creative",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+		)
+	}
+	writeCreative(w, http.StatusAccepted, resp)
+}
+
+func (api *API) describeCreative(creativeId string, transcodeInfo structure.TranscodeInfo) (creativeResponse, error) {
+	resp := creativeResponse{
+		CreativeId: creativeId,
+		Job:        transcodeInfo,
+		ExpiresIn:  -1,
+		History:    "/api/v1" + jobPath + "/" + creativeId + "/history",
+	}
+	ttl, err := api.valkeyStore.Ttl(creativeId)
+	if err == nil {
+		resp.ExpiresIn = ttl
+	}
+	if transcodeInfo.Source != "" {
+		resp.SourceBlacklisted, err = api.valkeyStore.InBlackList(transcodeInfo.Source)
+		if err != nil {
+			return resp, err
+		}
+	}
+	if transcodeInfo.Status == "PACKAGING" {
+		state, found, err := api.valkeyStore.GetPackagingJob(creativeId)
+		if err != nil {
+			return resp, err
+		}
+		if found {
+			resp.PackagingJob = &state
+		}
+	}
+	return resp, nil
+}
+
+func writeCreative(w http.ResponseWriter, status int, resp creativeResponse) {
+	ret, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("failed to marshal creative", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal creative", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(ret)
+}
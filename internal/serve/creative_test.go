@@ -0,0 +1,206 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
+	"github.com/matryer/is"
+)
+
+func creativeMux(api *API) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{id}", api.HandleGetJob)
+	mux.HandleFunc("DELETE /jobs/{id}", api.HandleDeleteJob)
+	mux.HandleFunc("POST /jobs/{id}/retranscode", api.HandleRetranscode)
+	return mux
+}
+
+func TestGetJob(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	mux := creativeMux(api)
+	source := "https://example.com/ad.mp4"
+	_ = ss.Set("completed", structure.TranscodeInfo{Status: "COMPLETED", Source: source})
+	_ = ss.Set("packaging", structure.TranscodeInfo{Status: "PACKAGING", JobId: "job"})
+	_ = ss.BlackList(source, "not an ad")
+	_ = ss.TrackPackagingJob(structure.PackagingJobState{CreativeId: "packaging", Attempts: 1})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/completed", nil))
+	is.Equal(rr.Code, http.StatusOK)
+	var resp creativeResponse
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+	is.Equal(resp.CreativeId, "completed")
+	is.Equal(resp.Job.Status, "COMPLETED")
+	is.Equal(resp.ExpiresIn, int64(-1))
+	is.True(resp.SourceBlacklisted)
+	is.Equal(resp.PackagingJob, nil)
+	is.Equal(resp.History, "/api/v1/jobs/completed/history")
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/packaging", nil))
+	is.Equal(rr.Code, http.StatusOK)
+	resp = creativeResponse{}
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+	is.True(!resp.SourceBlacklisted)
+	is.Equal(resp.PackagingJob.Attempts, 1)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil))
+	is.Equal(rr.Code, http.StatusNotFound)
+}
+
+func TestDeleteJob(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	defer encoreHandler.reset()
+	mux := creativeMux(api)
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS", JobId: "job"})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/jobs/creative", nil))
+	is.Equal(rr.Code, http.StatusNoContent)
+	_, found, _ := ss.Get("creative")
+	is.True(!found)
+	is.Equal(encoreHandler.cancelled, []string{"job"})
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/jobs/creative", nil))
+	is.Equal(rr.Code, http.StatusNotFound)
+}
+
+func TestRetranscode(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	defer encoreHandler.reset()
+	mux := creativeMux(api)
+	_ = ss.Set("creative", structure.TranscodeInfo{
+		Status:    "IN_PROGRESS",
+		JobId:     "old-job",
+		Source:    "https://example.com/ad.mp4",
+		Subdomain: "tenant",
+	})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(
+		http.MethodPost,
+		"/jobs/creative/retranscode",
+		strings.NewReader(`{"profile":"other-profile"}`),
+	))
+	is.Equal(rr.Code, http.StatusAccepted)
+	var resp creativeResponse
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+	is.Equal(resp.Job.Status, "QUEUED")
+	is.Equal(resp.Job.Profile, "other-profile")
+	is.Equal(resp.Job.Subdomain, "tenant")
+	newJobId := resp.Job.JobId
+	is.True(newJobId != "" && newJobId != "old-job")
+	is.Equal(encoreHandler.calls, 1)
+	is.Equal(encoreHandler.cancelled, []string{"old-job"})
+
+	// The callbacks of the replaced job are ignored
+	for _, status := range []transcoder.JobStatus{transcoder.StatusCancelled, transcoder.StatusInProgress} {
+		is.NoErr(api.HandleJobUpdate(transcoder.JobUpdate{JobId: "old-job", CreativeId: "creative", Status: status}))
+	}
+	stored, found, _ := ss.Get("creative")
+	is.True(found)
+	is.Equal(stored.Status, "QUEUED")
+	is.Equal(stored.JobId, newJobId)
+
+	// Completed creatives can be transcoded again, with the default profile
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", JobId: newJobId, Source: stored.Source})
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/jobs/creative/retranscode", nil))
+	is.Equal(rr.Code, http.StatusAccepted)
+	is.Equal(encoreHandler.calls, 2)
+	// Nothing to cancel
+	is.Equal(len(encoreHandler.cancelled), 1)
+}
+
+func TestRetranscodeRemovesReplacedOutput(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	defer encoreHandler.reset()
+	api.jitPackage = true
+	root := setupCleanup(t, api, "ads/creative/old-job/index.m3u8", "ads/creative/running-job/index.m3u8")
+	mux := creativeMux(api)
+	_ = ss.Set("creative", structure.TranscodeInfo{
+		Status:       "COMPLETED",
+		JobId:        "old-job",
+		OutputFolder: "s3://test-bucket/ads/creative/old-job/",
+		Source:       "https://example.com/ad.mp4",
+	})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/jobs/creative/retranscode", nil))
+	is.Equal(rr.Code, http.StatusAccepted)
+	stored, _, _ := ss.Get("creative")
+	is.Equal(stored.ReplacedOutputFolder, "s3://test-bucket/ads/creative/old-job/")
+
+	// Transcoding again before the job completes replaces the same completed job,
+	// the output of the unfinished job is removed right away
+	stored.OutputFolder = "s3://test-bucket/ads/creative/running-job/"
+	_ = ss.Set("creative", stored)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/jobs/creative/retranscode", nil))
+	is.Equal(rr.Code, http.StatusAccepted)
+	is.True(!exists(root, "ads/creative/running-job"))
+	stored, _, _ = ss.Get("creative")
+	is.Equal(stored.ReplacedOutputFolder, "s3://test-bucket/ads/creative/old-job/")
+	// The output of the completed job is kept until the new job completes
+	is.True(exists(root, "ads/creative/old-job/index.m3u8"))
+
+	is.NoErr(api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      stored.JobId,
+		CreativeId: "creative",
+		Status:     transcoder.StatusSuccessful,
+	}))
+	stored, _, _ = ss.Get("creative")
+	is.Equal(stored.Status, "COMPLETED")
+	is.Equal(stored.ReplacedOutputFolder, "")
+	is.True(!exists(root, "ads/creative/old-job"))
+}
+
+func TestRetranscodeErrors(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	defer encoreHandler.reset()
+	mux := creativeMux(api)
+	_ = ss.Set("blacklisted", structure.TranscodeInfo{Status: "COMPLETED", Source: "https://example.com/ad.mp4"})
+	_ = ss.Set("no-source", structure.TranscodeInfo{Status: "COMPLETED"})
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", Source: "https://example.com/other.mp4"})
+	_ = ss.BlackList("https://example.com/ad.mp4", "not an ad")
+
+	cases := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/jobs/unknown/retranscode", "", http.StatusNotFound},
+		{"/jobs/blacklisted/retranscode", "", http.StatusConflict},
+		{"/jobs/no-source/retranscode", "", http.StatusConflict},
+		{"/jobs/blacklisted/retranscode", "{", http.StatusBadRequest},
+		{"/jobs/creative/retranscode", `{"profile":"unsupported"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(c.body)))
+		is.Equal(rr.Code, c.status)
+	}
+	is.Equal(encoreHandler.calls, 0)
+}
@@ -2,13 +2,22 @@ package serve
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Eyevinn/ad-normalizer/internal/encore"
+	"github.com/Eyevinn/ad-normalizer/internal/packaging"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
 	"github.com/matryer/is"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 )
 
 func TestEncoreCallback(t *testing.T) {
@@ -23,29 +32,32 @@ func TestEncoreCallback(t *testing.T) {
 		{
 			name: "Successful Transcode",
 			progressUpdate: structure.EncoreJobProgress{
+				JobId:  "test-job-id",
 				Status: "SUCCESSFUL",
 			},
-			expectSets:    1,
+			expectSets:    0, // unknown creatives are not stored
 			expectDeletes: 0,
-			expectGets:    0,
+			expectGets:    1,
 		},
 		{
 			name: "Failed Transcode",
 			progressUpdate: structure.EncoreJobProgress{
+				JobId:  "test-job-id",
 				Status: "FAILED",
 			},
 			expectSets:    0,
-			expectDeletes: 1,
-			expectGets:    0,
+			expectDeletes: 0, // unknown creatives are not failed
+			expectGets:    1,
 		},
 		{
 			name: "In Progress Transcode",
 			progressUpdate: structure.EncoreJobProgress{
+				JobId:  "test-job-id",
 				Status: "IN_PROGRESS",
 			},
-			expectSets:    0,
+			expectSets:    0, // unknown creatives are not stored
 			expectDeletes: 0,
-			expectGets:    0,
+			expectGets:    1,
 		},
 	}
 	for _, c := range cases {
@@ -66,4 +78,239 @@ func TestEncoreCallback(t *testing.T) {
 			ss.reset()
 		})
 	}
+
+	// Callbacks without a job ID can not be matched to the job of the creative
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	reqBody, err := json.Marshal(structure.EncoreJobProgress{ExternalId: "creative", Status: "FAILED"})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", "/encore/callback", bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	api.HandleEncoreCallback(rr, req)
+	is.Equal(rr.Code, http.StatusBadRequest)
+	is.Equal(ss.gets, 0)
+	ss.reset()
+}
+
+func TestEncoreProgress(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = ss.Set("creative", structure.TranscodeInfo{
+		Status:     "QUEUED",
+		JobId:      "test-job-id",
+		LastUpdate: time.Now().Add(-30 * time.Second).Unix(),
+	})
+	reqBody, err := json.Marshal(structure.EncoreJobProgress{
+		JobId:      "test-job-id",
+		ExternalId: "creative",
+		Progress:   25,
+		Status:     "IN_PROGRESS",
+	})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", "/encoreCallback", bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	api.HandleEncoreCallback(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	tci, _, _ := ss.Get("creative")
+	is.Equal(tci.Status, "IN_PROGRESS")
+	is.Equal(tci.EncoreStatus, "IN_PROGRESS")
+	is.Equal(tci.Progress, 25)
+	is.Equal(tci.JobId, "test-job-id")
+	// 25% in 30 seconds leaves roughly 90 seconds
+	remaining := tci.Eta - time.Now().Unix()
+	is.True(remaining >= 85 && remaining <= 95)
+
+	// Only the state change is sent to webhooks
+	req, err = http.NewRequest("POST", "/encoreCallback", bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	api.HandleEncoreCallback(httptest.NewRecorder(), req)
+	is.Equal(ss.events(), []string{structure.EventInProgress})
+	ss.reset()
+}
+
+func TestEncoreProgressAfterCompletion(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/index.m3u8"})
+
+	// A progress callback that arrives after the completion does not overwrite it
+	err := api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      "job",
+		CreativeId: "creative",
+		Status:     transcoder.StatusInProgress,
+		Progress:   90,
+	})
+	is.NoErr(err)
+	tci, _, _ := ss.Get("creative")
+	is.Equal(tci.Status, "COMPLETED")
+	is.Equal(tci.Progress, 0)
+	is.Equal(len(ss.events()), 0)
+	ss.reset()
+}
+
+func TestEncoreFailureAfterCompletion(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	failed := transcoder.JobUpdate{JobId: "job", CreativeId: "creative", Status: transcoder.StatusFailed}
+
+	// A late failure does not remove a completed or packaging creative, nor a creative transcoding another job
+	for _, stored := range []structure.TranscodeInfo{
+		{Status: "COMPLETED", JobId: "job", Url: "https://example.com/index.m3u8"},
+		{Status: "PACKAGING", JobId: "job"},
+		{Status: "IN_PROGRESS", JobId: "other-job"},
+	} {
+		_ = ss.Set("creative", stored)
+		is.NoErr(api.HandleJobUpdate(failed))
+		tci, found, _ := ss.Get("creative")
+		is.True(found)
+		is.Equal(tci.Status, stored.Status)
+	}
+	is.Equal(ss.deletes, 0)
+	is.Equal(len(ss.events()), 0)
+
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS", JobId: "job"})
+	is.NoErr(api.HandleJobUpdate(failed))
+	tci, _, _ := ss.Get("creative")
+	is.Equal(tci.Status, "FAILED")
+	is.Equal(ss.events(), []string{structure.EventFailed})
+}
+
+func TestBuiltinPackaging(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	fixture, err := os.ReadFile("../test_data/fragmented.mp4")
+	is.NoErr(err)
+	objectStore := &ObjectStoreStub{objects: map[string][]byte{"ads/job/job_x264_3100.mp4": fixture}}
+	api.jitPackage = false
+	api.hlsPackager = packaging.NewHlsPackager(objectStore)
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS", JobId: "job"})
+
+	err = api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      "job",
+		CreativeId: "creative",
+		Status:     transcoder.StatusSuccessful,
+	})
+	is.NoErr(err)
+	tci, _, _ := ss.Get("creative")
+	is.Equal(tci.Status, "COMPLETED")
+	is.Equal(tci.Url, "https://asset-server.example.com/ads/job/index.m3u8")
+	multivariant := string(objectStore.objects["ads/job/index.m3u8"])
+	is.True(strings.Contains(multivariant, "job_x264_3100.m3u8"))
+	is.True(strings.Contains(multivariant, `CODECS="avc1.64001F,mp4a.40.2"`))
+	is.True(strings.Contains(string(objectStore.objects["ads/job/job_x264_3100.m3u8"]), "#EXT-X-BYTERANGE:96@412\n"))
+	// Completed directly, without a packaging job
+	is.Equal(len(ss.tracked), 0)
+	is.Equal(ss.events(), []string{structure.EventCompleted})
+	ss.reset()
+}
+
+func TestDuplicateTranscodeCompletion(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	api.jitPackage = false
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS", JobId: "job", Subdomain: "tenant"})
+	completed := transcoder.JobUpdate{JobId: "job", CreativeId: "creative", Status: transcoder.StatusSuccessful}
+
+	is.NoErr(api.HandleJobUpdate(completed))
+	tci, _, _ := ss.Get("creative")
+	is.Equal(tci.Status, "PACKAGING")
+	is.Equal(tci.Subdomain, "tenant")
+	is.Equal(len(ss.enqueued), 1)
+
+	// A duplicate callback does not queue the packaging again
+	is.NoErr(api.HandleJobUpdate(completed))
+	is.Equal(len(ss.enqueued), 1)
+	is.Equal(ss.events(), []string{"PACKAGING"})
+	is.Equal(ss.historyEvents("creative"), []string{
+		structure.HistoryTranscodeSucceeded,
+		structure.HistoryPackagingEnqueued,
+	})
+
+	// Nor does a completion after the creative was removed bring it back
+	_ = ss.Delete("creative")
+	is.NoErr(api.HandleJobUpdate(completed))
+	_, found, _ := ss.Get("creative")
+	is.True(!found)
+	is.Equal(len(ss.enqueued), 1)
+	is.Equal(encoreHandler.getCalls, 1)
+	ss.reset()
+	encoreHandler.reset()
+}
+
+func TestEncoreCallbackVerification(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	api.callbackRejections, _ = provider.Meter("test").Int64Counter("callback_verification_failures")
+	api.callbackSecret = "secret"
+	_ = ss.Set("test-creative", structure.TranscodeInfo{Status: "QUEUED", JobId: "test-job-id"})
+
+	reqBody, err := json.Marshal(structure.EncoreJobProgress{
+		JobId:      "test-job-id",
+		ExternalId: "test-creative",
+		Status:     "FAILED",
+	})
+	is.NoErr(err)
+
+	req, err := http.NewRequest("POST", "/encoreCallback?token=forged", bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	api.HandleEncoreCallback(rr, req)
+	is.Equal(rr.Code, http.StatusUnauthorized)
+	tci, _, _ := ss.Get("test-creative")
+	is.Equal(tci.Status, "QUEUED")
+	is.Equal(callbackRejections(t, reader), int64(1))
+
+	// The token of another job of the creative is rejected
+	token := encore.CallbackToken("secret", "test-creative", "other-job-id")
+	req, err = http.NewRequest("POST", "/encoreCallback?token="+token, bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	api.HandleEncoreCallback(rr, req)
+	is.Equal(rr.Code, http.StatusUnauthorized)
+	is.Equal(callbackRejections(t, reader), int64(2))
+
+	token = encore.CallbackToken("secret", "test-creative", "test-job-id")
+	req, err = http.NewRequest("POST", "/encoreCallback?token="+token, bytes.NewBuffer(reqBody))
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	api.HandleEncoreCallback(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	tci, _, _ = ss.Get("test-creative")
+	is.Equal(tci.Status, "FAILED")
+	is.Equal(callbackRejections(t, reader), int64(2))
+	ss.reset()
+}
+
+func callbackRejections(t *testing.T, reader *sdkmetric.ManualReader) int64 {
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok {
+				for _, dp := range sum.DataPoints {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
 }
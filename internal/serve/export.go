@@ -0,0 +1,85 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"go.opentelemetry.io/otel"
+)
+
+// HandleExport streams all creatives, blacklist entries and tracked packaging jobs as NDJSON.
+// The export stops when the client goes away.
+func (api *API) HandleExport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("api").Start(r.Context(), "HandleExport")
+	defer span.End()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="ad-normalizer-export.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+	if err := store.Export(ctx, api.valkeyStore, w); err != nil {
+		// The status has been sent, the client sees a truncated export
+		logger.Error("failed to export store", slog.String("error", err.Error()))
+	}
+}
+
+// HandleImport reads an export into the store. The mode query parameter is merge (default),
+// to keep existing records, or overwrite, to replace them.
+func (api *API) HandleImport(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleImport")
+	defer span.End()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = store.IMPORT_MERGE
+	}
+	if mode != store.IMPORT_MERGE && mode != store.IMPORT_OVERWRITE {
+		http.Error(w, "Invalid mode parameter, must be one of merge, overwrite", http.StatusBadRequest)
+		return
+	}
+	result, err := store.Import(api.valkeyStore, r.Body, store.ImportOptions{
+		Mode:             mode,
+		PackagingQueue:   api.packageQueue,
+		PackagingTimeout: api.packagingTimeout,
+		OutputBucket:     api.outputBucket,
+	})
+	if err != nil {
+		logger.Error("failed to import into store",
+			slog.String("error", err.Error()),
+			slog.Int("creatives", result.Creatives),
+			slog.Int("blacklist", result.Blacklist),
+			slog.Int("packagingJobs", result.PackagingJobs),
+		)
+		if errors.Is(err, store.ErrInvalidRecord) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to import", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Imported into store",
+		slog.String("mode", mode),
+		slog.Int("creatives", result.Creatives),
+		slog.Int("blacklist", result.Blacklist),
+		slog.Int("packagingJobs", result.PackagingJobs),
+		slog.Int("skipped", result.Skipped),
+	)
+	ret, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("failed to marshal import result", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal import result", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(ret)
+}
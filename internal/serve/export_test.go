@@ -0,0 +1,72 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestExportImport(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	api.outputBucket = "s3://bucket/ads"
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/index.m3u8"})
+	_ = ss.Set("packaging", structure.TranscodeInfo{Status: "PACKAGING", OutputFolder: "s3://bucket/ads/packaging/job/"})
+	_ = ss.BlackList("https://example.com/ad.mp4", "not an ad")
+	_ = ss.TrackPackagingJob(structure.PackagingJobState{
+		CreativeId: "packaging",
+		Job:        structure.PackagingQueueMessage{JobId: "job", Url: "https://example.com/job/"},
+	})
+
+	rr := httptest.NewRecorder()
+	api.HandleExport(rr, httptest.NewRequest(http.MethodGet, "/export", nil))
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Type"), "application/x-ndjson")
+	export := rr.Body.String()
+	is.Equal(strings.Count(export, "\n"), 4)
+
+	ss.reset()
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "FAILED"})
+	rr = httptest.NewRecorder()
+	api.HandleImport(rr, httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(export)))
+	is.Equal(rr.Code, http.StatusOK)
+	var result store.ImportResult
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &result))
+	is.Equal(result, store.ImportResult{Creatives: 1, Blacklist: 1, PackagingJobs: 1, Skipped: 1})
+	is.Equal(ss.mockStore["creative"].Status, "FAILED")
+	is.Equal(ss.enqueued, []structure.PackagingQueueMessage{{JobId: "job", Url: "https://example.com/job/"}})
+	is.True(ss.tracked["packaging"].Deadline > 0)
+
+	rr = httptest.NewRecorder()
+	api.HandleImport(rr, httptest.NewRequest(http.MethodPost, "/import?mode=overwrite", strings.NewReader(export)))
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(ss.mockStore["creative"].Status, "COMPLETED")
+}
+
+func TestImportErrors(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+
+	rr := httptest.NewRecorder()
+	api.HandleImport(rr, httptest.NewRequest(http.MethodPost, "/import?mode=replace", strings.NewReader("")))
+	is.Equal(rr.Code, http.StatusBadRequest)
+
+	rr = httptest.NewRecorder()
+	api.HandleImport(rr, httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(`{"type":"webhook"}`)))
+	is.Equal(rr.Code, http.StatusBadRequest)
+	is.True(strings.Contains(rr.Body.String(), "line 1"))
+
+	rr = httptest.NewRecorder()
+	api.HandleImport(rr, httptest.NewRequest(http.MethodGet, "/import", nil))
+	is.Equal(rr.Code, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,107 @@
+package serve
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"go.opentelemetry.io/otel"
+)
+
+type historyResponse struct {
+	CreativeId string                   `json:"creativeId"`
+	Events     []structure.HistoryEvent `json:"events"`
+}
+
+// Records a state change of the creative, with the details taken from the creative.
+// The webhook event is published as well, unless it is empty.
+func (api *API) recordStateChange(
+	creativeId string,
+	event string,
+	source string,
+	transcodeInfo structure.TranscodeInfo,
+	webhookEvent string,
+) {
+	api.appendHistory(creativeId, event, source, historyDetails(transcodeInfo))
+	if webhookEvent != "" {
+		api.publishEvent(webhookEvent, creativeId, transcodeInfo)
+	}
+}
+
+// The details of a history event that describe the state of the creative
+func historyDetails(transcodeInfo structure.TranscodeInfo) map[string]string {
+	details := map[string]string{
+		"jobId":        transcodeInfo.JobId,
+		"status":       transcodeInfo.Status,
+		"encoreStatus": transcodeInfo.EncoreStatus,
+		"source":       transcodeInfo.Source,
+		"url":          transcodeInfo.Url,
+		"error":        transcodeInfo.Error,
+		"profile":      transcodeInfo.Profile,
+		"subdomain":    transcodeInfo.Subdomain,
+	}
+	if transcodeInfo.Progress > 0 {
+		details["progress"] = strconv.Itoa(transcodeInfo.Progress)
+	}
+	return details
+}
+
+// Appends a state change to the history of the creative. Empty details are left out.
+func (api *API) appendHistory(creativeId string, event string, source string, details map[string]string) {
+	for key, value := range details {
+		if value == "" {
+			delete(details, key)
+		}
+	}
+	err := api.valkeyStore.AppendHistory(creativeId, structure.HistoryEvent{
+		Timestamp: time.Now().UnixMilli(),
+		Event:     event,
+		Source:    source,
+		Details:   details,
+	})
+	if err != nil {
+		logger.Error("failed to record history of creative",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+			slog.String("event", event),
+		)
+	}
+}
+
+// HandleJobHistory returns the state changes of a creative, oldest first.
+// The history is kept after the creative is removed, f.ex. when it failed.
+func (api *API) HandleJobHistory(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleJobHistory")
+	defer span.End()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	creativeId := r.PathValue("id")
+	history, err := api.valkeyStore.GetHistory(creativeId)
+	if err != nil {
+		logger.Error("failed to get history of creative",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+		)
+		http.Error(w, "Failed to get history", http.StatusInternalServerError)
+		return
+	}
+	if len(history) == 0 {
+		http.Error(w, "No history found for creative", http.StatusNotFound)
+		return
+	}
+	ret, err := json.Marshal(historyResponse{CreativeId: creativeId, Events: history})
+	if err != nil {
+		logger.Error("failed to marshal history", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(ret)
+}
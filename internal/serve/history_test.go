@@ -0,0 +1,134 @@
+package serve
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/packaging"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
+	"github.com/matryer/is"
+)
+
+func TestJobHistory(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{id}/history", api.HandleJobHistory)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/creative/history", nil))
+	is.Equal(rr.Code, http.StatusNotFound)
+
+	api.recordStateChange(
+		"creative",
+		structure.HistoryDispatched,
+		structure.HistorySourceNormalizer,
+		structure.TranscodeInfo{JobId: "job"},
+		"",
+	)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/creative/history", nil))
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Type"), "application/json")
+	var response historyResponse
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &response))
+	is.Equal(response.CreativeId, "creative")
+	is.Equal(len(response.Events), 1)
+	is.Equal(response.Events[0].Event, structure.HistoryDispatched)
+	is.Equal(response.Events[0].Source, structure.HistorySourceNormalizer)
+	// Empty details are left out
+	is.Equal(response.Events[0].Details, map[string]string{"jobId": "job"})
+	is.True(response.Events[0].Timestamp > 0)
+}
+
+func TestTranscodeHistory(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	api.jitPackage = false
+	fixture, err := os.ReadFile("../test_data/fragmented.mp4")
+	is.NoErr(err)
+	api.hlsPackager = packaging.NewHlsPackager(&ObjectStoreStub{objects: map[string][]byte{
+		"ads/job/job_x264_3100.mp4": fixture,
+	}})
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "QUEUED", JobId: "job"})
+	_ = ss.Set("failing", structure.TranscodeInfo{Status: "QUEUED", JobId: "failing-job"})
+
+	updates := []transcoder.JobUpdate{
+		{JobId: "job", CreativeId: "creative", Status: transcoder.StatusInProgress, Progress: 10},
+		// Progress is recorded every 25 percent
+		{JobId: "job", CreativeId: "creative", Status: transcoder.StatusInProgress, Progress: 20},
+		{JobId: "job", CreativeId: "creative", Status: transcoder.StatusInProgress, Progress: 50},
+		{JobId: "job", CreativeId: "creative", Status: transcoder.StatusInProgress, Progress: 60},
+		{JobId: "job", CreativeId: "creative", Status: transcoder.StatusSuccessful},
+		// Late progress is not recorded
+		{JobId: "job", CreativeId: "creative", Status: transcoder.StatusInProgress, Progress: 90},
+		{JobId: "failing-job", CreativeId: "failing", Status: transcoder.StatusFailed, Message: "invalid input"},
+	}
+	for _, update := range updates {
+		_ = api.HandleJobUpdate(update)
+	}
+	is.Equal(ss.historyEvents("creative"), []string{
+		structure.HistoryProgress,
+		structure.HistoryProgress,
+		structure.HistoryTranscodeSucceeded,
+		structure.HistoryPackagingSucceeded,
+	})
+	is.Equal(ss.history["creative"][0].Details["progress"], "10")
+	is.Equal(ss.history["creative"][0].Details["status"], "IN_PROGRESS")
+	is.Equal(ss.history["creative"][1].Details["progress"], "50")
+	is.Equal(ss.history["creative"][3].Details["url"], "https://asset-server.example.com/ads/job/index.m3u8")
+	is.Equal(ss.historyEvents("failing"), []string{structure.HistoryTranscodeFailed})
+	is.Equal(ss.history["failing"][0].Source, structure.HistorySourceTranscoder)
+	is.Equal(ss.history["failing"][0].Details["error"], "invalid input")
+}
+
+func TestFailedCreativeInSqlHistory(t *testing.T) {
+	is := is.New(t)
+	api, ts, _, _ := setupApi()
+	defer ts.Close()
+	dsn := filepath.Join(t.TempDir(), "normalizer.db")
+	sqlStore, err := store.NewSqlStore("sqlite", dsn)
+	is.NoErr(err)
+	defer func() { _ = sqlStore.Close() }()
+	api.valkeyStore = sqlStore
+	is.NoErr(sqlStore.Set("failing", structure.TranscodeInfo{Status: "QUEUED", JobId: "job", Source: "ad.mp4"}))
+
+	is.NoErr(api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      "job",
+		CreativeId: "failing",
+		Status:     transcoder.StatusFailed,
+		Message:    "invalid input",
+	}))
+	_, found, _ := sqlStore.Get("failing")
+	is.True(!found)
+
+	// The failure is recorded, although the creative is removed
+	db, err := sql.Open("sqlite", dsn)
+	is.NoErr(err)
+	defer func() { _ = db.Close() }()
+	rows, err := db.Query("SELECT status, error, job_id, source FROM creative_history WHERE creative_id = ? ORDER BY id",
+		"failing")
+	is.NoErr(err)
+	defer func() { _ = rows.Close() }()
+	changes := [][4]string{}
+	for rows.Next() {
+		var change [4]string
+		is.NoErr(rows.Scan(&change[0], &change[1], &change[2], &change[3]))
+		changes = append(changes, change)
+	}
+	is.Equal(changes, [][4]string{
+		{"QUEUED", "", "job", "ad.mp4"},
+		{"FAILED", "invalid input", "job", "ad.mp4"},
+	})
+}
@@ -0,0 +1,87 @@
+package serve
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Removes the creatives with a job in flight for the blacklisted source, and cancels their jobs.
+// Sends a BLACKLISTED event for the source if none of its creatives were in flight.
+func (api *API) cancelSourceJobs(source string, reason string) {
+	if api.cancelSourceCreatives(source, reason) > 0 {
+		return
+	}
+	// Nothing was in flight, let the subscribers know about the blacklisted source itself
+	api.publishCreativeEvent(structure.CreativeEvent{
+		Event:     structure.EventBlacklisted,
+		Source:    source,
+		Error:     reason,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// Removes the in flight creatives of the source, and returns the number of removed creatives
+func (api *API) cancelSourceCreatives(source string, reason string) int {
+	creativeIds, err := api.valkeyStore.GetSourceCreatives(source)
+	if err != nil {
+		logger.Error("failed to get creatives of blacklisted source",
+			slog.String("error", err.Error()),
+			slog.String("source", source),
+		)
+		return 0
+	}
+	removed := 0
+	for _, creativeId := range creativeIds {
+		transcodeInfo, found, err := api.valkeyStore.Get(creativeId)
+		if err != nil || !found || !isInFlight(transcodeInfo) {
+			continue
+		}
+		if err := api.valkeyStore.Delete(creativeId); err != nil {
+			logger.Error("failed to remove creative of blacklisted source",
+				slog.String("error", err.Error()),
+				slog.String("creativeId", creativeId),
+			)
+			continue
+		}
+		api.cancelJob(creativeId, transcodeInfo)
+		api.removeJobAssets(creativeId, transcodeInfo)
+		transcodeInfo.Error = reason
+		api.recordStateChange(
+			creativeId,
+			structure.HistoryBlacklisted,
+			structure.HistorySourceApi,
+			transcodeInfo,
+			structure.EventBlacklisted,
+		)
+		removed++
+	}
+	return removed
+}
+
+// Cancels the transcoding job of the creative if it is still running.
+// The creative must be removed from the store, or stored with its new job, first,
+// so that the cancellation is not reported as a failure.
+func (api *API) cancelJob(creativeId string, transcodeInfo structure.TranscodeInfo) {
+	if transcodeInfo.JobId == "" || !isInFlight(transcodeInfo) {
+		return
+	}
+	if err := api.transcoder.CancelJob(transcodeInfo.JobId); err != nil {
+		logger.Error("failed to cancel transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+			slog.String("jobId", transcodeInfo.JobId),
+		)
+		return
+	}
+	logger.Info("cancelled transcoding job",
+		slog.String("creativeId", creativeId),
+		slog.String("jobId", transcodeInfo.JobId),
+	)
+}
+
+func isInFlight(transcodeInfo structure.TranscodeInfo) bool {
+	return transcodeInfo.Status == "QUEUED" || transcodeInfo.Status == "IN_PROGRESS"
+}
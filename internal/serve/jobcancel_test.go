@@ -0,0 +1,93 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
+	"github.com/matryer/is"
+)
+
+func TestBlacklistCancelsJobs(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	source := "https://adserver-assets.io/two-hours.mp4"
+	_ = ss.Set("running", structure.TranscodeInfo{Status: "IN_PROGRESS", JobId: "running-job", Source: source})
+	_ = ss.Set("completed", structure.TranscodeInfo{Status: "COMPLETED", JobId: "completed-job", Source: source})
+	_ = ss.AddSourceCreative(source, "running", 60)
+	_ = ss.AddSourceCreative(source, "completed", 60)
+
+	serializedBody, err := json.Marshal(blacklistRequest{MediaUrl: source, Reason: "not an ad"})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", ts.URL+"/blacklist", bytes.NewBuffer(serializedBody))
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusNoContent)
+
+	is.Equal(encoreHandler.cancelled, []string{"running-job"})
+	_, found, _ := ss.Get("running")
+	is.True(!found)
+	_, found, _ = ss.Get("completed")
+	is.True(found) // already transcoded, nothing to cancel
+	is.Equal(ss.events(), []string{structure.EventBlacklisted})
+
+	// The callback for the cancelled job does not report a failure
+	err = api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      "running-job",
+		CreativeId: "running",
+		Status:     transcoder.StatusCancelled,
+	})
+	is.NoErr(err)
+	is.Equal(ss.events(), []string{structure.EventBlacklisted})
+	is.Equal(ss.historyEvents("running"), []string{structure.HistoryBlacklisted})
+	is.Equal(ss.history["running"][0].Details["error"], "not an ad")
+}
+
+func TestBlacklistWithoutJobsInFlight(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	defer ss.reset()
+	_ = ss.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	source := "https://adserver-assets.io/unused.mp4"
+
+	serializedBody, err := json.Marshal(blacklistRequest{MediaUrl: source, Reason: "not an ad"})
+	is.NoErr(err)
+	req, err := http.NewRequest("POST", ts.URL+"/blacklist", bytes.NewBuffer(serializedBody))
+	is.NoErr(err)
+	recorder := httptest.NewRecorder()
+	api.HandleBlackList(recorder, req)
+	is.Equal(recorder.Result().StatusCode, http.StatusNoContent)
+
+	is.Equal(len(encoreHandler.cancelled), 0)
+	is.Equal(ss.events(), []string{structure.EventBlacklisted})
+	is.Equal(ss.deliveries[0].Event.CreativeId, "")
+	is.Equal(ss.deliveries[0].Event.Source, source)
+	is.Equal(ss.deliveries[0].Event.Job, nil)
+	is.Equal(len(ss.published), 1)
+}
+
+func TestDeleteCreativeCancelsJob(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, encoreHandler := setupApi()
+	defer ts.Close()
+	_ = ss.Set("queued", structure.TranscodeInfo{Status: "QUEUED", JobId: "queued-job"})
+	_ = ss.Set("packaging", structure.TranscodeInfo{Status: "PACKAGING", JobId: "packaging-job"})
+
+	found, err := api.DeleteCreative("queued")
+	is.NoErr(err)
+	is.True(found)
+	found, err = api.DeleteCreative("packaging")
+	is.NoErr(err)
+	is.True(found)
+	// Transcoding has finished for the packaging creative
+	is.Equal(encoreHandler.cancelled, []string{"queued-job"})
+	is.Equal(ss.historyEvents("queued"), []string{structure.HistoryDeleted})
+}
@@ -0,0 +1,173 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/klauspost/compress/gzhttp"
+)
+
+const (
+	eventBufferSize   = 64
+	keepAliveInterval = 15 * time.Second
+)
+
+// eventBroker fans out creative events received by this instance
+// to the connected event stream clients.
+type eventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan structure.CreativeEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[chan structure.CreativeEvent]struct{}),
+	}
+}
+
+func (b *eventBroker) subscribe() chan structure.CreativeEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	events := make(chan structure.CreativeEvent, eventBufferSize)
+	b.subscribers[events] = struct{}{}
+	return events
+}
+
+func (b *eventBroker) unsubscribe(events chan structure.CreativeEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, events)
+}
+
+// Sends the event to all subscribers. Events are dropped for
+// subscribers that do not keep up, instead of blocking the others.
+func (b *eventBroker) broadcast(event structure.CreativeEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			logger.Warn("event stream subscriber is too slow, dropping event",
+				slog.String("creativeId", event.CreativeId),
+				slog.String("event", event.Event),
+			)
+		}
+	}
+}
+
+// RunEventSubscription relays creative events published by all instances
+// to the event stream clients of this instance, until the context is cancelled.
+func (api *API) RunEventSubscription(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := api.valkeyStore.SubscribeEvents(ctx, api.events.broadcast)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("creative event subscription failed, resubscribing",
+				slog.String("error", err.Error()),
+			)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+type eventFilter struct {
+	creativeIds []string
+	subdomain   string
+	statuses    []string
+}
+
+func readEventFilter(r *http.Request) eventFilter {
+	query := r.URL.Query()
+	return eventFilter{
+		creativeIds: splitList(query.Get("creativeId")),
+		subdomain:   query.Get("subdomain"),
+		statuses:    splitList(strings.ToUpper(query.Get("status"))),
+	}
+}
+
+func (f eventFilter) matches(event structure.CreativeEvent) bool {
+	if len(f.creativeIds) > 0 && !slices.Contains(f.creativeIds, event.CreativeId) {
+		return false
+	}
+	if f.subdomain != "" && f.subdomain != event.Subdomain {
+		return false
+	}
+	if len(f.statuses) > 0 && !slices.Contains(f.statuses, event.Event) {
+		return false
+	}
+	return true
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// HandleJobEvents streams creative status changes as Server-Sent Events.
+// The stream can be filtered with the query parameters creativeId, subdomain and status,
+// where creativeId and status accept comma separated lists.
+func (api *API) HandleJobEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter := readEventFilter(r)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set(gzhttp.HeaderNoCompression, "true")
+	w.WriteHeader(http.StatusOK)
+	// Send something right away, so that clients know the stream is up
+	_, _ = w.Write([]byte(": connected\n\n"))
+	if err := rc.Flush(); err != nil {
+		logger.Error("event stream does not support flushing", slog.String("error", err.Error()))
+		return
+	}
+
+	events := api.events.subscribe()
+	defer api.events.unsubscribe(events)
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := w.Write([]byte(": keep-alive\n\n"))
+			if err != nil {
+				return
+			}
+		case event := <-events:
+			if !filter.matches(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.Error("failed to marshal creative event", slog.String("error", err.Error()))
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data)
+			if err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
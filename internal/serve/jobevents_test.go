@@ -0,0 +1,111 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/klauspost/compress/gzhttp"
+	"github.com/matryer/is"
+)
+
+func (b *eventBroker) subscriberCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subscribers)
+}
+
+func TestHandleJobEvents(t *testing.T) {
+	is := is.New(t)
+	api, ts, _, _ := setupApi()
+	defer ts.Close()
+	// Served through the compression middleware, which must not buffer the stream
+	server := httptest.NewServer(gzhttp.GzipHandler(http.HandlerFunc(api.HandleJobEvents)))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?subdomain=tenant&status=completed,failed", nil)
+	is.NoErr(err)
+	res, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	defer res.Body.Close()
+	is.Equal(res.StatusCode, http.StatusOK)
+	is.Equal(res.Header.Get("Content-Type"), "text/event-stream")
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, ": connected\n")
+
+	for api.events.subscriberCount() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	api.events.broadcast(structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "other", Subdomain: "other"})
+	api.events.broadcast(structure.CreativeEvent{Event: structure.EventQueued, CreativeId: "queued", Subdomain: "tenant"})
+	api.events.broadcast(structure.CreativeEvent{
+		Event:      structure.EventCompleted,
+		CreativeId: "creative",
+		Subdomain:  "tenant",
+		Job:        &structure.TranscodeInfo{Status: "COMPLETED", Url: "https://cdn.example.com/creative/index.m3u8"},
+	})
+
+	var eventType, data string
+	for data == "" {
+		line, err := reader.ReadString('\n')
+		is.NoErr(err)
+		if after, found := strings.CutPrefix(line, "event: "); found {
+			eventType = strings.TrimSpace(after)
+		}
+		if after, found := strings.CutPrefix(line, "data: "); found {
+			data = strings.TrimSpace(after)
+		}
+	}
+	is.Equal(eventType, structure.EventCompleted)
+	var event structure.CreativeEvent
+	is.NoErr(json.Unmarshal([]byte(data), &event))
+	is.Equal(event.CreativeId, "creative")
+	is.Equal(event.Job.Url, "https://cdn.example.com/creative/index.m3u8")
+
+	cancel()
+	for api.events.subscriberCount() != 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	is := is.New(t)
+	event := structure.CreativeEvent{Event: structure.EventFailed, CreativeId: "creative", Subdomain: "tenant"}
+	cases := []struct {
+		query    string
+		expected bool
+	}{
+		{query: "", expected: true},
+		{query: "creativeId=other,creative", expected: true},
+		{query: "creativeId=other", expected: false},
+		{query: "subdomain=tenant&status=FAILED", expected: true},
+		{query: "subdomain=other", expected: false},
+		{query: "status=completed", expected: false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/events?"+c.query, nil)
+		is.Equal(readEventFilter(req).matches(event), c.expected)
+	}
+}
+
+func TestPublishEvent(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	api.publishEvent(structure.EventPackaging, "creative", structure.TranscodeInfo{Status: "PACKAGING", Subdomain: "tenant"})
+	is.Equal(len(storeStub.published), 1)
+	is.Equal(storeStub.published[0].Event, structure.EventPackaging)
+	is.Equal(storeStub.published[0].Subdomain, "tenant")
+	is.Equal(storeStub.published[0].Job.Status, "PACKAGING")
+	storeStub.reset()
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/packaging"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 )
 
@@ -18,21 +19,54 @@ func (api *API) HandlePackagingFailure(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
 		return
 	}
-	encoreJob, err := api.encoreHandler.GetEncoreJob(body.Message.JobId)
+	creativeId, err := api.resolveCreative(body.Message.JobId)
 	if err != nil {
-		http.Error(w, "Failed to get Encore job", http.StatusNotFound)
+		logger.Error("Failed to resolve creative for packaging failure",
+			slog.String("error", err.Error()),
+			slog.String("jobId", body.Message.JobId),
+		)
+		http.Error(w, "Failed to resolve creative for job", http.StatusNotFound)
+		return
+	}
+	stored, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		http.Error(w, "Failed to get job from Valkey store", http.StatusInternalServerError)
 		return
 	}
-	if encoreJob.ExternalId == "" {
-		http.Error(w, "Encore job does not have an external ID", http.StatusNotFound)
+	if !found || stored.Status != "PACKAGING" || !isCurrentJob(stored, body.Message.JobId) {
+		// The creative was removed or replaced, or the callback is late or a duplicate
+		logger.Info("Ignoring packaging failure",
+			slog.String("creativeId", creativeId),
+			slog.String("jobId", body.Message.JobId),
+			slog.String("status", stored.Status),
+		)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	transcodeInfo := stored
+	transcodeInfo.Status = "FAILED"
+	transcodeInfo.Error = "packaging failed"
+	transcodeInfo.LastUpdate = time.Now().Unix()
+	set, err := api.failCreative(creativeId, stored.Status, transcodeInfo)
+	if err != nil {
+		http.Error(w, "Failed to save job to Valkey store", http.StatusInternalServerError)
 		return
 	}
-	if err := api.valkeyStore.Delete(encoreJob.ExternalId); err != nil {
-		http.Error(w, "Failed to delete job from Valkey store", http.StatusInternalServerError)
+	if !set {
+		logger.Info("Creative changed during packaging failure", slog.String("creativeId", creativeId))
+		w.WriteHeader(http.StatusOK)
 		return
 	}
+	api.untrackPackagingJob(creativeId)
+	api.recordStateChange(
+		creativeId,
+		structure.HistoryPackagingFailed,
+		structure.HistorySourcePackager,
+		transcodeInfo,
+		structure.EventFailed,
+	)
 	w.WriteHeader(http.StatusOK)
-	logger.Info("Packaging failure handled successfully", slog.String("creativeId", encoreJob.ExternalId))
+	logger.Info("Packaging failure handled successfully", slog.String("creativeId", creativeId))
 }
 
 func (api *API) HandlePackagingSuccess(w http.ResponseWriter, r *http.Request) {
@@ -43,37 +77,120 @@ func (api *API) HandlePackagingSuccess(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
 		return
 	}
-	logger.Debug("getting Encore job for packaging success", slog.String("jobId", body.JobId))
-	encoreJob, err := api.encoreHandler.GetEncoreJob(body.JobId)
+	creativeId, err := api.resolveCreative(body.JobId)
 	if err != nil {
-		http.Error(w, "Failed to get Encore job", http.StatusNotFound)
+		logger.Error("Failed to resolve creative for packaging success",
+			slog.String("error", err.Error()),
+			slog.String("jobId", body.JobId),
+		)
+		http.Error(w, "Failed to resolve creative for job", http.StatusNotFound)
 		return
 	}
-	if encoreJob.ExternalId == "" {
-		http.Error(w, "Encore job does not have an external ID", http.StatusNotFound)
+	stored, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil {
+		http.Error(w, "Failed to get job from Valkey store", http.StatusInternalServerError)
 		return
 	}
-	storeInfo, err := structure.TranscodeInfoFromEncoreJob(&encoreJob, api.jitPackage, api.assetServerUrl)
-	if err != nil {
-		logger.Error("Failed to create transcode info from Encore job",
-			slog.String("error", err.Error()),
-			slog.String("jobId", encoreJob.Id),
+	if !found || stored.Status != "PACKAGING" || !isCurrentJob(stored, body.JobId) {
+		// The creative was removed, f.ex. by a packaging timeout, or the callback is a duplicate
+		logger.Info("Ignoring packaging success",
+			slog.String("creativeId", creativeId),
+			slog.String("jobId", body.JobId),
+			slog.String("status", stored.Status),
 		)
-		_ = api.valkeyStore.Delete(encoreJob.ExternalId) // Something went wrong, remove the job from the store
-		http.Error(w, "Failed to create transcode info from Encore job", http.StatusInternalServerError)
+		api.untrackPackagingJob(creativeId)
+		w.WriteHeader(http.StatusOK)
 		return
 	}
+	storeInfo := stored
+	if storeInfo.AspectRatio == "" {
+		// The transcoding result is not stored locally, ask Encore for it
+		storeInfo, err = api.transcodeInfoFromEncore(stored, body.JobId)
+		if err != nil {
+			logger.Error("Failed to create transcode info from Encore job",
+				slog.String("error", err.Error()),
+				slog.String("jobId", body.JobId),
+			)
+			failed := stored
+			failed.Status = "FAILED"
+			failed.Error = "invalid transcoding job"
+			failed.LastUpdate = time.Now().Unix()
+			if set, _ := api.failCreative(creativeId, stored.Status, failed); set {
+				api.untrackPackagingJob(creativeId)
+			}
+			http.Error(w, "Failed to create transcode info from Encore job", http.StatusInternalServerError)
+			return
+		}
+	}
+	api.untrackPackagingJob(creativeId)
 	packageUrl := structure.CreatePackageUrl(api.assetServerUrl, body.OutputPath, "index")
 	storeInfo.Url = packageUrl.String()
 	storeInfo.Status = "COMPLETED"
 	storeInfo.LastUpdate = time.Now().Unix()
-	if err := api.valkeyStore.Set(encoreJob.ExternalId, storeInfo); err != nil {
+	replacedOutputFolder := storeInfo.ReplacedOutputFolder
+	storeInfo.ReplacedOutputFolder = ""
+	set, err := api.valkeyStore.CompareAndSet(creativeId, stored.Status, storeInfo)
+	if err != nil {
 		http.Error(w, "Failed to save job to Valkey store", http.StatusInternalServerError)
 		return
 	}
+	if !set {
+		logger.Info("Creative changed during packaging success", slog.String("creativeId", creativeId))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// The output of the re-transcoded job is no longer served
+	api.removeOutputFolder(creativeId, replacedOutputFolder)
+	api.recordStateChange(
+		creativeId,
+		structure.HistoryPackagingSucceeded,
+		structure.HistorySourcePackager,
+		storeInfo,
+		structure.EventCompleted,
+	)
 	w.WriteHeader(http.StatusOK)
 	logger.Info("Packaging success handled successfully",
-		slog.String("creativeId", encoreJob.ExternalId),
+		slog.String("creativeId", creativeId),
+		slog.String("packageUrl", packageUrl.String()),
+	)
+}
+
+// Writes the playlists of a completed job to the bucket,
+// completing the creative without an external packager.
+func (api *API) packageJob(job *structure.EncoreJob, transcodeInfo *structure.TranscodeInfo) error {
+	outputPath, err := api.hlsPackager.Package(job)
+	if err != nil {
+		return err
+	}
+	packageUrl := structure.CreatePackageUrl(api.assetServerUrl, outputPath, packaging.MultivariantName)
+	transcodeInfo.Url = packageUrl.String()
+	transcodeInfo.Status = "COMPLETED"
+	logger.Info("Packaged job in process",
+		slog.String("jobId", job.Id),
 		slog.String("packageUrl", packageUrl.String()),
 	)
+	return nil
+}
+
+func (api *API) transcodeInfoFromEncore(stored structure.TranscodeInfo, jobId string) (structure.TranscodeInfo, error) {
+	logger.Debug("getting Encore job for packaging success", slog.String("jobId", jobId))
+	encoreJob, err := api.transcoder.GetJob(jobId)
+	if err != nil {
+		return structure.TranscodeInfo{}, err
+	}
+	storeInfo, err := structure.TranscodeInfoFromEncoreJob(&encoreJob, api.jitPackage, api.assetServerUrl)
+	if err != nil {
+		return storeInfo, err
+	}
+	api.keepStoredFields(stored, &storeInfo)
+	return storeInfo, nil
+}
+
+func (api *API) untrackPackagingJob(creativeId string) {
+	if err := api.valkeyStore.UntrackPackagingJob(creativeId); err != nil {
+		logger.Error("failed to untrack packaging job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+		)
+	}
 }
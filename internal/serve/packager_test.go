@@ -7,6 +7,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/Eyevinn/ad-normalizer/internal/signature"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/matryer/is"
 )
 
@@ -15,15 +17,38 @@ func TestPackagingFailure(t *testing.T) {
 
 	api, ts, storeStub, _ := setupApi()
 	defer ts.Close()
+	defer storeStub.reset()
+	_ = storeStub.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
 	failureEvent := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
-	req, err := http.NewRequest("POST", "/failure", bytes.NewBufferString(failureEvent))
-	is.NoErr(err)
-	rr := httptest.NewRecorder()
-	api.HandlePackagingFailure(rr, req)
-	is.Equal(rr.Code, http.StatusOK)
-	is.Equal(storeStub.deletes, 1)
+	fail := func() {
+		req, err := http.NewRequest("POST", "/failure", bytes.NewBufferString(failureEvent))
+		is.NoErr(err)
+		rr := httptest.NewRecorder()
+		api.HandlePackagingFailure(rr, req)
+		is.Equal(rr.Code, http.StatusOK)
+	}
+	// Only a creative that is packaging the job of the callback is failed
+	for _, stored := range []structure.TranscodeInfo{
+		{Status: "COMPLETED", JobId: "test-job-id"},
+		{Status: "IN_PROGRESS", JobId: "test-job-id"},
+		{Status: "PACKAGING", JobId: "other-job-id"},
+	} {
+		_ = storeStub.Set("test-job-id", stored)
+		fail()
+		tci, _, _ := storeStub.Get("test-job-id")
+		is.Equal(tci, stored)
+	}
 
-	storeStub.reset()
+	_ = storeStub.Set("test-job-id", structure.TranscodeInfo{Status: "PACKAGING", JobId: "test-job-id"})
+	fail()
+	// The failed creative is kept, so that it can be listed until it expires
+	tci, _, _ := storeStub.Get("test-job-id")
+	is.Equal(tci.Status, "FAILED")
+	is.Equal(tci.Error, "packaging failed")
+	// A duplicate callback is ignored
+	fail()
+	is.Equal(storeStub.deletes, 0)
+	is.Equal(storeStub.events(), []string{structure.EventFailed})
 }
 
 func TestPackagingSuccess(t *testing.T) {
@@ -35,6 +60,9 @@ func TestPackagingSuccess(t *testing.T) {
 	}`
 	api, ts, storeStub, _ := setupApi()
 	defer ts.Close()
+	_ = storeStub.Set("test-job-id", structure.TranscodeInfo{Status: "PACKAGING", JobId: "test-job-id"})
+	_ = storeStub.TrackPackagingJob(structure.PackagingJobState{CreativeId: "test-job-id"})
+	storeStub.sets = 0
 	req, err := http.NewRequest("POST", "/success", bytes.NewBufferString(successEvent))
 	is.NoErr(err)
 	rr := httptest.NewRecorder()
@@ -46,5 +74,154 @@ func TestPackagingSuccess(t *testing.T) {
 	is.True(ok)
 	is.Equal(tci.Status, "COMPLETED")
 	is.True(strings.HasSuffix(tci.Url, "index.m3u8"))
+	is.Equal(len(storeStub.tracked), 0) // packaging job is no longer tracked
+	storeStub.reset()
+}
+
+func TestDuplicatePackagingSuccess(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	_ = storeStub.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = storeStub.SetJobCreative("test-job-id", "creative", 60)
+	_ = storeStub.Set("creative", structure.TranscodeInfo{
+		AspectRatio: "16:9",
+		Status:      "PACKAGING",
+		JobId:       "test-job-id",
+	})
+	success := func(outputPath string) int {
+		body := `{"jobId": "test-job-id", "url": "https://encore-instance", "outputPath": "` + outputPath + `"}`
+		req := httptest.NewRequest("POST", "/success", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		api.HandlePackagingSuccess(rr, req)
+		return rr.Code
+	}
+	is.Equal(success("/output-folder/creative/"), http.StatusOK)
+	// A duplicate callback does not change the completed creative
+	is.Equal(success("/other-folder/creative/"), http.StatusOK)
+	tci, _, _ := storeStub.Get("creative")
+	is.Equal(tci.Url, "https://asset-server.example.com/output-folder/creative/index.m3u8")
+	is.Equal(storeStub.events(), []string{structure.EventCompleted})
+
+	// Nor does a success after the creative was removed bring it back
+	_ = storeStub.Delete("creative")
+	is.Equal(success("/output-folder/creative/"), http.StatusOK)
+	_, found, _ := storeStub.Get("creative")
+	is.True(!found)
+	is.Equal(storeStub.events(), []string{structure.EventCompleted})
+	storeStub.reset()
+}
+
+func TestPackagingCallbacksResolvedLocally(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	_ = storeStub.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = storeStub.SetJobCreative("test-job-id", "creative", 60)
+	_ = storeStub.Set("creative", structure.TranscodeInfo{
+		AspectRatio: "16:9",
+		FrameRates:  []float64{25.0},
+		Status:      "PACKAGING",
+		Source:      "https://ads.example.com/creative.mp4",
+		JobId:       "test-job-id",
+	})
+	successEvent := `{"jobId": "test-job-id", "url": "https://encore-instance", "outputPath": "/output-folder/creative/"}`
+	req, err := http.NewRequest("POST", "/success", bytes.NewBufferString(successEvent))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	api.HandlePackagingSuccess(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(encoreHandler.getCalls, 0) // no round trip to Encore
+	tci, _, _ := storeStub.Get("creative")
+	is.Equal(tci.Status, "COMPLETED")
+	is.Equal(tci.AspectRatio, "16:9")
+	is.Equal(tci.Source, "https://ads.example.com/creative.mp4")
+	is.Equal(tci.JobId, "test-job-id")
+	is.Equal(tci.Url, "https://asset-server.example.com/output-folder/creative/index.m3u8")
+
+	// A late failure does not remove the completed creative
+	failureEvent := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
+	req, err = http.NewRequest("POST", "/failure", bytes.NewBufferString(failureEvent))
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	api.HandlePackagingFailure(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(encoreHandler.getCalls, 0)
+	tci, found, _ := storeStub.Get("creative")
+	is.True(found)
+	is.Equal(tci.Status, "COMPLETED")
+	is.Equal(storeStub.deletes, 0)
+	is.Equal(storeStub.events(), []string{structure.EventCompleted})
+	is.Equal(storeStub.deliveries[0].Event.Url, tci.Url)
+	is.Equal(storeStub.deliveries[0].Event.Source, "https://ads.example.com/creative.mp4")
+	storeStub.reset()
+	encoreHandler.reset()
+}
+
+func TestPackagerCallbackVerification(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	api.callbackSecret = "secret"
+	handler := api.VerifyPackagerCallback(http.HandlerFunc(api.HandlePackagingFailure))
+	failureEvent := `{"message": {"jobId":"test-job-id","url":"http://encore-example.osaas.io/"}}`
+
+	cases := []struct {
+		name         string
+		target       string
+		header       string
+		headerValue  string
+		expectedCode int
+	}{
+		{name: "no credentials", target: "/failure", expectedCode: http.StatusUnauthorized},
+		{name: "wrong token", target: "/failure?token=guess", expectedCode: http.StatusUnauthorized},
+		{
+			name:         "forged signature",
+			target:       "/failure",
+			header:       "X-Signature",
+			headerValue:  signature.Sign("guess", []byte(failureEvent)),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{name: "secret as query parameter", target: "/failure?token=secret", expectedCode: http.StatusUnauthorized},
+		{
+			name:         "secret without bearer scheme",
+			target:       "/failure",
+			header:       "Authorization",
+			headerValue:  "secret",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "bearer token",
+			target:       "/failure",
+			header:       "Authorization",
+			headerValue:  "Bearer secret",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "signed body",
+			target:       "/failure",
+			header:       "X-Signature",
+			headerValue:  signature.Sign("secret", []byte(failureEvent)),
+			expectedCode: http.StatusOK,
+		},
+	}
+	failed := 0
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_ = storeStub.Set("test-job-id", structure.TranscodeInfo{Status: "PACKAGING", JobId: "test-job-id"})
+			req, err := http.NewRequest("POST", c.target, bytes.NewBufferString(failureEvent))
+			is.NoErr(err)
+			if c.header != "" {
+				req.Header.Set(c.header, c.headerValue)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			is.Equal(rr.Code, c.expectedCode)
+			if tci, _, _ := storeStub.Get("test-job-id"); tci.Status == "FAILED" {
+				failed++
+			}
+		})
+	}
+	is.Equal(failed, 2)
 	storeStub.reset()
 }
@@ -0,0 +1,118 @@
+package serve
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// RunPackagingWatchdog periodically looks for packaging jobs that the packager has not
+// reported back on within the packaging timeout. Those jobs are queued again until
+// the max amount of retries is reached, after which the creative is marked as failed.
+// Runs until the context is cancelled.
+func (api *API) RunPackagingWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			api.handlePackagingTimeouts()
+		case <-ctx.Done():
+			logger.Info("Stopping packaging watchdog")
+			return
+		}
+	}
+}
+
+func (api *API) handlePackagingTimeouts() {
+	timedOut, err := api.valkeyStore.PopTimedOutPackagingJobs(time.Now())
+	if err != nil {
+		logger.Error("failed to get timed out packaging jobs", slog.String("error", err.Error()))
+	}
+	for _, state := range timedOut {
+		api.handlePackagingTimeout(state)
+	}
+}
+
+func (api *API) handlePackagingTimeout(state structure.PackagingJobState) {
+	transcodeInfo, found, err := api.valkeyStore.Get(state.CreativeId)
+	if err != nil {
+		logger.Error("failed to get creative with timed out packaging job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", state.CreativeId),
+		)
+		return
+	}
+	if !found || transcodeInfo.Status != "PACKAGING" {
+		return // The creative has been handled or removed since
+	}
+	if state.Attempts < api.packagingMaxRetries {
+		logger.Warn("packaging job timed out, retrying",
+			slog.String("creativeId", state.CreativeId),
+			slog.String("jobId", state.Job.JobId),
+			slog.Int("attempt", state.Attempts+1),
+		)
+		err = api.enqueuePackagingJob(state.CreativeId, state.Job, state.Attempts+1)
+		if err != nil {
+			logger.Error("failed to retry packaging job",
+				slog.String("error", err.Error()),
+				slog.String("creativeId", state.CreativeId),
+			)
+		}
+		return
+	}
+	logger.Error("packaging job timed out, giving up",
+		slog.String("creativeId", state.CreativeId),
+		slog.String("jobId", state.Job.JobId),
+	)
+	transcodeInfo.Status = "FAILED"
+	transcodeInfo.Error = "packaging timed out"
+	transcodeInfo.LastUpdate = time.Now().Unix()
+	// The failed creative expires, so that it is transcoded again at a later time
+	set, err := api.failCreative(state.CreativeId, "PACKAGING", transcodeInfo)
+	if err != nil {
+		logger.Error("failed to mark creative as failed",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", state.CreativeId),
+		)
+		return
+	}
+	if !set {
+		return // The packager reported back in the meantime
+	}
+	api.recordStateChange(
+		state.CreativeId,
+		structure.HistoryPackagingFailed,
+		structure.HistorySourceNormalizer,
+		transcodeInfo,
+		structure.EventFailed,
+	)
+}
+
+// Queues a packaging job and tracks it until the packager reports back
+func (api *API) enqueuePackagingJob(creativeId string, job structure.PackagingQueueMessage, attempts int) error {
+	err := api.valkeyStore.EnqueuePackagingJob(api.packageQueue, job)
+	if err != nil {
+		return err
+	}
+	api.appendHistory(
+		creativeId,
+		structure.HistoryPackagingEnqueued,
+		structure.HistorySourceNormalizer,
+		map[string]string{
+			"jobId":   job.JobId,
+			"queue":   api.packageQueue,
+			"attempt": strconv.Itoa(attempts + 1),
+		},
+	)
+	return api.valkeyStore.TrackPackagingJob(structure.PackagingJobState{
+		CreativeId: creativeId,
+		Job:        job,
+		Attempts:   attempts,
+		Deadline:   time.Now().Add(api.packagingTimeout).UnixMilli(),
+	})
+}
@@ -0,0 +1,69 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestPackagingTimeout(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	api.packagingMaxRetries = 1
+	api.packagingTimeout = time.Minute
+	api.inFlightTtl = 60
+
+	_ = storeStub.Set("creative", structure.TranscodeInfo{Status: "PACKAGING"})
+	job := structure.PackagingQueueMessage{JobId: "test-job-id"}
+	err := api.enqueuePackagingJob("creative", job, 0)
+	is.NoErr(err)
+	is.Equal(len(storeStub.enqueued), 1)
+	is.Equal(storeStub.tracked["creative"].Attempts, 0)
+
+	// Not timed out yet
+	api.handlePackagingTimeouts()
+	is.Equal(len(storeStub.enqueued), 1)
+
+	// First timeout is retried
+	state := storeStub.tracked["creative"]
+	state.Deadline = time.Now().Add(-time.Second).UnixMilli()
+	storeStub.tracked["creative"] = state
+	api.handlePackagingTimeouts()
+	is.Equal(len(storeStub.enqueued), 2)
+	is.Equal(storeStub.tracked["creative"].Attempts, 1)
+	is.True(storeStub.tracked["creative"].Deadline > time.Now().UnixMilli())
+
+	// Second timeout fails the creative
+	state = storeStub.tracked["creative"]
+	state.Deadline = time.Now().Add(-time.Second).UnixMilli()
+	storeStub.tracked["creative"] = state
+	api.handlePackagingTimeouts()
+	is.Equal(len(storeStub.enqueued), 2)
+	is.Equal(len(storeStub.tracked), 0)
+	tci, found, err := storeStub.Get("creative")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(tci.Status, "FAILED")
+	is.Equal(tci.Error, "packaging timed out")
+	storeStub.reset()
+}
+
+func TestPackagingTimeoutAfterCompletion(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+
+	_ = storeStub.Set("creative", structure.TranscodeInfo{Status: "COMPLETED"})
+	_ = storeStub.TrackPackagingJob(structure.PackagingJobState{
+		CreativeId: "creative",
+		Deadline:   time.Now().Add(-time.Second).UnixMilli(),
+	})
+	api.handlePackagingTimeouts()
+	is.Equal(len(storeStub.enqueued), 0)
+	tci, _, _ := storeStub.Get("creative")
+	is.Equal(tci.Status, "COMPLETED")
+	storeStub.reset()
+}
@@ -0,0 +1,394 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/VMAP/vmap"
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/util"
+	"go.opentelemetry.io/otel"
+)
+
+// Statuses of the creatives in a pre-ingest response
+const (
+	preIngestCompleted   = "completed"
+	preIngestInFlight    = "in_flight"
+	preIngestFailed      = "failed"
+	preIngestDispatched  = "dispatched"
+	preIngestBlacklisted = "blacklisted"
+	// The source did not pass validation
+	preIngestRejected = "rejected"
+	// The transcoding job could not be created
+	preIngestError = "error"
+	// The transcoding job is created after responding
+	preIngestPending = "pending"
+)
+
+// Max size of a pre-ingest request body and of a fetched ad tag
+const maxAdDocumentSize = 10 << 20
+
+const adTagTimeout = 10 * time.Second
+
+const maxAdTagRedirects = 10
+
+// Transcoding jobs created at a time by a pre-ingest request
+const preIngestConcurrency = 8
+
+// Transcoding jobs created before responding to a pre-ingest request, the rest are created in the background
+const preIngestMaxDispatch = 32
+
+// Ad tags fetched for a pre-ingest request, one at a time
+const preIngestMaxAdTags = 10
+
+// New creatives of a pre-ingest request that are left pending, after the first preIngestMaxDispatch
+const preIngestMaxPending = 500
+
+var errTooManyCreatives = errors.New("too many new creatives")
+
+type preIngestCreativeRequest struct {
+	// Media URLs, keyed with KEY_REGEX on the URL
+	MediaUrls []string `json:"mediaUrls"`
+	// URLs of VAST or VMAP documents to fetch, keyed like the /vast and /vmap endpoints
+	AdTags []string `json:"adTags"`
+}
+
+type preIngestCreativeStatus struct {
+	CreativeId string `json:"creativeId"`
+	MediaUrl   string `json:"mediaUrl"`
+	Status     string `json:"status"`
+	// Transcoding job of the creative, if it is in flight or was dispatched
+	JobId string `json:"jobId,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type preIngestAdTagError struct {
+	Url   string `json:"url"`
+	Error string `json:"error"`
+}
+
+type preIngestCreativeResponse struct {
+	// Number of creatives that transcoding jobs were or will be created for
+	NotYetProcessed int                       `json:"notYetProcessed"`
+	Creatives       []preIngestCreativeStatus `json:"creatives"`
+	// Ads of the documents that have no media file or creative ID to key them by
+	SkippedAds   int                   `json:"skippedAds,omitempty"`
+	FailedAdTags []preIngestAdTagError `json:"failedAdTags,omitempty"`
+}
+
+// HandlePreIngestCreatives transcodes the creatives of the request ahead of the ad requests that use them.
+// The body is either a VAST or VMAP document, or JSON with media URLs and ad tags to fetch.
+// Creatives of VAST and VMAP documents are keyed like in the /vast and /vmap responses.
+func (api *API) HandlePreIngestCreatives(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("api").Start(r.Context(), "PreIngestCreatives")
+	defer span.End()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdDocumentSize))
+	if err != nil {
+		logger.Error("failed to read request body", slog.String("error", err.Error()))
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	resp := preIngestCreativeResponse{Creatives: []preIngestCreativeStatus{}}
+	creatives := map[string]structure.ManifestAsset{}
+	if isXmlDocument(r, body) {
+		vasts, err := decodeAdDocument(body)
+		if err != nil {
+			logger.Error("failed to decode pre-ingest document", slog.String("error", err.Error()))
+			http.Error(w, "Failed to decode VAST or VMAP document", http.StatusBadRequest)
+			return
+		}
+		resp.SkippedAds = api.addDocumentCreatives(creatives, vasts)
+	} else {
+		var piRequest preIngestCreativeRequest
+		if err := json.Unmarshal(body, &piRequest); err != nil {
+			logger.Error("failed to read request body", slog.String("error", err.Error()))
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(piRequest.MediaUrls) > 0 && api.keyField != "url" {
+			logger.Warn("media URLs are keyed by URL, which does not match the keys of the VAST responses",
+				slog.String("keyField", api.keyField),
+			)
+		}
+		if len(piRequest.AdTags) > api.preIngestMaxAdTags {
+			logger.Warn("too many ad tags in pre-ingest request", slog.Int("adTags", len(piRequest.AdTags)))
+			http.Error(w,
+				fmt.Sprintf("Too many ad tags, at most %d are fetched per request", api.preIngestMaxAdTags),
+				http.StatusRequestEntityTooLarge,
+			)
+			return
+		}
+		maps.Copy(creatives, util.MakeCreatives(piRequest.MediaUrls, api.keyRegex))
+		for _, adTag := range piRequest.AdTags {
+			vasts, err := api.fetchAdTag(ctx, adTag)
+			if err != nil {
+				logger.Warn("failed to fetch ad tag", slog.String("error", err.Error()), slog.String("url", adTag))
+				resp.FailedAdTags = append(resp.FailedAdTags, preIngestAdTagError{Url: adTag, Error: err.Error()})
+				continue
+			}
+			resp.SkippedAds += api.addDocumentCreatives(creatives, vasts)
+		}
+	}
+	logger.Debug("Pre-ingesting creatives", slog.Int("creatives", len(creatives)))
+	statuses, err := api.preIngest(creatives, r.URL.Query().Get("subdomain"))
+	if errors.Is(err, errTooManyCreatives) {
+		http.Error(w,
+			fmt.Sprintf("Too many new creatives, at most %d are transcoded per request",
+				api.preIngestMaxDispatch+api.preIngestMaxPending),
+			http.StatusRequestEntityTooLarge,
+		)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up creatives", http.StatusInternalServerError)
+		return
+	}
+	for _, status := range statuses {
+		if status.Status == preIngestDispatched || status.Status == preIngestPending {
+			resp.NotYetProcessed++
+		}
+	}
+	resp.Creatives = statuses
+	ret, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("failed to marshal response", slog.String("error", err.Error()))
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(ret)
+}
+
+// Looks up the creatives and dispatches transcoding jobs for the ones that are not known yet.
+// Up to preIngestMaxDispatch jobs are created before returning, the others are pending and created
+// in the background. Returns the status of each creative, ordered by creative ID, or errTooManyCreatives
+// without creating any job if more than preIngestMaxPending creatives would be pending.
+func (api *API) preIngest(
+	creatives map[string]structure.ManifestAsset,
+	subdomain string,
+) ([]preIngestCreativeStatus, error) {
+	lookup := api.lookupCreatives(creatives)
+	if lookup.err != nil {
+		return nil, lookup.err
+	}
+	statuses := make([]preIngestCreativeStatus, 0, len(creatives))
+	pending := map[string]structure.ManifestAsset{}
+	dispatched := 0
+	for _, creativeId := range slices.Sorted(maps.Keys(creatives)) {
+		creative := creatives[creativeId]
+		status := preIngestCreativeStatus{CreativeId: creativeId, MediaUrl: creative.MasterPlaylistUrl}
+		stored, found := lookup.stored[creativeId]
+		switch {
+		case lookup.blacklisted[creative.MasterPlaylistUrl]:
+			status.Status = preIngestBlacklisted
+		case !found && dispatched < api.preIngestMaxDispatch:
+			status.Status = preIngestDispatched
+			dispatched++
+		case !found:
+			status.Status = preIngestPending
+			pending[creativeId] = creative
+		case stored.Status == "COMPLETED":
+			status.Status = preIngestCompleted
+		case stored.Status == "FAILED":
+			status.Status = preIngestFailed
+			status.Error = stored.Error
+		default:
+			status.Status = preIngestInFlight
+			status.JobId = stored.JobId
+		}
+		statuses = append(statuses, status)
+	}
+	if len(pending) > api.preIngestMaxPending {
+		logger.Warn("too many new creatives in pre-ingest request",
+			slog.Int("creatives", dispatched+len(pending)),
+		)
+		return nil, errTooManyCreatives
+	}
+	// The first jobs are created before responding, to report the ones that could not be created
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, preIngestConcurrency)
+	for i := range statuses {
+		if statuses[i].Status != preIngestDispatched {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(status *preIngestCreativeStatus) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			creative := creatives[status.CreativeId]
+			transcodeInfo, err := api.dispatchJob(&creative, subdomain)
+			switch {
+			case errors.Is(err, errSourceRejected):
+				status.Status = preIngestRejected
+			case err != nil:
+				status.Status = preIngestError
+				status.Error = err.Error()
+			default:
+				status.JobId = transcodeInfo.JobId
+			}
+		}(&statuses[i])
+	}
+	wg.Wait()
+	if len(pending) > 0 {
+		go api.dispatchPending(pending, subdomain)
+	}
+	return statuses, nil
+}
+
+// Creates the transcoding jobs of the pending creatives of a pre-ingest request, a few at a time.
+// Errors are logged by dispatchJob, since the response was already sent.
+func (api *API) dispatchPending(pending map[string]structure.ManifestAsset, subdomain string) {
+	slots := make(chan struct{}, preIngestConcurrency)
+	for _, creative := range pending {
+		slots <- struct{}{}
+		go func(creative structure.ManifestAsset) {
+			defer func() { <-slots }()
+			_, _ = api.dispatchJob(&creative, subdomain)
+		}(creative)
+	}
+}
+
+// Adds the creatives of the VASTs, keyed like in the VAST responses, and returns the number of
+// ads that were skipped since they can not be keyed.
+func (api *API) addDocumentCreatives(creatives map[string]structure.ManifestAsset, vasts []*vmap.VAST) int {
+	skipped := 0
+	for _, vast := range vasts {
+		keyable := &vmap.VAST{}
+		for _, ad := range vast.Ad {
+			if util.CanKeyAd(&ad, api.keyField) {
+				keyable.Ad = append(keyable.Ad, ad)
+			} else {
+				skipped++
+			}
+		}
+		maps.Copy(creatives, util.GetCreatives(keyable, api.keyField, api.keyRegex))
+	}
+	return skipped
+}
+
+func isXmlDocument(r *http.Request, body []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasSuffix(mediaType, "xml") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// Decodes a VAST or VMAP document, and returns its VASTs
+func decodeAdDocument(body []byte) (vasts []*vmap.VAST, err error) {
+	root, err := rootElement(body)
+	if err != nil {
+		return nil, err
+	}
+	// The decoder panics on malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			vasts, err = nil, fmt.Errorf("failed to decode %s: %v", root, r)
+		}
+	}()
+	switch root {
+	case "VAST":
+		vast, err := vmap.DecodeVast(body)
+		if err != nil {
+			return nil, err
+		}
+		return []*vmap.VAST{&vast}, nil
+	case "VMAP":
+		vmapData, err := vmap.DecodeVmap(body)
+		if err != nil {
+			return nil, err
+		}
+		for _, adBreak := range vmapData.AdBreaks {
+			if adBreak.AdSource != nil && adBreak.AdSource.VASTData != nil && adBreak.AdSource.VASTData.VAST != nil {
+				vasts = append(vasts, adBreak.AdSource.VASTData.VAST)
+			}
+		}
+		return vasts, nil
+	default:
+		return nil, fmt.Errorf("unexpected root element %s", root)
+	}
+}
+
+// Name of the root element of the XML document, without namespace
+func rootElement(body []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("failed to find root element: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+var errAdTagNotAllowed = errors.New("ad tag not allowed")
+
+// Checks that the ad tag is an http or https URL on one of the allowed hosts
+func (api *API) checkAdTag(adTag *url.URL) error {
+	if adTag.Scheme != "http" && adTag.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q", errAdTagNotAllowed, adTag.Scheme)
+	}
+	for _, host := range api.adTagHosts {
+		if host == "*" || host == adTag.Host || host == adTag.Hostname() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %s is not in AD_TAG_HOSTS", errAdTagNotAllowed, adTag.Host)
+}
+
+// Fetches the VAST or VMAP document of the ad tag, and returns its VASTs.
+// The ad tag, and the URLs it redirects to, must pass checkAdTag.
+func (api *API) fetchAdTag(ctx context.Context, adTag string) ([]*vmap.VAST, error) {
+	ctx, cancel := context.WithTimeout(ctx, adTagTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, adTag, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ad tag request: %w", err)
+	}
+	if err := api.checkAdTag(req.URL); err != nil {
+		return nil, err
+	}
+	client := *api.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxAdTagRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxAdTagRedirects)
+		}
+		return api.checkAdTag(req.URL)
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ad tag: %w", err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ad server responded with status %d", response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxAdDocumentSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ad tag response: %w", err)
+	}
+	return decodeAdDocument(body)
+}
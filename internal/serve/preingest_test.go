@@ -0,0 +1,246 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/probe"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func preIngest(t *testing.T, api *API, target string, contentType string, body string) preIngestCreativeResponse {
+	t.Helper()
+	is := is.New(t)
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	api.HandlePreIngestCreatives(recorder, req)
+	is.Equal(recorder.Code, http.StatusOK)
+	var response preIngestCreativeResponse
+	is.NoErr(json.Unmarshal(recorder.Body.Bytes(), &response))
+	return response
+}
+
+func TestPreIngestVastDocument(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	defer encoreHandler.reset()
+	// Keyed by the universal ad ID, like the VAST responses
+	api.keyField = "universalAdId"
+	_ = storeStub.Set("AAA2FBBBB1232F1", structure.TranscodeInfo{Status: "COMPLETED"})
+	vastData, err := os.ReadFile("../test_data/testVast.xml")
+	is.NoErr(err)
+
+	response := preIngest(t, api, "/preingest?subdomain=tenant", "application/xml", string(vastData))
+	is.Equal(response.NotYetProcessed, 1)
+	is.Equal(len(response.Creatives), 2)
+	is.Equal(response.Creatives[0], preIngestCreativeStatus{
+		CreativeId: "AAA2FBBBB1232F1",
+		MediaUrl:   "https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4",
+		Status:     preIngestCompleted,
+	})
+	dispatched := response.Creatives[1]
+	is.Equal(dispatched.CreativeId, "AAA2FDDDD1232F2")
+	is.Equal(dispatched.Status, preIngestDispatched)
+	is.True(dispatched.JobId != "")
+	is.Equal(encoreHandler.calls, 1)
+	is.Equal(storeStub.mockStore["AAA2FDDDD1232F2"].Subdomain, "tenant")
+	is.Equal(storeStub.mockStore["AAA2FDDDD1232F2"].JobId, dispatched.JobId)
+}
+
+func TestPreIngestAdTags(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	defer encoreHandler.reset()
+	_ = storeStub.Set("httpstestcontenteyevinntechnologyadsalvedon10smp4", structure.TranscodeInfo{
+		Status: "IN_PROGRESS",
+		JobId:  "job",
+	})
+	_ = storeStub.Set("httpsexamplecomfailedmp4", structure.TranscodeInfo{Status: "FAILED", Error: "broken"})
+	_ = storeStub.BlackList("https://testcontent.eyevinn.technology/ads/bromwel-15s.mp4", "not an ad")
+
+	body, err := json.Marshal(preIngestCreativeRequest{
+		MediaUrls: []string{"https://example.com/failed.mp4"},
+		AdTags:    []string{ts.URL + "?requestType=vmap", ts.URL + "?requestType=unknown"},
+	})
+	is.NoErr(err)
+	response := preIngest(t, api, "/preingest", "application/json", string(body))
+	is.Equal(response.NotYetProcessed, 0)
+	is.Equal(response.Creatives, []preIngestCreativeStatus{
+		{
+			CreativeId: "httpsexamplecomfailedmp4",
+			MediaUrl:   "https://example.com/failed.mp4",
+			Status:     preIngestFailed,
+			Error:      "broken",
+		},
+		{
+			CreativeId: "httpstestcontenteyevinntechnologyadsalvedon10smp4",
+			MediaUrl:   "https://testcontent.eyevinn.technology/ads/alvedon-10s.mp4",
+			Status:     preIngestInFlight,
+			JobId:      "job",
+		},
+		{
+			CreativeId: "httpstestcontenteyevinntechnologyadsbromwel15smp4",
+			MediaUrl:   "https://testcontent.eyevinn.technology/ads/bromwel-15s.mp4",
+			Status:     preIngestBlacklisted,
+		},
+	})
+	is.Equal(response.FailedAdTags, []preIngestAdTagError{{
+		Url:   ts.URL + "?requestType=unknown",
+		Error: "ad server responded with status 404",
+	}})
+	is.Equal(encoreHandler.calls, 0)
+}
+
+func TestPreIngestRejectedAndSkipped(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, encoreHandler := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	defer encoreHandler.reset()
+	api.sourceProber = &SourceProberStub{result: probe.ProbeResult{Reason: "timeout", Retryable: true}}
+	vast := `<VAST version="4.0">
+  <Ad id="wrapper"><Wrapper></Wrapper></Ad>
+  <Ad id="inline"><InLine><Creatives><Creative><Linear><MediaFiles>
+    <MediaFile bitrate="1000"><![CDATA[https://example.com/ad.mp4]]></MediaFile>
+  </MediaFiles></Linear></Creative></Creatives></InLine></Ad>
+</VAST>`
+
+	// Without a content type, documents are recognized by their first character
+	response := preIngest(t, api, "/preingest", "", vast)
+	is.Equal(response.SkippedAds, 1)
+	is.Equal(response.Creatives, []preIngestCreativeStatus{{
+		CreativeId: "httpsexamplecomadmp4",
+		MediaUrl:   "https://example.com/ad.mp4",
+		Status:     preIngestRejected,
+	}})
+	is.Equal(encoreHandler.calls, 0)
+}
+
+func TestPreIngestInvalidDocuments(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	for _, body := range []string{`<VAST><Ad id="broken"`, "<html></html>", "<", `{"mediaUrls":`} {
+		recorder := httptest.NewRecorder()
+		api.HandlePreIngestCreatives(recorder, httptest.NewRequest(http.MethodPost, "/preingest", strings.NewReader(body)))
+		is.Equal(recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPreIngestPendingCreatives(t *testing.T) {
+	is := is.New(t)
+	api, ts, _, encoreHandler := setupApi()
+	defer ts.Close()
+	defer encoreHandler.reset()
+	memoryStore, err := store.NewMemoryStore()
+	is.NoErr(err)
+	api.valkeyStore = memoryStore
+	api.preIngestMaxDispatch = 1
+
+	body, err := json.Marshal(preIngestCreativeRequest{
+		MediaUrls: []string{"https://example.com/a.mp4", "https://example.com/b.mp4"},
+	})
+	is.NoErr(err)
+	response := preIngest(t, api, "/preingest", "application/json", string(body))
+	is.Equal(response.NotYetProcessed, 2)
+	is.Equal(response.Creatives[0].Status, preIngestDispatched)
+	is.True(response.Creatives[0].JobId != "")
+	is.Equal(response.Creatives[1], preIngestCreativeStatus{
+		CreativeId: "httpsexamplecombmp4",
+		MediaUrl:   "https://example.com/b.mp4",
+		Status:     preIngestPending,
+	})
+	// The job of the pending creative is created after responding
+	deadline := time.Now().Add(time.Second)
+	for {
+		stored, found, err := memoryStore.Get("httpsexamplecombmp4")
+		is.NoErr(err)
+		if found {
+			is.Equal(stored.Status, "QUEUED")
+			break
+		}
+		is.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPreIngestTooLarge(t *testing.T) {
+	is := is.New(t)
+	api, ts, _, encoreHandler := setupApi()
+	defer ts.Close()
+	defer encoreHandler.reset()
+	memoryStore, err := store.NewMemoryStore()
+	is.NoErr(err)
+	api.valkeyStore = memoryStore
+	api.preIngestMaxDispatch = 1
+	api.preIngestMaxPending = 1
+	api.preIngestMaxAdTags = 1
+	is.NoErr(memoryStore.Set("httpsexamplecomcompletedmp4", structure.TranscodeInfo{Status: "COMPLETED"}))
+	var body []byte
+
+	for _, piRequest := range []preIngestCreativeRequest{
+		{AdTags: []string{ts.URL + "?requestType=vast", ts.URL + "?requestType=vmap"}},
+		{MediaUrls: []string{"https://example.com/a.mp4", "https://example.com/b.mp4", "https://example.com/c.mp4"}},
+	} {
+		body, err = json.Marshal(piRequest)
+		is.NoErr(err)
+		req := httptest.NewRequest(http.MethodPost, "/preingest", strings.NewReader(string(body)))
+		recorder := httptest.NewRecorder()
+		api.HandlePreIngestCreatives(recorder, req)
+		is.Equal(recorder.Code, http.StatusRequestEntityTooLarge)
+	}
+	is.Equal(encoreHandler.calls, 0)
+
+	// Known creatives do not count
+	body, err = json.Marshal(preIngestCreativeRequest{
+		MediaUrls: []string{"https://example.com/completed.mp4", "https://example.com/a.mp4", "https://example.com/b.mp4"},
+	})
+	is.NoErr(err)
+	response := preIngest(t, api, "/preingest", "application/json", string(body))
+	is.Equal(response.NotYetProcessed, 2)
+}
+
+func TestPreIngestAdTagNotAllowed(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	defer storeStub.reset()
+	redirect := httptest.NewServer(http.RedirectHandler(ts.URL+"?requestType=vast", http.StatusFound))
+	defer redirect.Close()
+	redirectUrl, err := url.Parse(redirect.URL)
+	is.NoErr(err)
+	// Only the redirecting server is allowed, not the one it redirects to
+	api.adTagHosts = []string{redirectUrl.Host}
+
+	body, err := json.Marshal(preIngestCreativeRequest{
+		AdTags: []string{"file:///etc/passwd", ts.URL + "?requestType=vast", redirect.URL},
+	})
+	is.NoErr(err)
+	response := preIngest(t, api, "/preingest", "application/json", string(body))
+	is.Equal(len(response.Creatives), 0)
+	is.Equal(len(response.FailedAdTags), 3)
+	for _, failed := range response.FailedAdTags {
+		is.True(strings.Contains(failed.Error, errAdTagNotAllowed.Error()))
+	}
+	is.True(strings.Contains(response.FailedAdTags[0].Error, "unsupported scheme"))
+
+	// Any host is allowed with "*"
+	api.adTagHosts = []string{"*"}
+	response = preIngest(t, api, "/preingest", "application/json", string(body))
+	is.Equal(len(response.FailedAdTags), 1)
+	is.Equal(len(response.Creatives), 2)
+}
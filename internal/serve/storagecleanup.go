@@ -0,0 +1,159 @@
+package serve
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// DeleteCreative removes the creative from the store, cancels its transcoding job if it is
+// still running, and removes its assets from the bucket if storage cleanup is enabled.
+// Returns false if the creative was not found.
+func (api *API) DeleteCreative(creativeId string) (bool, error) {
+	transcodeInfo, found, err := api.valkeyStore.Get(creativeId)
+	if err != nil || !found {
+		return found, err
+	}
+	if err := api.valkeyStore.Delete(creativeId); err != nil {
+		return true, err
+	}
+	api.cancelJob(creativeId, transcodeInfo)
+	api.recordStateChange(creativeId, structure.HistoryDeleted, structure.HistorySourceApi, transcodeInfo, "")
+	if api.assetCleaner != nil {
+		if err := api.assetCleaner.RemoveCreative(creativeId); err != nil {
+			// The orphan sweeper will have another go at it
+			logger.Error("failed to remove assets of deleted creative",
+				slog.String("error", err.Error()),
+				slog.String("creativeId", creativeId),
+			)
+		}
+	}
+	logger.Info("deleted creative", slog.String("creativeId", creativeId))
+	return true, nil
+}
+
+// Removes the output of the job of a failed creative, and of the job it replaced,
+// if storage cleanup is enabled
+func (api *API) removeJobAssets(creativeId string, transcodeInfo structure.TranscodeInfo) {
+	api.removeOutputFolder(creativeId, transcodeInfo.OutputFolder)
+	api.removeOutputFolder(creativeId, transcodeInfo.ReplacedOutputFolder)
+}
+
+// Removes the output folder of a job of the creative, if storage cleanup is enabled
+func (api *API) removeOutputFolder(creativeId string, outputFolder string) {
+	if api.assetCleaner == nil || outputFolder == "" {
+		return
+	}
+	if err := api.assetCleaner.RemoveFolder(outputFolder); err != nil {
+		logger.Error("failed to remove assets of job",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+			slog.String("outputFolder", outputFolder),
+		)
+	}
+}
+
+// RunOrphanSweeper periodically removes assets from the bucket that no creative in the store refers to,
+// f.ex. left behind by failed or retried jobs. Assets are only removed once they are older than the
+// orphan min age, so that jobs that are being set up are left alone.
+// Runs until the context is cancelled.
+func (api *API) RunOrphanSweeper(ctx context.Context, interval time.Duration) {
+	if api.assetCleaner == nil {
+		return
+	}
+	if !api.assetCleaner.CanSweep() {
+		// Anything else in the bucket would be taken for an orphaned creative
+		logger.Warn("orphan sweep disabled, OUTPUT_BUCKET_URL has no path dedicated to creatives")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			api.sweepOrphans(time.Now())
+		case <-ctx.Done():
+			logger.Info("Stopping orphan sweeper")
+			return
+		}
+	}
+}
+
+func (api *API) sweepOrphans(now time.Time) {
+	creativeIds, err := api.assetCleaner.CreativeIds()
+	if err != nil {
+		logger.Error("failed to list creative folders", slog.String("error", err.Error()))
+		return
+	}
+	removed := 0
+	for _, creativeId := range creativeIds {
+		transcodeInfo, found, err := api.valkeyStore.Get(creativeId)
+		if err != nil {
+			logger.Error("failed to get creative for orphan sweep",
+				slog.String("error", err.Error()),
+				slog.String("creativeId", creativeId),
+			)
+			continue
+		}
+		if !found {
+			if api.isOrphanExpired(api.assetCleaner.CreativeFolder(creativeId), now) &&
+				api.assetCleaner.RemoveCreative(creativeId) == nil {
+				removed++
+			}
+			continue
+		}
+		jobFolders, err := api.assetCleaner.JobFolders(creativeId)
+		if err != nil {
+			logger.Error("failed to list job folders",
+				slog.String("error", err.Error()),
+				slog.String("creativeId", creativeId),
+			)
+			continue
+		}
+		for _, folder := range jobFolders {
+			if referencesFolder(transcodeInfo, folder) || !api.isOrphanExpired(folder, now) {
+				continue
+			}
+			if api.assetCleaner.RemoveFolder(folder) == nil {
+				removed++
+			}
+		}
+	}
+	logger.Info("orphan sweep done", slog.Int("removed", removed), slog.Int("creatives", len(creativeIds)))
+}
+
+func (api *API) isOrphanExpired(folder string, now time.Time) bool {
+	lastModified, err := api.assetCleaner.LastModified(folder)
+	if err != nil {
+		logger.Error("failed to get age of folder",
+			slog.String("error", err.Error()),
+			slog.String("folder", folder),
+		)
+		return false
+	}
+	return lastModified.Before(now.Add(-api.orphanMinAge))
+}
+
+// Checks if the job output or the package of the creative, or the output of the job it replaces,
+// is stored in the folder. The folder must match whole path segments, so that f.ex. the folder of
+// job-1 is not kept for job-10. The URL of the package may have a path prefix of the asset server.
+func referencesFolder(transcodeInfo structure.TranscodeInfo, folder string) bool {
+	for _, ref := range []string{transcodeInfo.OutputFolder, transcodeInfo.Url, transcodeInfo.ReplacedOutputFolder} {
+		if ref == "" {
+			continue
+		}
+		parsed, err := url.Parse(ref)
+		if err != nil {
+			continue
+		}
+		if strings.Contains("/"+strings.Trim(parsed.Path, "/")+"/", "/"+strings.Trim(folder, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package serve
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
+	"github.com/matryer/is"
+)
+
+func setupCleanup(t *testing.T, api *API, keys ...string) string {
+	t.Helper()
+	return setupCleanupAt(t, api, "s3://test-bucket/ads", keys...)
+}
+
+func setupCleanupAt(t *testing.T, api *API, bucket string, keys ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	objectStore := storage.NewLocalObjectStore(root)
+	for _, key := range keys {
+		if err := objectStore.Put(key, strings.NewReader("data"), 4, "application/octet-stream"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bucketUrl, _ := url.Parse(bucket)
+	api.assetCleaner = storage.NewAssetCleaner(objectStore, *bucketUrl)
+	api.orphanMinAge = time.Hour
+	return root
+}
+
+func exists(root string, key string) bool {
+	_, err := os.Stat(filepath.Join(root, key))
+	return err == nil
+}
+
+func TestDeleteCreative(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	root := setupCleanup(t, api, "ads/creative/job/index.m3u8", "ads/other/job/index.m3u8")
+	_ = ss.Set("creative", structure.TranscodeInfo{Status: "COMPLETED"})
+
+	found, err := api.DeleteCreative("creative")
+	is.NoErr(err)
+	is.True(found)
+	_, found, _ = ss.Get("creative")
+	is.True(!found)
+	is.True(!exists(root, "ads/creative"))
+	is.True(exists(root, "ads/other/job/index.m3u8"))
+
+	found, err = api.DeleteCreative("unknown")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestFailedJobAssetsRemoved(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	root := setupCleanup(t, api, "ads/creative/job/video.mp4", "ads/creative/source/ad.mp4")
+	_ = ss.Set("creative", structure.TranscodeInfo{
+		Status:       "IN_PROGRESS",
+		JobId:        "job-id",
+		OutputFolder: "s3://test-bucket/ads/creative/job/",
+	})
+
+	err := api.HandleJobUpdate(transcoder.JobUpdate{
+		JobId:      "job-id",
+		CreativeId: "creative",
+		Status:     transcoder.StatusFailed,
+	})
+	is.NoErr(err)
+	is.True(!exists(root, "ads/creative/job"))
+	is.True(exists(root, "ads/creative/source/ad.mp4")) // the source is only removed with the creative
+}
+
+func TestSweepOrphans(t *testing.T) {
+	is := is.New(t)
+	api, ts, ss, _ := setupApi()
+	defer ts.Close()
+	root := setupCleanup(t, api,
+		"ads/live/current/index.m3u8",
+		"ads/live/packaged/index.m3u8",
+		"ads/live/retried/index.m3u8",
+		"ads/live/source/ad.mp4",
+		"ads/removed/job/index.m3u8",
+	)
+	_ = ss.Set("live", structure.TranscodeInfo{
+		Status:       "COMPLETED",
+		OutputFolder: "s3://test-bucket/ads/live/current/",
+		Url:          "https://asset-server.example.com/ads/live/packaged/index.m3u8",
+	})
+
+	// Too recent to be considered orphans
+	api.sweepOrphans(time.Now())
+	is.True(exists(root, "ads/removed/job/index.m3u8"))
+	is.True(exists(root, "ads/live/retried/index.m3u8"))
+
+	api.sweepOrphans(time.Now().Add(2 * time.Hour))
+	is.True(!exists(root, "ads/removed"))
+	is.True(!exists(root, "ads/live/retried"))
+	is.True(exists(root, "ads/live/current/index.m3u8"))
+	is.True(exists(root, "ads/live/packaged/index.m3u8"))
+	is.True(exists(root, "ads/live/source/ad.mp4"))
+}
+
+func TestSweepOrphansAtBucketRoot(t *testing.T) {
+	is := is.New(t)
+	api, ts, _, _ := setupApi()
+	defer ts.Close()
+	root := setupCleanupAt(t, api, "s3://test-bucket", "creative/job/index.m3u8", "backups/db.dump")
+
+	api.sweepOrphans(time.Now().Add(2 * time.Hour))
+	is.True(exists(root, "backups/db.dump"))
+	is.True(exists(root, "creative/job/index.m3u8"))
+}
+
+func TestReferencesFolder(t *testing.T) {
+	is := is.New(t)
+	transcodeInfo := structure.TranscodeInfo{
+		OutputFolder: "s3://test-bucket/ads/live/job-1/",
+		Url:          "https://asset-server.example.com/cdn/ads/live/packaged/index.m3u8",
+	}
+	is.True(referencesFolder(transcodeInfo, "ads/live/job-1/"))
+	is.True(referencesFolder(transcodeInfo, "ads/live/job-1"))
+	is.True(referencesFolder(transcodeInfo, "ads/live/packaged"))
+	// Only whole path segments match
+	is.True(!referencesFolder(transcodeInfo, "ads/live/job-10/"))
+	is.True(!referencesFolder(transcodeInfo, "ads/live/job-"))
+	is.True(!referencesFolder(transcodeInfo, "ads/live/pack"))
+	is.True(!referencesFolder(transcodeInfo, "s/live/packaged"))
+}
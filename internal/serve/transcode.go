@@ -0,0 +1,264 @@
+package serve
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/Eyevinn/ad-normalizer/internal/transcoder"
+)
+
+// Progress is reported often, so only every historyProgressStep percent of it is recorded in the history
+const historyProgressStep = 25
+
+// HandleJobUpdate updates the creative of a transcoding job with the reported progress,
+// regardless of the backend that runs the job.
+func (api *API) HandleJobUpdate(update transcoder.JobUpdate) error {
+	switch update.Status {
+	case transcoder.StatusSuccessful:
+		return api.handleTranscodeCompleted(update)
+	case transcoder.StatusFailed, transcoder.StatusCancelled:
+		return api.handleTranscodeFailed(update)
+	case transcoder.StatusInProgress:
+		return api.handleTranscodeInProgress(update)
+	default:
+		logger.Info("Job status does not match any known status", slog.String("status", update.BackendStatus))
+		return nil
+	}
+}
+
+func (api *API) handleTranscodeInProgress(update transcoder.JobUpdate) error {
+	logger.Info("Transcoding progress updated",
+		slog.String("creative ID", update.CreativeId),
+		slog.Int("progress", update.Progress),
+	)
+	transcodeInfo, found, err := api.valkeyStore.Get(update.CreativeId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// The creative has been removed, f.ex. by a failure callback. Don't bring it back.
+		logger.Debug("No creative found for progress update", slog.String("creativeId", update.CreativeId))
+		return nil
+	}
+	if !isCurrentJob(transcodeInfo, update.JobId) {
+		logger.Debug("Ignoring progress update of replaced job", slog.String("jobId", update.JobId))
+		return nil
+	}
+	previousStatus, previousProgress := transcodeInfo.Status, transcodeInfo.Progress
+	if previousStatus != "QUEUED" && previousStatus != "IN_PROGRESS" {
+		// A late progress update, the transcoding has already finished
+		logger.Debug("Ignoring progress update",
+			slog.String("creativeId", update.CreativeId),
+			slog.String("status", previousStatus),
+		)
+		return nil
+	}
+	transcodeInfo.Status = "IN_PROGRESS"
+	transcodeInfo.UpdateProgress(update.Progress, update.BackendStatus, time.Now())
+	set, err := api.valkeyStore.CompareAndSet(update.CreativeId, previousStatus, transcodeInfo)
+	if err != nil {
+		return err
+	}
+	if !set {
+		// The creative was updated by another callback in the meantime
+		logger.Debug("Creative changed during progress update", slog.String("creativeId", update.CreativeId))
+		return nil
+	}
+	if previousStatus != transcodeInfo.Status {
+		api.recordStateChange(
+			update.CreativeId,
+			structure.HistoryProgress,
+			structure.HistorySourceTranscoder,
+			transcodeInfo,
+			structure.EventInProgress,
+		)
+	} else if previousProgress/historyProgressStep != transcodeInfo.Progress/historyProgressStep {
+		api.recordStateChange(
+			update.CreativeId,
+			structure.HistoryProgress,
+			structure.HistorySourceTranscoder,
+			transcodeInfo,
+			"",
+		)
+	}
+	return nil
+}
+
+func (api *API) handleTranscodeFailed(update transcoder.JobUpdate) error {
+	stored, found, err := api.valkeyStore.Get(update.CreativeId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// F.ex. cancelled by the normalizer, after the creative was removed
+		logger.Debug("No creative found for failed job", slog.String("jobId", update.JobId))
+		return nil
+	}
+	if !isCurrentJob(stored, update.JobId) {
+		// F.ex. cancelled by a re-transcode, the creative belongs to the new job
+		logger.Debug("Ignoring failure of replaced job", slog.String("jobId", update.JobId))
+		return nil
+	}
+	if stored.Status != "QUEUED" && stored.Status != "IN_PROGRESS" {
+		// A late or duplicate callback, the creative is no longer transcoding
+		logger.Debug("Ignoring failure",
+			slog.String("creativeId", update.CreativeId),
+			slog.String("status", stored.Status),
+		)
+		return nil
+	}
+	transcodeInfo := stored
+	transcodeInfo.Status = "FAILED"
+	transcodeInfo.Error = "transcoding failed"
+	if update.Message != "" {
+		transcodeInfo.Error = update.Message
+	}
+	transcodeInfo.EncoreStatus = update.BackendStatus
+	transcodeInfo.LastUpdate = time.Now().Unix()
+	// Claims the failure, so that a concurrent callback can not complete or fail the creative again
+	set, err := api.failCreative(update.CreativeId, stored.Status, transcodeInfo)
+	if err != nil {
+		return err
+	}
+	if !set {
+		logger.Debug("Creative changed during failure", slog.String("creativeId", update.CreativeId))
+		return nil
+	}
+	api.recordStateChange(
+		update.CreativeId,
+		structure.HistoryTranscodeFailed,
+		structure.HistorySourceTranscoder,
+		transcodeInfo,
+		structure.EventFailed,
+	)
+	return nil
+}
+
+func (api *API) handleTranscodeCompleted(update transcoder.JobUpdate) error {
+	stored, found, err := api.valkeyStore.Get(update.CreativeId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// The creative has been removed, f.ex. by a failure callback or a blacklisting. Don't bring it back.
+		logger.Debug("No creative found for completed job", slog.String("creativeId", update.CreativeId))
+		return nil
+	}
+	if !isCurrentJob(stored, update.JobId) {
+		logger.Debug("Ignoring completion of replaced job", slog.String("jobId", update.JobId))
+		return nil
+	}
+	if stored.Status != "QUEUED" && stored.Status != "IN_PROGRESS" {
+		// A duplicate callback, the completion has already been handled
+		logger.Debug("Ignoring completion",
+			slog.String("creativeId", update.CreativeId),
+			slog.String("status", stored.Status),
+		)
+		return nil
+	}
+	job, err := api.transcoder.GetJob(update.JobId)
+	if err != nil {
+		logger.Error("failed to get transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("jobId", update.JobId),
+		)
+		return err
+	}
+	transcodeInfo, err := structure.TranscodeInfoFromEncoreJob(&job, api.jitPackage, api.assetServerUrl)
+	if err != nil {
+		logger.Error("failed to create transcode info from transcoding job",
+			slog.String("error", err.Error()),
+			slog.String("jobId", update.JobId),
+		)
+		failed := stored
+		failed.Status = "FAILED"
+		failed.Error = "invalid transcoding job"
+		failed.LastUpdate = time.Now().Unix()
+		_, err = api.failCreative(update.CreativeId, stored.Status, failed)
+		return err
+	}
+	api.keepStoredFields(stored, &transcodeInfo)
+	transcodeInfo.UpdateProgress(100, update.BackendStatus, time.Now())
+	if !api.jitPackage && api.hlsPackager != nil {
+		if err := api.packageJob(&job, &transcodeInfo); err != nil {
+			logger.Error("failed to package transcoding job",
+				slog.String("error", err.Error()),
+				slog.String("jobId", update.JobId),
+			)
+			transcodeInfo.Status = "FAILED"
+			transcodeInfo.Error = "packaging failed"
+			set, err := api.failCreative(update.CreativeId, stored.Status, transcodeInfo)
+			if err != nil || !set {
+				return err
+			}
+			api.recordStateChange(
+				update.CreativeId,
+				structure.HistoryTranscodeSucceeded,
+				structure.HistorySourceTranscoder,
+				transcodeInfo,
+				"",
+			)
+			api.recordStateChange(
+				update.CreativeId,
+				structure.HistoryPackagingFailed,
+				structure.HistorySourceNormalizer,
+				transcodeInfo,
+				structure.EventFailed,
+			)
+			return nil
+		}
+	}
+	replacedOutputFolder := transcodeInfo.ReplacedOutputFolder
+	if transcodeInfo.Status == "COMPLETED" {
+		transcodeInfo.ReplacedOutputFolder = ""
+	}
+	// Only the first completion of the job is stored, a duplicate finds the creative completed
+	set, err := api.valkeyStore.CompareAndSet(update.CreativeId, stored.Status, transcodeInfo)
+	if err != nil {
+		logger.Error("failed to store transcode info",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", update.CreativeId),
+		)
+		// Something went wrong, remove the job from the store
+		_ = api.valkeyStore.DeleteFailed(update.CreativeId, structure.TranscodeInfo{
+			JobId:  update.JobId,
+			Source: transcodeInfo.Source,
+			Error:  "failed to store transcoding result",
+		})
+		return err
+	}
+	if !set {
+		logger.Debug("Creative changed during completion", slog.String("creativeId", update.CreativeId))
+		return nil
+	}
+	if transcodeInfo.Status == "COMPLETED" {
+		// The output of the re-transcoded job is no longer served
+		api.removeOutputFolder(update.CreativeId, replacedOutputFolder)
+	}
+	if !api.jitPackage && api.hlsPackager != nil {
+		api.recordStateChange(update.CreativeId, structure.HistoryTranscodeSucceeded, structure.HistorySourceTranscoder,
+			transcodeInfo, "")
+		api.recordStateChange(update.CreativeId, structure.HistoryPackagingSucceeded, structure.HistorySourceNormalizer,
+			transcodeInfo, transcodeInfo.Status)
+	} else {
+		api.recordStateChange(update.CreativeId, structure.HistoryTranscodeSucceeded, structure.HistorySourceTranscoder,
+			transcodeInfo, transcodeInfo.Status)
+	}
+	if !api.jitPackage && api.hlsPackager == nil {
+		logger.Debug("JIT packaging is disabled, queueing packaing job", slog.String("creativeId", update.CreativeId))
+		packageInfo := structure.PackagingQueueMessage{
+			JobId: update.JobId,
+			Url:   api.encoreUrl.JoinPath("encoreJobs", update.JobId).String(),
+		}
+		return api.enqueuePackagingJob(update.CreativeId, packageInfo, 0)
+	}
+	return nil
+}
+
+// Whether the update is for the current job of the creative. Updates without a job ID, and updates of
+// an earlier job, that has been replaced by a re-transcode, are not.
+func isCurrentJob(stored structure.TranscodeInfo, jobId string) bool {
+	return jobId != "" && stored.JobId == jobId
+}
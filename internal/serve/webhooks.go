@@ -0,0 +1,142 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"go.opentelemetry.io/otel"
+)
+
+type webhookResponse struct {
+	Webhooks []structure.Webhook `json:"webhooks"`
+}
+
+func readWebhookRequest(r *http.Request) (structure.Webhook, error) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return structure.Webhook{}, err
+	}
+	var webhook structure.Webhook
+	if err := json.Unmarshal(bytes, &webhook); err != nil {
+		return webhook, err
+	}
+	if _, err := url.ParseRequestURI(webhook.Url); err != nil {
+		return webhook, err
+	}
+	return webhook, nil
+}
+
+// HandleWebhooks registers (POST), removes (DELETE) and lists (GET) webhooks
+// that receive creative lifecycle events.
+func (api *API) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer("api").Start(r.Context(), "HandleWebhooks")
+	defer span.End()
+	switch r.Method {
+	case http.MethodPost:
+		webhook, err := readWebhookRequest(r)
+		if err != nil {
+			logger.Error("failed to read webhook request", slog.String("error", err.Error()))
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := api.valkeyStore.AddWebhook(webhook); err != nil {
+			logger.Error("failed to register webhook",
+				slog.String("url", webhook.Url),
+				slog.String("error", err.Error()),
+			)
+			http.Error(w, "Failed to register webhook", http.StatusInternalServerError)
+			return
+		}
+		api.invalidateWebhooks()
+		logger.Info("registered webhook",
+			slog.String("url", webhook.Url),
+			slog.String("subdomain", webhook.Subdomain),
+		)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		webhook, err := readWebhookRequest(r)
+		if err != nil {
+			logger.Error("failed to read webhook request", slog.String("error", err.Error()))
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := api.valkeyStore.RemoveWebhook(webhook); err != nil {
+			logger.Error("failed to remove webhook",
+				slog.String("url", webhook.Url),
+				slog.String("error", err.Error()),
+			)
+			http.Error(w, "Failed to remove webhook", http.StatusInternalServerError)
+			return
+		}
+		api.invalidateWebhooks()
+		logger.Info("removed webhook",
+			slog.String("url", webhook.Url),
+			slog.String("subdomain", webhook.Subdomain),
+		)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		webhooks, err := api.valkeyStore.GetWebhooks()
+		if err != nil {
+			logger.Error("failed to list webhooks", slog.String("error", err.Error()))
+			http.Error(w, "Failed to list webhooks", http.StatusInternalServerError)
+			return
+		}
+		ret, err := json.Marshal(webhookResponse{Webhooks: webhooks})
+		if err != nil {
+			logger.Error("failed to marshal webhooks", slog.String("error", err.Error()))
+			http.Error(w, "Failed to marshal webhooks", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(ret)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RunWebhookDelivery sends queued webhook events until the context is cancelled
+func (api *API) RunWebhookDelivery(ctx context.Context, interval time.Duration) {
+	api.notifier.Run(ctx, interval)
+}
+
+func (api *API) invalidateWebhooks() {
+	if api.notifier != nil {
+		api.notifier.InvalidateWebhooks()
+	}
+}
+
+// Notifies the webhooks and event stream subscribers of a state change of the creative
+func (api *API) publishEvent(event string, creativeId string, transcodeInfo structure.TranscodeInfo) {
+	api.publishCreativeEvent(structure.CreativeEvent{
+		Event:      event,
+		CreativeId: creativeId,
+		Source:     transcodeInfo.Source,
+		Url:        transcodeInfo.Url,
+		Error:      transcodeInfo.Error,
+		Subdomain:  transcodeInfo.Subdomain,
+		Timestamp:  time.Now().Unix(),
+		Job:        &transcodeInfo,
+	})
+}
+
+func (api *API) publishCreativeEvent(creativeEvent structure.CreativeEvent) {
+	creativeId, event := creativeEvent.CreativeId, creativeEvent.Event
+	if api.notifier != nil {
+		api.notifier.Notify(creativeEvent)
+	}
+	if err := api.valkeyStore.PublishEvent(creativeEvent); err != nil {
+		logger.Error("failed to publish creative event",
+			slog.String("error", err.Error()),
+			slog.String("creativeId", creativeId),
+			slog.String("event", event),
+		)
+	}
+}
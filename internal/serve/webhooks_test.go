@@ -0,0 +1,73 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestHandleWebhooks(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+
+	body := `{"url": "https://hooks.example.com/ads", "subdomain": "tenant"}`
+	req, _ := http.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	api.HandleWebhooks(rr, req)
+	is.Equal(rr.Code, http.StatusNoContent)
+	is.Equal(storeStub.webhooks, []structure.Webhook{{Url: "https://hooks.example.com/ads", Subdomain: "tenant"}})
+
+	req, _ = http.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(`{"url": "not a url"}`))
+	rr = httptest.NewRecorder()
+	api.HandleWebhooks(rr, req)
+	is.Equal(rr.Code, http.StatusBadRequest)
+
+	req, _ = http.NewRequest(http.MethodGet, "/webhooks", nil)
+	rr = httptest.NewRecorder()
+	api.HandleWebhooks(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	var resp webhookResponse
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+	is.Equal(len(resp.Webhooks), 1)
+	is.Equal(resp.Webhooks[0].Subdomain, "tenant")
+
+	req, _ = http.NewRequest(http.MethodDelete, "/webhooks", bytes.NewBufferString(body))
+	rr = httptest.NewRecorder()
+	api.HandleWebhooks(rr, req)
+	is.Equal(rr.Code, http.StatusNoContent)
+	is.Equal(len(storeStub.webhooks), 0)
+
+	req, _ = http.NewRequest(http.MethodPut, "/webhooks", nil)
+	rr = httptest.NewRecorder()
+	api.HandleWebhooks(rr, req)
+	is.Equal(rr.Code, http.StatusMethodNotAllowed)
+	storeStub.reset()
+}
+
+func TestPublishEventBySubdomain(t *testing.T) {
+	is := is.New(t)
+	api, ts, storeStub, _ := setupApi()
+	defer ts.Close()
+	_ = storeStub.AddWebhook(structure.Webhook{Url: "https://hooks.example.com/all"})
+	_ = storeStub.AddWebhook(structure.Webhook{Url: "https://hooks.example.com/tenant", Subdomain: "tenant"})
+
+	api.publishEvent(structure.EventQueued, "creative", structure.TranscodeInfo{Subdomain: "other"})
+	is.Equal(len(storeStub.deliveries), 1)
+	is.Equal(storeStub.deliveries[0].Url, "https://hooks.example.com/all")
+
+	api.publishEvent(structure.EventCompleted, "creative", structure.TranscodeInfo{
+		Url:       "https://cdn.example.com/creative/index.m3u8",
+		Subdomain: "tenant",
+	})
+	is.Equal(len(storeStub.deliveries), 3)
+	is.Equal(storeStub.deliveries[2].Url, "https://hooks.example.com/tenant")
+	is.Equal(storeStub.deliveries[2].Event.CreativeId, "creative")
+	is.Equal(storeStub.deliveries[2].Event.Url, "https://cdn.example.com/creative/index.m3u8")
+	storeStub.reset()
+}
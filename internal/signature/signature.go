@@ -0,0 +1,39 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const signaturePrefix = "sha256="
+
+// Token returns a hex encoded HMAC-SHA256 of the subject,
+// f.ex. used as per job token in callback URLs.
+func Token(secret string, subject string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(subject))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the signature of the body in the form sha256=<hex encoded HMAC>
+func Sign(secret string, body []byte) string {
+	return signaturePrefix + Token(secret, string(body))
+}
+
+// VerifyToken checks the token against the expected token for the subject in constant time
+func VerifyToken(secret string, subject string, token string) bool {
+	if token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(Token(secret, subject)), []byte(strings.ToLower(token)))
+}
+
+// Verify checks a signature created by Sign in constant time
+func Verify(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	return VerifyToken(secret, string(body), strings.TrimPrefix(signature, signaturePrefix))
+}
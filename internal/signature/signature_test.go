@@ -0,0 +1,28 @@
+package signature
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestToken(t *testing.T) {
+	is := is.New(t)
+	token := Token("secret", "creative-id")
+	is.Equal(len(token), 64)
+	is.Equal(token, Token("secret", "creative-id"))
+	is.True(token != Token("other-secret", "creative-id"))
+	is.True(VerifyToken("secret", "creative-id", token))
+	is.True(!VerifyToken("secret", "other-creative-id", token))
+	is.True(!VerifyToken("secret", "creative-id", ""))
+}
+
+func TestSign(t *testing.T) {
+	is := is.New(t)
+	body := []byte(`{"jobId":"test-job-id"}`)
+	sig := Sign("secret", body)
+	is.True(Verify("secret", body, sig))
+	is.True(!Verify("secret", []byte(`{"jobId":"forged"}`), sig))
+	is.True(!Verify("wrong-secret", body, sig))
+	is.True(!Verify("secret", body, Token("secret", string(body)))) // prefix is required
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+)
+
+// ErrNoSweepPrefix is returned when listing creative folders at the root of the bucket,
+// where other folders can not be told apart from creative folders.
+var ErrNoSweepPrefix = errors.New("the output bucket URL has no path to sweep")
+
+// AssetCleaner removes assets of creatives from the output bucket.
+// All assets of a creative are stored in the creative folder, <bucket path>/<creative id>/,
+// with one subfolder per job and the mirrored source in the source subfolder.
+type AssetCleaner struct {
+	objectStore PrefixStore
+	prefix      string
+}
+
+func NewAssetCleaner(objectStore PrefixStore, bucketUrl url.URL) *AssetCleaner {
+	return &AssetCleaner{
+		objectStore: objectStore,
+		prefix:      strings.Trim(bucketUrl.Path, "/"),
+	}
+}
+
+// CreativeFolder returns the folder holding all assets of the creative
+func (c *AssetCleaner) CreativeFolder(creativeId string) string {
+	return path.Join(c.prefix, creativeId) + "/"
+}
+
+// RemoveCreative removes all assets of the creative
+func (c *AssetCleaner) RemoveCreative(creativeId string) error {
+	if creativeId == "" || strings.Contains(creativeId, "/") {
+		return fmt.Errorf("invalid creative id %q", creativeId)
+	}
+	return c.remove(c.CreativeFolder(creativeId))
+}
+
+// RemoveFolder removes a job folder, given as a bucket URL or as a path relative to the bucket.
+// Only folders within a creative folder are removed.
+func (c *AssetCleaner) RemoveFolder(folder string) error {
+	parsed, err := url.Parse(folder)
+	if err != nil {
+		return fmt.Errorf("invalid folder %s: %w", folder, err)
+	}
+	relative := strings.Trim(parsed.Path, "/")
+	if c.prefix != "" {
+		if !strings.HasPrefix(relative, c.prefix+"/") {
+			return fmt.Errorf("folder %s is outside of the output bucket path", folder)
+		}
+		relative = strings.TrimPrefix(relative, c.prefix+"/")
+	}
+	// <creative id>/<job folder>
+	if strings.Count(relative, "/") < 1 {
+		return fmt.Errorf("folder %s is not a job folder", folder)
+	}
+	return c.remove(path.Join(c.prefix, relative) + "/")
+}
+
+// CanSweep returns whether the creative folders are below a dedicated path of the bucket,
+// so that all folders there can be treated as creative folders.
+func (c *AssetCleaner) CanSweep() bool {
+	return c.prefix != ""
+}
+
+// CreativeIds returns the ids of all creatives that have a folder in the bucket.
+// Returns ErrNoSweepPrefix if the creative folders are at the root of the bucket.
+func (c *AssetCleaner) CreativeIds() ([]string, error) {
+	if !c.CanSweep() {
+		return nil, ErrNoSweepPrefix
+	}
+	folders, err := c.objectStore.ListPrefixes(c.prefix + "/")
+	if err != nil {
+		return nil, err
+	}
+	creativeIds := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		creativeIds = append(creativeIds, path.Base(folder))
+	}
+	return creativeIds, nil
+}
+
+// JobFolders returns the job folders of the creative, excluding the mirrored source
+func (c *AssetCleaner) JobFolders(creativeId string) ([]string, error) {
+	folders, err := c.objectStore.ListPrefixes(c.CreativeFolder(creativeId))
+	if err != nil {
+		return nil, err
+	}
+	jobFolders := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		if path.Base(folder) != SourceFolder {
+			jobFolders = append(jobFolders, folder)
+		}
+	}
+	return jobFolders, nil
+}
+
+// LastModified returns the time the newest object in the folder was written
+func (c *AssetCleaner) LastModified(folder string) (time.Time, error) {
+	return c.objectStore.LastModified(folder)
+}
+
+func (c *AssetCleaner) remove(folder string) error {
+	if err := c.objectStore.DeletePrefix(folder); err != nil {
+		return err
+	}
+	logger.Info("Removed assets", slog.String("folder", folder))
+	return nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+)
+
+var (
+	_ PrefixStore   = (*LocalObjectStore)(nil)
+	_ ReadableStore = (*LocalObjectStore)(nil)
+)
+
+// LocalObjectStore writes objects to a local directory,
+// f.ex. a volume that is served by a web server.
+type LocalObjectStore struct {
+	root string
+}
+
+func NewLocalObjectStore(root string) *LocalObjectStore {
+	return &LocalObjectStore{root: root}
+}
+
+func (l *LocalObjectStore) Put(key string, body io.Reader, size int64, contentType string) error {
+	target := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+	file, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("failed to create file for %s: %w", key, err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, body); err != nil {
+		return fmt.Errorf("failed to write file for %s: %w", key, err)
+	}
+	logger.Debug("Wrote object", slog.String("path", target))
+	return nil
+}
+
+func (l *LocalObjectStore) Url(key string) string {
+	return "file://" + l.path(key)
+}
+
+func (l *LocalObjectStore) ReadRange(key string, offset int64, length int64) ([]byte, error) {
+	file, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file for %s: %w", key, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file for %s: %w", key, err)
+	}
+	return data, nil
+}
+
+func (l *LocalObjectStore) Size(key string) (int64, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file for %s: %w", key, err)
+	}
+	return info.Size(), nil
+}
+
+func (l *LocalObjectStore) ListPrefixes(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(l.path(prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	prefixes := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			prefixes = append(prefixes, path.Join(prefix, entry.Name())+"/")
+		}
+	}
+	return prefixes, nil
+}
+
+func (l *LocalObjectStore) LastModified(prefix string) (time.Time, error) {
+	var lastModified time.Time
+	err := filepath.WalkDir(l.path(prefix), func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return lastModified, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	return lastModified, nil
+}
+
+func (l *LocalObjectStore) DeletePrefix(prefix string) error {
+	target := l.path(prefix)
+	if target == filepath.Clean(l.root) {
+		return fmt.Errorf("refusing to delete the root directory %s", l.root)
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", prefix, err)
+	}
+	logger.Debug("Deleted directory", slog.String("path", target))
+	return nil
+}
+
+func (l *LocalObjectStore) path(key string) string {
+	// Clean the key as an absolute path, so that it can not point outside of the root
+	return filepath.Join(l.root, filepath.Clean("/"+key))
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+)
+
+// Subfolder of the creative folder that holds the mirrored source
+const SourceFolder = "source"
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// SourceMirror copies source creatives into the output bucket, so that
+// transcoding jobs do not depend on short lived ad server URLs.
+type SourceMirror struct {
+	client      *http.Client
+	objectStore ObjectStore
+	prefix      string
+}
+
+func NewSourceMirror(client *http.Client, objectStore ObjectStore, bucketUrl url.URL) *SourceMirror {
+	return &SourceMirror{
+		client:      client,
+		objectStore: objectStore,
+		prefix:      strings.Trim(bucketUrl.Path, "/"),
+	}
+}
+
+// Mirror downloads the source and uploads it under the creative key in the bucket.
+// Returns the bucket URL of the copy.
+func (m *SourceMirror) Mirror(creativeId string, sourceUrl string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceUrl, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create source request: %w", err)
+	}
+	req.Header.Set("User-Agent", "eyevinn/ad-normalizer")
+	res, err := m.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch source %s: %w", sourceUrl, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch source %s, status code: %d", sourceUrl, res.StatusCode)
+	}
+	key := m.SourceKey(creativeId, sourceUrl)
+	err = m.objectStore.Put(key, res.Body, res.ContentLength, res.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	mirroredUrl := m.objectStore.Url(key)
+	logger.Info("Mirrored source into bucket",
+		slog.String("creativeId", creativeId),
+		slog.String("source", sourceUrl),
+		slog.String("copy", mirroredUrl),
+	)
+	return mirroredUrl, nil
+}
+
+// SourceKey returns the bucket key of the mirrored source, f.ex. prefix/creativeId/source/ad.mp4
+func (m *SourceMirror) SourceKey(creativeId string, sourceUrl string) string {
+	fileName := "source"
+	if parsed, err := url.Parse(sourceUrl); err == nil {
+		base := unsafeFileChars.ReplaceAllString(path.Base(parsed.Path), "")
+		if base != "" && base != "." {
+			fileName = base
+		}
+	}
+	return path.Join(m.prefix, creativeId, SourceFolder, fileName)
+}
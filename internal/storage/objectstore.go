@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ObjectStore is a minimal abstraction of an S3 compatible bucket.
+// Keys are paths relative to the bucket root.
+type ObjectStore interface {
+	Put(key string, body io.Reader, size int64, contentType string) error
+	// Url returns the URL of the object, f.ex. in the form s3://bucket/key
+	Url(key string) string
+}
+
+// ReadableStore is an ObjectStore whose objects can be read back
+type ReadableStore interface {
+	ObjectStore
+	// ReadRange returns length bytes of the object from offset, fewer at the end of the object
+	ReadRange(key string, offset int64, length int64) ([]byte, error)
+	// Size returns the size of the object in bytes
+	Size(key string) (int64, error)
+}
+
+// PrefixStore is an ObjectStore that can list and remove folders,
+// i.e. all objects sharing a key prefix ending with "/".
+type PrefixStore interface {
+	ObjectStore
+	// ListPrefixes returns the folders directly below the prefix, ending with "/"
+	ListPrefixes(prefix string) ([]string, error)
+	// LastModified returns the modification time of the newest object below the prefix,
+	// or the zero time if there are no objects.
+	LastModified(prefix string) (time.Time, error)
+	// DeletePrefix removes all objects below the prefix
+	DeletePrefix(prefix string) error
+}
+
+var (
+	_ PrefixStore   = (*S3ObjectStore)(nil)
+	_ ReadableStore = (*S3ObjectStore)(nil)
+)
+
+type S3ObjectStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3ObjectStore(
+	endpoint url.URL,
+	accessKey string,
+	secretKey string,
+	region string,
+	bucket string,
+) (*S3ObjectStore, error) {
+	logger.Debug("Creating S3 client",
+		slog.String("endpoint", endpoint.Host),
+		slog.String("bucket", bucket),
+	)
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:       endpoint.Scheme == "https",
+		Region:       region,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		logger.Error("Failed to create S3 client", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return &S3ObjectStore{
+		client: client,
+		bucket: bucket,
+	}, nil
+}
+
+func (s *S3ObjectStore) Put(key string, body io.Reader, size int64, contentType string) error {
+	// Source files can be large, allow for slow transfers
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	_, err := s.client.PutObject(ctx, s.bucket, key, body, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload object %s to bucket %s: %w", key, s.bucket, err)
+	}
+	logger.Debug("Uploaded object", slog.String("bucket", s.bucket), slog.String("key", key))
+	return nil
+}
+
+func (s *S3ObjectStore) Url(key string) string {
+	return "s3://" + s.bucket + "/" + strings.TrimPrefix(key, "/")
+}
+
+func (s *S3ObjectStore) ReadRange(key string, offset int64, length int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	options := minio.GetObjectOptions{}
+	if err := options.SetRange(offset, offset+length-1); err != nil {
+		return nil, fmt.Errorf("invalid range of object %s: %w", key, err)
+	}
+	object, err := s.client.GetObject(ctx, s.bucket, key, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s from bucket %s: %w", key, s.bucket, err)
+	}
+	defer object.Close()
+	data, err := io.ReadAll(io.LimitReader(object, length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s from bucket %s: %w", key, s.bucket, err)
+	}
+	return data, nil
+}
+
+func (s *S3ObjectStore) Size(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat object %s in bucket %s: %w", key, s.bucket, err)
+	}
+	return info.Size, nil
+}
+
+func (s *S3ObjectStore) ListPrefixes(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	prefixes := []string{}
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list %s in bucket %s: %w", prefix, s.bucket, object.Err)
+		}
+		if strings.HasSuffix(object.Key, "/") {
+			prefixes = append(prefixes, object.Key)
+		}
+	}
+	return prefixes, nil
+}
+
+func (s *S3ObjectStore) LastModified(prefix string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var lastModified time.Time
+	options := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	for object := range s.client.ListObjects(ctx, s.bucket, options) {
+		if object.Err != nil {
+			return lastModified, fmt.Errorf("failed to list %s in bucket %s: %w", prefix, s.bucket, object.Err)
+		}
+		if object.LastModified.After(lastModified) {
+			lastModified = object.LastModified
+		}
+	}
+	return lastModified, nil
+}
+
+func (s *S3ObjectStore) DeletePrefix(prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true})
+	var listErr error
+	toRemove := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(toRemove)
+		for object := range objects {
+			if object.Err != nil {
+				listErr = object.Err
+				return
+			}
+			toRemove <- object
+		}
+	}()
+	// Drain all results, so that the listing is not blocked
+	var removeErr error
+	for result := range s.client.RemoveObjects(ctx, s.bucket, toRemove, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil && removeErr == nil {
+			removeErr = fmt.Errorf("failed to delete %s from bucket %s: %w", result.ObjectName, s.bucket, result.Err)
+		}
+	}
+	if removeErr != nil {
+		return removeErr
+	}
+	if listErr != nil {
+		return fmt.Errorf("failed to list %s in bucket %s: %w", prefix, s.bucket, listErr)
+	}
+	logger.Debug("Deleted objects", slog.String("bucket", s.bucket), slog.String("prefix", prefix))
+	return nil
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// fakeS3 is a local stand-in for an S3 compatible storage, using path style bucket lookup
+type fakeS3 struct {
+	server       *httptest.Server
+	mutex        sync.Mutex
+	objects      map[string][]byte
+	contentTypes map[string]string
+	modified     map[string]time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{
+		objects:      make(map[string][]byte),
+		contentTypes: make(map[string]string),
+		modified:     make(map[string]time.Time),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		f.contentTypes[key] = r.Header.Get("Content-Type")
+		f.modified[key] = time.Now()
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		if r.URL.Query().Has("list-type") {
+			f.list(w, strings.TrimSuffix(key, "/"), r.URL.Query())
+			return
+		}
+		body, found := f.objects[key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", f.modified[key].UTC().Format(http.TimeFormat))
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			end = min(end+1, len(body))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(body[start:end])
+			return
+		}
+		_, _ = w.Write(body)
+	case http.MethodHead:
+		body, found := f.objects[key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", f.modified[key].UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		if !r.URL.Query().Has("delete") {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		request := struct {
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, object := range request.Objects {
+			delete(f.objects, strings.TrimSuffix(key, "/")+"/"+object.Key)
+		}
+		_, _ = w.Write([]byte(`<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></DeleteResult>`))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Answers a ListObjectsV2 request, must be called with the mutex held
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	var result strings.Builder
+	result.WriteString(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	result.WriteString("<Name>" + bucket + "</Name><IsTruncated>false</IsTruncated>")
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	commonPrefixes := map[string]bool{}
+	for _, fullKey := range keys {
+		key, found := strings.CutPrefix(fullKey, bucket+"/")
+		if !found || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			rest := strings.TrimPrefix(key, prefix)
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				commonPrefix := prefix + rest[:i+1]
+				if !commonPrefixes[commonPrefix] {
+					commonPrefixes[commonPrefix] = true
+					result.WriteString("<CommonPrefixes><Prefix>" + commonPrefix + "</Prefix></CommonPrefixes>")
+				}
+				continue
+			}
+		}
+		result.WriteString("<Contents><Key>" + key + "</Key>")
+		result.WriteString("<LastModified>" + f.modified[fullKey].UTC().Format(time.RFC3339) + "</LastModified>")
+		result.WriteString(fmt.Sprintf("<Size>%d</Size></Contents>", len(f.objects[fullKey])))
+	}
+	result.WriteString("</ListBucketResult>")
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(result.String()))
+}
+
+func (f *fakeS3) objectStore() *S3ObjectStore {
+	endpoint, _ := url.Parse(f.server.URL)
+	objectStore, _ := NewS3ObjectStore(*endpoint, "", "", "us-east-1", "test-bucket")
+	return objectStore
+}
+
+func TestPut(t *testing.T) {
+	is := is.New(t)
+	s3 := newFakeS3()
+	defer s3.server.Close()
+	objectStore := s3.objectStore()
+
+	err := objectStore.Put("ads/creative/index.m3u8", strings.NewReader("#EXTM3U"), 7, "application/x-mpegURL")
+	is.NoErr(err)
+	is.Equal(string(s3.objects["test-bucket/ads/creative/index.m3u8"]), "#EXTM3U")
+	is.Equal(s3.contentTypes["test-bucket/ads/creative/index.m3u8"], "application/x-mpegURL")
+	is.Equal(objectStore.Url("ads/creative/index.m3u8"), "s3://test-bucket/ads/creative/index.m3u8")
+}
+
+func TestReadRange(t *testing.T) {
+	is := is.New(t)
+	s3 := newFakeS3()
+	defer s3.server.Close()
+	local := NewLocalObjectStore(t.TempDir())
+	for _, objectStore := range []ReadableStore{s3.objectStore(), local} {
+		is.NoErr(objectStore.Put("ads/creative/video.mp4", strings.NewReader("ftypmoovmoof"), 12, "video/mp4"))
+		data, err := objectStore.ReadRange("ads/creative/video.mp4", 4, 4)
+		is.NoErr(err)
+		is.Equal(string(data), "moov")
+		// Shorter at the end of the object
+		data, err = objectStore.ReadRange("ads/creative/video.mp4", 8, 16)
+		is.NoErr(err)
+		is.Equal(string(data), "moof")
+		size, err := objectStore.Size("ads/creative/video.mp4")
+		is.NoErr(err)
+		is.Equal(size, int64(12))
+		_, err = objectStore.Size("ads/creative/missing.mp4")
+		is.True(err != nil)
+	}
+}
+
+func TestLocalPut(t *testing.T) {
+	is := is.New(t)
+	root := t.TempDir()
+	objectStore := NewLocalObjectStore(root)
+
+	err := objectStore.Put("ads/creative/index.m3u8", strings.NewReader("#EXTM3U"), 7, "application/x-mpegURL")
+	is.NoErr(err)
+	data, err := os.ReadFile(filepath.Join(root, "ads", "creative", "index.m3u8"))
+	is.NoErr(err)
+	is.Equal(string(data), "#EXTM3U")
+	is.Equal(objectStore.Url("ads/creative/index.m3u8"), "file://"+filepath.Join(root, "ads/creative/index.m3u8"))
+
+	// Keys can not escape the root
+	err = objectStore.Put("../../escaped.m3u8", strings.NewReader("#EXTM3U"), 7, "application/x-mpegURL")
+	is.NoErr(err)
+	_, err = os.Stat(filepath.Join(root, "escaped.m3u8"))
+	is.NoErr(err)
+}
+
+func TestMirror(t *testing.T) {
+	is := is.New(t)
+	s3 := newFakeS3()
+	defer s3.server.Close()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ads/alvedon-10s.mp4" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		_, _ = w.Write([]byte("not really an mp4"))
+	}))
+	defer source.Close()
+	bucketUrl, _ := url.Parse("s3://test-bucket/transcoded")
+	mirror := NewSourceMirror(&http.Client{}, s3.objectStore(), *bucketUrl)
+
+	copyUrl, err := mirror.Mirror("alvedon10s", source.URL+"/ads/alvedon-10s.mp4?signature=abc")
+	is.NoErr(err)
+	is.Equal(copyUrl, "s3://test-bucket/transcoded/alvedon10s/source/alvedon-10s.mp4")
+	is.Equal(string(s3.objects["test-bucket/transcoded/alvedon10s/source/alvedon-10s.mp4"]), "not really an mp4")
+	is.Equal(s3.contentTypes["test-bucket/transcoded/alvedon10s/source/alvedon-10s.mp4"], "video/mp4")
+
+	_, err = mirror.Mirror("expired", source.URL+"/ads/expired.mp4")
+	is.True(err != nil)
+}
+
+func TestSourceKey(t *testing.T) {
+	is := is.New(t)
+	bucketUrl, _ := url.Parse("s3://test-bucket/")
+	mirror := NewSourceMirror(&http.Client{}, nil, *bucketUrl)
+	is.Equal(mirror.SourceKey("abc", "https://cdn.example.com/ads/my ad.mp4"), "abc/source/myad.mp4")
+	is.Equal(mirror.SourceKey("abc", "https://cdn.example.com/"), "abc/source/source")
+}
+
+func TestDeletePrefix(t *testing.T) {
+	is := is.New(t)
+	s3 := newFakeS3()
+	defer s3.server.Close()
+	objectStore := s3.objectStore()
+	for _, key := range []string{"ads/a/job1/index.m3u8", "ads/a/job1/video.mp4", "ads/a/job2/index.m3u8", "ads/b/job3/index.m3u8"} {
+		is.NoErr(objectStore.Put(key, strings.NewReader("data"), 4, "application/octet-stream"))
+	}
+
+	prefixes, err := objectStore.ListPrefixes("ads/")
+	is.NoErr(err)
+	is.Equal(prefixes, []string{"ads/a/", "ads/b/"})
+	lastModified, err := objectStore.LastModified("ads/a/")
+	is.NoErr(err)
+	is.True(time.Since(lastModified) < time.Minute)
+
+	is.NoErr(objectStore.DeletePrefix("ads/a/job1/"))
+	is.Equal(len(s3.objects), 2)
+	_, found := s3.objects["test-bucket/ads/a/job2/index.m3u8"]
+	is.True(found)
+
+	lastModified, err = objectStore.LastModified("ads/c/")
+	is.NoErr(err)
+	is.True(lastModified.IsZero())
+}
+
+func TestAssetCleaner(t *testing.T) {
+	is := is.New(t)
+	root := t.TempDir()
+	objectStore := NewLocalObjectStore(root)
+	for _, key := range []string{"ads/a/job1/index.m3u8", "ads/a/source/ad.mp4", "ads/b/job2/index.m3u8"} {
+		is.NoErr(objectStore.Put(key, strings.NewReader("data"), 4, "application/octet-stream"))
+	}
+	bucketUrl, _ := url.Parse("s3://test-bucket/ads")
+	cleaner := NewAssetCleaner(objectStore, *bucketUrl)
+
+	creativeIds, err := cleaner.CreativeIds()
+	is.NoErr(err)
+	is.Equal(creativeIds, []string{"a", "b"})
+	jobFolders, err := cleaner.JobFolders("a")
+	is.NoErr(err)
+	is.Equal(jobFolders, []string{"ads/a/job1/"}) // the source is not a job folder
+
+	// Folders outside of a creative folder are not removed
+	is.True(cleaner.RemoveFolder("s3://test-bucket/ads/") != nil)
+	is.True(cleaner.RemoveFolder("s3://test-bucket/ads/a/") != nil)
+	is.True(cleaner.RemoveFolder("s3://test-bucket/other/a/job1/") != nil)
+	is.True(cleaner.RemoveCreative("") != nil)
+
+	is.NoErr(cleaner.RemoveFolder("s3://test-bucket/ads/a/job1/"))
+	_, err = os.Stat(filepath.Join(root, "ads/a/job1"))
+	is.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(root, "ads/a/source/ad.mp4"))
+	is.NoErr(err)
+
+	is.NoErr(cleaner.RemoveCreative("a"))
+	creativeIds, err = cleaner.CreativeIds()
+	is.NoErr(err)
+	is.Equal(creativeIds, []string{"b"})
+}
+
+func TestAssetCleanerBucketRoot(t *testing.T) {
+	is := is.New(t)
+	root := t.TempDir()
+	objectStore := NewLocalObjectStore(root)
+	for _, key := range []string{"creative/job/index.m3u8", "other-service/data.json"} {
+		is.NoErr(objectStore.Put(key, strings.NewReader("data"), 4, "application/octet-stream"))
+	}
+	bucketUrl, _ := url.Parse("s3://test-bucket/")
+	cleaner := NewAssetCleaner(objectStore, *bucketUrl)
+
+	// Other folders in the bucket can not be told apart from creative folders
+	is.True(!cleaner.CanSweep())
+	_, err := cleaner.CreativeIds()
+	is.True(errors.Is(err, ErrNoSweepPrefix))
+	// Assets of known creatives can still be removed
+	is.NoErr(cleaner.RemoveFolder("s3://test-bucket/creative/job/"))
+	_, err = os.Stat(filepath.Join(root, "other-service/data.json"))
+	is.NoErr(err)
+}
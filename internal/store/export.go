@@ -0,0 +1,264 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Types of the records of an export
+const (
+	EXPORT_CREATIVE      = "creative"
+	EXPORT_BLACKLIST     = "blacklist"
+	EXPORT_PACKAGING_JOB = "packagingJob"
+)
+
+// How an import treats records that already exist in the store
+const (
+	// Existing records are kept, only new ones are added
+	IMPORT_MERGE = "merge"
+	// Imported records replace existing ones
+	IMPORT_OVERWRITE = "overwrite"
+)
+
+// Number of blacklist entries read per page during an export
+const exportPageSize = 500
+
+// Longest line accepted by an import
+const maxExportRecordSize = 1024 * 1024
+
+// ErrInvalidRecord is returned by Import for lines that are not a valid export record
+var ErrInvalidRecord = errors.New("invalid export record")
+
+// A line of an export, with the field of its type set
+type ExportRecord struct {
+	Type string `json:"type"`
+	// Key of the creative
+	Key      string                   `json:"key,omitempty"`
+	Creative *structure.TranscodeInfo `json:"creative,omitempty"`
+	// When the creative expires in unix milliseconds, 0 if it does not expire
+	ExpiresAt    int64                        `json:"expiresAt,omitempty"`
+	Blacklist    *structure.BlacklistEntry    `json:"blacklist,omitempty"`
+	PackagingJob *structure.PackagingJobState `json:"packagingJob,omitempty"`
+}
+
+type ImportOptions struct {
+	// IMPORT_MERGE or IMPORT_OVERWRITE
+	Mode string
+	// Queue and timeout of the imported packaging jobs
+	PackagingQueue   string
+	PackagingTimeout time.Duration
+	// Output bucket of the importing deployment, f.ex. s3://bucket/ads. Creatives that are not completed,
+	// and their packaging jobs, are only imported if their output folder is in it.
+	OutputBucket string
+}
+
+// Number of records imported and skipped, by type
+type ImportResult struct {
+	Creatives     int `json:"creatives"`
+	Blacklist     int `json:"blacklist"`
+	PackagingJobs int `json:"packagingJobs"`
+	Skipped       int `json:"skipped"`
+}
+
+// Export writes all creatives, blacklist entries and tracked packaging jobs of the store
+// to w as NDJSON, one ExportRecord per line. It stops when the context is done.
+func Export(ctx context.Context, s Store, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	err := s.ExportCreatives(ctx, func(key string, value structure.TranscodeInfo, expiresAt int64) error {
+		return encoder.Encode(ExportRecord{Type: EXPORT_CREATIVE, Key: key, Creative: &value, ExpiresAt: expiresAt})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export creatives: %w", err)
+	}
+	for page := 0; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("failed to export blacklist: %w", err)
+		}
+		entries, _, err := s.GetBlackList(page, exportPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to export blacklist: %w", err)
+		}
+		for _, entry := range entries {
+			if err := encoder.Encode(ExportRecord{Type: EXPORT_BLACKLIST, Blacklist: &entry}); err != nil {
+				return fmt.Errorf("failed to export blacklist: %w", err)
+			}
+		}
+		if len(entries) < exportPageSize {
+			break
+		}
+	}
+	states, err := s.GetPackagingJobs()
+	if err != nil {
+		return fmt.Errorf("failed to export packaging jobs: %w", err)
+	}
+	for _, state := range states {
+		if err := encoder.Encode(ExportRecord{Type: EXPORT_PACKAGING_JOB, PackagingJob: &state}); err != nil {
+			return fmt.Errorf("failed to export packaging jobs: %w", err)
+		}
+	}
+	return nil
+}
+
+// Import reads the NDJSON written by Export into the store. Creatives that are not completed are skipped,
+// unless their output folder is in the output bucket of this deployment, so that an import from another
+// deployment does not take over its jobs. The packaging jobs of the imported creatives are queued again,
+// since the packager may never report back. They are skipped by stores without a packaging queue.
+// Creatives that expired since the export are skipped. Records of the store that are not in the import
+// are left as they are. Import stops at the first invalid line, keeping the records before it.
+func Import(s Store, r io.Reader, options ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	if options.Mode != IMPORT_MERGE && options.Mode != IMPORT_OVERWRITE {
+		return result, fmt.Errorf("unsupported import mode %s", options.Mode)
+	}
+	var trackedJobs map[string]bool
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxExportRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record ExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return result, fmt.Errorf("%w on line %d: %w", ErrInvalidRecord, line, err)
+		}
+		var imported bool
+		var err error
+		switch {
+		case record.Type == EXPORT_CREATIVE && record.Key != "" && record.Creative != nil:
+			imported, err = importCreative(s, record, options)
+			if imported {
+				result.Creatives++
+			}
+		case record.Type == EXPORT_BLACKLIST && record.Blacklist != nil && record.Blacklist.MediaUrl != "":
+			imported, err = importBlacklistEntry(s, *record.Blacklist, options.Mode)
+			if imported {
+				result.Blacklist++
+			}
+		case record.Type == EXPORT_PACKAGING_JOB && record.PackagingJob != nil && record.PackagingJob.CreativeId != "":
+			if trackedJobs == nil {
+				trackedJobs, err = trackedPackagingJobs(s)
+				if err != nil {
+					return result, err
+				}
+			}
+			imported, err = importPackagingJob(s, *record.PackagingJob, options, trackedJobs)
+			if imported {
+				result.PackagingJobs++
+			}
+		default:
+			return result, fmt.Errorf("%w on line %d: unknown or incomplete record of type %q",
+				ErrInvalidRecord, line, record.Type)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to import line %d: %w", line, err)
+		}
+		if !imported {
+			result.Skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("failed to read import: %w", err)
+	}
+	return result, nil
+}
+
+// Whether the output folder of a job is in the output bucket, f.ex. s3://bucket/ads/creative/job in s3://bucket/ads
+func inOutputBucket(outputFolder string, outputBucket string) bool {
+	outputBucket = strings.TrimSuffix(outputBucket, "/")
+	return outputBucket != "" && strings.HasPrefix(outputFolder, outputBucket+"/")
+}
+
+func importCreative(s Store, record ExportRecord, options ImportOptions) (bool, error) {
+	if record.Creative.Status != "COMPLETED" && !inOutputBucket(record.Creative.OutputFolder, options.OutputBucket) {
+		// The job belongs to another deployment, the creative is transcoded again when it is requested
+		return false, nil
+	}
+	var ttl []int64
+	if record.ExpiresAt != 0 {
+		remaining := time.Until(time.UnixMilli(record.ExpiresAt))
+		if remaining < time.Second {
+			return false, nil
+		}
+		ttl = append(ttl, int64(remaining.Seconds()))
+	}
+	if options.Mode == IMPORT_MERGE {
+		_, found, err := s.Get(record.Key)
+		if err != nil || found {
+			return false, err
+		}
+	}
+	if err := s.Set(record.Key, *record.Creative, ttl...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func importBlacklistEntry(s Store, entry structure.BlacklistEntry, mode string) (bool, error) {
+	if mode == IMPORT_MERGE {
+		found, err := s.InBlackList(entry.MediaUrl)
+		if err != nil || found {
+			return false, err
+		}
+	}
+	timestamp := entry.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixMilli()
+	}
+	if err := s.BlackListAt(entry.MediaUrl, entry.Reason, timestamp); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func trackedPackagingJobs(s Store) (map[string]bool, error) {
+	states, err := s.GetPackagingJobs()
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool, len(states))
+	for _, state := range states {
+		tracked[state.CreativeId] = true
+	}
+	return tracked, nil
+}
+
+func importPackagingJob(
+	s Store,
+	state structure.PackagingJobState,
+	options ImportOptions,
+	tracked map[string]bool,
+) (bool, error) {
+	if options.Mode == IMPORT_MERGE && tracked[state.CreativeId] {
+		return false, nil
+	}
+	// Only the jobs of imported creatives are queued, the creatives are exported before their jobs
+	creative, found, err := s.Get(state.CreativeId)
+	if err != nil {
+		return false, err
+	}
+	if !found || creative.Status != "PACKAGING" || !inOutputBucket(creative.OutputFolder, options.OutputBucket) {
+		return false, nil
+	}
+	err = s.EnqueuePackagingJob(options.PackagingQueue, state.Job)
+	if errors.Is(err, ErrNoPackagingQueue) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// The job is queued again, so it gets a full timeout
+	state.Deadline = time.Now().Add(options.PackagingTimeout).UnixMilli()
+	if err := s.TrackPackagingJob(state); err != nil {
+		return false, err
+	}
+	tracked[state.CreativeId] = true
+	return true, nil
+}
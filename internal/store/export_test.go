@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func exportedStore(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	is := is.New(t)
+	source, _ := newTestMemoryStore(t)
+	is.NoErr(source.Set("completed", structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/a.m3u8"}))
+	is.NoErr(source.Set("packaging", structure.TranscodeInfo{
+		Status:       "PACKAGING",
+		JobId:        "job",
+		OutputFolder: "s3://bucket/ads/packaging/job/",
+	}, 3600))
+	// Transcoded by another deployment
+	is.NoErr(source.Set("queued", structure.TranscodeInfo{
+		Status:       "QUEUED",
+		JobId:        "prod-job",
+		OutputFolder: "s3://prod-bucket/ads/queued/prod-job/",
+	}, 3600))
+	is.NoErr(source.BlackListAt("https://example.com/ad.mp4", "not an ad", 1600000000000))
+	is.NoErr(source.TrackPackagingJob(structure.PackagingJobState{
+		CreativeId: "packaging",
+		Job:        structure.PackagingQueueMessage{JobId: "job", Url: "https://example.com/job/"},
+		Attempts:   1,
+		Deadline:   time.Now().Add(-time.Minute).UnixMilli(),
+	}))
+	var export bytes.Buffer
+	is.NoErr(Export(context.Background(), source, &export))
+	is.Equal(strings.Count(export.String(), "\n"), 5)
+	return &export
+}
+
+func TestExportImport(t *testing.T) {
+	is := is.New(t)
+	export := exportedStore(t)
+	target, _ := newTestSqlStore(t)
+	is.NoErr(target.Set("completed", structure.TranscodeInfo{Status: "FAILED"}))
+
+	result, err := Import(target, bytes.NewReader(export.Bytes()), ImportOptions{
+		Mode:             IMPORT_MERGE,
+		PackagingQueue:   "package",
+		PackagingTimeout: time.Minute,
+		OutputBucket:     "s3://bucket/ads",
+	})
+	is.NoErr(err)
+	is.Equal(result, ImportResult{Creatives: 1, Blacklist: 1, PackagingJobs: 1, Skipped: 2})
+	// Existing creatives are kept when merging
+	value, _, _ := target.Get("completed")
+	is.Equal(value.Status, "FAILED")
+	value, _, _ = target.Get("packaging")
+	is.Equal(value.JobId, "job")
+	ttl, err := target.Ttl("packaging")
+	is.NoErr(err)
+	is.True(ttl > 3500 && ttl <= 3600)
+	// Creatives in flight in another deployment are not taken over
+	_, found, _ := target.Get("queued")
+	is.True(!found)
+	// Blacklist entries keep their timestamp
+	entries, _, err := target.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(entries, []structure.BlacklistEntry{
+		{MediaUrl: "https://example.com/ad.mp4", Reason: "not an ad", Timestamp: 1600000000000},
+	})
+	// Packaging jobs are queued again, with a new deadline
+	jobs, err := target.PopPackagingJobs("package")
+	is.NoErr(err)
+	is.Equal(jobs, []structure.PackagingQueueMessage{{JobId: "job", Url: "https://example.com/job/"}})
+	states, err := target.GetPackagingJobs()
+	is.NoErr(err)
+	is.Equal(len(states), 1)
+	is.Equal(states[0].Attempts, 1)
+	is.True(states[0].Deadline > time.Now().UnixMilli())
+
+	// Without an output bucket, only completed creatives are imported
+	result, err = Import(target, bytes.NewReader(export.Bytes()), ImportOptions{Mode: IMPORT_OVERWRITE})
+	is.NoErr(err)
+	is.Equal(result, ImportResult{Creatives: 1, Blacklist: 1, Skipped: 3})
+	value, _, _ = target.Get("completed")
+	is.Equal(value.Status, "COMPLETED")
+	ttl, err = target.Ttl("completed")
+	is.NoErr(err)
+	is.Equal(ttl, int64(-1))
+}
+
+func TestImportWithoutPackagingQueue(t *testing.T) {
+	is := is.New(t)
+	export := exportedStore(t)
+	target, _ := newTestMemoryStore(t)
+	result, err := Import(target, bytes.NewReader(export.Bytes()), ImportOptions{
+		Mode:             IMPORT_MERGE,
+		PackagingQueue:   "package",
+		PackagingTimeout: time.Minute,
+		OutputBucket:     "s3://bucket/ads",
+	})
+	is.NoErr(err)
+	is.Equal(result, ImportResult{Creatives: 2, Blacklist: 1, Skipped: 2})
+	states, err := target.GetPackagingJobs()
+	is.NoErr(err)
+	is.Equal(len(states), 0)
+}
+
+func TestImportInvalidRecords(t *testing.T) {
+	is := is.New(t)
+	target, _ := newTestMemoryStore(t)
+	expired := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	input := `{"type":"creative","key":"a","creative":{"status":"COMPLETED"}}
+
+{"type":"creative","key":"expired","creative":{"status":"COMPLETED"},"expiresAt":` + expired + `}
+{"type":"webhook"}
+{"type":"creative","key":"b","creative":{"status":"COMPLETED"}}
+`
+	result, err := Import(target, strings.NewReader(input), ImportOptions{Mode: IMPORT_MERGE})
+	is.True(errors.Is(err, ErrInvalidRecord))
+	is.True(strings.Contains(err.Error(), "line 4"))
+	// The records before the invalid line are imported, expired creatives are skipped
+	is.Equal(result, ImportResult{Creatives: 1, Skipped: 1})
+	_, found, _ := target.Get("b")
+	is.True(!found)
+
+	_, err = Import(target, strings.NewReader("{"), ImportOptions{Mode: IMPORT_MERGE})
+	is.True(errors.Is(err, ErrInvalidRecord))
+	_, err = Import(target, strings.NewReader(""), ImportOptions{Mode: "replace"})
+	is.True(err != nil)
+}
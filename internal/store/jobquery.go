@@ -0,0 +1,106 @@
+package store
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Orders of ListJobs, by the time the creatives were created
+const (
+	ORDER_NEWEST = "newest"
+	ORDER_OLDEST = "oldest"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// JobQuery selects a page of creatives for ListJobs. Empty fields do not filter.
+type JobQuery struct {
+	// Statuses of the creatives, any status if empty
+	Statuses []string
+	// Substring of the source URL of the creatives
+	Source    string
+	Subdomain string
+	// Range of the time the creatives were last updated, in unix milliseconds.
+	// UpdatedFrom is inclusive and UpdatedTo exclusive, 0 leaves the range open.
+	UpdatedFrom int64
+	UpdatedTo   int64
+	// ORDER_NEWEST or ORDER_OLDEST, newest first if empty
+	Order string
+	// Cursor returned with the previous page, empty for the first page. Cursors follow the time the
+	// creatives were created, so creatives updated while paging are neither skipped nor repeated.
+	Cursor string
+	Size   int
+}
+
+// Position of a creative in the listing. Creatives created at the same time are ordered by key,
+// so that the position is unique.
+type jobCursor struct {
+	created int64
+	key     string
+}
+
+func encodeJobCursor(created int64, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(created, 10) + ":" + key))
+}
+
+func (q JobQuery) cursor() (*jobCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	created, key, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return nil, ErrInvalidCursor
+	}
+	value, err := strconv.ParseInt(created, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &jobCursor{created: value, key: key}, nil
+}
+
+func (q JobQuery) newestFirst() bool {
+	return q.Order != ORDER_OLDEST
+}
+
+// Compares the positions of two creatives in the order of the query
+func (q JobQuery) compare(aCreated int64, aKey string, bCreated int64, bKey string) int {
+	order := cmp.Or(cmp.Compare(aCreated, bCreated), strings.Compare(aKey, bKey))
+	if q.newestFirst() {
+		return -order
+	}
+	return order
+}
+
+// Whether a creative updated at the given time is in the range of the query
+func (q JobQuery) inRange(updated int64) bool {
+	if q.UpdatedFrom > 0 && updated < q.UpdatedFrom {
+		return false
+	}
+	return q.UpdatedTo == 0 || updated < q.UpdatedTo
+}
+
+// Whether a creative created at the given time comes after the cursor
+func (q JobQuery) after(created int64, key string, cursor *jobCursor) bool {
+	return cursor == nil || q.compare(created, key, cursor.created, cursor.key) > 0
+}
+
+// Whether the creative matches the filters of the query on its fields
+func (q JobQuery) matches(value structure.TranscodeInfo) bool {
+	if len(q.Statuses) > 0 && !slices.Contains(q.Statuses, value.Status) {
+		return false
+	}
+	if q.Source != "" && !strings.Contains(value.Source, q.Source) {
+		return false
+	}
+	return q.Subdomain == "" || q.Subdomain == value.Subdomain
+}
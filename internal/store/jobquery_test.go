@@ -0,0 +1,124 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+// Pages through the creatives selected by the query, and returns their URLs
+func listAllJobs(t *testing.T, s Store, query JobQuery) []string {
+	t.Helper()
+	is := is.New(t)
+	urls := []string{}
+	for range 100 {
+		results, next, err := s.ListJobs(query)
+		is.NoErr(err)
+		is.True(len(results) <= query.Size)
+		for _, result := range results {
+			urls = append(urls, result.Url)
+		}
+		if next == "" {
+			return urls
+		}
+		query.Cursor = next
+	}
+	t.Fatal("listing did not end")
+	return nil
+}
+
+// Checks ListJobs of the store. advance moves the clock of the store forward.
+func testListJobs(t *testing.T, s Store, now func() time.Time, advance func()) {
+	is := is.New(t)
+	var from, to int64
+	for i := range 25 {
+		if i == 10 {
+			from = now().UnixMilli()
+		}
+		if i == 15 {
+			to = now().UnixMilli()
+		}
+		status := "COMPLETED"
+		if i%3 == 0 {
+			status = "FAILED"
+		}
+		subdomain := ""
+		if i%2 == 0 {
+			subdomain = "tenant"
+		}
+		key := fmt.Sprintf("creative-%02d", i)
+		is.NoErr(s.Set(key, structure.TranscodeInfo{
+			Url:       key,
+			Status:    status,
+			Source:    fmt.Sprintf("https://example.com/ad-%d.mp4", i),
+			Subdomain: subdomain,
+		}))
+		advance()
+	}
+
+	// Creatives created while paging are not listed on the following pages, newest first.
+	// Creatives updated while paging keep their position, so they are neither skipped nor repeated.
+	query := JobQuery{Statuses: []string{"FAILED"}, Size: 3}
+	results, next, err := s.ListJobs(query)
+	is.NoErr(err)
+	is.Equal(len(results), 3)
+	is.True(next != "")
+	is.NoErr(s.Set("creative-new", structure.TranscodeInfo{Url: "creative-new", Status: "FAILED"}))
+	for _, i := range []int{21, 12} {
+		key := fmt.Sprintf("creative-%02d", i)
+		stored, _, err := s.Get(key)
+		is.NoErr(err)
+		is.NoErr(s.Set(key, stored))
+	}
+	advance()
+	query.Cursor = next
+	urls := []string{results[0].Url, results[1].Url, results[2].Url}
+	urls = append(urls, listAllJobs(t, s, query)...)
+	is.Equal(urls, []string{
+		"creative-24", "creative-21", "creative-18", "creative-15", "creative-12",
+		"creative-09", "creative-06", "creative-03", "creative-00",
+	})
+
+	urls = listAllJobs(t, s, JobQuery{
+		Statuses:  []string{"FAILED"},
+		Source:    "ad-1",
+		Subdomain: "tenant",
+		Order:     ORDER_OLDEST,
+		Size:      1,
+	})
+	is.Equal(urls, []string{"creative-12", "creative-18"})
+
+	// creative-12 was updated after the range
+	urls = listAllJobs(t, s, JobQuery{UpdatedFrom: from, UpdatedTo: to, Order: ORDER_OLDEST, Size: 2})
+	is.Equal(urls, []string{"creative-10", "creative-11", "creative-13", "creative-14"})
+
+	_, _, err = s.ListJobs(JobQuery{Cursor: "invalid", Size: 1})
+	is.True(errors.Is(err, ErrInvalidCursor))
+}
+
+func TestJobQueryCursor(t *testing.T) {
+	is := is.New(t)
+	cursor, err := JobQuery{Cursor: encodeJobCursor(1700000000000, "creative:with:colons")}.cursor()
+	is.NoErr(err)
+	is.Equal(*cursor, jobCursor{created: 1700000000000, key: "creative:with:colons"})
+
+	for _, invalid := range []string{"!", encodeJobCursor(0, "")[:1], "MTIzNA"} {
+		_, err = JobQuery{Cursor: invalid}.cursor()
+		is.True(errors.Is(err, ErrInvalidCursor))
+	}
+
+	query := JobQuery{UpdatedFrom: 10, UpdatedTo: 20}
+	is.True(query.inRange(10))
+	is.True(!query.inRange(20))
+	is.True(query.after(15, "a", nil))
+	// Newest first, creatives created at the same time by key, descending
+	is.True(query.after(15, "a", &jobCursor{created: 15, key: "b"}))
+	is.True(!query.after(15, "c", &jobCursor{created: 15, key: "b"}))
+	query.Order = ORDER_OLDEST
+	is.True(query.after(15, "c", &jobCursor{created: 15, key: "b"}))
+	is.True(!query.after(14, "c", &jobCursor{created: 15, key: "b"}))
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// Size of the buffer of each event subscriber, events are dropped for subscribers that fall behind
+const localEventBuffer = 64
+
+// Delivers creative events to subscribers in the same process,
+// for stores that have no way of notifying other instances.
+type localEvents struct {
+	mutex       sync.Mutex
+	subscribers map[chan structure.CreativeEvent]struct{}
+}
+
+func (le *localEvents) publish(event structure.CreativeEvent) {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	for subscriber := range le.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			logger.Warn("Dropped creative event for slow subscriber", slog.String("creativeId", event.CreativeId))
+		}
+	}
+}
+
+// Calls the handler for each event published after the subscription, until the context is cancelled
+func (le *localEvents) subscribe(ctx context.Context, handler func(structure.CreativeEvent)) error {
+	events := make(chan structure.CreativeEvent, localEventBuffer)
+	le.mutex.Lock()
+	if le.subscribers == nil {
+		le.subscribers = map[chan structure.CreativeEvent]struct{}{}
+	}
+	le.subscribers[events] = struct{}{}
+	le.mutex.Unlock()
+	defer func() {
+		le.mutex.Lock()
+		delete(le.subscribers, events)
+		le.mutex.Unlock()
+	}()
+	for {
+		select {
+		case event := <-events:
+			handler(event)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (le *localEvents) subscriberCount() int {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return len(le.subscribers)
+}
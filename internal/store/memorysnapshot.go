@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// The state of a MemoryStore as written to the snapshot file. Event subscriptions are not included.
+type memorySnapshot struct {
+	Creatives         map[string]memoryEntry[structure.TranscodeInfo]  `json:"creatives"`
+	TimeIndex         map[string]int64                                 `json:"timeIndex"`
+	CreatedIndex      map[string]int64                                 `json:"createdIndex"`
+	Blacklist         map[string]structure.BlacklistEntry              `json:"blacklist"`
+	PackagingJobs     map[string]structure.PackagingJobState           `json:"packagingJobs"`
+	JobIndex          map[string]memoryEntry[string]                   `json:"jobIndex"`
+	SourceIndex       map[string]memoryEntry[[]string]                 `json:"sourceIndex"`
+	Webhooks          []structure.Webhook                              `json:"webhooks"`
+	WebhookDeliveries []scheduledDelivery                              `json:"webhookDeliveries"`
+	Histories         map[string]memoryEntry[[]structure.HistoryEvent] `json:"histories"`
+}
+
+// Snapshot writes the state of the store to the snapshot file.
+// The file is replaced atomically, so a crash while writing leaves the previous snapshot intact.
+func (ms *MemoryStore) Snapshot() error {
+	if ms.snapshotPath == "" {
+		return errors.New("no snapshot file configured")
+	}
+	ms.mutex.Lock()
+	ms.removeExpired()
+	data, err := json.Marshal(memorySnapshot{
+		Creatives:         ms.creatives,
+		TimeIndex:         ms.timeIndex,
+		CreatedIndex:      ms.createdIndex,
+		Blacklist:         ms.blacklist,
+		PackagingJobs:     ms.packagingJobs,
+		JobIndex:          ms.jobIndex,
+		SourceIndex:       ms.sourceIndex,
+		Webhooks:          ms.webhooks,
+		WebhookDeliveries: ms.webhookDeliveries,
+		Histories:         ms.histories,
+	})
+	ms.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to serialize snapshot: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ms.snapshotPath), filepath.Base(ms.snapshotPath)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ms.snapshotPath); err != nil {
+		return fmt.Errorf("failed to replace snapshot %s: %w", ms.snapshotPath, err)
+	}
+	return nil
+}
+
+// RunSnapshots periodically writes the state of the store to the snapshot file,
+// until the context is cancelled.
+func (ms *MemoryStore) RunSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ms.Snapshot(); err != nil {
+				logger.Error("Failed to snapshot memory store", slog.String("error", err.Error()))
+			}
+		case <-ctx.Done():
+			logger.Info("Stopping memory store snapshots")
+			return
+		}
+	}
+}
+
+func (ms *MemoryStore) loadSnapshot() error {
+	data, err := os.ReadFile(ms.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Info("No memory store snapshot found, starting empty", slog.String("path", ms.snapshotPath))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", ms.snapshotPath, err)
+	}
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to parse snapshot %s: %w", ms.snapshotPath, err)
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if snapshot.Creatives != nil {
+		ms.creatives = snapshot.Creatives
+	}
+	if snapshot.TimeIndex != nil {
+		ms.timeIndex = snapshot.TimeIndex
+	}
+	if snapshot.CreatedIndex != nil {
+		ms.createdIndex = snapshot.CreatedIndex
+	}
+	// Snapshots of earlier releases have no creation times, the last update is the closest
+	for key, updated := range ms.timeIndex {
+		if _, found := ms.createdIndex[key]; !found {
+			ms.createdIndex[key] = updated
+		}
+	}
+	if snapshot.Blacklist != nil {
+		ms.blacklist = snapshot.Blacklist
+	}
+	if snapshot.PackagingJobs != nil {
+		ms.packagingJobs = snapshot.PackagingJobs
+	}
+	if snapshot.JobIndex != nil {
+		ms.jobIndex = snapshot.JobIndex
+	}
+	if snapshot.SourceIndex != nil {
+		ms.sourceIndex = snapshot.SourceIndex
+	}
+	if snapshot.Histories != nil {
+		ms.histories = snapshot.Histories
+	}
+	ms.webhooks = snapshot.Webhooks
+	ms.webhookDeliveries = snapshot.WebhookDeliveries
+	ms.removeExpired()
+	logger.Info("Loaded memory store snapshot",
+		slog.String("path", ms.snapshotPath),
+		slog.Int("creatives", len(ms.creatives)),
+	)
+	return nil
+}
@@ -0,0 +1,592 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// MemoryStore keeps all state in process memory, for single instance deployments without Valkey.
+// Keys expire like their Valkey counterparts, and the state can be snapshotted to a local file
+// to survive restarts. Events are only delivered to subscribers in the same process.
+type MemoryStore struct {
+	mutex             sync.Mutex
+	now               func() time.Time
+	creatives         map[string]memoryEntry[structure.TranscodeInfo]
+	timeIndex         map[string]int64
+	createdIndex      map[string]int64
+	blacklist         map[string]structure.BlacklistEntry
+	packagingJobs     map[string]structure.PackagingJobState
+	jobIndex          map[string]memoryEntry[string]
+	sourceIndex       map[string]memoryEntry[[]string]
+	webhooks          []structure.Webhook
+	webhookDeliveries []scheduledDelivery
+	histories         map[string]memoryEntry[[]structure.HistoryEvent]
+	events            localEvents
+	snapshotPath      string
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// ErrNoPackagingQueue is returned when queueing a packaging job in a store no external packager can read
+var ErrNoPackagingQueue = errors.New("the store has no packaging queue")
+
+type memoryEntry[T any] struct {
+	Value T `json:"value"`
+	// Unix milliseconds, 0 if the entry does not expire
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+type scheduledDelivery struct {
+	Delivery structure.WebhookDelivery `json:"delivery"`
+	Due      int64                     `json:"due"`
+}
+
+type MemoryStoreOption func(*MemoryStore)
+
+// WithSnapshotFile makes the store load its state from the file when created,
+// and write it back with Snapshot.
+func WithSnapshotFile(path string) MemoryStoreOption {
+	return func(ms *MemoryStore) {
+		ms.snapshotPath = path
+	}
+}
+
+func NewMemoryStore(opts ...MemoryStoreOption) (*MemoryStore, error) {
+	ms := &MemoryStore{
+		now:           time.Now,
+		creatives:     map[string]memoryEntry[structure.TranscodeInfo]{},
+		timeIndex:     map[string]int64{},
+		createdIndex:  map[string]int64{},
+		blacklist:     map[string]structure.BlacklistEntry{},
+		packagingJobs: map[string]structure.PackagingJobState{},
+		jobIndex:      map[string]memoryEntry[string]{},
+		sourceIndex:   map[string]memoryEntry[[]string]{},
+		histories:     map[string]memoryEntry[[]structure.HistoryEvent]{},
+	}
+	for _, opt := range opts {
+		opt(ms)
+	}
+	if ms.snapshotPath != "" {
+		if err := ms.loadSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+func (ms *MemoryStore) expiresAt(ttl int64) int64 {
+	return ms.now().Add(time.Duration(ttl) * time.Second).UnixMilli()
+}
+
+func (ms *MemoryStore) expired(expiresAt int64) bool {
+	return expiresAt != 0 && expiresAt <= ms.now().UnixMilli()
+}
+
+// RunExpirySweeps periodically removes the expired creatives, indexes and histories, until the context
+// is cancelled. Expired entries are otherwise only removed when they are read.
+func (ms *MemoryStore) RunExpirySweeps(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ms.mutex.Lock()
+			ms.removeExpired()
+			ms.mutex.Unlock()
+		case <-ctx.Done():
+			logger.Info("Stopping memory store expiry sweeps")
+			return
+		}
+	}
+}
+
+// Must be called with the mutex held
+func (ms *MemoryStore) removeExpired() {
+	for key, entry := range ms.creatives {
+		if ms.expired(entry.ExpiresAt) {
+			delete(ms.creatives, key)
+			delete(ms.timeIndex, key)
+			delete(ms.createdIndex, key)
+		}
+	}
+	for jobId, entry := range ms.jobIndex {
+		if ms.expired(entry.ExpiresAt) {
+			delete(ms.jobIndex, jobId)
+		}
+	}
+	for source, entry := range ms.sourceIndex {
+		if ms.expired(entry.ExpiresAt) {
+			delete(ms.sourceIndex, source)
+		}
+	}
+	for creativeId, entry := range ms.histories {
+		if ms.expired(entry.ExpiresAt) {
+			delete(ms.histories, creativeId)
+		}
+	}
+}
+
+// Returns the creative, removing it if it has expired. Must be called with the mutex held.
+func (ms *MemoryStore) creative(key string) (structure.TranscodeInfo, bool) {
+	entry, found := ms.creatives[key]
+	if !found {
+		return structure.TranscodeInfo{}, false
+	}
+	if ms.expired(entry.ExpiresAt) {
+		delete(ms.creatives, key)
+		return structure.TranscodeInfo{}, false
+	}
+	return entry.Value, true
+}
+
+func (ms *MemoryStore) Get(key string) (structure.TranscodeInfo, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	value, found := ms.creative(key)
+	return value, found, nil
+}
+
+func (ms *MemoryStore) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	values := make(map[string]structure.TranscodeInfo, len(keys))
+	for _, key := range keys {
+		if value, found := ms.creative(key); found {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func (ms *MemoryStore) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.set(key, value, ttl...)
+	return nil
+}
+
+func (ms *MemoryStore) CompareAndSet(
+	key string,
+	expectedStatus string,
+	value structure.TranscodeInfo,
+	ttl ...int64,
+) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	stored, found := ms.creative(key)
+	if !found || stored.Status != expectedStatus {
+		return false, nil
+	}
+	ms.set(key, value, ttl...)
+	return true, nil
+}
+
+// Must be called with the mutex held
+func (ms *MemoryStore) set(key string, value structure.TranscodeInfo, ttl ...int64) {
+	entry := memoryEntry[structure.TranscodeInfo]{Value: value}
+	if len(ttl) > 0 {
+		entry.ExpiresAt = ms.expiresAt(ttl[0])
+	}
+	// A creative that expired is created again
+	if _, found := ms.creative(key); !found || ms.createdIndex[key] == 0 {
+		ms.createdIndex[key] = ms.now().UnixMilli()
+	}
+	ms.creatives[key] = entry
+	ms.timeIndex[key] = ms.now().UnixMilli()
+}
+
+func (ms *MemoryStore) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.creatives, key)
+	delete(ms.timeIndex, key)
+	delete(ms.createdIndex, key)
+	return nil
+}
+
+// DeleteFailed removes the creative, the failure is kept in its history
+func (ms *MemoryStore) DeleteFailed(key string, value structure.TranscodeInfo) error {
+	return ms.Delete(key)
+}
+
+// Ttl returns the remaining time to live of the key in seconds, or -1 if it does not expire
+func (ms *MemoryStore) Ttl(key string) (int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, found := ms.creative(key); !found {
+		return 0, errors.New("key does not exist")
+	}
+	expiresAt := ms.creatives[key].ExpiresAt
+	if expiresAt == 0 {
+		return -1, nil
+	}
+	return (expiresAt - ms.now().UnixMilli()) / 1000, nil
+}
+
+// EnqueuePackagingJob returns ErrNoPackagingQueue, an external packager cannot reach
+// the memory of the normalizer.
+func (ms *MemoryStore) EnqueuePackagingJob(queueName string, packagingJob structure.PackagingQueueMessage) error {
+	return ErrNoPackagingQueue
+}
+
+func (ms *MemoryStore) TrackPackagingJob(state structure.PackagingJobState) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.packagingJobs[state.CreativeId] = state
+	return nil
+}
+
+func (ms *MemoryStore) GetPackagingJob(creativeId string) (structure.PackagingJobState, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	state, found := ms.packagingJobs[creativeId]
+	return state, found, nil
+}
+
+func (ms *MemoryStore) UntrackPackagingJob(creativeId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.packagingJobs, creativeId)
+	return nil
+}
+
+func (ms *MemoryStore) PopTimedOutPackagingJobs(now time.Time) ([]structure.PackagingJobState, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	states := []structure.PackagingJobState{}
+	for creativeId, state := range ms.packagingJobs {
+		if state.Deadline <= now.UnixMilli() {
+			states = append(states, state)
+			delete(ms.packagingJobs, creativeId)
+		}
+	}
+	slices.SortFunc(states, func(a, b structure.PackagingJobState) int {
+		return cmp.Compare(a.Deadline, b.Deadline)
+	})
+	return states, nil
+}
+
+func (ms *MemoryStore) SetJobCreative(jobId string, creativeId string, ttl int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.jobIndex[jobId] = memoryEntry[string]{Value: creativeId, ExpiresAt: ms.expiresAt(ttl)}
+	return nil
+}
+
+func (ms *MemoryStore) GetJobCreative(jobId string) (string, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry, found := ms.jobIndex[jobId]
+	if !found {
+		return "", false, nil
+	}
+	if ms.expired(entry.ExpiresAt) {
+		delete(ms.jobIndex, jobId)
+		return "", false, nil
+	}
+	return entry.Value, true, nil
+}
+
+func (ms *MemoryStore) AddSourceCreative(source string, creativeId string, ttl int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry := ms.sourceIndex[source]
+	if ms.expired(entry.ExpiresAt) {
+		entry.Value = nil
+	}
+	if !slices.Contains(entry.Value, creativeId) {
+		entry.Value = append(entry.Value, creativeId)
+	}
+	entry.ExpiresAt = ms.expiresAt(ttl)
+	ms.sourceIndex[source] = entry
+	return nil
+}
+
+func (ms *MemoryStore) GetSourceCreatives(source string) ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry, found := ms.sourceIndex[source]
+	if !found {
+		return []string{}, nil
+	}
+	if ms.expired(entry.ExpiresAt) {
+		delete(ms.sourceIndex, source)
+		return []string{}, nil
+	}
+	return slices.Clone(entry.Value), nil
+}
+
+func (ms *MemoryStore) AddWebhook(webhook structure.Webhook) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if !slices.Contains(ms.webhooks, webhook) {
+		ms.webhooks = append(ms.webhooks, webhook)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) RemoveWebhook(webhook structure.Webhook) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.webhooks = slices.DeleteFunc(ms.webhooks, func(w structure.Webhook) bool {
+		return w == webhook
+	})
+	return nil
+}
+
+func (ms *MemoryStore) GetWebhooks() ([]structure.Webhook, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return slices.Clone(ms.webhooks), nil
+}
+
+func (ms *MemoryStore) EnqueueWebhookDelivery(delivery structure.WebhookDelivery, due time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.removeWebhookDelivery(delivery.Id)
+	ms.webhookDeliveries = append(ms.webhookDeliveries, scheduledDelivery{Delivery: delivery, Due: due.UnixMilli()})
+	return nil
+}
+
+func (ms *MemoryStore) ClaimDueWebhookDeliveries(
+	now time.Time,
+	claimUntil time.Time,
+	limit int,
+) ([]structure.WebhookDelivery, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	slices.SortStableFunc(ms.webhookDeliveries, func(a, b scheduledDelivery) int {
+		return cmp.Compare(a.Due, b.Due)
+	})
+	deliveries := []structure.WebhookDelivery{}
+	for i := range ms.webhookDeliveries {
+		if len(deliveries) == limit || ms.webhookDeliveries[i].Due > now.UnixMilli() {
+			break
+		}
+		ms.webhookDeliveries[i].Due = claimUntil.UnixMilli()
+		deliveries = append(deliveries, ms.webhookDeliveries[i].Delivery)
+	}
+	return deliveries, nil
+}
+
+func (ms *MemoryStore) RemoveWebhookDelivery(id string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.removeWebhookDelivery(id)
+	return nil
+}
+
+func (ms *MemoryStore) removeWebhookDelivery(id string) {
+	ms.webhookDeliveries = slices.DeleteFunc(ms.webhookDeliveries, func(scheduled scheduledDelivery) bool {
+		return scheduled.Delivery.Id == id
+	})
+}
+
+func (ms *MemoryStore) PublishEvent(event structure.CreativeEvent) error {
+	ms.events.publish(event)
+	return nil
+}
+
+// SubscribeEvents calls the handler for each event published after the subscription,
+// until the context is cancelled.
+func (ms *MemoryStore) SubscribeEvents(ctx context.Context, handler func(structure.CreativeEvent)) error {
+	return ms.events.subscribe(ctx, handler)
+}
+
+func (ms *MemoryStore) BlackList(value string, reason string) error {
+	return ms.BlackListAt(value, reason, ms.now().UnixMilli())
+}
+
+func (ms *MemoryStore) BlackListAt(value string, reason string, timestamp int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry := ms.blacklist[value]
+	entry.MediaUrl = value
+	entry.Timestamp = timestamp
+	if reason != "" {
+		entry.Reason = reason
+	}
+	ms.blacklist[value] = entry
+	logger.Info("Added URL to blacklist", slog.String("key", value), slog.String("reason", reason))
+	return nil
+}
+
+func (ms *MemoryStore) InBlackList(value string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	_, found := ms.blacklist[value]
+	return found, nil
+}
+
+func (ms *MemoryStore) InBlackListMany(values []string) (map[string]bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	blacklisted := make(map[string]bool, len(values))
+	for _, value := range values {
+		_, blacklisted[value] = ms.blacklist[value]
+	}
+	return blacklisted, nil
+}
+
+func (ms *MemoryStore) RemoveFromBlackList(value string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.blacklist, value)
+	logger.Info("Removed URL from blacklist", slog.String("key", value))
+	return nil
+}
+
+// GetBlackList returns a page of the blacklist, most recently added first
+func (ms *MemoryStore) GetBlackList(page int, size int) ([]structure.BlacklistEntry, int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entries := make([]structure.BlacklistEntry, 0, len(ms.blacklist))
+	for _, entry := range ms.blacklist {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b structure.BlacklistEntry) int {
+		return cmp.Or(cmp.Compare(b.Timestamp, a.Timestamp), cmp.Compare(b.MediaUrl, a.MediaUrl))
+	})
+	return paginate(entries, page, size), int64(len(entries)), nil
+}
+
+// List returns a page of the creatives, most recently updated first
+func (ms *MemoryStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	keys := make([]string, 0, len(ms.timeIndex))
+	for key := range ms.timeIndex {
+		if _, found := ms.creative(key); !found {
+			delete(ms.timeIndex, key)
+			delete(ms.createdIndex, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(ms.timeIndex[b], ms.timeIndex[a]), cmp.Compare(b, a))
+	})
+	keys = paginate(keys, page, size)
+	results := make([]structure.TranscodeInfo, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, ms.creatives[key].Value)
+	}
+	return results, int64(len(ms.timeIndex)), nil
+}
+
+// ListJobs returns a page of the creatives selected by the query
+func (ms *MemoryStore) ListJobs(query JobQuery) ([]structure.TranscodeInfo, string, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	keys := []string{}
+	for key, created := range ms.createdIndex {
+		value, found := ms.creative(key)
+		if found && query.inRange(ms.timeIndex[key]) && query.after(created, key, cursor) && query.matches(value) {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return query.compare(ms.createdIndex[a], a, ms.createdIndex[b], b)
+	})
+	var next string
+	if query.Size > 0 && len(keys) > query.Size {
+		keys = keys[:query.Size]
+		last := keys[len(keys)-1]
+		next = encodeJobCursor(ms.createdIndex[last], last)
+	}
+	results := make([]structure.TranscodeInfo, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, ms.creatives[key].Value)
+	}
+	return results, next, nil
+}
+
+// ExportCreatives calls fn with the creatives that have not expired, in no particular order.
+// The creatives are copied first, so that fn may use the store.
+func (ms *MemoryStore) ExportCreatives(
+	ctx context.Context,
+	fn func(key string, value structure.TranscodeInfo, expiresAt int64) error,
+) error {
+	ms.mutex.Lock()
+	creatives := make(map[string]memoryEntry[structure.TranscodeInfo], len(ms.creatives))
+	for key, entry := range ms.creatives {
+		if !ms.expired(entry.ExpiresAt) {
+			creatives[key] = entry
+		}
+	}
+	ms.mutex.Unlock()
+	for key, entry := range creatives {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key, entry.Value, entry.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPackagingJobs returns the tracked packaging jobs, by earliest deadline first
+func (ms *MemoryStore) GetPackagingJobs() ([]structure.PackagingJobState, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	states := make([]structure.PackagingJobState, 0, len(ms.packagingJobs))
+	for _, state := range ms.packagingJobs {
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b structure.PackagingJobState) int {
+		return cmp.Or(cmp.Compare(a.Deadline, b.Deadline), cmp.Compare(a.CreativeId, b.CreativeId))
+	})
+	return states, nil
+}
+
+func paginate[T any](values []T, page int, size int) []T {
+	start := page * size
+	if start < 0 || size <= 0 || start >= len(values) {
+		return values[:0]
+	}
+	return values[start:min(start+size, len(values))]
+}
+
+// AppendHistory adds the event to the history of the creative. Like in Valkey, the history is capped
+// to HISTORY_MAX_EVENTS events and expires HISTORY_TTL after the last event.
+func (ms *MemoryStore) AppendHistory(creativeId string, event structure.HistoryEvent) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry, found := ms.histories[creativeId]
+	if found && ms.expired(entry.ExpiresAt) {
+		entry.Value = nil
+	}
+	history := append(entry.Value, event)
+	if len(history) > HISTORY_MAX_EVENTS {
+		history = history[len(history)-HISTORY_MAX_EVENTS:]
+	}
+	ms.histories[creativeId] = memoryEntry[[]structure.HistoryEvent]{
+		Value:     history,
+		ExpiresAt: ms.expiresAt(int64(HISTORY_TTL.Seconds())),
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetHistory(creativeId string) ([]structure.HistoryEvent, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry, found := ms.histories[creativeId]
+	if !found || ms.expired(entry.ExpiresAt) {
+		delete(ms.histories, creativeId)
+		return []structure.HistoryEvent{}, nil
+	}
+	return slices.Clone(entry.Value), nil
+}
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestMemoryStore(t *testing.T, opts ...MemoryStoreOption) (*MemoryStore, *fakeClock) {
+	t.Helper()
+	store, err := NewMemoryStore(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots are loaded with the wall clock, so the fake clock starts from it
+	clock := &fakeClock{now: time.UnixMilli(time.Now().UnixMilli())}
+	store.now = clock.Now
+	return store, clock
+}
+
+func TestMemoryStore(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	err := store.Set("persisted", structure.TranscodeInfo{Status: "COMPLETED"})
+	is.NoErr(err)
+	err = store.Set("in-flight", structure.TranscodeInfo{Status: "IN_PROGRESS"}, 10)
+	is.NoErr(err)
+
+	value, found, err := store.Get("persisted")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(value.Status, "COMPLETED")
+	ttl, err := store.Ttl("persisted")
+	is.NoErr(err)
+	is.Equal(ttl, int64(-1))
+	ttl, err = store.Ttl("in-flight")
+	is.NoErr(err)
+	is.Equal(ttl, int64(10))
+
+	clock.now = clock.now.Add(11 * time.Second)
+	_, found, err = store.Get("in-flight")
+	is.NoErr(err)
+	is.True(!found)
+	_, err = store.Ttl("in-flight")
+	is.True(err != nil)
+
+	is.NoErr(store.Delete("persisted"))
+	_, found, _ = store.Get("persisted")
+	is.True(!found)
+}
+
+func TestMemoryStoreCompareAndSet(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore(t)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "PACKAGING"}))
+	set, err := store.CompareAndSet("creative", "IN_PROGRESS", structure.TranscodeInfo{Status: "FAILED"})
+	is.NoErr(err)
+	is.True(!set)
+	set, err = store.CompareAndSet("creative", "PACKAGING", structure.TranscodeInfo{Status: "COMPLETED"})
+	is.NoErr(err)
+	is.True(set)
+	value, _, _ := store.Get("creative")
+	is.Equal(value.Status, "COMPLETED")
+	set, _ = store.CompareAndSet("missing", "", structure.TranscodeInfo{Status: "COMPLETED"})
+	is.True(!set)
+}
+
+func TestMemoryStoreGetMany(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	is.NoErr(store.Set("a", structure.TranscodeInfo{Status: "COMPLETED"}))
+	is.NoErr(store.Set("b", structure.TranscodeInfo{Status: "QUEUED"}, 10))
+	clock.now = clock.now.Add(11 * time.Second)
+	values, err := store.GetMany([]string{"a", "b", "c"})
+	is.NoErr(err)
+	is.Equal(values, map[string]structure.TranscodeInfo{"a": {Status: "COMPLETED"}})
+
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", ""))
+	blacklisted, err := store.InBlackListMany([]string{"https://example.com/broken.mp4", "https://example.com/ok.mp4"})
+	is.NoErr(err)
+	is.Equal(blacklisted, map[string]bool{"https://example.com/broken.mp4": true, "https://example.com/ok.mp4": false})
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "QUEUED"}))
+	for i := range HISTORY_MAX_EVENTS + 1 {
+		is.NoErr(store.AppendHistory("creative", structure.HistoryEvent{
+			Timestamp: int64(i),
+			Event:     structure.HistoryProgress,
+			Source:    structure.HistorySourceTranscoder,
+		}))
+	}
+	is.NoErr(store.Delete("creative"))
+
+	// The oldest events are dropped, the history is kept when the creative is removed
+	history, err := store.GetHistory("creative")
+	is.NoErr(err)
+	is.Equal(len(history), HISTORY_MAX_EVENTS)
+	is.Equal(history[0].Timestamp, int64(1))
+
+	clock.now = clock.now.Add(HISTORY_TTL)
+	history, err = store.GetHistory("creative")
+	is.NoErr(err)
+	is.Equal(len(history), 0)
+}
+
+func TestMemoryStoreList(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	_ = store.Set("first", structure.TranscodeInfo{Url: "first"})
+	clock.now = clock.now.Add(time.Second)
+	_ = store.Set("expiring", structure.TranscodeInfo{Url: "expiring"}, 5)
+	clock.now = clock.now.Add(time.Second)
+	_ = store.Set("second", structure.TranscodeInfo{Url: "second"})
+	clock.now = clock.now.Add(time.Second)
+	_ = store.Set("first", structure.TranscodeInfo{Url: "first updated"})
+
+	results, total, err := store.List(0, 2)
+	is.NoErr(err)
+	is.Equal(total, int64(3))
+	is.Equal(len(results), 2)
+	is.Equal(results[0].Url, "first updated")
+	is.Equal(results[1].Url, "second")
+
+	clock.now = clock.now.Add(10 * time.Second)
+	results, total, err = store.List(1, 1)
+	is.NoErr(err)
+	is.Equal(total, int64(2)) // expired keys are not counted
+	is.Equal(results[0].Url, "second")
+
+	results, _, err = store.List(5, 10)
+	is.NoErr(err)
+	is.Equal(len(results), 0)
+}
+
+func TestMemoryStoreListJobs(t *testing.T) {
+	store, clock := newTestMemoryStore(t)
+	testListJobs(t, store, clock.Now, func() { clock.now = clock.now.Add(time.Second) })
+}
+
+func TestMemoryStoreBlackList(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	added := clock.now.UnixMilli()
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", "not found"))
+	clock.now = clock.now.Add(time.Second)
+	is.NoErr(store.BlackList("https://example.com/huge.mp4", ""))
+
+	blacklisted, err := store.InBlackList("https://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(blacklisted)
+	entries, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.Equal(entries[0].MediaUrl, "https://example.com/huge.mp4")
+	is.Equal(entries[1].Reason, "not found")
+	is.Equal(entries[1].Timestamp, added)
+
+	// Blacklisting again without a reason keeps the previous one
+	clock.now = clock.now.Add(time.Second)
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", ""))
+	entries, _, _ = store.GetBlackList(0, 1)
+	is.Equal(entries[0].Reason, "not found")
+
+	is.NoErr(store.RemoveFromBlackList("https://example.com/broken.mp4"))
+	blacklisted, _ = store.InBlackList("https://example.com/broken.mp4")
+	is.True(!blacklisted)
+}
+
+func TestMemoryStorePackagingJobs(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore(t)
+	err := store.EnqueuePackagingJob("package", structure.PackagingQueueMessage{JobId: "job-1"})
+	is.True(errors.Is(err, ErrNoPackagingQueue))
+
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "late", Deadline: 2000}))
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "early", Deadline: 1000}))
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "done", Deadline: 1000}))
+	is.NoErr(store.UntrackPackagingJob("done"))
+	states, err := store.PopTimedOutPackagingJobs(time.UnixMilli(1500))
+	is.NoErr(err)
+	is.Equal(len(states), 1)
+	is.Equal(states[0].CreativeId, "early")
+	states, _ = store.PopTimedOutPackagingJobs(time.UnixMilli(2500))
+	is.Equal(len(states), 1)
+	is.Equal(states[0].CreativeId, "late")
+}
+
+func TestMemoryStoreIndexes(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	is.NoErr(store.SetJobCreative("job-id", "creative", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "creative", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "other", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "other", 60))
+
+	creativeId, found, err := store.GetJobCreative("job-id")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(creativeId, "creative")
+	creativeIds, err := store.GetSourceCreatives("https://example.com/ad.mp4")
+	is.NoErr(err)
+	is.Equal(creativeIds, []string{"creative", "other"})
+
+	clock.now = clock.now.Add(time.Minute)
+	_, found, _ = store.GetJobCreative("job-id")
+	is.True(!found)
+	creativeIds, _ = store.GetSourceCreatives("https://example.com/ad.mp4")
+	is.Equal(len(creativeIds), 0)
+}
+
+func TestMemoryStoreExpirySweeps(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestMemoryStore(t)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS"}, 60))
+	is.NoErr(store.Set("persisted", structure.TranscodeInfo{Status: "COMPLETED"}))
+	is.NoErr(store.SetJobCreative("job-id", "creative", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "creative", 60))
+	is.NoErr(store.AppendHistory("creative", structure.HistoryEvent{Event: "dispatched"}))
+
+	clock.now = clock.now.Add(HISTORY_TTL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.RunExpirySweeps(ctx, time.Millisecond)
+	// Expired entries are removed without being read
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		store.mutex.Lock()
+		remaining := len(store.creatives) + len(store.jobIndex) + len(store.sourceIndex) + len(store.histories)
+		store.mutex.Unlock()
+		if remaining == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	is.Equal(len(store.creatives), 1)
+	is.Equal(len(store.timeIndex), 1)
+	is.Equal(len(store.jobIndex), 0)
+	is.Equal(len(store.sourceIndex), 0)
+	is.Equal(len(store.histories), 0)
+}
+
+func TestMemoryStoreWebhooks(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore(t)
+	webhook := structure.Webhook{Url: "https://hooks.example.com", Subdomain: "demo"}
+	is.NoErr(store.AddWebhook(webhook))
+	is.NoErr(store.AddWebhook(webhook))
+	webhooks, err := store.GetWebhooks()
+	is.NoErr(err)
+	is.Equal(webhooks, []structure.Webhook{webhook})
+	is.NoErr(store.RemoveWebhook(webhook))
+	webhooks, _ = store.GetWebhooks()
+	is.Equal(len(webhooks), 0)
+
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "retry"}, time.UnixMilli(3000)))
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "first"}, time.UnixMilli(1000)))
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "second"}, time.UnixMilli(2000)))
+	deliveries, err := store.ClaimDueWebhookDeliveries(time.UnixMilli(2500), time.UnixMilli(5000), 1)
+	is.NoErr(err)
+	is.Equal(len(deliveries), 1)
+	is.Equal(deliveries[0].Id, "first")
+	deliveries, _ = store.ClaimDueWebhookDeliveries(time.UnixMilli(2500), time.UnixMilli(5000), 10)
+	is.Equal(len(deliveries), 1)
+	is.Equal(deliveries[0].Id, "second")
+
+	// Claimed deliveries are due again when their claim times out, unless removed or rescheduled
+	is.NoErr(store.RemoveWebhookDelivery("first"))
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "second", Attempts: 1}, time.UnixMilli(6000)))
+	deliveries, _ = store.ClaimDueWebhookDeliveries(time.UnixMilli(5000), time.UnixMilli(7000), 10)
+	is.Equal(len(deliveries), 1)
+	is.Equal(deliveries[0].Id, "retry")
+	deliveries, _ = store.ClaimDueWebhookDeliveries(time.UnixMilli(6000), time.UnixMilli(7000), 10)
+	is.Equal(deliveries, []structure.WebhookDelivery{{Id: "second", Attempts: 1}})
+}
+
+func TestMemoryStoreEvents(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestMemoryStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan structure.CreativeEvent, 1)
+	done := make(chan error)
+	go func() {
+		done <- store.SubscribeEvents(ctx, func(event structure.CreativeEvent) {
+			received <- event
+		})
+	}()
+	// Wait for the subscription, events published before it are not delivered
+	for store.events.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	is.NoErr(store.PublishEvent(structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"}))
+	select {
+	case event := <-received:
+		is.Equal(event.CreativeId, "creative")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+	cancel()
+	is.NoErr(<-done)
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	is := is.New(t)
+	snapshotPath := filepath.Join(t.TempDir(), "store.json")
+	store, clock := newTestMemoryStore(t, WithSnapshotFile(snapshotPath))
+	_ = store.Set("persisted", structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/index.m3u8"})
+	_ = store.Set("expiring", structure.TranscodeInfo{Status: "IN_PROGRESS"}, 60)
+	_ = store.BlackList("https://example.com/broken.mp4", "not found")
+	_ = store.SetJobCreative("job-id", "expiring", 60)
+	_ = store.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"})
+	_ = store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "packaging", Deadline: 1000})
+	is.NoErr(store.Snapshot())
+
+	restored, err := NewMemoryStore(WithSnapshotFile(snapshotPath))
+	is.NoErr(err)
+	restored.now = clock.Now
+	value, found, _ := restored.Get("persisted")
+	is.True(found)
+	is.Equal(value.Url, "https://example.com/index.m3u8")
+	_, total, _ := restored.List(0, 10)
+	is.Equal(total, int64(2))
+	blacklisted, _ := restored.InBlackList("https://example.com/broken.mp4")
+	is.True(blacklisted)
+	creativeId, _, _ := restored.GetJobCreative("job-id")
+	is.Equal(creativeId, "expiring")
+	webhooks, _ := restored.GetWebhooks()
+	is.Equal(len(webhooks), 1)
+	states, _ := restored.PopTimedOutPackagingJobs(time.UnixMilli(1000))
+	is.Equal(len(states), 1)
+
+	// TTLs keep running while the service is down
+	clock.now = clock.now.Add(2 * time.Minute)
+	_, found, _ = restored.Get("expiring")
+	is.True(!found)
+
+	_, err = NewMemoryStore(WithSnapshotFile(filepath.Join(t.TempDir(), "missing.json")))
+	is.NoErr(err)
+}
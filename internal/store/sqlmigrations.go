@@ -0,0 +1,288 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+)
+
+// Differences between the supported SQL databases
+type sqlDialect struct {
+	name string
+	// Name of the database/sql driver
+	driver string
+	// Column definition of an auto incremented primary key
+	serial string
+	// Statement serializing migrations between instances, empty if there can only be one instance
+	migrationLock string
+	// Placeholders are numbered, $1, $2... instead of ?
+	numberedPlaceholders bool
+	// Suffix of a SELECT locking the selected rows until the end of the transaction
+	lockRow string
+	// Function returning the position of a substring in a string, 0 if it is not found
+	position string
+}
+
+var sqliteDialect = sqlDialect{
+	name:     "sqlite",
+	driver:   "sqlite",
+	serial:   "INTEGER PRIMARY KEY AUTOINCREMENT",
+	position: "instr",
+}
+
+var postgresDialect = sqlDialect{
+	name:                 "postgres",
+	driver:               "pgx",
+	serial:               "BIGSERIAL PRIMARY KEY",
+	migrationLock:        "SELECT pg_advisory_xact_lock(726564)",
+	numberedPlaceholders: true,
+	lockRow:              " FOR UPDATE",
+	position:             "strpos",
+}
+
+// Rewrites the ? placeholders of the query to the placeholders of the dialect
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	var builder strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// A schema migration. Migrations are applied in order and never changed once released,
+// changes to the schema are made by adding a new migration.
+type sqlMigration struct {
+	version     int
+	description string
+	statements  func(d sqlDialect) []string
+}
+
+// Times are stored as unix milliseconds
+var sqlMigrations = []sqlMigration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: func(d sqlDialect) []string {
+			return []string{
+				`CREATE TABLE creatives (
+					creative_id TEXT PRIMARY KEY,
+					status TEXT NOT NULL,
+					url TEXT NOT NULL DEFAULT '',
+					aspect_ratio TEXT NOT NULL DEFAULT '',
+					frame_rates TEXT NOT NULL DEFAULT '',
+					source TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					job_id TEXT NOT NULL DEFAULT '',
+					output_folder TEXT NOT NULL DEFAULT '',
+					profile TEXT NOT NULL DEFAULT '',
+					progress INTEGER NOT NULL DEFAULT 0,
+					encore_status TEXT NOT NULL DEFAULT '',
+					eta BIGINT NOT NULL DEFAULT 0,
+					subdomain TEXT NOT NULL DEFAULT '',
+					last_update BIGINT NOT NULL DEFAULT 0,
+					created_at BIGINT NOT NULL,
+					updated_at BIGINT NOT NULL,
+					expires_at BIGINT
+				)`,
+				`CREATE INDEX creatives_updated_at ON creatives (updated_at)`,
+				`CREATE INDEX creatives_status ON creatives (status)`,
+				`CREATE INDEX creatives_expires_at ON creatives (expires_at)`,
+				// Status changes of creatives, kept when the creative is deleted or expires
+				`CREATE TABLE creative_history (
+					id ` + d.serial + `,
+					creative_id TEXT NOT NULL,
+					status TEXT NOT NULL,
+					error TEXT NOT NULL DEFAULT '',
+					job_id TEXT NOT NULL DEFAULT '',
+					source TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX creative_history_creative_id ON creative_history (creative_id, created_at)`,
+				`CREATE INDEX creative_history_created_at ON creative_history (created_at)`,
+				`CREATE TABLE blacklist (
+					media_url TEXT PRIMARY KEY,
+					reason TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE TABLE packaging_queue (
+					id ` + d.serial + `,
+					queue_name TEXT NOT NULL,
+					job_id TEXT NOT NULL,
+					url TEXT NOT NULL,
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE TABLE packaging_jobs (
+					creative_id TEXT PRIMARY KEY,
+					job_id TEXT NOT NULL,
+					url TEXT NOT NULL,
+					attempts INTEGER NOT NULL,
+					deadline BIGINT NOT NULL
+				)`,
+				`CREATE INDEX packaging_jobs_deadline ON packaging_jobs (deadline)`,
+				`CREATE TABLE job_index (
+					job_id TEXT PRIMARY KEY,
+					creative_id TEXT NOT NULL,
+					expires_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX job_index_expires_at ON job_index (expires_at)`,
+				`CREATE TABLE source_index (
+					source TEXT NOT NULL,
+					creative_id TEXT NOT NULL,
+					expires_at BIGINT NOT NULL,
+					PRIMARY KEY (source, creative_id)
+				)`,
+				`CREATE INDEX source_index_expires_at ON source_index (expires_at)`,
+				`CREATE TABLE webhooks (
+					url TEXT NOT NULL,
+					subdomain TEXT NOT NULL DEFAULT '',
+					PRIMARY KEY (url, subdomain)
+				)`,
+				`CREATE TABLE webhook_deliveries (
+					id TEXT PRIMARY KEY,
+					delivery TEXT NOT NULL,
+					due BIGINT NOT NULL
+				)`,
+				`CREATE INDEX webhook_deliveries_due ON webhook_deliveries (due)`,
+			}
+		},
+	},
+	{
+		version:     2,
+		description: "creative history events",
+		statements: func(d sqlDialect) []string {
+			return []string{
+				// State changes of creatives with their source and details
+				`CREATE TABLE creative_history_events (
+					id ` + d.serial + `,
+					creative_id TEXT NOT NULL,
+					event TEXT NOT NULL,
+					source TEXT NOT NULL,
+					details TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX creative_history_events_creative_id ON creative_history_events (creative_id, id)`,
+			}
+		},
+	},
+	{
+		version:     3,
+		description: "creative listing index",
+		statements: func(d sqlDialect) []string {
+			return []string{
+				// Pages of creatives with a status, in the order of the cursor of ListJobs
+				`CREATE INDEX creatives_status_updated_at ON creatives (status, updated_at, creative_id)`,
+			}
+		},
+	},
+	{
+		version:     4,
+		description: "creative history events retention",
+		statements: func(d sqlDialect) []string {
+			return []string{
+				// Expired history events are removed on every append
+				`CREATE INDEX creative_history_events_created_at ON creative_history_events (created_at)`,
+			}
+		},
+	},
+	{
+		version:     5,
+		description: "replaced output folder of re-transcoded creatives",
+		statements: func(d sqlDialect) []string {
+			return []string{
+				`ALTER TABLE creatives ADD COLUMN replaced_output_folder TEXT NOT NULL DEFAULT ''`,
+			}
+		},
+	},
+	{
+		version:     6,
+		description: "creative listing by creation time",
+		statements: func(d sqlDialect) []string {
+			return []string{
+				// Pages of creatives, in the order of the cursor of ListJobs
+				`CREATE INDEX creatives_created_at ON creatives (created_at, creative_id)`,
+				`CREATE INDEX creatives_status_created_at ON creatives (status, created_at, creative_id)`,
+			}
+		},
+	},
+}
+
+// Applies the migrations that have not been applied to the database yet, each in its own transaction
+func migrate(ctx context.Context, db *sql.DB, d sqlDialect) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+	for _, migration := range sqlMigrations {
+		if err := applyMigration(ctx, db, d, migration); err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", migration.version, migration.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, d sqlDialect, migration sqlMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if d.migrationLock != "" {
+		if _, err := tx.ExecContext(ctx, d.migrationLock); err != nil {
+			return err
+		}
+	}
+	var applied int
+	err = tx.QueryRowContext(
+		ctx,
+		d.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"),
+		migration.version,
+	).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	for _, statement := range migration.statements(d) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		d.rebind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"),
+		migration.version,
+		migration.description,
+		time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Info("Applied schema migration",
+		slog.Int("version", migration.version),
+		slog.String("description", migration.description),
+	)
+	return nil
+}
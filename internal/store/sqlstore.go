@@ -0,0 +1,1160 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+const creativeColumns = `status, url, aspect_ratio, frame_rates, source, error, job_id, output_folder,
+	replaced_output_folder, profile, progress, encore_status, eta, subdomain, last_update`
+
+// SqlStore keeps the state in a SQL database, SQLite for a single instance or Postgres.
+// Creatives are stored in proper tables, with their status changes in creative_history,
+// so that they can be queried with SQL. The schema is migrated when the store is created.
+type SqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	now     func() time.Time
+	// Events of SQLite stores are only delivered within the instance
+	events localEvents
+}
+
+var _ Store = (*SqlStore)(nil)
+
+// NewSqlStore connects to the database and migrates its schema. The dialect is "sqlite", with the
+// path of the database file as DSN, or "postgres", with a connection URL as DSN.
+func NewSqlStore(dialectName string, dsn string) (*SqlStore, error) {
+	var dialect sqlDialect
+	switch dialectName {
+	case sqliteDialect.name:
+		dialect = sqliteDialect
+	case postgresDialect.name:
+		dialect = postgresDialect
+	default:
+		return nil, fmt.Errorf("unsupported SQL dialect %s", dialectName)
+	}
+	logger.Debug("Connecting to SQL database", slog.String("dialect", dialect.name))
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", dialect.name, err)
+	}
+	if dialect == sqliteDialect {
+		// SQLite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to %s database: %w", dialect.name, err)
+	}
+	if err := migrate(ctx, db, dialect); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SqlStore{
+		db:      db,
+		dialect: dialect,
+		now:     time.Now,
+	}, nil
+}
+
+func (ss *SqlStore) Close() error {
+	return ss.db.Close()
+}
+
+func (ss *SqlStore) exec(query string, args ...any) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return ss.db.ExecContext(ctx, ss.dialect.rebind(query), args...)
+}
+
+// Deletes or updates the row matched by the query, reporting whether this caller was the one to change it.
+// Used to claim queued items when several instances poll the same queue.
+func (ss *SqlStore) claim(query string, args ...any) (bool, error) {
+	result, err := ss.exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return changed > 0, nil
+}
+
+func (ss *SqlStore) Get(key string) (structure.TranscodeInfo, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	row := ss.db.QueryRowContext(
+		ctx,
+		ss.dialect.rebind("SELECT "+creativeColumns+
+			" FROM creatives WHERE creative_id = ? AND (expires_at IS NULL OR expires_at > ?)"),
+		key,
+		ss.now().UnixMilli(),
+	)
+	value, err := scanCreative(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return value, false, nil
+	}
+	if err != nil {
+		return value, false, fmt.Errorf("failed to get creative %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// GetMany returns the stored creatives of the keys with one query
+func (ss *SqlStore) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	values := make(map[string]structure.TranscodeInfo, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := make([]any, 0, len(keys)+1)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, ss.now().UnixMilli())
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT creative_id, "+creativeColumns+" FROM creatives WHERE creative_id IN ("+
+			placeholders(len(keys))+") AND (expires_at IS NULL OR expires_at > ?)"),
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get creatives: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var key string
+		value, err := scanCreative(keyedRow{rows: rows, key: &key})
+		if err != nil {
+			logger.Error("Failed to read creative", slog.String("error", err.Error()))
+			continue
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+// Row with the creative ID before the creative columns
+type keyedRow struct {
+	rows *sql.Rows
+	key  *string
+	// Columns after the creative columns
+	after []any
+}
+
+func (r keyedRow) Scan(dest ...any) error {
+	return r.rows.Scan(append(append([]any{r.key}, dest...), r.after...)...)
+}
+
+// Placeholders for an IN clause with n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func scanCreative(row interface{ Scan(dest ...any) error }) (structure.TranscodeInfo, error) {
+	var value structure.TranscodeInfo
+	var frameRates string
+	err := row.Scan(
+		&value.Status,
+		&value.Url,
+		&value.AspectRatio,
+		&frameRates,
+		&value.Source,
+		&value.Error,
+		&value.JobId,
+		&value.OutputFolder,
+		&value.ReplacedOutputFolder,
+		&value.Profile,
+		&value.Progress,
+		&value.EncoreStatus,
+		&value.Eta,
+		&value.Subdomain,
+		&value.LastUpdate,
+	)
+	if err != nil {
+		return value, err
+	}
+	value.FrameRates, err = parseFrameRates(frameRates)
+	return value, err
+}
+
+// Frame rates are stored comma separated, f.ex. "25,29.97"
+func formatFrameRates(frameRates []float64) string {
+	formatted := make([]string, 0, len(frameRates))
+	for _, frameRate := range frameRates {
+		formatted = append(formatted, strconv.FormatFloat(frameRate, 'f', -1, 64))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func parseFrameRates(frameRates string) ([]float64, error) {
+	if frameRates == "" {
+		return nil, nil
+	}
+	parts := strings.Split(frameRates, ",")
+	parsed := make([]float64, 0, len(parts))
+	for _, part := range parts {
+		frameRate, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame rate %s: %w", part, err)
+		}
+		parsed = append(parsed, frameRate)
+	}
+	return parsed, nil
+}
+
+// Set stores the creative, and records the change in creative_history if the status changed
+func (ss *SqlStore) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
+	_, err := ss.set(key, value, nil, ttl...)
+	return err
+}
+
+func (ss *SqlStore) CompareAndSet(
+	key string,
+	expectedStatus string,
+	value structure.TranscodeInfo,
+	ttl ...int64,
+) (bool, error) {
+	return ss.set(key, value, &expectedStatus, ttl...)
+}
+
+// Upserts the creative and records status changes in the history.
+// If expectedStatus is set, the creative is only updated if it is stored with that status.
+func (ss *SqlStore) set(key string, value structure.TranscodeInfo, expectedStatus *string, ttl ...int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	now := ss.now().UnixMilli()
+	var expiresAt *int64
+	if len(ttl) > 0 {
+		expires := now + ttl[0]*1000
+		expiresAt = &expires
+	}
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to set key %s: %w", key, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var previousStatus string
+	err = tx.QueryRowContext(
+		ctx,
+		ss.dialect.rebind(`SELECT status FROM creatives
+			WHERE creative_id = ? AND (expires_at IS NULL OR expires_at > ?)`+ss.dialect.lockRow),
+		key,
+		now,
+	).Scan(&previousStatus)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("failed to get status of key %s: %w", key, err)
+	}
+	if expectedStatus != nil && (errors.Is(err, sql.ErrNoRows) || previousStatus != *expectedStatus) {
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, ss.dialect.rebind(`INSERT INTO creatives (creative_id, `+creativeColumns+`,
+			created_at, updated_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (creative_id) DO UPDATE SET
+			status = excluded.status,
+			url = excluded.url,
+			aspect_ratio = excluded.aspect_ratio,
+			frame_rates = excluded.frame_rates,
+			source = excluded.source,
+			error = excluded.error,
+			job_id = excluded.job_id,
+			output_folder = excluded.output_folder,
+			replaced_output_folder = excluded.replaced_output_folder,
+			profile = excluded.profile,
+			progress = excluded.progress,
+			encore_status = excluded.encore_status,
+			eta = excluded.eta,
+			subdomain = excluded.subdomain,
+			last_update = excluded.last_update,
+			created_at = CASE WHEN creatives.expires_at IS NOT NULL AND creatives.expires_at <= excluded.updated_at
+				THEN excluded.created_at ELSE creatives.created_at END,
+			updated_at = excluded.updated_at,
+			expires_at = excluded.expires_at`),
+		key,
+		value.Status,
+		value.Url,
+		value.AspectRatio,
+		formatFrameRates(value.FrameRates),
+		value.Source,
+		value.Error,
+		value.JobId,
+		value.OutputFolder,
+		value.ReplacedOutputFolder,
+		value.Profile,
+		value.Progress,
+		value.EncoreStatus,
+		value.Eta,
+		value.Subdomain,
+		value.LastUpdate,
+		now,
+		now,
+		expiresAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to set key %s: %w", key, err)
+	}
+	if value.Status != previousStatus {
+		if err := ss.recordStatus(ctx, tx, key, value, now); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to set key %s: %w", key, err)
+	}
+	// Expired creatives are never read again. Removing them is left out of the transaction,
+	// so that it does not hold the lock on the table while the creative is written.
+	if _, err := ss.exec("DELETE FROM creatives WHERE expires_at <= ?", now); err != nil {
+		logger.Warn("Failed to remove expired creatives", slog.String("error", err.Error()))
+	}
+	return true, nil
+}
+
+// Records the status of the creative in creative_history
+func (ss *SqlStore) recordStatus(
+	ctx context.Context,
+	tx *sql.Tx,
+	key string,
+	value structure.TranscodeInfo,
+	now int64,
+) error {
+	_, err := tx.ExecContext(
+		ctx,
+		ss.dialect.rebind(`INSERT INTO creative_history (creative_id, status, error, job_id, source, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`),
+		key,
+		value.Status,
+		value.Error,
+		value.JobId,
+		value.Source,
+		now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record history of key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Delete removes the creative. Its history is kept.
+func (ss *SqlStore) Delete(key string) error {
+	if _, err := ss.exec("DELETE FROM creatives WHERE creative_id = ?", key); err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	return nil
+}
+
+// DeleteFailed removes the creative, and records the failure in creative_history
+func (ss *SqlStore) DeleteFailed(key string, value structure.TranscodeInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	_, err = tx.ExecContext(ctx, ss.dialect.rebind("DELETE FROM creatives WHERE creative_id = ?"), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	value.Status = "FAILED"
+	if err := ss.recordStatus(ctx, tx, key, value, ss.now().UnixMilli()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Ttl returns the remaining time to live of the key in seconds, or -1 if it does not expire
+func (ss *SqlStore) Ttl(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	now := ss.now().UnixMilli()
+	var expiresAt sql.NullInt64
+	err := ss.db.QueryRowContext(
+		ctx,
+		ss.dialect.rebind(`SELECT expires_at FROM creatives
+			WHERE creative_id = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		key,
+		now,
+	).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errors.New("key does not exist")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get TTL of key %s: %w", key, err)
+	}
+	if !expiresAt.Valid {
+		return -1, nil
+	}
+	return (expiresAt.Int64 - now) / 1000, nil
+}
+
+func (ss *SqlStore) EnqueuePackagingJob(queueName string, packagingJob structure.PackagingQueueMessage) error {
+	_, err := ss.exec(
+		"INSERT INTO packaging_queue (queue_name, job_id, url, created_at) VALUES (?, ?, ?, ?)",
+		queueName,
+		packagingJob.JobId,
+		packagingJob.Url,
+		ss.now().UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue packaging job %s: %w", packagingJob.JobId, err)
+	}
+	return nil
+}
+
+// PopPackagingJobs returns and removes all jobs in the packaging queue, oldest first.
+// The queue is not read by the external packager, it is up to the embedding application to consume it.
+func (ss *SqlStore) PopPackagingJobs(queueName string) ([]structure.PackagingQueueMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT id, job_id, url FROM packaging_queue WHERE queue_name = ? ORDER BY id"),
+		queueName,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packaging jobs: %w", err)
+	}
+	type queuedJob struct {
+		id  int64
+		job structure.PackagingQueueMessage
+	}
+	queued := []queuedJob{}
+	for rows.Next() {
+		var q queuedJob
+		if err := rows.Scan(&q.id, &q.job.JobId, &q.job.Url); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to read packaging job: %w", err)
+		}
+		queued = append(queued, q)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get packaging jobs: %w", err)
+	}
+	jobs := make([]structure.PackagingQueueMessage, 0, len(queued))
+	for _, q := range queued {
+		claimed, err := ss.claim("DELETE FROM packaging_queue WHERE id = ?", q.id)
+		if err != nil {
+			return jobs, fmt.Errorf("failed to claim packaging job %s: %w", q.job.JobId, err)
+		}
+		if claimed {
+			jobs = append(jobs, q.job)
+		}
+	}
+	return jobs, nil
+}
+
+func (ss *SqlStore) TrackPackagingJob(state structure.PackagingJobState) error {
+	_, err := ss.exec(`INSERT INTO packaging_jobs (creative_id, job_id, url, attempts, deadline)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (creative_id) DO UPDATE SET
+			job_id = excluded.job_id,
+			url = excluded.url,
+			attempts = excluded.attempts,
+			deadline = excluded.deadline`,
+		state.CreativeId,
+		state.Job.JobId,
+		state.Job.Url,
+		state.Attempts,
+		state.Deadline,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to track packaging job for %s: %w", state.CreativeId, err)
+	}
+	return nil
+}
+
+func (ss *SqlStore) GetPackagingJob(creativeId string) (structure.PackagingJobState, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var state structure.PackagingJobState
+	err := ss.db.QueryRowContext(
+		ctx,
+		ss.dialect.rebind(
+			"SELECT creative_id, job_id, url, attempts, deadline FROM packaging_jobs WHERE creative_id = ?",
+		),
+		creativeId,
+	).Scan(&state.CreativeId, &state.Job.JobId, &state.Job.Url, &state.Attempts, &state.Deadline)
+	if errors.Is(err, sql.ErrNoRows) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, fmt.Errorf("failed to get packaging job of %s: %w", creativeId, err)
+	}
+	return state, true, nil
+}
+
+func (ss *SqlStore) UntrackPackagingJob(creativeId string) error {
+	if _, err := ss.exec("DELETE FROM packaging_jobs WHERE creative_id = ?", creativeId); err != nil {
+		return fmt.Errorf("failed to untrack packaging job for %s: %w", creativeId, err)
+	}
+	return nil
+}
+
+// PopTimedOutPackagingJobs returns and untracks all packaging jobs with a deadline before now.
+// A job is only returned to one caller, even if several instances poll for timeouts.
+func (ss *SqlStore) PopTimedOutPackagingJobs(now time.Time) ([]structure.PackagingJobState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind(`SELECT creative_id, job_id, url, attempts, deadline
+			FROM packaging_jobs WHERE deadline <= ? ORDER BY deadline`),
+		now.UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timed out packaging jobs: %w", err)
+	}
+	timedOut := []structure.PackagingJobState{}
+	for rows.Next() {
+		var state structure.PackagingJobState
+		err := rows.Scan(&state.CreativeId, &state.Job.JobId, &state.Job.Url, &state.Attempts, &state.Deadline)
+		if err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to read packaging job state: %w", err)
+		}
+		timedOut = append(timedOut, state)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get timed out packaging jobs: %w", err)
+	}
+	states := make([]structure.PackagingJobState, 0, len(timedOut))
+	for _, state := range timedOut {
+		claimed, err := ss.claim(
+			"DELETE FROM packaging_jobs WHERE creative_id = ? AND deadline = ?",
+			state.CreativeId,
+			state.Deadline,
+		)
+		if err != nil {
+			return states, fmt.Errorf("failed to claim timed out packaging job for %s: %w", state.CreativeId, err)
+		}
+		if claimed {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+func (ss *SqlStore) SetJobCreative(jobId string, creativeId string, ttl int64) error {
+	now := ss.now().UnixMilli()
+	_, err := ss.exec(`INSERT INTO job_index (job_id, creative_id, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (job_id) DO UPDATE SET creative_id = excluded.creative_id, expires_at = excluded.expires_at`,
+		jobId,
+		creativeId,
+		now+ttl*1000,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to index job %s: %w", jobId, err)
+	}
+	if _, err := ss.exec("DELETE FROM job_index WHERE expires_at <= ?", now); err != nil {
+		return fmt.Errorf("failed to remove expired jobs from index: %w", err)
+	}
+	return nil
+}
+
+func (ss *SqlStore) GetJobCreative(jobId string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var creativeId string
+	err := ss.db.QueryRowContext(
+		ctx,
+		ss.dialect.rebind("SELECT creative_id FROM job_index WHERE job_id = ? AND expires_at > ?"),
+		jobId,
+		ss.now().UnixMilli(),
+	).Scan(&creativeId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get creative for job %s: %w", jobId, err)
+	}
+	return creativeId, true, nil
+}
+
+// AddSourceCreative indexes the creative ID by source URL. Like in Valkey,
+// the TTL of the whole source is refreshed with each creative.
+func (ss *SqlStore) AddSourceCreative(source string, creativeId string, ttl int64) error {
+	now := ss.now().UnixMilli()
+	expiresAt := now + ttl*1000
+	_, err := ss.exec(`INSERT INTO source_index (source, creative_id, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (source, creative_id) DO UPDATE SET expires_at = excluded.expires_at`,
+		source,
+		creativeId,
+		expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to index source %s: %w", source, err)
+	}
+	if _, err := ss.exec("UPDATE source_index SET expires_at = ? WHERE source = ? AND expires_at > ?",
+		expiresAt, source, now); err != nil {
+		return fmt.Errorf("failed to index source %s: %w", source, err)
+	}
+	if _, err := ss.exec("DELETE FROM source_index WHERE expires_at <= ?", now); err != nil {
+		return fmt.Errorf("failed to remove expired sources from index: %w", err)
+	}
+	return nil
+}
+
+func (ss *SqlStore) GetSourceCreatives(source string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind(`SELECT creative_id FROM source_index
+			WHERE source = ? AND expires_at > ? ORDER BY creative_id`),
+		source,
+		ss.now().UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get creatives for source %s: %w", source, err)
+	}
+	defer func() { _ = rows.Close() }()
+	creativeIds := []string{}
+	for rows.Next() {
+		var creativeId string
+		if err := rows.Scan(&creativeId); err != nil {
+			return nil, fmt.Errorf("failed to get creatives for source %s: %w", source, err)
+		}
+		creativeIds = append(creativeIds, creativeId)
+	}
+	return creativeIds, rows.Err()
+}
+
+func (ss *SqlStore) AddWebhook(webhook structure.Webhook) error {
+	_, err := ss.exec(
+		"INSERT INTO webhooks (url, subdomain) VALUES (?, ?) ON CONFLICT (url, subdomain) DO NOTHING",
+		webhook.Url,
+		webhook.Subdomain,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add webhook %s: %w", webhook.Url, err)
+	}
+	return nil
+}
+
+func (ss *SqlStore) RemoveWebhook(webhook structure.Webhook) error {
+	_, err := ss.exec("DELETE FROM webhooks WHERE url = ? AND subdomain = ?", webhook.Url, webhook.Subdomain)
+	if err != nil {
+		return fmt.Errorf("failed to remove webhook %s: %w", webhook.Url, err)
+	}
+	return nil
+}
+
+func (ss *SqlStore) GetWebhooks() ([]structure.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(ctx, "SELECT url, subdomain FROM webhooks ORDER BY url, subdomain")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	webhooks := []structure.Webhook{}
+	for rows.Next() {
+		var webhook structure.Webhook
+		if err := rows.Scan(&webhook.Url, &webhook.Subdomain); err != nil {
+			return nil, fmt.Errorf("failed to get webhooks: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (ss *SqlStore) EnqueueWebhookDelivery(delivery structure.WebhookDelivery, due time.Time) error {
+	serializedDelivery, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to serialize webhook delivery %s: %w", delivery.Id, err)
+	}
+	_, err = ss.exec(`INSERT INTO webhook_deliveries (id, delivery, due) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET delivery = excluded.delivery, due = excluded.due`,
+		delivery.Id,
+		string(serializedDelivery),
+		due.UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue webhook delivery %s: %w", delivery.Id, err)
+	}
+	return nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit deliveries that are due, and postpones them to claimUntil.
+// A delivery is only returned to one caller until claimUntil, even if several instances poll the queue.
+func (ss *SqlStore) ClaimDueWebhookDeliveries(
+	now time.Time,
+	claimUntil time.Time,
+	limit int,
+) ([]structure.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT id, delivery FROM webhook_deliveries WHERE due <= ? ORDER BY due LIMIT ?"),
+		now.UnixMilli(),
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due webhook deliveries: %w", err)
+	}
+	serializedDeliveries := map[string]string{}
+	ids := []string{}
+	for rows.Next() {
+		var id, serializedDelivery string
+		if err := rows.Scan(&id, &serializedDelivery); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to read webhook delivery: %w", err)
+		}
+		ids = append(ids, id)
+		serializedDeliveries[id] = serializedDelivery
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get due webhook deliveries: %w", err)
+	}
+	deliveries := make([]structure.WebhookDelivery, 0, len(ids))
+	for _, id := range ids {
+		claimed, err := ss.claim(
+			"UPDATE webhook_deliveries SET due = ? WHERE id = ? AND due <= ?",
+			claimUntil.UnixMilli(),
+			id,
+			now.UnixMilli(),
+		)
+		if err != nil {
+			return deliveries, fmt.Errorf("failed to claim webhook delivery: %w", err)
+		}
+		if !claimed {
+			continue // Claimed by another instance
+		}
+		var delivery structure.WebhookDelivery
+		if err := json.Unmarshal([]byte(serializedDeliveries[id]), &delivery); err != nil {
+			logger.Error("Failed to unmarshal webhook delivery", slog.String("delivery", serializedDeliveries[id]))
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (ss *SqlStore) RemoveWebhookDelivery(id string) error {
+	if _, err := ss.exec("DELETE FROM webhook_deliveries WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to remove webhook delivery %s: %w", id, err)
+	}
+	return nil
+}
+
+// PublishEvent sends the event to all subscribers, using NOTIFY on Postgres
+// and within the instance on SQLite.
+func (ss *SqlStore) PublishEvent(event structure.CreativeEvent) error {
+	if ss.dialect != postgresDialect {
+		ss.events.publish(event)
+		return nil
+	}
+	serializedEvent, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize event for %s: %w", event.CreativeId, err)
+	}
+	if _, err := ss.exec("SELECT pg_notify(?, ?)", EVENTS_CHANNEL, string(serializedEvent)); err != nil {
+		return fmt.Errorf("failed to publish event for %s: %w", event.CreativeId, err)
+	}
+	return nil
+}
+
+// SubscribeEvents calls the handler for each published creative event.
+// Blocks until the context is cancelled or the subscription fails.
+func (ss *SqlStore) SubscribeEvents(ctx context.Context, handler func(structure.CreativeEvent)) error {
+	if ss.dialect != postgresDialect {
+		return ss.events.subscribe(ctx, handler)
+	}
+	// LISTEN on a dedicated connection, it is held until the subscription ends
+	conn, err := ss.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection for event subscription: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	err = conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+EVENTS_CHANNEL); err != nil {
+			return err
+		}
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+			var event structure.CreativeEvent
+			if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+				logger.Error("Failed to unmarshal creative event", slog.String("event", notification.Payload))
+				continue
+			}
+			handler(event)
+		}
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// BlackList adds the value to the blacklist. Blacklisting a value again without a reason keeps the previous one.
+func (ss *SqlStore) BlackList(value string, reason string) error {
+	return ss.BlackListAt(value, reason, ss.now().UnixMilli())
+}
+
+func (ss *SqlStore) BlackListAt(value string, reason string, timestamp int64) error {
+	_, err := ss.exec(`INSERT INTO blacklist (media_url, reason, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (media_url) DO UPDATE SET
+			reason = CASE WHEN excluded.reason = '' THEN blacklist.reason ELSE excluded.reason END,
+			created_at = excluded.created_at`,
+		value,
+		reason,
+		timestamp,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add key %s to blacklist: %w", value, err)
+	}
+	logger.Info("Added URL to blacklist", slog.String("key", value), slog.String("reason", reason))
+	return nil
+}
+
+func (ss *SqlStore) InBlackList(value string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var count int
+	err := ss.db.QueryRowContext(
+		ctx,
+		ss.dialect.rebind("SELECT COUNT(*) FROM blacklist WHERE media_url = ?"),
+		value,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if key %s is in blacklist: %w", value, err)
+	}
+	return count > 0, nil
+}
+
+// InBlackListMany checks all values with one query
+func (ss *SqlStore) InBlackListMany(values []string) (map[string]bool, error) {
+	blacklisted := make(map[string]bool, len(values))
+	if len(values) == 0 {
+		return blacklisted, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := make([]any, 0, len(values))
+	for _, value := range values {
+		blacklisted[value] = false
+		args = append(args, value)
+	}
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT media_url FROM blacklist WHERE media_url IN ("+placeholders(len(values))+")"),
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if keys are in blacklist: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var mediaUrl string
+		if err := rows.Scan(&mediaUrl); err != nil {
+			return nil, fmt.Errorf("failed to read blacklist: %w", err)
+		}
+		blacklisted[mediaUrl] = true
+	}
+	return blacklisted, rows.Err()
+}
+
+func (ss *SqlStore) RemoveFromBlackList(value string) error {
+	if _, err := ss.exec("DELETE FROM blacklist WHERE media_url = ?", value); err != nil {
+		return fmt.Errorf("failed to remove key %s from blacklist: %w", value, err)
+	}
+	logger.Info("Removed URL from blacklist", slog.String("key", value))
+	return nil
+}
+
+// GetBlackList returns a page of the blacklist, most recently added first
+func (ss *SqlStore) GetBlackList(page int, size int) ([]structure.BlacklistEntry, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var cardinality int64
+	if err := ss.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM blacklist").Scan(&cardinality); err != nil {
+		return nil, 0, fmt.Errorf("failed to get cardinality of blacklist: %w", err)
+	}
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind(`SELECT media_url, reason, created_at FROM blacklist
+			ORDER BY created_at DESC, media_url DESC LIMIT ? OFFSET ?`),
+		size,
+		page*size,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get values from blacklist: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	entries := []structure.BlacklistEntry{}
+	for rows.Next() {
+		var entry structure.BlacklistEntry
+		if err := rows.Scan(&entry.MediaUrl, &entry.Reason, &entry.Timestamp); err != nil {
+			return nil, 0, fmt.Errorf("failed to get values from blacklist: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, cardinality, rows.Err()
+}
+
+// List returns a page of the creatives, most recently updated first
+func (ss *SqlStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := ss.now().UnixMilli()
+	var cardinality int64
+	err := ss.db.QueryRowContext(
+		ctx,
+		ss.dialect.rebind("SELECT COUNT(*) FROM creatives WHERE expires_at IS NULL OR expires_at > ?"),
+		now,
+	).Scan(&cardinality)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get cardinality of creatives: %w", err)
+	}
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT "+creativeColumns+` FROM creatives
+			WHERE expires_at IS NULL OR expires_at > ?
+			ORDER BY updated_at DESC, creative_id DESC LIMIT ? OFFSET ?`),
+		now,
+		size,
+		page*size,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list creatives: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	results := []structure.TranscodeInfo{}
+	for rows.Next() {
+		value, err := scanCreative(rows)
+		if err != nil {
+			logger.Error("Failed to read creative", slog.String("error", err.Error()))
+			continue
+		}
+		results = append(results, value)
+	}
+	return results, cardinality, rows.Err()
+}
+
+// ListJobs returns a page of the creatives selected by the query
+func (ss *SqlStore) ListJobs(query JobQuery) ([]structure.TranscodeInfo, string, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conditions := []string{"(expires_at IS NULL OR expires_at > ?)"}
+	args := []any{ss.now().UnixMilli()}
+	if len(query.Statuses) > 0 {
+		conditions = append(conditions, "status IN ("+placeholders(len(query.Statuses))+")")
+		for _, status := range query.Statuses {
+			args = append(args, status)
+		}
+	}
+	if query.Source != "" {
+		conditions = append(conditions, ss.dialect.position+"(source, ?) > 0")
+		args = append(args, query.Source)
+	}
+	if query.Subdomain != "" {
+		conditions = append(conditions, "subdomain = ?")
+		args = append(args, query.Subdomain)
+	}
+	if query.UpdatedFrom > 0 {
+		conditions = append(conditions, "updated_at >= ?")
+		args = append(args, query.UpdatedFrom)
+	}
+	if query.UpdatedTo > 0 {
+		conditions = append(conditions, "updated_at < ?")
+		args = append(args, query.UpdatedTo)
+	}
+	direction, comparison := "DESC", "<"
+	if !query.newestFirst() {
+		direction, comparison = "ASC", ">"
+	}
+	if cursor != nil {
+		conditions = append(
+			conditions,
+			"(created_at "+comparison+" ? OR (created_at = ? AND creative_id "+comparison+" ?))",
+		)
+		args = append(args, cursor.created, cursor.created, cursor.key)
+	}
+	// One more creative than the page is read, to know if there is a next page
+	args = append(args, query.Size+1)
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT creative_id, "+creativeColumns+", created_at FROM creatives WHERE "+
+			strings.Join(conditions, " AND ")+
+			" ORDER BY created_at "+direction+", creative_id "+direction+" LIMIT ?"),
+		args...,
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list creatives: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	results := []structure.TranscodeInfo{}
+	var next string
+	var lastKey string
+	var lastCreated int64
+	for rows.Next() {
+		if len(results) == query.Size {
+			next = encodeJobCursor(lastCreated, lastKey)
+			break
+		}
+		var key string
+		var created int64
+		value, err := scanCreative(keyedRow{rows: rows, key: &key, after: []any{&created}})
+		if err != nil {
+			logger.Error("Failed to read creative", slog.String("error", err.Error()))
+			continue
+		}
+		results = append(results, value)
+		lastKey, lastCreated = key, created
+	}
+	return results, next, rows.Err()
+}
+
+// ExportCreatives calls fn with the creatives that have not expired, oldest first
+func (ss *SqlStore) ExportCreatives(
+	ctx context.Context,
+	fn func(key string, value structure.TranscodeInfo, expiresAt int64) error,
+) error {
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind("SELECT creative_id, "+creativeColumns+`, expires_at FROM creatives
+			WHERE expires_at IS NULL OR expires_at > ? ORDER BY created_at, creative_id`),
+		ss.now().UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to export creatives: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var key string
+		var expiresAt sql.NullInt64
+		value, err := scanCreative(keyedRow{rows: rows, key: &key, after: []any{&expiresAt}})
+		if err != nil {
+			return fmt.Errorf("failed to read creative: %w", err)
+		}
+		if err := fn(key, value, expiresAt.Int64); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetPackagingJobs returns the tracked packaging jobs, by earliest deadline first
+func (ss *SqlStore) GetPackagingJobs() ([]structure.PackagingJobState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(
+		ctx,
+		"SELECT creative_id, job_id, url, attempts, deadline FROM packaging_jobs ORDER BY deadline, creative_id",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packaging jobs: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	states := []structure.PackagingJobState{}
+	for rows.Next() {
+		var state structure.PackagingJobState
+		err := rows.Scan(&state.CreativeId, &state.Job.JobId, &state.Job.Url, &state.Attempts, &state.Deadline)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read packaging job state: %w", err)
+		}
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+// AppendHistory records the event in creative_history_events. Like in Valkey, the history is capped
+// to HISTORY_MAX_EVENTS events of the creative, and events are removed HISTORY_TTL after they happened.
+func (ss *SqlStore) AppendHistory(creativeId string, event structure.HistoryEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return fmt.Errorf("failed to serialize history event of %s: %w", creativeId, err)
+	}
+	_, err = ss.exec(
+		"INSERT INTO creative_history_events (creative_id, event, source, details, created_at) VALUES (?, ?, ?, ?, ?)",
+		creativeId,
+		event.Event,
+		event.Source,
+		string(details),
+		event.Timestamp,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to append history event of %s: %w", creativeId, err)
+	}
+	_, err = ss.exec(`DELETE FROM creative_history_events WHERE creative_id = ? AND id <= (
+			SELECT id FROM creative_history_events WHERE creative_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+		)`,
+		creativeId,
+		creativeId,
+		HISTORY_MAX_EVENTS,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to trim history of %s: %w", creativeId, err)
+	}
+	if _, err := ss.exec("DELETE FROM creative_history_events WHERE created_at <= ?", ss.historyCutoff()); err != nil {
+		return fmt.Errorf("failed to remove expired history events: %w", err)
+	}
+	return nil
+}
+
+// Events that happened at or before the returned unix milliseconds have expired
+func (ss *SqlStore) historyCutoff() int64 {
+	return ss.now().Add(-HISTORY_TTL).UnixMilli()
+}
+
+func (ss *SqlStore) GetHistory(creativeId string) ([]structure.HistoryEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := ss.db.QueryContext(
+		ctx,
+		ss.dialect.rebind(`SELECT event, source, details, created_at FROM creative_history_events
+			WHERE creative_id = ? AND created_at > ? ORDER BY id`),
+		creativeId,
+		ss.historyCutoff(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history of %s: %w", creativeId, err)
+	}
+	defer func() { _ = rows.Close() }()
+	history := []structure.HistoryEvent{}
+	for rows.Next() {
+		var event structure.HistoryEvent
+		var details string
+		if err := rows.Scan(&event.Event, &event.Source, &details, &event.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to read history of %s: %w", creativeId, err)
+		}
+		if err := json.Unmarshal([]byte(details), &event.Details); err != nil {
+			logger.Error("Failed to unmarshal history event details", slog.String("creativeId", creativeId))
+		}
+		history = append(history, event)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,437 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func newTestSqlStore(t *testing.T) (*SqlStore, *fakeClock) {
+	t.Helper()
+	store, err := NewSqlStore("sqlite", filepath.Join(t.TempDir(), "normalizer.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	clock := &fakeClock{now: time.UnixMilli(1700000000000)}
+	store.now = clock.Now
+	return store, clock
+}
+
+func TestSqlStore(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	testData := structure.TranscodeInfo{
+		Url:          "http://example.com/video/index.m3u8",
+		AspectRatio:  "16:9",
+		FrameRates:   []float64{25, 29.97},
+		Status:       "COMPLETED",
+		Source:       "https://example.com/ad.mp4",
+		JobId:        "job-id",
+		OutputFolder: "s3://bucket/creative/job-id/",
+		Progress:     100,
+		Subdomain:    "demo",
+
+		ReplacedOutputFolder: "s3://bucket/creative/old-job-id/",
+	}
+	is.NoErr(store.Set("test-key", testData))
+	retrieved, found, err := store.Get("test-key")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(retrieved, testData)
+	ttl, err := store.Ttl("test-key")
+	is.NoErr(err)
+	is.Equal(ttl, int64(-1))
+
+	is.NoErr(store.Set("in-flight", structure.TranscodeInfo{Status: "IN_PROGRESS"}, 10))
+	ttl, err = store.Ttl("in-flight")
+	is.NoErr(err)
+	is.Equal(ttl, int64(10))
+	clock.now = clock.now.Add(11 * time.Second)
+	_, found, err = store.Get("in-flight")
+	is.NoErr(err)
+	is.True(!found)
+
+	is.NoErr(store.Delete("test-key"))
+	_, found, err = store.Get("test-key")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestSqlStoreHistory(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "QUEUED", JobId: "job-id"}, 60))
+	clock.now = clock.now.Add(time.Second)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS", Progress: 10}, 60))
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS", Progress: 50}, 60))
+	clock.now = clock.now.Add(time.Second)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "FAILED", Error: "invalid input"}, 60))
+	is.NoErr(store.Delete("creative"))
+
+	// Only status changes are recorded, and they are kept when the creative is deleted
+	rows, err := store.db.Query(
+		"SELECT status, error, created_at FROM creative_history WHERE creative_id = ? ORDER BY id",
+		"creative",
+	)
+	is.NoErr(err)
+	defer func() { _ = rows.Close() }()
+	type change struct {
+		status    string
+		err       string
+		createdAt int64
+	}
+	changes := []change{}
+	for rows.Next() {
+		var c change
+		is.NoErr(rows.Scan(&c.status, &c.err, &c.createdAt))
+		changes = append(changes, c)
+	}
+	is.Equal(changes, []change{
+		{"QUEUED", "", 1700000000000},
+		{"IN_PROGRESS", "", 1700000001000},
+		{"FAILED", "invalid input", 1700000002000},
+	})
+}
+
+func TestSqlStoreHistoryEvents(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestSqlStore(t)
+	history, err := store.GetHistory("creative")
+	is.NoErr(err)
+	is.Equal(len(history), 0)
+
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "QUEUED"}, 60))
+	is.NoErr(store.AppendHistory("creative", structure.HistoryEvent{
+		Timestamp: 1700000000000,
+		Event:     structure.HistoryDispatched,
+		Source:    structure.HistorySourceNormalizer,
+		Details:   map[string]string{"jobId": "job-id"},
+	}))
+	is.NoErr(store.AppendHistory("creative", structure.HistoryEvent{
+		Timestamp: 1700000001000,
+		Event:     structure.HistoryDeleted,
+		Source:    structure.HistorySourceApi,
+	}))
+	is.NoErr(store.Delete("creative"))
+
+	history, err = store.GetHistory("creative")
+	is.NoErr(err)
+	is.Equal(history, []structure.HistoryEvent{
+		{
+			Timestamp: 1700000000000,
+			Event:     structure.HistoryDispatched,
+			Source:    structure.HistorySourceNormalizer,
+			Details:   map[string]string{"jobId": "job-id"},
+		},
+		{Timestamp: 1700000001000, Event: structure.HistoryDeleted, Source: structure.HistorySourceApi},
+	})
+}
+
+func TestSqlStoreHistoryRetention(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	start := clock.now.UnixMilli()
+	for i := range HISTORY_MAX_EVENTS + 1 {
+		is.NoErr(store.AppendHistory("creative", structure.HistoryEvent{
+			Timestamp: start + int64(i),
+			Event:     structure.HistoryProgress,
+			Source:    structure.HistorySourceTranscoder,
+		}))
+	}
+
+	// The oldest events are dropped
+	history, err := store.GetHistory("creative")
+	is.NoErr(err)
+	is.Equal(len(history), HISTORY_MAX_EVENTS)
+	is.Equal(history[0].Timestamp, start+1)
+
+	clock.now = clock.now.Add(HISTORY_TTL).Add(time.Second)
+	history, err = store.GetHistory("creative")
+	is.NoErr(err)
+	is.Equal(len(history), 0)
+
+	// Expired events are removed when another event is appended
+	is.NoErr(store.AppendHistory("other", structure.HistoryEvent{
+		Timestamp: clock.now.UnixMilli(),
+		Event:     structure.HistoryDispatched,
+		Source:    structure.HistorySourceNormalizer,
+	}))
+	var events int
+	is.NoErr(store.db.QueryRow("SELECT COUNT(*) FROM creative_history_events").Scan(&events))
+	is.Equal(events, 1)
+}
+
+func TestSqlStoreExport(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", FrameRates: []float64{25}}))
+	is.NoErr(store.Set("expiring", structure.TranscodeInfo{Status: "QUEUED"}, 60))
+	is.NoErr(store.Set("expired", structure.TranscodeInfo{Status: "QUEUED"}, 1))
+	clock.now = clock.now.Add(2 * time.Second)
+
+	type exported struct {
+		key       string
+		value     structure.TranscodeInfo
+		expiresAt int64
+	}
+	creatives := []exported{}
+	err := store.ExportCreatives(context.Background(), func(key string, value structure.TranscodeInfo, expiresAt int64) error {
+		creatives = append(creatives, exported{key, value, expiresAt})
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(creatives, []exported{
+		{"creative", structure.TranscodeInfo{Status: "COMPLETED", FrameRates: []float64{25}}, 0},
+		{"expiring", structure.TranscodeInfo{Status: "QUEUED"}, 1700000060000},
+	})
+
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "later", Deadline: 2000}))
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "sooner", Deadline: 1000}))
+	states, err := store.GetPackagingJobs()
+	is.NoErr(err)
+	is.Equal(len(states), 2)
+	is.Equal(states[0].CreativeId, "sooner")
+	state, found, err := store.GetPackagingJob("later")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(state.Deadline, int64(2000))
+	_, found, err = store.GetPackagingJob("unknown")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestSqlStoreCompareAndSet(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "PACKAGING"}, 10))
+	set, err := store.CompareAndSet("creative", "IN_PROGRESS", structure.TranscodeInfo{Status: "FAILED"})
+	is.NoErr(err)
+	is.True(!set)
+	set, err = store.CompareAndSet("creative", "PACKAGING", structure.TranscodeInfo{Status: "COMPLETED"})
+	is.NoErr(err)
+	is.True(set)
+	value, _, _ := store.Get("creative")
+	is.Equal(value.Status, "COMPLETED")
+
+	// Expired creatives are not updated
+	is.NoErr(store.Set("expiring", structure.TranscodeInfo{Status: "IN_PROGRESS"}, 10))
+	clock.now = clock.now.Add(11 * time.Second)
+	set, _ = store.CompareAndSet("expiring", "IN_PROGRESS", structure.TranscodeInfo{Status: "COMPLETED"})
+	is.True(!set)
+}
+
+func TestSqlStoreGetMany(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	is.NoErr(store.Set("a", structure.TranscodeInfo{Status: "COMPLETED", FrameRates: []float64{25}}))
+	is.NoErr(store.Set("b", structure.TranscodeInfo{Status: "QUEUED"}, 10))
+	clock.now = clock.now.Add(11 * time.Second)
+	values, err := store.GetMany([]string{"a", "b", "c"})
+	is.NoErr(err)
+	is.Equal(len(values), 1)
+	is.Equal(values["a"].Status, "COMPLETED")
+	is.Equal(values["a"].FrameRates, []float64{25})
+	values, err = store.GetMany(nil)
+	is.NoErr(err)
+	is.Equal(len(values), 0)
+
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", ""))
+	blacklisted, err := store.InBlackListMany([]string{"https://example.com/broken.mp4", "https://example.com/ok.mp4"})
+	is.NoErr(err)
+	is.Equal(blacklisted, map[string]bool{"https://example.com/broken.mp4": true, "https://example.com/ok.mp4": false})
+}
+
+func TestSqlStoreList(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	_ = store.Set("first", structure.TranscodeInfo{Url: "first"})
+	clock.now = clock.now.Add(time.Second)
+	_ = store.Set("expiring", structure.TranscodeInfo{Url: "expiring"}, 5)
+	clock.now = clock.now.Add(time.Second)
+	_ = store.Set("second", structure.TranscodeInfo{Url: "second"})
+	clock.now = clock.now.Add(time.Second)
+	_ = store.Set("first", structure.TranscodeInfo{Url: "first updated"})
+
+	results, total, err := store.List(0, 2)
+	is.NoErr(err)
+	is.Equal(total, int64(3))
+	is.Equal(len(results), 2)
+	is.Equal(results[0].Url, "first updated")
+	is.Equal(results[1].Url, "second")
+
+	clock.now = clock.now.Add(10 * time.Second)
+	results, total, err = store.List(1, 1)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.Equal(results[0].Url, "second")
+}
+
+func TestSqlStoreListJobs(t *testing.T) {
+	store, clock := newTestSqlStore(t)
+	testListJobs(t, store, clock.Now, func() { clock.now = clock.now.Add(time.Second) })
+}
+
+func TestSqlStoreBlackList(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", "not found"))
+	clock.now = clock.now.Add(time.Second)
+	is.NoErr(store.BlackList("https://example.com/huge.mp4", ""))
+
+	blacklisted, err := store.InBlackList("https://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(blacklisted)
+	entries, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.Equal(entries[0].MediaUrl, "https://example.com/huge.mp4")
+	is.Equal(entries[1].Reason, "not found")
+	is.Equal(entries[1].Timestamp, int64(1700000000000))
+
+	clock.now = clock.now.Add(time.Second)
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", ""))
+	entries, _, _ = store.GetBlackList(0, 1)
+	is.Equal(entries[0].Reason, "not found")
+
+	is.NoErr(store.RemoveFromBlackList("https://example.com/broken.mp4"))
+	blacklisted, _ = store.InBlackList("https://example.com/broken.mp4")
+	is.True(!blacklisted)
+}
+
+func TestSqlStorePackagingJobs(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestSqlStore(t)
+	is.NoErr(store.EnqueuePackagingJob("package", structure.PackagingQueueMessage{JobId: "job-1", Url: "url-1"}))
+	is.NoErr(store.EnqueuePackagingJob("package", structure.PackagingQueueMessage{JobId: "job-2", Url: "url-2"}))
+	jobs, err := store.PopPackagingJobs("package")
+	is.NoErr(err)
+	is.Equal(jobs, []structure.PackagingQueueMessage{{JobId: "job-1", Url: "url-1"}, {JobId: "job-2", Url: "url-2"}})
+	jobs, _ = store.PopPackagingJobs("package")
+	is.Equal(len(jobs), 0)
+
+	late := structure.PackagingJobState{CreativeId: "late", Job: structure.PackagingQueueMessage{JobId: "job-3"}, Deadline: 2000}
+	is.NoErr(store.TrackPackagingJob(late))
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "early", Attempts: 1, Deadline: 1000}))
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "done", Deadline: 1000}))
+	is.NoErr(store.UntrackPackagingJob("done"))
+	states, err := store.PopTimedOutPackagingJobs(time.UnixMilli(1500))
+	is.NoErr(err)
+	is.Equal(len(states), 1)
+	is.Equal(states[0].CreativeId, "early")
+	is.Equal(states[0].Attempts, 1)
+	states, _ = store.PopTimedOutPackagingJobs(time.UnixMilli(2500))
+	is.Equal(states, []structure.PackagingJobState{late})
+}
+
+func TestSqlStoreIndexes(t *testing.T) {
+	is := is.New(t)
+	store, clock := newTestSqlStore(t)
+	is.NoErr(store.SetJobCreative("job-id", "creative", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "creative", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "other", 60))
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "other", 60))
+
+	creativeId, found, err := store.GetJobCreative("job-id")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(creativeId, "creative")
+	creativeIds, err := store.GetSourceCreatives("https://example.com/ad.mp4")
+	is.NoErr(err)
+	is.Equal(creativeIds, []string{"creative", "other"})
+
+	clock.now = clock.now.Add(time.Minute)
+	_, found, _ = store.GetJobCreative("job-id")
+	is.True(!found)
+	creativeIds, _ = store.GetSourceCreatives("https://example.com/ad.mp4")
+	is.Equal(len(creativeIds), 0)
+}
+
+func TestSqlStoreWebhooks(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestSqlStore(t)
+	webhook := structure.Webhook{Url: "https://hooks.example.com", Subdomain: "demo"}
+	is.NoErr(store.AddWebhook(webhook))
+	is.NoErr(store.AddWebhook(webhook))
+	webhooks, err := store.GetWebhooks()
+	is.NoErr(err)
+	is.Equal(webhooks, []structure.Webhook{webhook})
+	is.NoErr(store.RemoveWebhook(webhook))
+	webhooks, _ = store.GetWebhooks()
+	is.Equal(len(webhooks), 0)
+
+	event := structure.CreativeEvent{Event: structure.EventFailed, CreativeId: "creative"}
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "retry"}, time.UnixMilli(3000)))
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "first", Event: event}, time.UnixMilli(1000)))
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "second"}, time.UnixMilli(2000)))
+	deliveries, err := store.ClaimDueWebhookDeliveries(time.UnixMilli(2500), time.UnixMilli(5000), 1)
+	is.NoErr(err)
+	is.Equal(deliveries, []structure.WebhookDelivery{{Id: "first", Event: event}})
+	deliveries, _ = store.ClaimDueWebhookDeliveries(time.UnixMilli(2500), time.UnixMilli(5000), 10)
+	is.Equal(len(deliveries), 1)
+	is.Equal(deliveries[0].Id, "second")
+
+	// Claimed deliveries are due again when their claim times out, unless removed or rescheduled
+	is.NoErr(store.RemoveWebhookDelivery("first"))
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "second", Attempts: 1}, time.UnixMilli(6000)))
+	deliveries, _ = store.ClaimDueWebhookDeliveries(time.UnixMilli(5000), time.UnixMilli(7000), 10)
+	is.Equal(len(deliveries), 1)
+	is.Equal(deliveries[0].Id, "retry")
+	deliveries, _ = store.ClaimDueWebhookDeliveries(time.UnixMilli(6000), time.UnixMilli(7000), 10)
+	is.Equal(deliveries, []structure.WebhookDelivery{{Id: "second", Attempts: 1}})
+}
+
+func TestSqlStoreEvents(t *testing.T) {
+	is := is.New(t)
+	store, _ := newTestSqlStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan structure.CreativeEvent, 1)
+	done := make(chan error)
+	go func() {
+		done <- store.SubscribeEvents(ctx, func(event structure.CreativeEvent) {
+			received <- event
+		})
+	}()
+	for store.events.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	is.NoErr(store.PublishEvent(structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"}))
+	event := <-received
+	is.Equal(event.CreativeId, "creative")
+	cancel()
+	is.NoErr(<-done)
+}
+
+func TestSqlMigrations(t *testing.T) {
+	is := is.New(t)
+	dbPath := filepath.Join(t.TempDir(), "normalizer.db")
+	store, err := NewSqlStore("sqlite", dbPath)
+	is.NoErr(err)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "COMPLETED"}))
+	is.NoErr(store.Close())
+
+	// Migrations are only applied once, the data is kept
+	store, err = NewSqlStore("sqlite", dbPath)
+	is.NoErr(err)
+	defer func() { _ = store.Close() }()
+	var applied int
+	is.NoErr(store.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied))
+	is.Equal(applied, len(sqlMigrations))
+	_, found, err := store.Get("creative")
+	is.NoErr(err)
+	is.True(found)
+
+	_, err = NewSqlStore("oracle", "")
+	is.True(err != nil)
+}
+
+func TestRebind(t *testing.T) {
+	is := is.New(t)
+	query := "SELECT status FROM creatives WHERE creative_id = ? AND expires_at > ?"
+	is.Equal(sqliteDialect.rebind(query), query)
+	is.Equal(postgresDialect.rebind(query), "SELECT status FROM creatives WHERE creative_id = $1 AND expires_at > $2")
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/valkey-io/valkey-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Prefixes of the cache keys, the cache keys are sent to the other instances to invalidate them
+const cachedCreativePrefix = "creative:"
+const cachedBlacklistPrefix = "blacklist:"
+
+// In-process LRU cache of the Valkey store. Entries are removed when another instance changes them,
+// and expire after the TTL in case an invalidation is lost.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+	// Incremented on each invalidation, so that a value read before an invalidation is not cached after it
+	generation uint64
+	now        func() time.Time
+}
+
+type lruEntry struct {
+	key       string
+	value     any
+	expiresAt time.Time
+}
+
+func newLruCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *lruCache) get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Current generation, to pass to add after reading the value from Valkey
+func (c *lruCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Adds the value, unless the cache has been invalidated since the given generation
+func (c *lruCache) add(key string, value any, generation uint64) {
+	c.addExpiring(key, value, generation, c.ttl)
+}
+
+// Adds the value like add, for at most the given TTL
+func (c *lruCache) addExpiring(key string, value any, generation uint64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &lruEntry{key: key, value: value, expiresAt: c.now().Add(min(ttl, c.ttl))}
+	if element, found := c.entries[key]; found {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+func newCacheRequestCounter() metric.Int64Counter {
+	counter, err := otel.Meter("store").Int64Counter(
+		"store_cache_requests",
+		metric.WithDescription("Number of lookups in the store cache, by cache and result (hit or miss)"),
+	)
+	if err != nil {
+		logger.Error("failed to create cache request counter", slog.String("error", err.Error()))
+	}
+	return counter
+}
+
+// The cache, if it is enabled and invalidations are received. Without invalidations,
+// changes by other instances would not be seen, so the cache is not used.
+func (vs *ValkeyStore) activeCache() *lruCache {
+	if vs.cache == nil || !vs.cacheActive.Load() {
+		return nil
+	}
+	return vs.cache
+}
+
+func (vs *ValkeyStore) countCacheRequest(cache string, hit bool) {
+	if vs.cacheRequests == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	vs.cacheRequests.Add(
+		context.Background(),
+		1,
+		metric.WithAttributes(attribute.String("cache", cache), attribute.String("result", result)),
+	)
+}
+
+// Removes the cache key from the cache of this and all other instances. The invalidation is sent
+// also without a cache, since other instances, or other processes, may have one.
+func (vs *ValkeyStore) invalidate(ctx context.Context, cacheKey string) {
+	if vs.cache != nil {
+		vs.cache.remove(cacheKey)
+	}
+	err := vs.client.Do(
+		ctx,
+		vs.client.B().Publish().Channel(vs.keys.cacheInvalidationsChannel()).Message(cacheKey).Build(),
+	).Error()
+	if err != nil {
+		logger.Error("Failed to publish cache invalidation",
+			slog.String("key", cacheKey),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// RunCacheInvalidation removes the entries changed by other instances from the cache, until the context
+// is cancelled. The cache is only used while the invalidations are received.
+func (vs *ValkeyStore) RunCacheInvalidation(ctx context.Context) {
+	if vs.cache == nil {
+		return
+	}
+	for ctx.Err() == nil {
+		err := vs.receiveInvalidations(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("cache invalidation subscription failed, resubscribing",
+				slog.String("error", err.Error()),
+			)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+	logger.Info("Stopping cache invalidation")
+}
+
+func (vs *ValkeyStore) receiveInvalidations(ctx context.Context) error {
+	dedicated, release := vs.client.Dedicate()
+	defer release()
+	defer vs.cacheActive.Store(false)
+	channel := vs.keys.cacheInvalidationsChannel()
+	closed := dedicated.SetPubSubHooks(valkey.PubSubHooks{
+		OnMessage: func(msg valkey.PubSubMessage) {
+			vs.cache.remove(msg.Message)
+		},
+		OnSubscription: func(s valkey.PubSubSubscription) {
+			if s.Kind == "subscribe" && s.Channel == channel {
+				// Invalidations may have been missed while not subscribed
+				vs.cache.clear()
+				vs.cacheActive.Store(true)
+			}
+		},
+	})
+	if err := dedicated.Do(ctx, dedicated.B().Subscribe().Channel(channel).Build()).Error(); err != nil {
+		return err
+	}
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
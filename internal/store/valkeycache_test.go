@@ -0,0 +1,215 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/matryer/is"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestLruCache(t *testing.T) {
+	is := is.New(t)
+	cache := newLruCache(2, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.add("a", 1, cache.currentGeneration())
+	cache.add("b", 2, cache.currentGeneration())
+	_, found := cache.get("a")
+	is.True(found)
+	// b is the least recently used entry
+	cache.add("c", 3, cache.currentGeneration())
+	_, found = cache.get("b")
+	is.True(!found)
+	value, found := cache.get("c")
+	is.True(found)
+	is.Equal(value, 3)
+
+	// A value read before an invalidation is not cached
+	generation := cache.currentGeneration()
+	cache.remove("a")
+	cache.add("a", 1, generation)
+	_, found = cache.get("a")
+	is.True(!found)
+
+	now = now.Add(time.Minute)
+	_, found = cache.get("c")
+	is.True(!found)
+}
+
+// Waits until the store receives cache invalidations
+func startCacheInvalidation(t *testing.T, store *ValkeyStore) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go store.RunCacheInvalidation(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.activeCache() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("cache invalidation not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func cacheRequests(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				cache, _ := point.Attributes.Value("cache")
+				result, _ := point.Attributes.Value("result")
+				counts[cache.AsString()+" "+result.AsString()] = point.Value
+			}
+		}
+	}
+	return counts
+}
+
+func TestValkeyStoreCache(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://"+mr.Addr(), WithCache(100, time.Minute))
+	is.NoErr(err)
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	store.cacheRequests, _ = provider.Meter("test").Int64Counter("store_cache_requests")
+
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/a.m3u8"}))
+	is.NoErr(store.Set("in-progress", structure.TranscodeInfo{Status: "IN_PROGRESS"}))
+	// Not used before the invalidations are received
+	_, _, err = store.Get("creative")
+	is.NoErr(err)
+	is.Equal(len(cacheRequests(t, reader)), 0)
+
+	startCacheInvalidation(t, store)
+	for range 3 {
+		value, found, err := store.Get("creative")
+		is.NoErr(err)
+		is.True(found)
+		is.Equal(value.Url, "https://example.com/a.m3u8")
+		_, _, err = store.Get("in-progress")
+		is.NoErr(err)
+		blacklisted, err := store.InBlackList("https://example.com/ad.mp4")
+		is.NoErr(err)
+		is.True(!blacklisted)
+	}
+	is.Equal(cacheRequests(t, reader), map[string]int64{
+		"creative hit":   2,
+		"creative miss":  4, // creatives in progress are not cached
+		"blacklist hit":  2,
+		"blacklist miss": 1,
+	})
+
+	// The batch lookups use the same cache
+	values, err := store.GetMany([]string{"creative", "in-progress"})
+	is.NoErr(err)
+	is.Equal(len(values), 2)
+	blacklist, err := store.InBlackListMany([]string{"https://example.com/ad.mp4", "https://example.com/other.mp4"})
+	is.NoErr(err)
+	is.Equal(blacklist, map[string]bool{"https://example.com/ad.mp4": false, "https://example.com/other.mp4": false})
+	counts := cacheRequests(t, reader)
+	is.Equal(counts["creative hit"], int64(3))
+	is.Equal(counts["blacklist hit"], int64(3))
+	is.Equal(counts["blacklist miss"], int64(2))
+
+	// Changes by this instance are seen right away
+	is.NoErr(store.BlackList("https://example.com/ad.mp4", ""))
+	blacklisted, err := store.InBlackList("https://example.com/ad.mp4")
+	is.NoErr(err)
+	is.True(blacklisted)
+	is.NoErr(store.Delete("creative"))
+	_, found, err := store.Get("creative")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestValkeyStoreCacheInvalidation(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://"+mr.Addr(), WithCache(100, time.Minute))
+	is.NoErr(err)
+	other, err := NewValkeyStore("redis://"+mr.Addr(), WithCache(100, time.Minute))
+	is.NoErr(err)
+	startCacheInvalidation(t, store)
+
+	for i := range 5 {
+		key := "creative-" + strconv.Itoa(i)
+		is.NoErr(other.Set(key, structure.TranscodeInfo{Status: "COMPLETED", Url: key}))
+		_, _, err := store.Get(key)
+		is.NoErr(err)
+	}
+	_, err = store.InBlackList("https://example.com/ad.mp4")
+	is.NoErr(err)
+
+	// Changes by other instances are received through the invalidations
+	is.NoErr(other.Set("creative-1", structure.TranscodeInfo{Status: "FAILED"}))
+	is.NoErr(other.Delete("creative-2"))
+	is.NoErr(other.BlackList("https://example.com/ad.mp4", ""))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		value, _, err := store.Get("creative-1")
+		is.NoErr(err)
+		_, found, err := store.Get("creative-2")
+		is.NoErr(err)
+		blacklisted, err := store.InBlackList("https://example.com/ad.mp4")
+		is.NoErr(err)
+		if value.Status == "FAILED" && !found && blacklisted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache not invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	value, found, err := store.Get("creative-3")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(value.Url, "creative-3")
+}
+
+func TestValkeyStoreCacheCompletedOnly(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://"+mr.Addr(), WithCache(100, time.Minute))
+	is.NoErr(err)
+	startCacheInvalidation(t, store)
+
+	// Creatives that are not completed can't be cached, so replacing them sends no invalidation
+	generation := store.cache.currentGeneration()
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "QUEUED"}, 60))
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "IN_PROGRESS"}, 60))
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "COMPLETED"}, 60))
+	is.Equal(store.cache.currentGeneration(), generation)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/a.m3u8"}))
+	is.True(store.cache.currentGeneration() > generation)
+
+	// Completed creatives with a TTL are cached until they expire
+	now := time.Now()
+	store.cache.now = func() time.Time { return now }
+	is.NoErr(store.Set("expiring", structure.TranscodeInfo{Status: "COMPLETED"}, 2))
+	_, found, err := store.Get("expiring")
+	is.NoErr(err)
+	is.True(found)
+	values, err := store.GetMany([]string{"creative"})
+	is.NoErr(err)
+	is.Equal(len(values), 1)
+	_, cached := store.cache.get(cachedCreativePrefix + "expiring")
+	is.True(cached)
+	now = now.Add(3 * time.Second)
+	_, cached = store.cache.get(cachedCreativePrefix + "expiring")
+	is.True(!cached)
+	_, cached = store.cache.get(cachedCreativePrefix + "creative")
+	is.True(cached)
+}
@@ -0,0 +1,339 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/matryer/is"
+	"github.com/valkey-io/valkey-go"
+)
+
+const clusterSlots = 16384
+
+// A Valkey cluster of miniredis nodes. Each node owns a range of the slots, and like a real
+// cluster, redirects commands for keys in other slots with MOVED and rejects commands with
+// keys in several slots with CROSSSLOT.
+type testCluster struct {
+	nodes []*miniredis.Miniredis
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	t.Helper()
+	tc := &testCluster{}
+	for range size {
+		tc.nodes = append(tc.nodes, miniredis.RunT(t))
+	}
+	for i, node := range tc.nodes {
+		node.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+			return tc.handle(i, c, cmd, args)
+		})
+	}
+	return tc
+}
+
+// Url with all nodes of the cluster as init addresses
+func (tc *testCluster) url() string {
+	url := "redis://" + tc.nodes[0].Addr()
+	for i, node := range tc.nodes[1:] {
+		if i == 0 {
+			url += "?addr=" + node.Addr()
+		} else {
+			url += "&addr=" + node.Addr()
+		}
+	}
+	return url
+}
+
+func (tc *testCluster) owner(slot uint16) int {
+	return int(slot) * len(tc.nodes) / clusterSlots
+}
+
+// Node that stores the key
+func (tc *testCluster) node(key string) *miniredis.Miniredis {
+	return tc.nodes[tc.owner(keySlot(key))]
+}
+
+func (tc *testCluster) handle(i int, c *server.Peer, cmd string, args []string) bool {
+	switch cmd {
+	case "CLUSTER":
+		if len(args) > 0 && strings.EqualFold(args[0], "SLOTS") {
+			tc.writeSlots(c)
+			return true
+		}
+		return false
+	case "PUBLISH":
+		// Messages are broadcast to the subscribers on all nodes
+		if len(args) == 2 {
+			for j, node := range tc.nodes {
+				if j != i {
+					node.Publish(args[0], args[1])
+				}
+			}
+		}
+		return false
+	}
+	keys := commandKeys(cmd, args)
+	if len(keys) == 0 {
+		return false
+	}
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			c.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+			return true
+		}
+	}
+	if owner := tc.owner(slot); owner != i {
+		c.WriteError(fmt.Sprintf("MOVED %d %s", slot, tc.nodes[owner].Addr()))
+		return true
+	}
+	return false
+}
+
+func (tc *testCluster) writeSlots(c *server.Peer) {
+	c.WriteLen(len(tc.nodes))
+	for i, node := range tc.nodes {
+		c.WriteLen(3)
+		c.WriteInt(i * clusterSlots / len(tc.nodes))
+		c.WriteInt((i+1)*clusterSlots/len(tc.nodes) - 1)
+		c.WriteLen(3)
+		c.WriteBulk(node.Host())
+		c.WriteInt(node.Server().Addr().Port)
+		c.WriteBulk("node-" + strconv.Itoa(i))
+	}
+}
+
+var keylessCommands = map[string]bool{
+	"AUTH": true, "CLIENT": true, "COMMAND": true, "DBSIZE": true, "DISCARD": true, "ECHO": true,
+	"EXEC": true, "FLUSHALL": true, "FLUSHDB": true, "HELLO": true, "INFO": true, "KEYS": true,
+	"MULTI": true, "PING": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true, "QUIT": true,
+	"READONLY": true, "SCAN": true, "SCRIPT": true, "SELECT": true, "SUBSCRIBE": true, "TIME": true,
+	"UNSUBSCRIBE": true,
+}
+
+// Keys of the commands used by the store
+func commandKeys(cmd string, args []string) []string {
+	switch {
+	case keylessCommands[cmd] || len(args) == 0:
+		return nil
+	case cmd == "MGET" || cmd == "DEL" || cmd == "EXISTS" || cmd == "UNLINK":
+		return args
+	case cmd == "XGROUP":
+		return args[1:min(2, len(args))]
+	case cmd == "EVAL" || cmd == "EVALSHA":
+		if len(args) < 2 {
+			return nil
+		}
+		numKeys, _ := strconv.Atoi(args[1])
+		return args[2:min(2+numKeys, len(args))]
+	default:
+		return args[:1]
+	}
+}
+
+// Slot of the key, only the hash tag is hashed if the key has one
+func keySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % clusterSlots
+}
+
+// CRC16-CCITT (XModem), as used by Valkey for key slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestTestCluster(t *testing.T) {
+	is := is.New(t)
+	is.Equal(crc16("123456789"), uint16(0x31C3))
+	is.Equal(keySlot("{user1000}.following"), keySlot("{user1000}.followers"))
+
+	tc := newTestCluster(t, 3)
+	// A client that does not follow redirects sees the errors of a real cluster
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{tc.nodes[0].Addr()},
+		ForceSingleClient: true,
+		DisableCache:      true,
+	})
+	is.NoErr(err)
+	defer client.Close()
+	ctx := context.Background()
+	key := "creative"
+	for tc.node(key) == tc.nodes[0] {
+		key += "-"
+	}
+	err = client.Do(ctx, client.B().Get().Key(key).Build()).Error()
+	is.True(err != nil && strings.HasPrefix(err.Error(), "MOVED"))
+	err = client.Do(ctx, client.B().Mget().Key("{a}", "{b}").Build()).Error()
+	is.True(err != nil && strings.HasPrefix(err.Error(), "CROSSSLOT"))
+}
+
+func TestValkeyStoreCluster(t *testing.T) {
+	is := is.New(t)
+	tc := newTestCluster(t, 3)
+	store, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+
+	usedNodes := map[*miniredis.Miniredis]bool{}
+	for i := range 20 {
+		key := "creative-" + strconv.Itoa(i)
+		is.NoErr(store.Set(key, structure.TranscodeInfo{Url: key, Status: "COMPLETED"}))
+		usedNodes[tc.node(store.keys.creative(key))] = true
+	}
+	is.Equal(len(usedNodes), 3) // the creatives are spread over the cluster
+	value, found, err := store.Get("creative-3")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(value.Url, "creative-3")
+	values, err := store.GetMany([]string{"creative-1", "creative-2", "creative-7", "unknown"})
+	is.NoErr(err)
+	is.Equal(len(values), 3)
+	set, err := store.CompareAndSet("creative-3", "COMPLETED", structure.TranscodeInfo{Url: "creative-3", Status: "FAILED"}, 60)
+	is.NoErr(err)
+	is.True(set)
+
+	results, total, err := store.List(0, 15)
+	is.NoErr(err)
+	is.Equal(total, int64(20))
+	is.Equal(len(results), 15)
+	is.NoErr(store.Delete("creative-3"))
+	_, found, err = store.Get("creative-3")
+	is.NoErr(err)
+	is.True(!found)
+	tc.node(store.keys.creative("creative-4")).Del(store.keys.creative("creative-4"))
+	pruned, err := store.PruneTimeIndex(context.Background())
+	is.NoErr(err)
+	is.Equal(pruned, int64(1))
+
+	// Keys that are used together are stored on the same node
+	is.Equal(keySlot(store.keys.blacklist()), keySlot(store.keys.blacklistReasons()))
+	is.Equal(keySlot(store.keys.packagingJobs()), keySlot(store.keys.packagingDeadlines()))
+	is.NoErr(store.BlackList("https://example.com/broken.mp4", "not found"))
+	entries, total, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(1))
+	is.Equal(entries[0].Reason, "not found")
+	is.NoErr(store.RemoveFromBlackList("https://example.com/broken.mp4"))
+
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "creative-1", Deadline: 1000}))
+	states, err := store.PopTimedOutPackagingJobs(time.UnixMilli(2000))
+	is.NoErr(err)
+	is.Equal(len(states), 1)
+
+	is.NoErr(store.SetJobCreative("job-id", "creative-1", 60))
+	creativeId, found, err := store.GetJobCreative("job-id")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(creativeId, "creative-1")
+	is.NoErr(store.AddSourceCreative("https://example.com/ad.mp4", "creative-1", 60))
+	creativeIds, err := store.GetSourceCreatives("https://example.com/ad.mp4")
+	is.NoErr(err)
+	is.Equal(creativeIds, []string{"creative-1"})
+
+	is.NoErr(store.AddWebhook(structure.Webhook{Url: "https://hooks.example.com"}))
+	webhooks, err := store.GetWebhooks()
+	is.NoErr(err)
+	is.Equal(len(webhooks), 1)
+	is.NoErr(store.EnqueueWebhookDelivery(structure.WebhookDelivery{Id: "delivery"}, time.UnixMilli(1000)))
+	deliveries, err := store.ClaimDueWebhookDeliveries(time.UnixMilli(2000), time.UnixMilli(3000), 10)
+	is.NoErr(err)
+	is.Equal(len(deliveries), 1)
+	is.NoErr(store.RemoveWebhookDelivery("delivery"))
+	deliveries, err = store.ClaimDueWebhookDeliveries(time.UnixMilli(3000), time.UnixMilli(4000), 10)
+	is.NoErr(err)
+	is.Equal(len(deliveries), 0)
+}
+
+func TestValkeyStoreClusterStreamQueue(t *testing.T) {
+	is := is.New(t)
+	tc := newTestCluster(t, 3)
+	store, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"), WithStreamPackagingQueue("encore-packager"))
+	is.NoErr(err)
+	for _, stream := range []string{"package-a", "package-b", "package-c"} {
+		is.NoErr(store.EnqueuePackagingJob(stream, structure.PackagingQueueMessage{JobId: "job-id"}))
+		key := store.keys.packagingQueue(stream)
+		length, err := store.client.Do(context.Background(), store.client.B().Xlen().Key(key).Build()).AsInt64()
+		is.NoErr(err)
+		is.Equal(length, int64(1))
+		is.True(tc.node(key).Exists(key))
+	}
+}
+
+func TestValkeyStoreClusterEvents(t *testing.T) {
+	is := is.New(t)
+	tc := newTestCluster(t, 3)
+	subscriber, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+	publisher, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan structure.CreativeEvent, 10)
+	go func() {
+		_ = subscriber.SubscribeEvents(ctx, func(event structure.CreativeEvent) {
+			received <- event
+		})
+	}()
+	event := structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"}
+	deadline := time.After(5 * time.Second)
+	for {
+		is.NoErr(publisher.PublishEvent(event))
+		select {
+		case got := <-received:
+			is.Equal(got, event)
+			return
+		case <-deadline:
+			t.Fatal("no event received")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestValkeyStoreClusterCache(t *testing.T) {
+	is := is.New(t)
+	tc := newTestCluster(t, 3)
+	store, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"), WithCache(100, time.Minute))
+	is.NoErr(err)
+	other, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+	startCacheInvalidation(t, store)
+	is.NoErr(store.Set("creative", structure.TranscodeInfo{Status: "COMPLETED"}))
+	_, _, err = store.Get("creative")
+	is.NoErr(err)
+
+	// Other instances without a cache still send invalidations
+	is.NoErr(other.Delete("creative"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, found, err := store.Get("creative")
+		is.NoErr(err)
+		if !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache not invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,443 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/valkey-io/valkey-go"
+)
+
+// Names of the keys, below the namespace of the store
+const JOBS_KEY = "jobs"
+const CREATIVE_PREFIX = "creative:"
+const TIME_INDEX_KEY = "time_index"
+const CREATED_INDEX_KEY = "created_index"
+const BLACKLIST_KEY = "blacklist"
+const BLACKLIST_REASON_KEY = "reasons"
+const PACKAGING_KEY = "packaging"
+const PACKAGING_JOBS_KEY = "jobs"
+const PACKAGING_DEADLINES_KEY = "deadlines"
+const JOB_INDEX_PREFIX = "job_index:"
+const SOURCE_INDEX_PREFIX = "source_index:"
+const HISTORY_PREFIX = "history:"
+const WEBHOOKS_KEY = "webhooks"
+const WEBHOOK_DELIVERIES_KEY = "webhook_deliveries"
+const EVENTS_CHANNEL = "creative_events"
+const CACHE_INVALIDATIONS_CHANNEL = "cache_invalidations"
+const LAYOUT_VERSION_KEY = "layout_version"
+
+// Creatives and the time indexes are split in shards. The creatives of a shard share a hash tag with
+// the time indexes of the shard, so that they can be updated atomically, and are spread over the cluster.
+const JOB_SHARDS = 16
+
+// Version of the key layout, the data of the unprefixed layout is moved when the store is created
+const layoutVersion = 1
+
+// Key layout of the Valkey store. All keys and channels are below the namespace
+// <prefix>:<tenant>:, so that several deployments and tenants can share a Valkey instance.
+// Keys that are used together share a hash tag, so that they are stored in the same slot in a cluster.
+// Without prefix and tenant, the unprefixed layout of the first releases is used, with creatives
+// stored under their creative ID and a single time index. It does not support clusters.
+type valkeyKeyspace struct {
+	namespace string
+	legacy    bool
+}
+
+// The unprefixed layout
+var legacyKeyspace = valkeyKeyspace{legacy: true}
+
+func newValkeyKeyspace(prefix string, tenant string) valkeyKeyspace {
+	if prefix == "" && tenant == "" {
+		return legacyKeyspace
+	}
+	namespace := ""
+	if prefix != "" {
+		namespace = prefix + ":"
+	}
+	if tenant != "" {
+		namespace += tenant + ":"
+	}
+	return valkeyKeyspace{namespace: namespace}
+}
+
+func (k valkeyKeyspace) key(name string) string {
+	return k.namespace + name
+}
+
+// Key in the slot of the group
+func (k valkeyKeyspace) tagged(group string, name string) string {
+	return "{" + k.namespace + group + "}:" + name
+}
+
+func jobShard(creativeId string) int {
+	return int(crc32.ChecksumIEEE([]byte(creativeId)) % JOB_SHARDS)
+}
+
+// Number of shards of the time index
+func (k valkeyKeyspace) shards() int {
+	if k.legacy {
+		return 1
+	}
+	return JOB_SHARDS
+}
+
+// Shard of the creative
+func (k valkeyKeyspace) shard(creativeId string) int {
+	if k.legacy {
+		return 0
+	}
+	return jobShard(creativeId)
+}
+
+// Hash tag group of the shard
+func jobsGroup(shard int) string {
+	return JOBS_KEY + ":" + strconv.Itoa(shard)
+}
+
+func (k valkeyKeyspace) creative(creativeId string) string {
+	if k.legacy {
+		return creativeId
+	}
+	return k.tagged(jobsGroup(jobShard(creativeId)), CREATIVE_PREFIX+creativeId)
+}
+
+// Time index of the shard of the creative
+func (k valkeyKeyspace) timeIndex(creativeId string) string {
+	return k.shardTimeIndex(k.shard(creativeId))
+}
+
+func (k valkeyKeyspace) shardTimeIndex(shard int) string {
+	if k.legacy {
+		return legacyTimeIndexKey
+	}
+	return k.tagged(jobsGroup(shard), TIME_INDEX_KEY)
+}
+
+// Creation time index of the shard of the creative
+func (k valkeyKeyspace) createdIndex(creativeId string) string {
+	return k.shardCreatedIndex(k.shard(creativeId))
+}
+
+func (k valkeyKeyspace) shardCreatedIndex(shard int) string {
+	if k.legacy {
+		return "job_created_index"
+	}
+	return k.tagged(jobsGroup(shard), CREATED_INDEX_KEY)
+}
+
+func (k valkeyKeyspace) blacklist() string {
+	if k.legacy {
+		return "blacklist"
+	}
+	return "{" + k.namespace + BLACKLIST_KEY + "}"
+}
+
+func (k valkeyKeyspace) blacklistReasons() string {
+	if k.legacy {
+		return "blacklist_reasons"
+	}
+	return k.tagged(BLACKLIST_KEY, BLACKLIST_REASON_KEY)
+}
+
+func (k valkeyKeyspace) packagingJobs() string {
+	if k.legacy {
+		return "packaging_jobs"
+	}
+	return k.tagged(PACKAGING_KEY, PACKAGING_JOBS_KEY)
+}
+
+func (k valkeyKeyspace) packagingDeadlines() string {
+	if k.legacy {
+		return "packaging_deadlines"
+	}
+	return k.tagged(PACKAGING_KEY, PACKAGING_DEADLINES_KEY)
+}
+
+// The packaging queue or stream, read by the external packager. It is not namespaced,
+// since the packager reads the queue exactly as configured.
+func (k valkeyKeyspace) packagingQueue(queueName string) string {
+	return queueName
+}
+
+func (k valkeyKeyspace) jobIndex(jobId string) string {
+	return k.key(JOB_INDEX_PREFIX + jobId)
+}
+
+func (k valkeyKeyspace) sourceIndex(source string) string {
+	return k.key(SOURCE_INDEX_PREFIX + source)
+}
+
+func (k valkeyKeyspace) history(creativeId string) string {
+	return k.key(HISTORY_PREFIX + creativeId)
+}
+
+func (k valkeyKeyspace) webhooks() string {
+	return k.key(WEBHOOKS_KEY)
+}
+
+func (k valkeyKeyspace) webhookDeliveries() string {
+	return k.key(WEBHOOK_DELIVERIES_KEY)
+}
+
+func (k valkeyKeyspace) eventsChannel() string {
+	return k.key(EVENTS_CHANNEL)
+}
+
+func (k valkeyKeyspace) cacheInvalidationsChannel() string {
+	return k.key(CACHE_INVALIDATIONS_CHANNEL)
+}
+
+func (k valkeyKeyspace) layoutVersion() string {
+	return k.key(LAYOUT_VERSION_KEY)
+}
+
+// Keys that are moved from the unprefixed layout
+var legacyKeys = []func(k valkeyKeyspace) string{
+	valkeyKeyspace.blacklist,
+	valkeyKeyspace.blacklistReasons,
+	valkeyKeyspace.packagingJobs,
+	valkeyKeyspace.packagingDeadlines,
+	valkeyKeyspace.webhooks,
+	valkeyKeyspace.webhookDeliveries,
+}
+
+// Time index of the unprefixed layout, the creatives were stored under their creative ID
+const legacyTimeIndexKey = "job_time_index"
+
+// MigrateKeys moves the data of the unprefixed key layout into the namespace of the store.
+// It does nothing if the namespace already has the current layout. Keys are moved one by one,
+// so it is safe to run on several instances at once, and to run again if it was interrupted.
+// The unprefixed keys belong to a single deployment, so it is run by the operator
+// for the namespace that takes over the data, and not when the store is created.
+func (vs *ValkeyStore) MigrateKeys(ctx context.Context) error {
+	if vs.keys.legacy {
+		return errors.New("the store uses the unprefixed key layout, set REDIS_KEY_PREFIX to migrate the keys")
+	}
+	version, err := vs.client.Do(ctx, vs.client.B().Get().Key(vs.keys.layoutVersion()).Build()).AsInt64()
+	if err != nil && !errors.Is(err, valkey.Nil) {
+		return fmt.Errorf("failed to get key layout version: %w", err)
+	}
+	if version >= layoutVersion {
+		return nil
+	}
+	started := time.Now()
+	moved := 0
+	for _, key := range legacyKeys {
+		n, err := vs.moveKey(ctx, key(legacyKeyspace), key(vs.keys))
+		if err != nil {
+			return err
+		}
+		moved += n
+	}
+	n, err := vs.moveCreatives(ctx)
+	if err != nil {
+		return err
+	}
+	moved += n
+	for _, prefix := range []string{JOB_INDEX_PREFIX, SOURCE_INDEX_PREFIX} {
+		n, err := vs.moveKeysWithPrefix(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		moved += n
+	}
+	err = vs.client.Do(
+		ctx,
+		vs.client.B().Set().Key(vs.keys.layoutVersion()).Value(strconv.Itoa(layoutVersion)).Build(),
+	).Error()
+	if err != nil {
+		return fmt.Errorf("failed to set key layout version: %w", err)
+	}
+	logger.Info("Migrated keys to the current layout",
+		slog.String("namespace", vs.keys.namespace),
+		slog.Int("fromVersion", int(version)),
+		slog.Int("keys", moved),
+		slog.Duration("duration", time.Since(started)),
+	)
+	return nil
+}
+
+// Logs a warning if the namespace is not migrated, and there is data in the unprefixed key layout
+func (vs *ValkeyStore) checkLegacyKeys(ctx context.Context) error {
+	if vs.keys.legacy {
+		return nil
+	}
+	version, err := vs.client.Do(ctx, vs.client.B().Get().Key(vs.keys.layoutVersion()).Build()).AsInt64()
+	if err != nil && !errors.Is(err, valkey.Nil) {
+		return fmt.Errorf("failed to get key layout version: %w", err)
+	}
+	if version >= layoutVersion {
+		return nil
+	}
+	legacy, err := vs.client.Do(ctx, vs.client.B().Exists().Key(legacyTimeIndexKey).Build()).AsInt64()
+	if err != nil {
+		return fmt.Errorf("failed to check for unprefixed keys: %w", err)
+	}
+	if legacy > 0 {
+		logger.Warn("Found creatives stored under unprefixed keys, run ad-normalizer migrate-keys to move them",
+			slog.String("namespace", vs.keys.namespace),
+		)
+	}
+	return nil
+}
+
+// Moves the creatives listed in the legacy time index, and the time index, into the shards of the namespace
+func (vs *ValkeyStore) moveCreatives(ctx context.Context) (int, error) {
+	members, err := vs.client.Do(
+		ctx,
+		vs.client.B().Zrange().Key(legacyTimeIndexKey).Min("0").Max("-1").Withscores().Build(),
+	).AsZScores()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read time index %s: %w", legacyTimeIndexKey, err)
+	}
+	moved := 0
+	for _, member := range members {
+		n, err := vs.moveKey(ctx, member.Member, vs.keys.creative(member.Member))
+		if err != nil {
+			return moved, err
+		}
+		moved += n
+		// The creation time is not known, the last update is the closest
+		err = vs.transaction(
+			ctx,
+			vs.client.B().
+				Zadd().
+				Key(vs.keys.timeIndex(member.Member)).
+				ScoreMember().
+				ScoreMember(member.Score, member.Member).
+				Build(),
+			vs.client.B().
+				Zadd().
+				Key(vs.keys.createdIndex(member.Member)).
+				Nx().
+				ScoreMember().
+				ScoreMember(member.Score, member.Member).
+				Build(),
+		)
+		if err != nil {
+			return moved, fmt.Errorf("failed to move %s to the time index: %w", member.Member, err)
+		}
+	}
+	if err := vs.client.Do(ctx, vs.client.B().Del().Key(legacyTimeIndexKey).Build()).Error(); err != nil {
+		return moved, fmt.Errorf("failed to delete time index %s: %w", legacyTimeIndexKey, err)
+	}
+	return moved, nil
+}
+
+// Moves the keys starting with the prefix into the namespace. Keys are scanned on each node of a cluster.
+func (vs *ValkeyStore) moveKeysWithPrefix(ctx context.Context, prefix string) (int, error) {
+	moved := 0
+	for addr, node := range vs.client.Nodes() {
+		var cursor uint64
+		for {
+			entry, err := node.Do(
+				ctx,
+				node.B().Scan().Cursor(cursor).Match(prefix+"*").Count(1000).Build(),
+			).AsScanEntry()
+			if err != nil {
+				return moved, fmt.Errorf("failed to scan keys on %s: %w", addr, err)
+			}
+			for _, key := range entry.Elements {
+				n, err := vs.moveKey(ctx, key, vs.keys.key(key))
+				if err != nil {
+					return moved, err
+				}
+				moved += n
+			}
+			cursor = entry.Cursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return moved, nil
+}
+
+// Copies the value and TTL of the key to the new key and deletes it. The keys may be in different slots,
+// so the value is copied instead of renaming the key. Returns the number of moved keys.
+func (vs *ValkeyStore) moveKey(ctx context.Context, from string, to string) (int, error) {
+	keyType, err := vs.client.Do(ctx, vs.client.B().Type().Key(from).Build()).ToString()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get type of key %s: %w", from, err)
+	}
+	ttl, err := vs.client.Do(ctx, vs.client.B().Pttl().Key(from).Build()).AsInt64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get TTL of key %s: %w", from, err)
+	}
+	switch keyType {
+	case "none":
+		return 0, nil
+	case "string":
+		value, err := vs.client.Do(ctx, vs.client.B().Get().Key(from).Build()).ToString()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read key %s: %w", from, err)
+		}
+		err = vs.client.Do(ctx, vs.client.B().Set().Key(to).Value(value).Build()).Error()
+		if err != nil {
+			return 0, fmt.Errorf("failed to move key %s: %w", from, err)
+		}
+	case "zset":
+		members, err := vs.client.Do(
+			ctx,
+			vs.client.B().Zrange().Key(from).Min("0").Max("-1").Withscores().Build(),
+		).AsZScores()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read key %s: %w", from, err)
+		}
+		if len(members) > 0 {
+			cmd := vs.client.B().Zadd().Key(to).ScoreMember()
+			for _, member := range members {
+				cmd = cmd.ScoreMember(member.Score, member.Member)
+			}
+			if err := vs.client.Do(ctx, cmd.Build()).Error(); err != nil {
+				return 0, fmt.Errorf("failed to move key %s: %w", from, err)
+			}
+		}
+	case "hash":
+		fields, err := vs.client.Do(ctx, vs.client.B().Hgetall().Key(from).Build()).AsStrMap()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read key %s: %w", from, err)
+		}
+		if len(fields) > 0 {
+			cmd := vs.client.B().Hset().Key(to).FieldValue()
+			for field, value := range fields {
+				cmd = cmd.FieldValue(field, value)
+			}
+			if err := vs.client.Do(ctx, cmd.Build()).Error(); err != nil {
+				return 0, fmt.Errorf("failed to move key %s: %w", from, err)
+			}
+		}
+	case "set":
+		members, err := vs.client.Do(ctx, vs.client.B().Smembers().Key(from).Build()).AsStrSlice()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read key %s: %w", from, err)
+		}
+		if len(members) > 0 {
+			if err := vs.client.Do(ctx, vs.client.B().Sadd().Key(to).Member(members...).Build()).Error(); err != nil {
+				return 0, fmt.Errorf("failed to move key %s: %w", from, err)
+			}
+		}
+	default:
+		logger.Warn("Key has an unexpected type, not moving it",
+			slog.String("key", from),
+			slog.String("type", keyType),
+		)
+		return 0, nil
+	}
+	if ttl > 0 {
+		if err := vs.client.Do(ctx, vs.client.B().Pexpire().Key(to).Milliseconds(ttl).Build()).Error(); err != nil {
+			return 0, fmt.Errorf("failed to set TTL of key %s: %w", to, err)
+		}
+	}
+	if err := vs.client.Do(ctx, vs.client.B().Del().Key(from).Build()).Error(); err != nil {
+		return 0, fmt.Errorf("failed to delete key %s: %w", from, err)
+	}
+	logger.Debug("Moved key", slog.String("from", from), slog.String("to", to))
+	return 1, nil
+}
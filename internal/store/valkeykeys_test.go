@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/matryer/is"
+)
+
+func TestValkeyKeyspace(t *testing.T) {
+	is := is.New(t)
+	keys := newValkeyKeyspace("ad-normalizer", "")
+	shard := strconv.Itoa(jobShard("blacklist"))
+	is.Equal(keys.creative("blacklist"), "{ad-normalizer:jobs:"+shard+"}:creative:blacklist")
+	is.Equal(keys.timeIndex("blacklist"), "{ad-normalizer:jobs:"+shard+"}:time_index")
+	is.Equal(keys.blacklist(), "{ad-normalizer:blacklist}")
+	is.Equal(keys.blacklistReasons(), "{ad-normalizer:blacklist}:reasons")
+	is.Equal(keys.eventsChannel(), "ad-normalizer:creative_events")
+	keys = newValkeyKeyspace("staging", "acme")
+	is.Equal(keys.blacklist(), "{staging:acme:blacklist}")
+	is.Equal(keys.packagingDeadlines(), "{staging:acme:packaging}:deadlines")
+
+	// The creatives are spread over the shards
+	shards := map[int]bool{}
+	for i := range 100 {
+		shards[jobShard("creative-"+strconv.Itoa(i))] = true
+	}
+	is.Equal(len(shards), JOB_SHARDS)
+}
+
+func TestValkeyStoreTenants(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	acme, err := NewValkeyStore("redis://"+mr.Addr(), WithKeyPrefix("ad-normalizer"), WithTenant("acme"))
+	is.NoErr(err)
+	globex, err := NewValkeyStore("redis://"+mr.Addr(), WithKeyPrefix("staging"), WithTenant("globex"))
+	is.NoErr(err)
+
+	// A creative named like another key does not overwrite it
+	is.NoErr(acme.BlackList("https://example.com/broken.mp4", ""))
+	is.NoErr(acme.Set("blacklist", structure.TranscodeInfo{Status: "COMPLETED"}))
+	blacklisted, err := acme.InBlackList("https://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(blacklisted)
+
+	blacklisted, err = globex.InBlackList("https://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(!blacklisted)
+	_, found, err := globex.Get("blacklist")
+	is.NoErr(err)
+	is.True(!found)
+	_, total, err := globex.List(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(0))
+	is.True(mr.Exists(acme.keys.creative("blacklist")))
+	is.True(strings.HasPrefix(acme.keys.creative("blacklist"), "{ad-normalizer:acme:jobs:"))
+
+	// The packaging queue is used as configured, the tenants configure their own
+	is.NoErr(acme.EnqueuePackagingJob("acme-package", structure.PackagingQueueMessage{JobId: "acme-job"}))
+	acmeJobs, err := mr.ZMembers("acme-package")
+	is.NoErr(err)
+	is.Equal(len(acmeJobs), 1)
+	is.True(strings.Contains(acmeJobs[0], "acme-job"))
+}
+
+func TestValkeyStoreUnprefixedLayout(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	creative, _ := json.Marshal(structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/index.m3u8"})
+	// Stored by an earlier version
+	_ = mr.Set("creative", string(creative))
+	_, _ = mr.ZAdd("job_time_index", 1000, "creative")
+	_, _ = mr.ZAdd("blacklist", 1000, "https://example.com/broken.mp4")
+
+	store, err := NewValkeyStore("redis://" + mr.Addr())
+	is.NoErr(err)
+	value, found, err := store.Get("creative")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(value.Url, "https://example.com/index.m3u8")
+	blacklisted, err := store.InBlackList("https://example.com/broken.mp4")
+	is.NoErr(err)
+	is.True(blacklisted)
+	is.NoErr(store.Set("other", structure.TranscodeInfo{Status: "QUEUED"}))
+	_, total, err := store.List(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2))
+	is.True(mr.Exists("other"))
+	is.NoErr(store.EnqueuePackagingJob("package", structure.PackagingQueueMessage{JobId: "job"}))
+	is.True(mr.Exists("package"))
+	// There is nothing to migrate to
+	is.True(store.MigrateKeys(context.Background()) != nil)
+	is.True(mr.Exists("creative"))
+}
+
+func TestMigrateKeys(t *testing.T) {
+	is := is.New(t)
+	tc := newTestCluster(t, 3)
+	creative, _ := json.Marshal(structure.TranscodeInfo{Status: "COMPLETED", Url: "https://example.com/index.m3u8"})
+	inFlight, _ := json.Marshal(structure.TranscodeInfo{Status: "IN_PROGRESS"})
+	// The layout before the namespaces
+	_ = tc.node("creative").Set("creative", string(creative))
+	_ = tc.node("in-flight").Set("in-flight", string(inFlight))
+	tc.node("in-flight").SetTTL("in-flight", time.Minute)
+	_, _ = tc.node("job_time_index").ZAdd("job_time_index", 1000, "creative")
+	_, _ = tc.node("job_time_index").ZAdd("job_time_index", 2000, "in-flight")
+	_, _ = tc.node("job_time_index").ZAdd("job_time_index", 3000, "expired")
+	_, _ = tc.node("blacklist").ZAdd("blacklist", 1000, "https://example.com/broken.mp4")
+	_, _ = tc.node("blacklist").ZAdd("blacklist", 2000, "https://example.com/huge.mp4")
+	tc.node("blacklist_reasons").HSet("blacklist_reasons", "https://example.com/broken.mp4", "not found")
+	_ = tc.node("job_index:job-id").Set("job_index:job-id", "in-flight")
+	tc.node("job_index:job-id").SetTTL("job_index:job-id", time.Minute)
+	_, _ = tc.node("source_index:https://example.com/ad.mp4").SetAdd("source_index:https://example.com/ad.mp4", "creative")
+	_, _ = tc.node("webhooks").SetAdd("webhooks", `{"url":"https://hooks.example.com"}`)
+
+	// The unprefixed layout does not support clusters
+	_, err := NewValkeyStore(tc.url(), WithCluster())
+	is.True(err != nil)
+	store, err := NewValkeyStore(tc.url(), WithCluster(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+	// The keys are only moved on request
+	_, found, err := store.Get("creative")
+	is.NoErr(err)
+	is.True(!found)
+	is.NoErr(store.MigrateKeys(context.Background()))
+	value, found, err := store.Get("creative")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(value.Url, "https://example.com/index.m3u8")
+	ttl, err := store.Ttl("in-flight")
+	is.NoErr(err)
+	is.True(ttl > 0 && ttl <= 60)
+	results, total, err := store.List(0, 10)
+	is.NoErr(err)
+	is.Equal(total, int64(2)) // the expired creative is removed from the time index
+	is.Equal(len(results), 2)
+	entries, _, err := store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(len(entries), 2)
+	is.Equal(entries[1].Reason, "not found")
+	creativeId, found, err := store.GetJobCreative("job-id")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(creativeId, "in-flight")
+	is.Equal(tc.node(store.keys.jobIndex("job-id")).TTL(store.keys.jobIndex("job-id")), time.Minute)
+	creativeIds, err := store.GetSourceCreatives("https://example.com/ad.mp4")
+	is.NoErr(err)
+	is.Equal(creativeIds, []string{"creative"})
+	webhooks, err := store.GetWebhooks()
+	is.NoErr(err)
+	is.Equal(webhooks, []structure.Webhook{{Url: "https://hooks.example.com"}})
+	for _, key := range []string{"creative", "job_time_index", "blacklist", "job_index:job-id", "webhooks"} {
+		is.True(!tc.node(key).Exists(key)) // legacy keys are removed
+	}
+
+	// Once migrated, keys of the old layout are left alone
+	_ = tc.node("late").Set("late", string(creative))
+	_, _ = tc.node("job_time_index").ZAdd("job_time_index", 4000, "late")
+	is.NoErr(store.MigrateKeys(context.Background()))
+	is.True(tc.node("late").Exists("late"))
+}
+
+func TestMigrateKeysOfTenant(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	creative, _ := json.Marshal(structure.TranscodeInfo{Status: "COMPLETED"})
+	_ = mr.Set("creative", string(creative))
+	_, _ = mr.ZAdd("job_time_index", 1000, "creative")
+
+	// Starting a tenant does not take over the unprefixed keys
+	globex, err := NewValkeyStore("redis://"+mr.Addr(), WithKeyPrefix("ad-normalizer"), WithTenant("globex"))
+	is.NoErr(err)
+	_, found, _ := globex.Get("creative")
+	is.True(!found)
+	is.True(mr.Exists("creative"))
+
+	acme, err := NewValkeyStore("redis://"+mr.Addr(), WithKeyPrefix("ad-normalizer"), WithTenant("acme"))
+	is.NoErr(err)
+	is.NoErr(acme.MigrateKeys(context.Background()))
+	_, found, _ = acme.Get("creative")
+	is.True(found)
+	version, _ := mr.Get("ad-normalizer:acme:layout_version")
+	is.Equal(version, "1")
+	_, found, _ = globex.Get("creative")
+	is.True(!found)
+}
@@ -0,0 +1,112 @@
+package store
+
+import "github.com/valkey-io/valkey-go"
+
+// Stores a creative and adds it to the time indexes of its shard. The creation time is only set when the
+// creative does not exist, also if it expired. Returns 0 if the creative was not stored,
+// 2 if it replaced a completed creative, that may be cached, and 1 otherwise.
+// KEYS: creative, time index, created index
+// ARGV: value, TTL in seconds (0 to persist), time index score, creative ID,
+// "1" to only store the creative if it has the expected status, expected status
+var setCreativeScript = valkey.NewLuaScript(`
+local previous = nil
+local current = redis.call("GET", KEYS[1])
+if current then
+	local ok, stored = pcall(cjson.decode, current)
+	if ok then
+		previous = stored["status"]
+	end
+end
+if ARGV[5] == "1" and previous ~= ARGV[6] then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[4])
+if current then
+	redis.call("ZADD", KEYS[3], "NX", ARGV[3], ARGV[4])
+else
+	redis.call("ZADD", KEYS[3], ARGV[3], ARGV[4])
+end
+if previous == "COMPLETED" then
+	return 2
+end
+return 1
+`)
+
+// Removes a creative and its entries in the time indexes.
+// KEYS: creative, time index, created index
+// ARGV: creative ID
+var deleteCreativeScript = valkey.NewLuaScript(`
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+return 1
+`)
+
+// Removes the members of the time indexes whose creative no longer exists, f.ex. because it expired.
+// Returns the number of members removed from the time index.
+// KEYS: time index, created index, creatives
+// ARGV: creative IDs
+var pruneTimeIndexScript = valkey.NewLuaScript(`
+local removed = 0
+for i, id in ipairs(ARGV) do
+	if redis.call("EXISTS", KEYS[i + 2]) == 0 then
+		removed = removed + redis.call("ZREM", KEYS[1], id)
+		redis.call("ZREM", KEYS[2], id)
+	end
+end
+return removed
+`)
+
+// Fills the created index of a shard from its time index, if the created index does not exist yet.
+// The creatives of earlier releases have no creation time, the last update is the closest.
+// KEYS: created index, time index
+var backfillCreatedIndexScript = valkey.NewLuaScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+return redis.call("ZUNIONSTORE", KEYS[1], 1, KEYS[2])
+`)
+
+// Removes the packaging jobs with a deadline before now, and returns their states.
+// Runs as one script, so that a job is only claimed by one instance, and its state is never
+// left behind without a deadline.
+// KEYS: packaging deadlines, packaging jobs
+// ARGV: now in unix milliseconds
+var claimTimedOutPackagingJobsScript = valkey.NewLuaScript(`
+local states = {}
+for _, id in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])) do
+	redis.call("ZREM", KEYS[1], id)
+	local state = redis.call("HGET", KEYS[2], id)
+	if state then
+		redis.call("HDEL", KEYS[2], id)
+		table.insert(states, state)
+	end
+end
+return states
+`)
+
+// Postpones up to limit deliveries that are due to the end of their claim, and returns them.
+// Runs as one script, so that a delivery is only claimed by one instance.
+// KEYS: webhook deliveries
+// ARGV: now in unix milliseconds, end of the claim in unix milliseconds, limit
+var claimDueWebhookDeliveriesScript = valkey.NewLuaScript(`
+local members = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[3])
+for _, member in ipairs(members) do
+	redis.call("ZADD", KEYS[1], ARGV[2], member)
+end
+return members
+`)
+
+// Replaces a claimed delivery, f.ex. with its next attempt
+// KEYS: webhook deliveries
+// ARGV: claimed delivery, new delivery, due time in unix milliseconds
+var replaceWebhookDeliveryScript = valkey.NewLuaScript(`
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[2])
+return 1
+`)
@@ -1,74 +1,294 @@
 package store
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Eyevinn/ad-normalizer/internal/logger"
 	"github.com/Eyevinn/ad-normalizer/internal/structure"
 	"github.com/valkey-io/valkey-go"
+	"go.opentelemetry.io/otel/metric"
 )
 
-const BLACKLIST_KEY = "blacklist"
-const TIME_INDEX_KEY = "job_time_index"
-
 type Store interface {
 	Get(key string) (structure.TranscodeInfo, bool, error)
+	// GetMany returns the stored creatives of the keys, keys without a creative are left out
+	GetMany(keys []string) (map[string]structure.TranscodeInfo, error)
 	Set(key string, value structure.TranscodeInfo, ttl ...int64) error
+	// CompareAndSet only stores the value if the stored creative has the expected status
+	CompareAndSet(key string, expectedStatus string, value structure.TranscodeInfo, ttl ...int64) (bool, error)
 	Delete(key string) error
+	// DeleteFailed removes a creative whose job failed, the value is the failed creative with its error
+	DeleteFailed(key string, value structure.TranscodeInfo) error
+	// Ttl returns the remaining time to live of the creative in seconds, or -1 if it does not expire
+	Ttl(key string) (int64, error)
 	EnqueuePackagingJob(queueName string, packagingJob structure.PackagingQueueMessage) error
-	BlackList(value string) error
+	TrackPackagingJob(state structure.PackagingJobState) error
+	UntrackPackagingJob(creativeId string) error
+	PopTimedOutPackagingJobs(now time.Time) ([]structure.PackagingJobState, error)
+	SetJobCreative(jobId string, creativeId string, ttl int64) error
+	GetJobCreative(jobId string) (string, bool, error)
+	AddSourceCreative(source string, creativeId string, ttl int64) error
+	GetSourceCreatives(source string) ([]string, error)
+	AddWebhook(webhook structure.Webhook) error
+	RemoveWebhook(webhook structure.Webhook) error
+	GetWebhooks() ([]structure.Webhook, error)
+	// EnqueueWebhookDelivery schedules the delivery, replacing a claimed delivery with the same ID
+	EnqueueWebhookDelivery(delivery structure.WebhookDelivery, due time.Time) error
+	// ClaimDueWebhookDeliveries returns up to limit deliveries that are due, and postpones them to claimUntil.
+	// A claimed delivery is due again at claimUntil, unless it is removed or enqueued again before.
+	ClaimDueWebhookDeliveries(now time.Time, claimUntil time.Time, limit int) ([]structure.WebhookDelivery, error)
+	// RemoveWebhookDelivery removes a delivery claimed through this store
+	RemoveWebhookDelivery(id string) error
+	PublishEvent(event structure.CreativeEvent) error
+	SubscribeEvents(ctx context.Context, handler func(structure.CreativeEvent)) error
+	BlackList(value string, reason string) error
+	// BlackListAt adds the value to the blacklist with the given timestamp in unix milliseconds, f.ex. on import
+	BlackListAt(value string, reason string, timestamp int64) error
 	InBlackList(value string) (bool, error)
+	// InBlackListMany returns for each value whether it is in the blacklist
+	InBlackListMany(values []string) (map[string]bool, error)
 	RemoveFromBlackList(value string) error
-	GetBlackList(page int, size int) ([]string, int64, error)
+	GetBlackList(page int, size int) ([]structure.BlacklistEntry, int64, error)
 	List(page int, size int) ([]structure.TranscodeInfo, int64, error)
+	// ListJobs returns a page of the creatives selected by the query, and the cursor of the next page,
+	// empty if there are no more creatives
+	ListJobs(query JobQuery) ([]structure.TranscodeInfo, string, error)
+	// AppendHistory adds the event to the history of the creative, which is kept after the creative is removed
+	AppendHistory(creativeId string, event structure.HistoryEvent) error
+	// GetHistory returns the history of the creative, oldest event first
+	GetHistory(creativeId string) ([]structure.HistoryEvent, error)
+	// ExportCreatives calls fn with each stored creative, its key and when it expires
+	// in unix milliseconds, 0 if it does not expire. It stops when the context is done.
+	ExportCreatives(
+		ctx context.Context,
+		fn func(key string, value structure.TranscodeInfo, expiresAt int64) error,
+	) error
+	// GetPackagingJobs returns the tracked packaging jobs, that have not been reported back by the packager
+	GetPackagingJobs() ([]structure.PackagingJobState, error)
+	// GetPackagingJob returns the tracked packaging job of the creative, if any
+	GetPackagingJob(creativeId string) (structure.PackagingJobState, bool, error)
 }
 
+// The history of a creative is kept for HISTORY_TTL after its last event, and is capped
+// to about HISTORY_MAX_EVENTS events. The SQL store removes each event HISTORY_TTL after it happened.
+const HISTORY_TTL = 30 * 24 * time.Hour
+const HISTORY_MAX_EVENTS = 1000
+
+// Times List reads a page again after removing expired creatives from it. Each time, the expired
+// creatives on the page are replaced by the ones after them, of which fewer have usually expired.
+const listAttempts = 10
+
+// Members of the time index read at a time by ListJobs, and at most per call
+const jobQueryBatchSize = 200
+const jobQueryMaxScanned = 10000
+
+// Number of time index members checked by each pruning script
+const pruneBatchSize = 500
+
 type ValkeyStore struct {
-	client valkey.Client
+	client  valkey.Client
+	cluster bool
+	prefix  string
+	tenant  string
+	keys    valkeyKeyspace
+	// Consumer group of the packaging stream, if empty packaging jobs are added to a sorted set
+	streamGroup  string
+	streamGroups sync.Map
+	// Serialized webhook deliveries claimed by this instance, by delivery ID
+	claimedDeliveries sync.Map
+	// Completed creatives and blacklist lookups, nil if caching is disabled
+	cache         *lruCache
+	cacheActive   atomic.Bool
+	cacheRequests metric.Int64Counter
+}
+
+type ValkeyStoreOption func(*ValkeyStore)
+
+// WithStreamPackagingQueue makes the store publish packaging jobs to a Valkey Stream,
+// consumed by the given consumer group, instead of a sorted set.
+func WithStreamPackagingQueue(group string) ValkeyStoreOption {
+	return func(vs *ValkeyStore) {
+		vs.streamGroup = group
+	}
+}
+
+// WithCluster connects to a Valkey cluster. The URL may list more nodes to discover
+// the cluster from with addr query parameters, e.g. redis://node-1:6379?addr=node-2:6379
+func WithCluster() ValkeyStoreOption {
+	return func(vs *ValkeyStore) {
+		vs.cluster = true
+	}
+}
+
+// WithKeyPrefix sets the prefix of all keys of the store, so that several deployments can share a Valkey instance.
+// Without prefix and tenant, the keys of the unprefixed layout of the first releases are used.
+func WithKeyPrefix(prefix string) ValkeyStoreOption {
+	return func(vs *ValkeyStore) {
+		vs.prefix = prefix
+	}
+}
+
+// WithTenant scopes all keys of the store to the namespace of the tenant.
+func WithTenant(tenant string) ValkeyStoreOption {
+	return func(vs *ValkeyStore) {
+		vs.tenant = tenant
+	}
+}
+
+// WithCache caches up to size completed creatives and blacklist lookups in the memory of the instance,
+// for at most ttl. Changes by other instances are received by RunCacheInvalidation.
+func WithCache(size int, ttl time.Duration) ValkeyStoreOption {
+	return func(vs *ValkeyStore) {
+		vs.cache = newLruCache(size, ttl)
+		vs.cacheRequests = newCacheRequestCounter()
+	}
 }
 
-func NewValkeyStore(valkeyUrl string) (*ValkeyStore, error) {
-	logger.Debug("Connecting to Valkey", slog.String("valkeyUrl", valkeyUrl))
-	options := valkey.MustParseURL(valkeyUrl)
+func NewValkeyStore(valkeyUrl string, opts ...ValkeyStoreOption) (*ValkeyStore, error) {
+	vs := &ValkeyStore{}
+	for _, opt := range opts {
+		opt(vs)
+	}
+	vs.keys = newValkeyKeyspace(vs.prefix, vs.tenant)
+	if vs.cluster && vs.keys.legacy {
+		// The keys of the unprefixed layout are not in the same slots
+		return nil, errors.New("the unprefixed key layout does not support clusters, set a key prefix")
+	}
+	logger.Debug("Connecting to Valkey", slog.String("valkeyUrl", valkeyUrl), slog.Bool("cluster", vs.cluster))
+	options, err := valkey.ParseURL(valkeyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Valkey url: %w", err)
+	}
 	options.SendToReplicas = func(cmd valkey.Completed) bool {
 		return false // No read from replicas
 	}
 	options.DisableCache = true
+	// Without this, the client falls back to a single node client when the server is not a cluster
+	options.ForceSingleClient = !vs.cluster
 	client, err := valkey.NewClient(options)
 	if err != nil {
 		logger.Error("Failed to create Valkey client", slog.String("error", err.Error()))
 		return nil, err
 	}
-	return &ValkeyStore{
-		client: client,
-	}, nil
+	if vs.cluster && client.Mode() != valkey.ClientModeCluster {
+		client.Close()
+		return nil, errors.New("valkey is not running in cluster mode")
+	}
+	vs.client = client
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := vs.checkLegacyKeys(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := vs.backfillCreatedIndex(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return vs, nil
+}
+
+// Fills the created indexes of the shards that have none yet, from their time index
+func (vs *ValkeyStore) backfillCreatedIndex(ctx context.Context) error {
+	execs := make([]valkey.LuaExec, 0, vs.keys.shards())
+	for shard := range vs.keys.shards() {
+		execs = append(execs, valkey.LuaExec{
+			Keys: []string{vs.keys.shardCreatedIndex(shard), vs.keys.shardTimeIndex(shard)},
+		})
+	}
+	var filled int64
+	for _, result := range backfillCreatedIndexScript.ExecMulti(ctx, vs.client, execs...) {
+		n, err := result.AsInt64()
+		if err != nil {
+			return fmt.Errorf("failed to fill created index: %w", err)
+		}
+		filled += n
+	}
+	if filled > 0 {
+		logger.Info("Filled created index from the time index", slog.Int64("creatives", filled))
+	}
+	return nil
+}
+
+// Runs the commands in a MULTI/EXEC transaction. All keys of the commands must be in the same slot.
+func (vs *ValkeyStore) transaction(ctx context.Context, cmds ...valkey.Completed) error {
+	multi := make(valkey.Commands, 0, len(cmds)+2)
+	multi = append(multi, vs.client.B().Multi().Build())
+	multi = append(multi, cmds...)
+	multi = append(multi, vs.client.B().Exec().Build())
+	results := vs.client.DoMulti(ctx, multi...)
+	for _, result := range results {
+		if err := result.Error(); err != nil {
+			return err
+		}
+	}
+	// Errors of the commands are returned by EXEC
+	replies, err := results[len(results)-1].ToArray()
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err := reply.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (vs *ValkeyStore) Delete(key string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-
-	err := vs.client.Do(ctx, vs.client.B().Del().Key(key).Build()).Error()
+	err := deleteCreativeScript.Exec(
+		ctx,
+		vs.client,
+		[]string{vs.keys.creative(key), vs.keys.timeIndex(key), vs.keys.createdIndex(key)},
+		[]string{key},
+	).Error()
 	if err != nil {
 		return fmt.Errorf("failed to delete key %s: %w", key, err)
 	}
-	err = deleteFromTimeIndex(vs, key)
-	if err != nil {
-		return fmt.Errorf("failed to delete key %s from time index: %w", key, err)
-	}
+	vs.invalidate(ctx, cachedCreativePrefix+key)
 	return nil
 }
 
+// DeleteFailed removes the creative, the failure is kept in its history
+func (vs *ValkeyStore) DeleteFailed(key string, value structure.TranscodeInfo) error {
+	return vs.Delete(key)
+}
+
+// Get returns the creative. Completed creatives are cached, if caching is enabled.
 func (vs *ValkeyStore) Get(key string) (structure.TranscodeInfo, bool, error) {
+	cache := vs.activeCache()
+	var generation uint64
+	if cache != nil {
+		cached, hit := cache.get(cachedCreativePrefix + key)
+		vs.countCacheRequest("creative", hit)
+		if hit {
+			return cached.(structure.TranscodeInfo), true, nil
+		}
+		generation = cache.currentGeneration()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	value := structure.TranscodeInfo{}
-	result, err := vs.client.Do(ctx, vs.client.B().Get().Key(key).Build()).AsBytes()
+	cmds := valkey.Commands{vs.client.B().Get().Key(vs.keys.creative(key)).Build()}
+	if cache != nil {
+		// The TTL of the creative, so that it is not cached for longer than it exists
+		cmds = append(cmds, vs.client.B().Pttl().Key(vs.keys.creative(key)).Build())
+	}
+	results := vs.client.DoMulti(ctx, cmds...)
+	result, err := results[0].AsBytes()
 	if err != nil {
 		if errors.Is(err, valkey.Nil) {
 			return value, false, nil // Key does not exist
@@ -84,69 +304,165 @@ func (vs *ValkeyStore) Get(key string) (structure.TranscodeInfo, bool, error) {
 		logger.Error("Failed to unmarshal value from Valkey", slog.String("key", key))
 		return value, false, fmt.Errorf("failed to unmarshal value for key %s: %w", key, err)
 	}
+	// Completed creatives rarely change, while the others are updated by each progress callback
+	if cache != nil && value.Status == "COMPLETED" {
+		vs.cacheCreative(cache, key, value, results[1], generation)
+	}
 	return value, true, nil
 }
 
+// GetMany returns the stored creatives of the keys. Completed creatives are cached, if caching is enabled.
+func (vs *ValkeyStore) GetMany(keys []string) (map[string]structure.TranscodeInfo, error) {
+	values := make(map[string]structure.TranscodeInfo, len(keys))
+	cache := vs.activeCache()
+	var generation uint64
+	remaining := keys
+	if cache != nil {
+		remaining = make([]string, 0, len(keys))
+		for _, key := range keys {
+			cached, hit := cache.get(cachedCreativePrefix + key)
+			vs.countCacheRequest("creative", hit)
+			if hit {
+				values[key] = cached.(structure.TranscodeInfo)
+			} else {
+				remaining = append(remaining, key)
+			}
+		}
+		generation = cache.currentGeneration()
+	}
+	if len(remaining) == 0 {
+		return values, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// Like in List, a GET each instead of an MGET, since the creatives are spread over the cluster.
+	// With the cache, each GET is followed by a PTTL of the creative.
+	step := 1
+	if cache != nil {
+		step = 2
+	}
+	cmds := make(valkey.Commands, 0, step*len(remaining))
+	for _, key := range remaining {
+		cmds = append(cmds, vs.client.B().Get().Key(vs.keys.creative(key)).Build())
+		if cache != nil {
+			cmds = append(cmds, vs.client.B().Pttl().Key(vs.keys.creative(key)).Build())
+		}
+	}
+	results := vs.client.DoMulti(ctx, cmds...)
+	for i := range remaining {
+		bytesData, err := results[i*step].AsBytes()
+		if err != nil {
+			if errors.Is(err, valkey.Nil) {
+				continue // Key does not exist
+			}
+			return nil, fmt.Errorf("failed to get key %s: %w", remaining[i], err)
+		}
+		var value structure.TranscodeInfo
+		if err := json.Unmarshal(bytesData, &value); err != nil {
+			logger.Error("Failed to unmarshal value from Valkey", slog.String("key", remaining[i]))
+			continue
+		}
+		values[remaining[i]] = value
+		if cache != nil && value.Status == "COMPLETED" {
+			vs.cacheCreative(cache, remaining[i], value, results[i*step+1], generation)
+		}
+	}
+	return values, nil
+}
+
+// Caches the creative for at most the remaining TTL of its key, given by the result of a PTTL
+func (vs *ValkeyStore) cacheCreative(
+	cache *lruCache,
+	key string,
+	value structure.TranscodeInfo,
+	pttl valkey.ValkeyResult,
+	generation uint64,
+) {
+	ttl, err := pttl.AsInt64()
+	switch {
+	case err != nil || ttl == -2:
+		// The TTL is unknown, or the creative expired right after it was read
+		return
+	case ttl == -1:
+		cache.add(cachedCreativePrefix+key, value, generation)
+	default:
+		cache.addExpiring(cachedCreativePrefix+key, value, generation, time.Duration(ttl)*time.Millisecond)
+	}
+}
+
+// Set stores the creative and adds it to the time index in one step.
+// Without a TTL, the creative does not expire.
 func (vs *ValkeyStore) Set(key string, value structure.TranscodeInfo, ttl ...int64) error {
+	_, err := vs.set(key, value, nil, ttl...)
+	return err
+}
+
+// CompareAndSet stores the creative only if the stored creative has the expected status.
+// Returns false if the creative was changed or removed in the meantime.
+func (vs *ValkeyStore) CompareAndSet(
+	key string,
+	expectedStatus string,
+	value structure.TranscodeInfo,
+	ttl ...int64,
+) (bool, error) {
+	return vs.set(key, value, &expectedStatus, ttl...)
+}
+
+func (vs *ValkeyStore) set(
+	key string,
+	value structure.TranscodeInfo,
+	expectedStatus *string,
+	ttl ...int64,
+) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	valueBytes, err := json.Marshal(value)
 	if err != nil {
-		return fmt.Errorf("failed to marshal value for key %s: %w", key, err)
-	}
-	err = vs.client.Do(
-		ctx,
-		vs.client.B().Set().
-			Key(key).
-			Value(string(valueBytes)).
-			Build()).
-		Error()
-	if err != nil {
-		return fmt.Errorf("failed to set key %s: %w", key, err)
+		return false, fmt.Errorf("failed to marshal value for key %s: %w", key, err)
 	}
+	var ttlValue int64
 	if len(ttl) > 0 {
-		ttlValue := ttl[0]
-
-		err = vs.client.Do(
-			ctx,
-			vs.client.B().Expire().
-				Key(key).
-				Seconds(int64(ttlValue)).
-				Build()).
-			Error()
-		if err != nil {
-			return fmt.Errorf("failed to set TTL for key %s: %w", key, err)
-		}
-	} else {
-		// make sure the key does not expire
-		err = vs.client.Do(
-			ctx,
-			vs.client.B().Persist().
-				Key(key).
-				Build()).
-			Error()
-		if err != nil {
-			return fmt.Errorf("failed to persist key %s: %w", key, err)
-		}
-		logger.Debug("Persisted key in Valkey", slog.String("key", key))
-		logger.Debug("Set key in Valkey",
-			slog.String("key", key),
-			slog.String("url", value.Url),
-			slog.String("status", value.Status),
-		)
+		ttlValue = ttl[0]
 	}
-	err = vs.updateTimeIndex(key)
+	checkStatus, status := "0", ""
+	if expectedStatus != nil {
+		checkStatus, status = "1", *expectedStatus
+	}
+	result, err := setCreativeScript.Exec(
+		ctx,
+		vs.client,
+		[]string{vs.keys.creative(key), vs.keys.timeIndex(key), vs.keys.createdIndex(key)},
+		[]string{
+			string(valueBytes),
+			strconv.FormatInt(ttlValue, 10),
+			strconv.FormatInt(time.Now().UnixMilli(), 10),
+			key,
+			checkStatus,
+			status,
+		},
+	).AsInt64()
 	if err != nil {
-		return fmt.Errorf("failed to update time index for key %s: %w", key, err)
+		return false, fmt.Errorf("failed to set key %s: %w", key, err)
 	}
-	return nil
+	// Only completed creatives are cached, so only their replacement is sent to the other instances
+	if result == 2 {
+		vs.invalidate(ctx, cachedCreativePrefix+key)
+	}
+	logger.Debug("Set key in Valkey",
+		slog.String("key", key),
+		slog.String("url", value.Url),
+		slog.String("status", value.Status),
+		slog.Int64("ttl", ttlValue),
+		slog.Bool("set", result > 0),
+	)
+	return result > 0, nil
 }
 
 func (vs *ValkeyStore) Ttl(key string) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
-	result, err := vs.client.Do(ctx, vs.client.B().Ttl().Key(key).Build()).AsInt64()
+	result, err := vs.client.Do(ctx, vs.client.B().Ttl().Key(vs.keys.creative(key)).Build()).AsInt64()
 	if err != nil {
 		logger.Warn("Could not get TTL from valkey", slog.String("key", key), slog.String("err", err.Error()))
 		return 0, err
@@ -161,6 +477,7 @@ func (vs *ValkeyStore) Ttl(key string) (int64, error) {
 	}
 }
 
+// EnqueuePackagingJob adds the job to the queue or stream named queueName, read by the packager.
 func (vs *ValkeyStore) EnqueuePackagingJob(queueName string, packagingJob structure.PackagingQueueMessage) error {
 	serializedJob, err := json.Marshal(packagingJob)
 	if err != nil {
@@ -168,11 +485,15 @@ func (vs *ValkeyStore) EnqueuePackagingJob(queueName string, packagingJob struct
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	queueKey := vs.keys.packagingQueue(queueName)
+	if vs.streamGroup != "" {
+		return vs.publishPackagingJob(ctx, queueKey, packagingJob.JobId, serializedJob)
+	}
 	err = vs.client.Do(
 		ctx,
 		vs.client.B().
 			Zadd().
-			Key(queueName).
+			Key(queueKey).
 			ScoreMember().
 			ScoreMember(float64(time.Now().UnixMilli()), string(serializedJob)).
 			Build()).
@@ -183,161 +504,1049 @@ func (vs *ValkeyStore) EnqueuePackagingJob(queueName string, packagingJob struct
 	return nil
 }
 
-func (vs *ValkeyStore) BlackList(value string) error {
+func (vs *ValkeyStore) publishPackagingJob(ctx context.Context, streamName string, jobId string, job []byte) error {
+	if _, created := vs.streamGroups.Load(streamName); !created {
+		// Create the consumer group from the start of the stream, so that no jobs are missed
+		err := vs.client.Do(
+			ctx,
+			vs.client.B().
+				XgroupCreate().
+				Key(streamName).
+				Group(vs.streamGroup).
+				Id("0").
+				Mkstream().
+				Build()).
+			Error()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group %s for stream %s: %w", vs.streamGroup, streamName, err)
+		}
+		vs.streamGroups.Store(streamName, true)
+	}
+	err := vs.client.Do(
+		ctx,
+		vs.client.B().
+			Xadd().
+			Key(streamName).
+			Id("*").
+			FieldValue().
+			FieldValue("jobId", jobId).
+			FieldValue("job", string(job)).
+			Build()).
+		Error()
+	if err != nil {
+		return fmt.Errorf("failed to publish packaging job %s: %w", jobId, err)
+	}
+	return nil
+}
+
+// TrackPackagingJob stores the packaging job with a deadline,
+// to be able to find jobs that never get a callback from the packager.
+func (vs *ValkeyStore) TrackPackagingJob(state structure.PackagingJobState) error {
+	serializedState, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize packaging job state for %s: %w", state.CreativeId, err)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := vs.client.Do(
+	err = vs.transaction(
 		ctx,
+		vs.client.B().
+			Hset().
+			Key(vs.keys.packagingJobs()).
+			FieldValue().
+			FieldValue(state.CreativeId, string(serializedState)).
+			Build(),
 		vs.client.B().
 			Zadd().
-			Key(BLACKLIST_KEY).
+			Key(vs.keys.packagingDeadlines()).
 			ScoreMember().
-			ScoreMember(float64(time.Now().UnixMilli()), value).
-			Build()).
-		Error()
+			ScoreMember(float64(state.Deadline), state.CreativeId).
+			Build(),
+	)
 	if err != nil {
-		return fmt.Errorf("failed to add key %s to blacklist: %w", value, err)
+		return fmt.Errorf("failed to track packaging job for %s: %w", state.CreativeId, err)
 	}
-	logger.Info("Added URL to blacklist", slog.String("key", value))
 	return nil
 }
 
-func (vs *ValkeyStore) InBlackList(value string) (bool, error) {
+func (vs *ValkeyStore) GetPackagingJob(creativeId string) (structure.PackagingJobState, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := vs.client.Do(ctx, vs.client.B().Zscore().Key(BLACKLIST_KEY).Member(value).Build()).AsFloat64()
+	var state structure.PackagingJobState
+	serializedState, err := vs.client.Do(
+		ctx,
+		vs.client.B().Hget().Key(vs.keys.packagingJobs()).Field(creativeId).Build(),
+	).AsBytes()
+	if errors.Is(err, valkey.Nil) {
+		return state, false, nil
+	}
 	if err != nil {
-		if errors.Is(err, valkey.Nil) {
-			return false, nil // Key is not in blacklist
+		return state, false, fmt.Errorf("failed to get packaging job of %s: %w", creativeId, err)
+	}
+	if err := json.Unmarshal(serializedState, &state); err != nil {
+		return state, false, fmt.Errorf("failed to unmarshal packaging job of %s: %w", creativeId, err)
+	}
+	return state, true, nil
+}
+
+func (vs *ValkeyStore) UntrackPackagingJob(creativeId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := vs.transaction(
+		ctx,
+		vs.client.B().Zrem().Key(vs.keys.packagingDeadlines()).Member(creativeId).Build(),
+		vs.client.B().Hdel().Key(vs.keys.packagingJobs()).Field(creativeId).Build(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to untrack packaging job for %s: %w", creativeId, err)
+	}
+	return nil
+}
+
+// PopTimedOutPackagingJobs returns and untracks all packaging jobs with a deadline before now.
+// A job is only returned to one caller, even if several instances poll for timeouts.
+func (vs *ValkeyStore) PopTimedOutPackagingJobs(now time.Time) ([]structure.PackagingJobState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	serializedStates, err := claimTimedOutPackagingJobsScript.Exec(
+		ctx,
+		vs.client,
+		[]string{vs.keys.packagingDeadlines(), vs.keys.packagingJobs()},
+		[]string{strconv.FormatInt(now.UnixMilli(), 10)},
+	).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim timed out packaging jobs: %w", err)
+	}
+	states := make([]structure.PackagingJobState, 0, len(serializedStates))
+	for _, serializedState := range serializedStates {
+		var state structure.PackagingJobState
+		if err := json.Unmarshal([]byte(serializedState), &state); err != nil {
+			logger.Error("Failed to unmarshal packaging job state", slog.String("error", err.Error()))
+			continue
 		}
-		return false, fmt.Errorf("failed to check if key %s is in blacklist: %w", value, err)
+		states = append(states, state)
 	}
-	return true, nil // If score is >= 0, the key is in the blacklist
+	return states, nil
 }
 
-func (vs *ValkeyStore) RemoveFromBlackList(value string) error {
+// SetJobCreative indexes the creative ID by transcoding job ID,
+// so that callbacks referring to the job can be resolved without asking Encore.
+func (vs *ValkeyStore) SetJobCreative(jobId string, creativeId string, ttl int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := vs.client.Do(
 		ctx,
-		vs.client.B().
-			Zrem().
-			Key(BLACKLIST_KEY).
-			Member(value).
+		vs.client.B().Set().
+			Key(vs.keys.jobIndex(jobId)).
+			Value(creativeId).
+			ExSeconds(ttl).
 			Build()).
 		Error()
+	if err != nil {
+		return fmt.Errorf("failed to index job %s: %w", jobId, err)
+	}
+	return nil
+}
 
+func (vs *ValkeyStore) GetJobCreative(jobId string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	creativeId, err := vs.client.Do(ctx, vs.client.B().Get().Key(vs.keys.jobIndex(jobId)).Build()).ToString()
 	if err != nil {
-		return fmt.Errorf("failed to remove key %s from blacklist: %w", value, err)
+		if errors.Is(err, valkey.Nil) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to get creative for job %s: %w", jobId, err)
+	}
+	return creativeId, true, nil
+}
+
+// AddSourceCreative indexes the creative ID by source URL, so that jobs can be found when a source
+// is blacklisted. Several creatives may share a source. The TTL is refreshed with each creative.
+func (vs *ValkeyStore) AddSourceCreative(source string, creativeId string, ttl int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	key := vs.keys.sourceIndex(source)
+	results := vs.client.DoMulti(
+		ctx,
+		vs.client.B().Sadd().Key(key).Member(creativeId).Build(),
+		vs.client.B().Expire().Key(key).Seconds(ttl).Build(),
+	)
+	for _, result := range results {
+		if err := result.Error(); err != nil {
+			return fmt.Errorf("failed to index source %s: %w", source, err)
+		}
 	}
-	logger.Info("Removed URL from blacklist", slog.String("key", value))
 	return nil
 }
 
-func (vs *ValkeyStore) GetBlackList(page int, size int) ([]string, int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (vs *ValkeyStore) GetSourceCreatives(source string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	start := int64(page * size)
-	end := int64(start + int64(size) - 1)
-	values, err := vs.client.Do(
+	creativeIds, err := vs.client.Do(
 		ctx,
-		vs.client.B().
-			Zrevrange().
-			Key(BLACKLIST_KEY).
-			Start(start).
-			Stop(end).
-			Build()).AsStrSlice()
+		vs.client.B().Smembers().Key(vs.keys.sourceIndex(source)).Build(),
+	).AsStrSlice()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get values from blacklist: %w", err)
+		return nil, fmt.Errorf("failed to get creatives for source %s: %w", source, err)
 	}
-	cardinality, err := vs.client.Do(
+	return creativeIds, nil
+}
+
+func (vs *ValkeyStore) AddWebhook(webhook structure.Webhook) error {
+	serializedWebhook, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to serialize webhook %s: %w", webhook.Url, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = vs.client.Do(
 		ctx,
-		vs.client.B().
-			Zcard().
-			Key(BLACKLIST_KEY).
-			Build()).AsInt64()
+		vs.client.B().Sadd().Key(vs.keys.webhooks()).Member(string(serializedWebhook)).Build(),
+	).Error()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get cardinality of blacklist: %w", err)
+		return fmt.Errorf("failed to add webhook %s: %w", webhook.Url, err)
 	}
-	return values, cardinality, nil
+	return nil
 }
 
-func (vs *ValkeyStore) updateTimeIndex(key string) error {
+func (vs *ValkeyStore) RemoveWebhook(webhook structure.Webhook) error {
+	serializedWebhook, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to serialize webhook %s: %w", webhook.Url, err)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := vs.client.Do(
+	err = vs.client.Do(
+		ctx,
+		vs.client.B().Srem().Key(vs.keys.webhooks()).Member(string(serializedWebhook)).Build(),
+	).Error()
+	if err != nil {
+		return fmt.Errorf("failed to remove webhook %s: %w", webhook.Url, err)
+	}
+	return nil
+}
+
+func (vs *ValkeyStore) GetWebhooks() ([]structure.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	members, err := vs.client.Do(ctx, vs.client.B().Smembers().Key(vs.keys.webhooks()).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	webhooks := make([]structure.Webhook, 0, len(members))
+	for _, member := range members {
+		var webhook structure.Webhook
+		if err := json.Unmarshal([]byte(member), &webhook); err != nil {
+			logger.Error("Failed to unmarshal webhook", slog.String("webhook", member))
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// EnqueueWebhookDelivery schedules the delivery to be sent at the due time.
+// A delivery claimed through this store is replaced, f.ex. when it is retried.
+func (vs *ValkeyStore) EnqueueWebhookDelivery(delivery structure.WebhookDelivery, due time.Time) error {
+	serializedDelivery, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to serialize webhook delivery %s: %w", delivery.Id, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if claimed, found := vs.claimedDeliveries.LoadAndDelete(delivery.Id); found {
+		err = replaceWebhookDeliveryScript.Exec(
+			ctx,
+			vs.client,
+			[]string{vs.keys.webhookDeliveries()},
+			[]string{claimed.(string), string(serializedDelivery), strconv.FormatInt(due.UnixMilli(), 10)},
+		).Error()
+		if err != nil {
+			return fmt.Errorf("failed to enqueue webhook delivery %s: %w", delivery.Id, err)
+		}
+		return nil
+	}
+	err = vs.client.Do(
 		ctx,
 		vs.client.B().
 			Zadd().
-			Key(TIME_INDEX_KEY).
+			Key(vs.keys.webhookDeliveries()).
 			ScoreMember().
-			ScoreMember(float64(time.Now().UnixMilli()), key).
+			ScoreMember(float64(due.UnixMilli()), string(serializedDelivery)).
 			Build()).
 		Error()
 	if err != nil {
-		return fmt.Errorf("failed to update time index for key %s: %w", key, err)
+		return fmt.Errorf("failed to enqueue webhook delivery %s: %w", delivery.Id, err)
 	}
-	return err
+	return nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit deliveries that are due, and postpones them to claimUntil.
+// A delivery is only returned to one caller until claimUntil, even if several instances poll the queue.
+func (vs *ValkeyStore) ClaimDueWebhookDeliveries(
+	now time.Time,
+	claimUntil time.Time,
+	limit int,
+) ([]structure.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	members, err := claimDueWebhookDeliveriesScript.Exec(
+		ctx,
+		vs.client,
+		[]string{vs.keys.webhookDeliveries()},
+		[]string{
+			strconv.FormatInt(now.UnixMilli(), 10),
+			strconv.FormatInt(claimUntil.UnixMilli(), 10),
+			strconv.Itoa(limit),
+		},
+	).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim due webhook deliveries: %w", err)
+	}
+	deliveries := make([]structure.WebhookDelivery, 0, len(members))
+	for _, member := range members {
+		var delivery structure.WebhookDelivery
+		if err := json.Unmarshal([]byte(member), &delivery); err != nil {
+			logger.Error("Failed to unmarshal webhook delivery", slog.String("delivery", member))
+			continue
+		}
+		vs.claimedDeliveries.Store(delivery.Id, member)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
 }
 
-func deleteFromTimeIndex(vs *ValkeyStore, key string) error {
+// RemoveWebhookDelivery removes a delivery claimed through this store, f.ex. after it was sent
+func (vs *ValkeyStore) RemoveWebhookDelivery(id string) error {
+	claimed, found := vs.claimedDeliveries.LoadAndDelete(id)
+	if !found {
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := vs.client.Do(
 		ctx,
+		vs.client.B().Zrem().Key(vs.keys.webhookDeliveries()).Member(claimed.(string)).Build(),
+	).Error()
+	if err != nil {
+		return fmt.Errorf("failed to remove webhook delivery %s: %w", id, err)
+	}
+	return nil
+}
+
+// PublishEvent sends the event to all instances subscribed to creative events
+func (vs *ValkeyStore) PublishEvent(event structure.CreativeEvent) error {
+	serializedEvent, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize event for %s: %w", event.CreativeId, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = vs.client.Do(
+		ctx,
+		vs.client.B().Publish().Channel(vs.keys.eventsChannel()).Message(string(serializedEvent)).Build(),
+	).Error()
+	if err != nil {
+		return fmt.Errorf("failed to publish event for %s: %w", event.CreativeId, err)
+	}
+	return nil
+}
+
+// SubscribeEvents calls the handler for each published creative event.
+// Blocks until the context is cancelled or the subscription fails.
+func (vs *ValkeyStore) SubscribeEvents(ctx context.Context, handler func(structure.CreativeEvent)) error {
+	// Subscribe on a dedicated connection, so that the subscription
+	// does not block other commands on the shared connection
+	dedicated, release := vs.client.Dedicate()
+	defer release()
+	subscribe := dedicated.B().Subscribe().Channel(vs.keys.eventsChannel()).Build()
+	return dedicated.Receive(ctx, subscribe, func(msg valkey.PubSubMessage) {
+		var event structure.CreativeEvent
+		if err := json.Unmarshal([]byte(msg.Message), &event); err != nil {
+			logger.Error("Failed to unmarshal creative event", slog.String("event", msg.Message))
+			return
+		}
+		handler(event)
+	})
+}
+
+func (vs *ValkeyStore) BlackList(value string, reason string) error {
+	return vs.BlackListAt(value, reason, time.Now().UnixMilli())
+}
+
+func (vs *ValkeyStore) BlackListAt(value string, reason string, timestamp int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cmds := valkey.Commands{
 		vs.client.B().
-			Zrem().
-			Key(TIME_INDEX_KEY).
-			Member(key).
-			Build()).
-		Error()
+			Zadd().
+			Key(vs.keys.blacklist()).
+			ScoreMember().
+			ScoreMember(float64(timestamp), value).
+			Build(),
+	}
+	if reason != "" {
+		cmds = append(cmds, vs.client.B().
+			Hset().
+			Key(vs.keys.blacklistReasons()).
+			FieldValue().
+			FieldValue(value, reason).
+			Build())
+	}
+	if err := vs.transaction(ctx, cmds...); err != nil {
+		return fmt.Errorf("failed to add key %s to blacklist: %w", value, err)
+	}
+	vs.invalidate(ctx, cachedBlacklistPrefix+value)
+	logger.Info("Added URL to blacklist", slog.String("key", value), slog.String("reason", reason))
+	return nil
+}
+
+// InBlackList checks if the value is in the blacklist. Both results are cached, if caching is enabled.
+func (vs *ValkeyStore) InBlackList(value string) (bool, error) {
+	cache := vs.activeCache()
+	if cache == nil {
+		return vs.inBlackList(value)
+	}
+	cached, hit := cache.get(cachedBlacklistPrefix + value)
+	vs.countCacheRequest("blacklist", hit)
+	if hit {
+		return cached.(bool), nil
+	}
+	generation := cache.currentGeneration()
+	blacklisted, err := vs.inBlackList(value)
 	if err != nil {
-		return fmt.Errorf("failed to delete key %s from time index: %w", key, err)
+		return false, err
 	}
-	return err
+	cache.add(cachedBlacklistPrefix+value, blacklisted, generation)
+	return blacklisted, nil
 }
 
-func (vs *ValkeyStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
+// InBlackListMany checks all values with one ZMSCORE. Both results are cached, if caching is enabled.
+func (vs *ValkeyStore) InBlackListMany(values []string) (map[string]bool, error) {
+	blacklisted := make(map[string]bool, len(values))
+	cache := vs.activeCache()
+	var generation uint64
+	remaining := values
+	if cache != nil {
+		remaining = make([]string, 0, len(values))
+		for _, value := range values {
+			cached, hit := cache.get(cachedBlacklistPrefix + value)
+			vs.countCacheRequest("blacklist", hit)
+			if hit {
+				blacklisted[value] = cached.(bool)
+			} else {
+				remaining = append(remaining, value)
+			}
+		}
+		generation = cache.currentGeneration()
+	}
+	if len(remaining) == 0 {
+		return blacklisted, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	scores, err := vs.client.Do(
+		ctx,
+		vs.client.B().Zmscore().Key(vs.keys.blacklist()).Member(remaining...).Build(),
+	).ToArray()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if keys are in blacklist: %w", err)
+	}
+	for i, score := range scores {
+		// Values that are not in the blacklist have no score
+		blacklisted[remaining[i]] = !score.IsNil()
+		if cache != nil {
+			cache.add(cachedBlacklistPrefix+remaining[i], blacklisted[remaining[i]], generation)
+		}
+	}
+	return blacklisted, nil
+}
+
+func (vs *ValkeyStore) inBlackList(value string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := vs.client.Do(ctx, vs.client.B().Zscore().Key(vs.keys.blacklist()).Member(value).Build()).AsFloat64()
+	if err != nil {
+		if errors.Is(err, valkey.Nil) {
+			return false, nil // Key is not in blacklist
+		}
+		return false, fmt.Errorf("failed to check if key %s is in blacklist: %w", value, err)
+	}
+	return true, nil // If score is >= 0, the key is in the blacklist
+}
+
+func (vs *ValkeyStore) RemoveFromBlackList(value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := vs.transaction(
+		ctx,
+		vs.client.B().Zrem().Key(vs.keys.blacklist()).Member(value).Build(),
+		vs.client.B().Hdel().Key(vs.keys.blacklistReasons()).Field(value).Build(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove key %s from blacklist: %w", value, err)
+	}
+	vs.invalidate(ctx, cachedBlacklistPrefix+value)
+	logger.Info("Removed URL from blacklist", slog.String("key", value))
+	return nil
+}
+
+func (vs *ValkeyStore) GetBlackList(page int, size int) ([]structure.BlacklistEntry, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	start := int64(page * size)
 	end := int64(start + int64(size) - 1)
-	keys, err := vs.client.Do(
+	values, err := vs.client.Do(
 		ctx,
 		vs.client.B().
 			Zrevrange().
-			Key(TIME_INDEX_KEY).
+			Key(vs.keys.blacklist()).
 			Start(start).
 			Stop(end).
-			Build()).AsStrSlice()
+			Withscores().
+			Build()).AsZScores()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get keys from time index: %w", err)
+		return nil, 0, fmt.Errorf("failed to get values from blacklist: %w", err)
 	}
 	cardinality, err := vs.client.Do(
 		ctx,
 		vs.client.B().
 			Zcard().
-			Key(TIME_INDEX_KEY).
+			Key(vs.keys.blacklist()).
 			Build()).AsInt64()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get cardinality of time index: %w", err)
+		return nil, 0, fmt.Errorf("failed to get cardinality of blacklist: %w", err)
+	}
+	entries := make([]structure.BlacklistEntry, 0, len(values))
+	if len(values) == 0 {
+		return entries, cardinality, nil
+	}
+	fields := make([]string, 0, len(values))
+	for _, v := range values {
+		fields = append(fields, v.Member)
+	}
+	reasons, err := vs.client.Do(
+		ctx,
+		vs.client.B().
+			Hmget().
+			Key(vs.keys.blacklistReasons()).
+			Field(fields...).
+			Build()).ToArray()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get blacklist reasons: %w", err)
+	}
+	for i, v := range values {
+		entry := structure.BlacklistEntry{
+			MediaUrl:  v.Member,
+			Timestamp: int64(v.Score),
+		}
+		if i < len(reasons) {
+			entry.Reason, _ = reasons[i].ToString() // nil if no reason was given
+		}
+		entries = append(entries, entry)
+	}
+	return entries, cardinality, nil
+}
+
+func (vs *ValkeyStore) List(page int, size int) ([]structure.TranscodeInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		results, cardinality, missing, err := vs.listPage(ctx, page, size)
+		if err != nil || len(missing) == 0 || attempt == listAttempts {
+			return results, cardinality, err
+		}
+		// Expired creatives are left in the time index until the pruner removes them. Remove the ones
+		// on the page right away and read the page again, so that it is filled with the creatives after them.
+		if _, err := vs.pruneTimeIndex(ctx, missing); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// Creatives of the page, the number of creatives in the time index, and the creatives of the page
+// that are in the time index but no longer exist.
+func (vs *ValkeyStore) listPage(
+	ctx context.Context,
+	page int,
+	size int,
+) ([]structure.TranscodeInfo, int64, []string, error) {
+	// The time index is split in shards. The newest creatives of all shards, up to the end of the page,
+	// are merged to find the creatives of the page.
+	fetched := (page + 1) * size
+	cmds := make(valkey.Commands, 0, 2*vs.keys.shards())
+	for shard := range vs.keys.shards() {
+		cmds = append(cmds, vs.client.B().Zcard().Key(vs.keys.shardTimeIndex(shard)).Build())
+	}
+	for shard := range vs.keys.shards() {
+		if fetched < 1 {
+			break
+		}
+		cmds = append(cmds, vs.client.B().
+			Zrevrange().
+			Key(vs.keys.shardTimeIndex(shard)).
+			Start(0).
+			Stop(int64(fetched-1)).
+			Withscores().
+			Build())
+	}
+	indexResults := vs.client.DoMulti(ctx, cmds...)
+	var cardinality int64
+	for _, result := range indexResults[:vs.keys.shards()] {
+		count, err := result.AsInt64()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to get cardinality of time index: %w", err)
+		}
+		cardinality += count
+	}
+	members := []valkey.ZScore{}
+	for _, result := range indexResults[vs.keys.shards():] {
+		scores, err := result.AsZScores()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to get keys from time index: %w", err)
+		}
+		members = append(members, scores...)
+	}
+	// Newest first, like ZREVRANGE
+	slices.SortFunc(members, func(a, b valkey.ZScore) int {
+		if a.Score != b.Score {
+			return cmp.Compare(b.Score, a.Score)
+		}
+		return strings.Compare(b.Member, a.Member)
+	})
+	start := min(max(page*size, 0), len(members))
+	end := max(min(fetched, len(members)), start)
+	keys := make([]string, 0, end-start)
+	for _, member := range members[start:end] {
+		keys = append(keys, member.Member)
 	}
 	results := make([]structure.TranscodeInfo, 0, len(keys))
-	mGetRes, err := valkey.MGet(vs.client, ctx, keys)
+	if len(keys) == 0 {
+		return results, cardinality, nil, nil
+	}
+	// The creatives are spread over the slots of a cluster, so they are fetched with a GET each
+	// instead of an MGET. The client sends the GETs to the nodes in one pipeline per node.
+	gets := make(valkey.Commands, 0, len(keys))
 	for _, key := range keys {
-		data, ok := mGetRes[key]
-		if !ok {
-			continue // Key does not exist
+		gets = append(gets, vs.client.B().Get().Key(vs.keys.creative(key)).Build())
+	}
+	var missing []string
+	for i, result := range vs.client.DoMulti(ctx, gets...) {
+		bytesData, err := result.AsBytes()
+		if err != nil {
+			if errors.Is(err, valkey.Nil) {
+				missing = append(missing, keys[i])
+				continue
+			}
+			return nil, 0, nil, fmt.Errorf("failed to get key %s: %w", keys[i], err)
 		}
-		// TODO: Error handling
-		bytesData, _ := data.AsBytes()
 		var value structure.TranscodeInfo
 		err = json.Unmarshal(bytesData, &value)
 		if err != nil {
-			logger.Error("Failed to unmarshal value from Valkey", slog.String("key", key))
+			logger.Error("Failed to unmarshal value from Valkey", slog.String("key", keys[i]))
 			continue
 		}
 		results = append(results, value)
 	}
-	return results, cardinality, err
+	return results, cardinality, missing, nil
+}
+
+// ListJobs returns a page of the creatives selected by the query. The creatives are read from
+// the created index in batches, with the time of their last update, and filtered, until the page is full
+// or jobQueryMaxScanned creatives have been read. In the latter case the page may be short, or even empty,
+// with a cursor to continue.
+func (vs *ValkeyStore) ListJobs(query JobQuery) ([]structure.TranscodeInfo, string, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := []structure.TranscodeInfo{}
+	for scanned := 0; scanned < jobQueryMaxScanned; {
+		members, exhausted, err := vs.jobQueryBatch(ctx, query, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(members) == 0 {
+			return results, "", nil
+		}
+		// Pairs of the creative and its score in the time index
+		cmds := make(valkey.Commands, 0, 2*len(members))
+		for _, member := range members {
+			cmds = append(cmds,
+				vs.client.B().Get().Key(vs.keys.creative(member.Member)).Build(),
+				vs.client.B().Zscore().Key(vs.keys.timeIndex(member.Member)).Member(member.Member).Build(),
+			)
+		}
+		replies := vs.client.DoMulti(ctx, cmds...)
+		var missing []string
+		for i, member := range members {
+			cursor = &jobCursor{created: int64(member.Score), key: member.Member}
+			scanned++
+			bytesData, err := replies[2*i].AsBytes()
+			if err != nil {
+				if errors.Is(err, valkey.Nil) {
+					missing = append(missing, member.Member)
+					continue
+				}
+				return nil, "", fmt.Errorf("failed to get key %s: %w", member.Member, err)
+			}
+			updated, err := replies[2*i+1].AsFloat64()
+			if errors.Is(err, valkey.Nil) {
+				updated = member.Score
+			} else if err != nil {
+				return nil, "", fmt.Errorf("failed to get update time of %s: %w", member.Member, err)
+			}
+			if !query.inRange(int64(updated)) {
+				continue
+			}
+			var value structure.TranscodeInfo
+			if err := json.Unmarshal(bytesData, &value); err != nil {
+				logger.Error("Failed to unmarshal value from Valkey", slog.String("key", member.Member))
+				continue
+			}
+			if !query.matches(value) {
+				continue
+			}
+			results = append(results, value)
+			if len(results) == query.Size {
+				if exhausted && i == len(members)-1 {
+					return results, "", nil
+				}
+				return results, encodeJobCursor(cursor.created, cursor.key), nil
+			}
+		}
+		if len(missing) > 0 {
+			if _, err := vs.pruneTimeIndex(ctx, missing); err != nil {
+				return nil, "", err
+			}
+		}
+		if exhausted {
+			return results, "", nil
+		}
+	}
+	return results, encodeJobCursor(cursor.created, cursor.key), nil
+}
+
+// The next jobQueryBatchSize members of the created index in the order of the query, after the cursor,
+// and whether there are no members after them. A creative is created before it is updated, so only
+// the end of the update range of the query bounds the members.
+func (vs *ValkeyStore) jobQueryBatch(
+	ctx context.Context,
+	query JobQuery,
+	cursor *jobCursor,
+) ([]valkey.ZScore, bool, error) {
+	// Score bounds of the members after the cursor, exclusive of the score of the cursor.
+	// Members with the same score as the cursor are read separately, and compared by key.
+	lower, upper := "-inf", "+inf"
+	if query.UpdatedTo > 0 {
+		upper = "(" + strconv.FormatInt(query.UpdatedTo, 10)
+	}
+	if cursor != nil && query.newestFirst() {
+		upper = "(" + strconv.FormatInt(cursor.created, 10)
+	} else if cursor != nil {
+		lower = "(" + strconv.FormatInt(cursor.created, 10)
+	}
+	cmds := make(valkey.Commands, 0, 2*vs.keys.shards())
+	for shard := range vs.keys.shards() {
+		key := vs.keys.shardCreatedIndex(shard)
+		if query.newestFirst() {
+			cmds = append(cmds, vs.client.B().Zrevrangebyscore().Key(key).Max(upper).Min(lower).
+				Withscores().Limit(0, jobQueryBatchSize).Build())
+		} else {
+			cmds = append(cmds, vs.client.B().Zrangebyscore().Key(key).Min(lower).Max(upper).
+				Withscores().Limit(0, jobQueryBatchSize).Build())
+		}
+		if cursor != nil {
+			score := strconv.FormatInt(cursor.created, 10)
+			cmds = append(cmds, vs.client.B().Zrangebyscore().Key(key).Min(score).Max(score).Withscores().Build())
+		}
+	}
+	members := []valkey.ZScore{}
+	exhausted := true
+	for i, result := range vs.client.DoMulti(ctx, cmds...) {
+		scores, err := result.AsZScores()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get keys from created index: %w", err)
+		}
+		tied := cursor != nil && i%2 == 1
+		if !tied && len(scores) == jobQueryBatchSize {
+			exhausted = false
+		}
+		for _, score := range scores {
+			if !tied || query.after(int64(score.Score), score.Member, cursor) {
+				members = append(members, score)
+			}
+		}
+	}
+	slices.SortFunc(members, func(a, b valkey.ZScore) int {
+		return query.compare(int64(a.Score), a.Member, int64(b.Score), b.Member)
+	})
+	if len(members) > jobQueryBatchSize {
+		return members[:jobQueryBatchSize], false, nil
+	}
+	return members, exhausted, nil
+}
+
+// PruneTimeIndex removes the creatives that no longer exist from the time index,
+// and returns the number of removed creatives.
+func (vs *ValkeyStore) PruneTimeIndex(ctx context.Context) (int64, error) {
+	var pruned int64
+	for shard := range vs.keys.shards() {
+		var cursor uint64
+		for {
+			entry, err := vs.client.Do(ctx, vs.client.B().
+				Zscan().
+				Key(vs.keys.shardTimeIndex(shard)).
+				Cursor(cursor).
+				Count(pruneBatchSize).
+				Build()).AsScanEntry()
+			if err != nil {
+				return pruned, fmt.Errorf("failed to scan time index: %w", err)
+			}
+			// The elements are pairs of member and score
+			creativeIds := make([]string, 0, len(entry.Elements)/2)
+			for i := 0; i < len(entry.Elements); i += 2 {
+				creativeIds = append(creativeIds, entry.Elements[i])
+			}
+			removed, err := vs.pruneTimeIndex(ctx, creativeIds)
+			pruned += removed
+			if err != nil {
+				return pruned, err
+			}
+			cursor = entry.Cursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// ExportCreatives scans the time index of each shard, and reads the creatives of each batch
+// with their expiry in one pipeline. Creatives that have expired in the meantime are left out.
+// Each batch has its own timeout, the export as a whole is only limited by the context.
+func (vs *ValkeyStore) ExportCreatives(
+	ctx context.Context,
+	fn func(key string, value structure.TranscodeInfo, expiresAt int64) error,
+) error {
+	for shard := range vs.keys.shards() {
+		var cursor uint64
+		for {
+			entry, results, err := vs.exportBatch(ctx, shard, cursor)
+			if err != nil {
+				return err
+			}
+			now := time.Now().UnixMilli()
+			for i := 0; i < len(entry.Elements); i += 2 {
+				key := entry.Elements[i]
+				bytesData, err := results[i].AsBytes()
+				if errors.Is(err, valkey.Nil) {
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("failed to get key %s: %w", key, err)
+				}
+				var value structure.TranscodeInfo
+				if err := json.Unmarshal(bytesData, &value); err != nil {
+					logger.Error("Failed to unmarshal value from Valkey", slog.String("key", key))
+					continue
+				}
+				ttl, err := results[i+1].AsInt64()
+				if err != nil {
+					return fmt.Errorf("failed to get TTL of key %s: %w", key, err)
+				}
+				var expiresAt int64
+				switch {
+				case ttl == -2: // expired after the GET
+					continue
+				case ttl >= 0:
+					expiresAt = now + ttl
+				}
+				if err := fn(key, value, expiresAt); err != nil {
+					return err
+				}
+			}
+			cursor = entry.Cursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Scans a batch of the time index of the shard, and reads the GET and PTTL of each of its creatives.
+// The elements of the scan entry are pairs of member and score, like the results are pairs of GET and PTTL.
+func (vs *ValkeyStore) exportBatch(
+	ctx context.Context,
+	shard int,
+	cursor uint64,
+) (valkey.ScanEntry, []valkey.ValkeyResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	entry, err := vs.client.Do(ctx, vs.client.B().
+		Zscan().
+		Key(vs.keys.shardTimeIndex(shard)).
+		Cursor(cursor).
+		Count(pruneBatchSize).
+		Build()).AsScanEntry()
+	if err != nil {
+		return entry, nil, fmt.Errorf("failed to scan time index: %w", err)
+	}
+	cmds := make(valkey.Commands, 0, len(entry.Elements))
+	for i := 0; i < len(entry.Elements); i += 2 {
+		key := entry.Elements[i]
+		cmds = append(cmds,
+			vs.client.B().Get().Key(vs.keys.creative(key)).Build(),
+			vs.client.B().Pttl().Key(vs.keys.creative(key)).Build(),
+		)
+	}
+	if len(cmds) == 0 {
+		return entry, nil, nil
+	}
+	return entry, vs.client.DoMulti(ctx, cmds...), nil
+}
+
+// GetPackagingJobs returns the tracked packaging jobs, by earliest deadline first
+func (vs *ValkeyStore) GetPackagingJobs() ([]structure.PackagingJobState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	serializedStates, err := vs.client.Do(
+		ctx,
+		vs.client.B().Hvals().Key(vs.keys.packagingJobs()).Build(),
+	).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packaging jobs: %w", err)
+	}
+	states := make([]structure.PackagingJobState, 0, len(serializedStates))
+	for _, serializedState := range serializedStates {
+		var state structure.PackagingJobState
+		if err := json.Unmarshal([]byte(serializedState), &state); err != nil {
+			logger.Error("Failed to unmarshal packaging job state", slog.String("error", err.Error()))
+			continue
+		}
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b structure.PackagingJobState) int {
+		return cmp.Or(cmp.Compare(a.Deadline, b.Deadline), strings.Compare(a.CreativeId, b.CreativeId))
+	})
+	return states, nil
+}
+
+// Removes the given creatives from the time indexes if they no longer exist. The check and the removal
+// are done by a script for each shard, so that a creative that is stored again in the meantime is kept.
+func (vs *ValkeyStore) pruneTimeIndex(ctx context.Context, creativeIds []string) (int64, error) {
+	if len(creativeIds) == 0 {
+		return 0, nil
+	}
+	shards := map[int]*valkey.LuaExec{}
+	for _, creativeId := range creativeIds {
+		shard := vs.keys.shard(creativeId)
+		exec, found := shards[shard]
+		if !found {
+			exec = &valkey.LuaExec{Keys: []string{vs.keys.shardTimeIndex(shard), vs.keys.shardCreatedIndex(shard)}}
+			shards[shard] = exec
+		}
+		exec.Keys = append(exec.Keys, vs.keys.creative(creativeId))
+		exec.Args = append(exec.Args, creativeId)
+	}
+	execs := make([]valkey.LuaExec, 0, len(shards))
+	for _, exec := range shards {
+		execs = append(execs, *exec)
+	}
+	var pruned int64
+	for _, result := range pruneTimeIndexScript.ExecMulti(ctx, vs.client, execs...) {
+		removed, err := result.AsInt64()
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune time index: %w", err)
+		}
+		pruned += removed
+	}
+	return pruned, nil
+}
+
+// RunTimeIndexPruner periodically removes expired creatives from the time index,
+// until the context is cancelled.
+func (vs *ValkeyStore) RunTimeIndexPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pruned, err := vs.PruneTimeIndex(ctx)
+			if err != nil {
+				logger.Error("Failed to prune time index", slog.String("error", err.Error()))
+			}
+			if pruned > 0 {
+				logger.Info("Pruned time index", slog.Int64("removed", pruned))
+			}
+		case <-ctx.Done():
+			logger.Info("Stopping time index pruner")
+			return
+		}
+	}
+}
+
+// AppendHistory adds the event to the stream holding the history of the creative.
+// The stream is trimmed to about HISTORY_MAX_EVENTS events and expires HISTORY_TTL after the last event.
+func (vs *ValkeyStore) AppendHistory(creativeId string, event structure.HistoryEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return fmt.Errorf("failed to serialize history event of %s: %w", creativeId, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	key := vs.keys.history(creativeId)
+	err = vs.transaction(
+		ctx,
+		vs.client.B().
+			Xadd().
+			Key(key).
+			Maxlen().
+			Almost().
+			Threshold(strconv.Itoa(HISTORY_MAX_EVENTS)).
+			Id("*").
+			FieldValue().
+			FieldValue("timestamp", strconv.FormatInt(event.Timestamp, 10)).
+			FieldValue("event", event.Event).
+			FieldValue("source", event.Source).
+			FieldValue("details", string(details)).
+			Build(),
+		vs.client.B().Pexpire().Key(key).Milliseconds(HISTORY_TTL.Milliseconds()).Build(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to append history event of %s: %w", creativeId, err)
+	}
+	return nil
+}
+
+func (vs *ValkeyStore) GetHistory(creativeId string) ([]structure.HistoryEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries, err := vs.client.Do(
+		ctx,
+		vs.client.B().Xrange().Key(vs.keys.history(creativeId)).Start("-").End("+").Build(),
+	).AsXRange()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history of %s: %w", creativeId, err)
+	}
+	history := make([]structure.HistoryEvent, 0, len(entries))
+	for _, entry := range entries {
+		event := structure.HistoryEvent{
+			Event:  entry.FieldValues["event"],
+			Source: entry.FieldValues["source"],
+		}
+		event.Timestamp, _ = strconv.ParseInt(entry.FieldValues["timestamp"], 10, 64)
+		if err := json.Unmarshal([]byte(entry.FieldValues["details"]), &event.Details); err != nil {
+			logger.Error("Failed to unmarshal history event details",
+				slog.String("creativeId", creativeId),
+				slog.String("id", entry.ID),
+			)
+		}
+		history = append(history, event)
+	}
+	return history, nil
 }
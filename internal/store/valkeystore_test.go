@@ -1,9 +1,14 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -85,6 +90,63 @@ func TestValkeyStoreTtl(t *testing.T) {
 	is.NoErr(err)
 }
 
+func TestValkeyStoreCompareAndSet(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	is.NoErr(store.Set("cas-key", structure.TranscodeInfo{Status: "QUEUED"}, 60))
+
+	set, err := store.CompareAndSet("cas-key", "QUEUED", structure.TranscodeInfo{Status: "IN_PROGRESS", Progress: 10}, 60)
+	is.NoErr(err)
+	is.True(set)
+	// A late update based on the old status is rejected
+	set, err = store.CompareAndSet("cas-key", "QUEUED", structure.TranscodeInfo{Status: "IN_PROGRESS", Progress: 5}, 60)
+	is.NoErr(err)
+	is.True(!set)
+	value, _, _ := store.Get("cas-key")
+	is.Equal(value.Progress, 10)
+	ttl, _ := store.Ttl("cas-key")
+	is.True(ttl > 0)
+
+	set, err = store.CompareAndSet("unknown-key", "", structure.TranscodeInfo{Status: "IN_PROGRESS"})
+	is.NoErr(err)
+	is.True(!set)
+	_, found, _ := store.Get("unknown-key")
+	is.True(!found)
+	is.NoErr(store.Delete("cas-key"))
+}
+
+func TestValkeyStoreGetMany(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	is.NoErr(store.Set("many-a", structure.TranscodeInfo{Status: "COMPLETED"}, 60))
+	is.NoErr(store.Set("many-b", structure.TranscodeInfo{Status: "QUEUED"}, 60))
+	values, err := store.GetMany([]string{"many-a", "many-b", "many-unknown"})
+	is.NoErr(err)
+	is.Equal(values, map[string]structure.TranscodeInfo{
+		"many-a": {Status: "COMPLETED"},
+		"many-b": {Status: "QUEUED"},
+	})
+	values, err = store.GetMany(nil)
+	is.NoErr(err)
+	is.Equal(len(values), 0)
+
+	is.NoErr(store.BlackList("https://example.com/many-broken.mp4", ""))
+	blacklisted, err := store.InBlackListMany([]string{
+		"https://example.com/many-broken.mp4",
+		"https://example.com/many-ok.mp4",
+	})
+	is.NoErr(err)
+	is.Equal(blacklisted, map[string]bool{
+		"https://example.com/many-broken.mp4": true,
+		"https://example.com/many-ok.mp4":     false,
+	})
+	is.NoErr(store.RemoveFromBlackList("https://example.com/many-broken.mp4"))
+	is.NoErr(store.Delete("many-a"))
+	is.NoErr(store.Delete("many-b"))
+}
+
 func TestQueuePackagingJob(t *testing.T) {
 	is := is.New(t)
 	store, err := NewValkeyStore("redis://" + redisAdress)
@@ -99,12 +161,218 @@ func TestQueuePackagingJob(t *testing.T) {
 	is.NoErr(err)
 }
 
+func TestQueuePackagingJobStream(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://"+redisAdress, WithStreamPackagingQueue("encore-packager"))
+	is.NoErr(err)
+
+	packagingJob := structure.PackagingQueueMessage{
+		JobId: "test-job-id",
+		Url:   "http://example-encore.osaas.io/encoreJobs/test-job-id",
+	}
+	err = store.EnqueuePackagingJob("test-stream", packagingJob)
+	is.NoErr(err)
+	err = store.EnqueuePackagingJob("test-stream", packagingJob)
+	is.NoErr(err) // consumer group already exists
+
+	entries, err := store.client.Do(
+		context.Background(),
+		store.client.B().Xrange().Key("test-stream").Start("-").End("+").Build(),
+	).AsXRange()
+	is.NoErr(err)
+	is.Equal(len(entries), 2)
+	is.Equal(entries[0].FieldValues["jobId"], "test-job-id")
+	var queued structure.PackagingQueueMessage
+	err = json.Unmarshal([]byte(entries[0].FieldValues["job"]), &queued)
+	is.NoErr(err)
+	is.Equal(queued, packagingJob)
+}
+
+func TestPackagingJobTracking(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	now := time.Now()
+	for i, creativeId := range []string{"timed-out", "in-time", "completed"} {
+		err = store.TrackPackagingJob(structure.PackagingJobState{
+			CreativeId: creativeId,
+			Job:        structure.PackagingQueueMessage{JobId: "job-" + creativeId},
+			Attempts:   i,
+			Deadline:   now.Add(time.Duration(2*i-1) * time.Minute).UnixMilli(),
+		})
+		is.NoErr(err)
+	}
+	err = store.UntrackPackagingJob("completed")
+	is.NoErr(err)
+
+	timedOut, err := store.PopTimedOutPackagingJobs(now.Add(time.Second))
+	is.NoErr(err)
+	is.Equal(len(timedOut), 1)
+	is.Equal(timedOut[0].CreativeId, "timed-out")
+	is.Equal(timedOut[0].Job.JobId, "job-timed-out")
+
+	// Timed out jobs are only returned once
+	timedOut, err = store.PopTimedOutPackagingJobs(now.Add(time.Second))
+	is.NoErr(err)
+	is.Equal(len(timedOut), 0)
+
+	timedOut, err = store.PopTimedOutPackagingJobs(now.Add(time.Hour))
+	is.NoErr(err)
+	is.Equal(len(timedOut), 1)
+	is.Equal(timedOut[0].CreativeId, "in-time")
+	is.Equal(timedOut[0].Attempts, 1)
+
+	// A deadline without job state is claimed, but not returned
+	err = store.client.Do(
+		context.Background(),
+		store.client.B().Zadd().Key(store.keys.packagingDeadlines()).ScoreMember().ScoreMember(1, "orphan").Build(),
+	).Error()
+	is.NoErr(err)
+	timedOut, err = store.PopTimedOutPackagingJobs(now)
+	is.NoErr(err)
+	is.Equal(len(timedOut), 0)
+	remaining, err := store.client.Do(
+		context.Background(),
+		store.client.B().Zcard().Key(store.keys.packagingDeadlines()).Build(),
+	).AsInt64()
+	is.NoErr(err)
+	is.Equal(remaining, int64(0))
+}
+
+func TestJobCreativeIndex(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+
+	err = store.SetJobCreative("test-job-id", "creative", 60)
+	is.NoErr(err)
+	creativeId, found, err := store.GetJobCreative("test-job-id")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(creativeId, "creative")
+	is.Equal(minir.TTL(store.keys.jobIndex("test-job-id")), 60*time.Second)
+
+	_, found, err = store.GetJobCreative("unknown-job-id")
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestSourceCreativeIndex(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+
+	is.NoErr(store.AddSourceCreative("https://ads.example.com/ad.mp4", "creative-a", 60))
+	is.NoErr(store.AddSourceCreative("https://ads.example.com/ad.mp4", "creative-b", 120))
+	creativeIds, err := store.GetSourceCreatives("https://ads.example.com/ad.mp4")
+	is.NoErr(err)
+	slices.Sort(creativeIds)
+	is.Equal(creativeIds, []string{"creative-a", "creative-b"})
+	is.Equal(minir.TTL(store.keys.sourceIndex("https://ads.example.com/ad.mp4")), 120*time.Second)
+
+	creativeIds, err = store.GetSourceCreatives("https://ads.example.com/unknown.mp4")
+	is.NoErr(err)
+	is.Equal(len(creativeIds), 0)
+}
+
+func TestWebhooks(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	global := structure.Webhook{Url: "https://hooks.example.com/all"}
+	scoped := structure.Webhook{Url: "https://hooks.example.com/tenant", Subdomain: "tenant"}
+	is.NoErr(store.AddWebhook(global))
+	is.NoErr(store.AddWebhook(scoped))
+	is.NoErr(store.AddWebhook(scoped)) // registering twice is a no-op
+	webhooks, err := store.GetWebhooks()
+	is.NoErr(err)
+	is.Equal(len(webhooks), 2)
+
+	is.NoErr(store.RemoveWebhook(scoped))
+	webhooks, err = store.GetWebhooks()
+	is.NoErr(err)
+	is.Equal(webhooks, []structure.Webhook{global})
+	is.NoErr(store.RemoveWebhook(global))
+}
+
+func TestWebhookDeliveryQueue(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	now := time.Now()
+	for i := range 3 {
+		delivery := structure.WebhookDelivery{
+			Id:    "delivery-" + strconv.Itoa(i),
+			Url:   "https://hooks.example.com",
+			Event: structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"},
+		}
+		// delivery-2 is not due yet
+		is.NoErr(store.EnqueueWebhookDelivery(delivery, now.Add(time.Duration(i-1)*time.Minute)))
+	}
+	claimUntil := now.Add(3 * time.Minute)
+	due, err := store.ClaimDueWebhookDeliveries(now, claimUntil, 1)
+	is.NoErr(err)
+	is.Equal(len(due), 1)
+	is.Equal(due[0].Id, "delivery-0")
+	due, err = store.ClaimDueWebhookDeliveries(now, claimUntil, 10)
+	is.NoErr(err)
+	is.Equal(len(due), 1)
+	is.Equal(due[0].Id, "delivery-1")
+	is.Equal(due[0].Event.CreativeId, "creative")
+
+	due, err = store.ClaimDueWebhookDeliveries(now.Add(2*time.Minute), claimUntil, 10)
+	is.NoErr(err)
+	is.Equal(len(due), 1)
+	is.Equal(due[0].Id, "delivery-2")
+
+	// Claimed deliveries are due again when their claim times out, unless removed or rescheduled
+	is.NoErr(store.RemoveWebhookDelivery("delivery-0"))
+	retry := due[0]
+	retry.Attempts++
+	is.NoErr(store.EnqueueWebhookDelivery(retry, now.Add(4*time.Minute)))
+	due, err = store.ClaimDueWebhookDeliveries(claimUntil, now.Add(5*time.Minute), 10)
+	is.NoErr(err)
+	is.Equal(len(due), 1)
+	is.Equal(due[0].Id, "delivery-1")
+	due, err = store.ClaimDueWebhookDeliveries(now.Add(4*time.Minute), now.Add(5*time.Minute), 10)
+	is.NoErr(err)
+	is.Equal(due, []structure.WebhookDelivery{retry})
+}
+
+func TestEventPubSub(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan structure.CreativeEvent, 10)
+	go func() {
+		_ = store.SubscribeEvents(ctx, func(event structure.CreativeEvent) {
+			received <- event
+		})
+	}()
+	// Publish until the subscription is set up
+	event := structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"}
+	deadline := time.After(5 * time.Second)
+	for {
+		is.NoErr(store.PublishEvent(event))
+		select {
+		case got := <-received:
+			is.Equal(got, event)
+			return
+		case <-deadline:
+			t.Fatal("no event received")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
 func TestBlackList(t *testing.T) {
 	is := is.New(t)
 	store, err := NewValkeyStore("redis://" + redisAdress)
 	is.NoErr(err)
 
-	err = store.BlackList("test-key")
+	err = store.BlackList("test-key", "source responded with status 404")
 	is.NoErr(err)
 
 	inBlackList, err := store.InBlackList("test-key")
@@ -115,7 +383,9 @@ func TestBlackList(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(cardinality, int64(1))
 	is.Equal(len(fullBlacklist), 1)
-	is.Equal(fullBlacklist[0], "test-key")
+	is.Equal(fullBlacklist[0].MediaUrl, "test-key")
+	is.Equal(fullBlacklist[0].Reason, "source responded with status 404")
+	is.True(fullBlacklist[0].Timestamp > 0)
 
 	err = store.RemoveFromBlackList("test-key")
 	is.NoErr(err)
@@ -123,6 +393,14 @@ func TestBlackList(t *testing.T) {
 	is.NoErr(err)
 	is.True(!inBlackList) // Should not be in blacklist anymore
 
+	err = store.BlackList("test-key", "")
+	is.NoErr(err)
+	fullBlacklist, _, err = store.GetBlackList(0, 10)
+	is.NoErr(err)
+	is.Equal(fullBlacklist[0].Reason, "") // reason is cleared when removed
+	err = store.RemoveFromBlackList("test-key")
+	is.NoErr(err)
+
 }
 
 func TestList(t *testing.T) {
@@ -166,3 +444,176 @@ func TestList(t *testing.T) {
 	is.Equal(len(results), 0)
 	is.Equal(cardinality, int64(0))
 }
+
+func TestListSkipsExpiredCreatives(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://" + mr.Addr())
+	is.NoErr(err)
+	for i := range 20 {
+		key := "creative-" + strconv.Itoa(i)
+		// Every other creative expires
+		var ttl int64 = 0
+		if i%2 == 0 {
+			ttl = 60
+		}
+		is.NoErr(store.Set(key, structure.TranscodeInfo{Url: key, Status: "COMPLETED"}, ttl))
+	}
+	mr.FastForward(2 * time.Minute)
+
+	// The page is filled with the creatives after the expired ones
+	results, total, err := store.List(0, 5)
+	is.NoErr(err)
+	is.Equal(len(results), 5)
+	for _, result := range results {
+		index, _ := strconv.Atoi(strings.TrimPrefix(result.Url, "creative-"))
+		is.True(index%2 == 1)
+	}
+	is.True(total < 20)
+
+	pruned, err := store.PruneTimeIndex(context.Background())
+	is.NoErr(err)
+	is.True(pruned > 0)
+	_, total, err = store.List(0, 5)
+	is.NoErr(err)
+	is.Equal(total, int64(10))
+	pruned, err = store.PruneTimeIndex(context.Background())
+	is.NoErr(err)
+	is.Equal(pruned, int64(0))
+}
+
+func TestValkeyStoreListJobs(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://" + mr.Addr())
+	is.NoErr(err)
+	testListJobs(t, store, time.Now, func() { time.Sleep(2 * time.Millisecond) })
+}
+
+func TestValkeyStoreListJobsBatches(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://" + mr.Addr())
+	is.NoErr(err)
+	expected := []string{}
+	for i := range 2*jobQueryBatchSize + 50 {
+		key := fmt.Sprintf("creative-%03d", i)
+		status := "COMPLETED"
+		if i%50 == 0 {
+			status = "FAILED"
+			expected = append(expected, key)
+		}
+		is.NoErr(store.Set(key, structure.TranscodeInfo{Url: key, Status: status}))
+		// All creatives are created at the same time, so they are ordered by key
+		_, err := mr.ZAdd(store.keys.createdIndex(key), 1000, key)
+		is.NoErr(err)
+	}
+	slices.Reverse(expected)
+	is.Equal(listAllJobs(t, store, JobQuery{Statuses: []string{"FAILED"}, Size: 4}), expected)
+
+	// Expired creatives are skipped
+	mr.Del(store.keys.creative("creative-400"))
+	is.Equal(listAllJobs(t, store, JobQuery{Statuses: []string{"FAILED"}, Size: 4}), expected[1:])
+}
+
+func TestValkeyStoreBackfillsCreatedIndex(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://"+mr.Addr(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+	for _, key := range []string{"first", "second"} {
+		is.NoErr(store.Set(key, structure.TranscodeInfo{Url: key}))
+		time.Sleep(2 * time.Millisecond)
+	}
+	// Stored by a release without the created index
+	for shard := range JOB_SHARDS {
+		mr.Del(store.keys.shardCreatedIndex(shard))
+	}
+
+	store, err = NewValkeyStore("redis://"+mr.Addr(), WithKeyPrefix("ad-normalizer"))
+	is.NoErr(err)
+	is.Equal(listAllJobs(t, store, JobQuery{Size: 1}), []string{"second", "first"})
+	updated, err := mr.ZScore(store.keys.timeIndex("first"), "first")
+	is.NoErr(err)
+	created, err := mr.ZScore(store.keys.createdIndex("first"), "first")
+	is.NoErr(err)
+	is.Equal(created, updated)
+}
+
+func TestValkeyStoreHistory(t *testing.T) {
+	is := is.New(t)
+	store, err := NewValkeyStore("redis://" + redisAdress)
+	is.NoErr(err)
+	history, err := store.GetHistory("history-key")
+	is.NoErr(err)
+	is.Equal(len(history), 0)
+
+	is.NoErr(store.Set("history-key", structure.TranscodeInfo{Status: "QUEUED"}))
+	is.NoErr(store.AppendHistory("history-key", structure.HistoryEvent{
+		Timestamp: 1700000000000,
+		Event:     structure.HistoryDispatched,
+		Source:    structure.HistorySourceNormalizer,
+		Details:   map[string]string{"jobId": "job-id"},
+	}))
+	is.NoErr(store.AppendHistory("history-key", structure.HistoryEvent{
+		Timestamp: 1700000001000,
+		Event:     structure.HistoryTranscodeFailed,
+		Source:    structure.HistorySourceTranscoder,
+	}))
+	// The history is kept when the creative is removed
+	is.NoErr(store.Delete("history-key"))
+	history, err = store.GetHistory("history-key")
+	is.NoErr(err)
+	is.Equal(history, []structure.HistoryEvent{
+		{
+			Timestamp: 1700000000000,
+			Event:     structure.HistoryDispatched,
+			Source:    structure.HistorySourceNormalizer,
+			Details:   map[string]string{"jobId": "job-id"},
+		},
+		{Timestamp: 1700000001000, Event: structure.HistoryTranscodeFailed, Source: structure.HistorySourceTranscoder},
+	})
+
+	minir.FastForward(HISTORY_TTL)
+	history, err = store.GetHistory("history-key")
+	is.NoErr(err)
+	is.Equal(len(history), 0)
+}
+
+func TestValkeyStoreExport(t *testing.T) {
+	is := is.New(t)
+	mr := miniredis.RunT(t)
+	store, err := NewValkeyStore("redis://" + mr.Addr())
+	is.NoErr(err)
+	for i := range 20 {
+		is.NoErr(store.Set("creative-"+strconv.Itoa(i), structure.TranscodeInfo{Status: "COMPLETED"}))
+	}
+	is.NoErr(store.Set("expiring", structure.TranscodeInfo{Status: "QUEUED"}, 60))
+	is.NoErr(store.Set("expired", structure.TranscodeInfo{Status: "QUEUED"}, 1))
+	mr.FastForward(2 * time.Second)
+
+	exported := map[string]int64{}
+	err = store.ExportCreatives(context.Background(), func(key string, value structure.TranscodeInfo, expiresAt int64) error {
+		exported[key] = expiresAt
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(len(exported), 21)
+	is.Equal(exported["creative-0"], int64(0))
+	remaining := time.Until(time.UnixMilli(exported["expiring"]))
+	is.True(remaining > 50*time.Second && remaining <= 60*time.Second)
+
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "later", Deadline: 2000}))
+	is.NoErr(store.TrackPackagingJob(structure.PackagingJobState{CreativeId: "sooner", Deadline: 1000}))
+	states, err := store.GetPackagingJobs()
+	is.NoErr(err)
+	is.Equal(len(states), 2)
+	is.Equal(states[0].CreativeId, "sooner")
+	state, found, err := store.GetPackagingJob("later")
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(state.Deadline, int64(2000))
+	_, found, err = store.GetPackagingJob("unknown")
+	is.NoErr(err)
+	is.True(!found)
+}
@@ -9,6 +9,7 @@ type EncoreJob struct {
 	OutputFolder        string         `json:"outputFolder"`
 	BaseName            string         `json:"baseName"`
 	Status              string         `json:"status,omitempty"`
+	Progress            int            `json:"progress,omitempty"`
 	Inputs              []EncoreInput  `json:"inputs,omitempty"`
 	Outputs             []EncoreOutput `json:"output,omitempty"`
 	ProgressCallbackUri string         `json:"progressCallbackUri,omitempty"`
@@ -44,6 +45,7 @@ type EncoreOutput struct {
 	File           string              `json:"file"`
 	FileSize       int64               `json:"fileSize"`
 	OverallBitrate int64               `json:"overallBitrate"`
+	Duration       float64             `json:"duration,omitempty"`
 	VideoStreams   []EncoreVideoStream `json:"videoStreams"`
 	AudioStreams   []EncoreAudioStream `json:"audioStreams"`
 }
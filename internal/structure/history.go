@@ -0,0 +1,31 @@
+package structure
+
+// Kinds of events in the history of a creative
+const (
+	HistoryDispatched         = "dispatched"
+	HistoryProgress           = "progress"
+	HistoryTranscodeSucceeded = "transcode_succeeded"
+	HistoryTranscodeFailed    = "transcode_failed"
+	HistoryPackagingEnqueued  = "packaging_enqueued"
+	HistoryPackagingSucceeded = "packaging_succeeded"
+	HistoryPackagingFailed    = "packaging_failed"
+	HistoryBlacklisted        = "blacklisted"
+	HistoryDeleted            = "deleted"
+)
+
+// Where the state change of a history event came from
+const (
+	HistorySourceNormalizer = "normalizer"
+	HistorySourceTranscoder = "transcoder"
+	HistorySourcePackager   = "packager"
+	HistorySourceApi        = "api"
+)
+
+// An entry in the append-only history of a creative
+type HistoryEvent struct {
+	// Unix milliseconds
+	Timestamp int64             `json:"timestamp"`
+	Event     string            `json:"event"`
+	Source    string            `json:"source"`
+	Details   map[string]string `json:"details,omitempty"`
+}
@@ -18,3 +18,11 @@ type PackagingQueueMessage struct {
 	JobId string `json:"jobId"`
 	Url   string `json:"url"`
 }
+
+// Tracks a packaging job that has been queued, but not yet reported back by the packager
+type PackagingJobState struct {
+	CreativeId string                `json:"creativeId"`
+	Job        PackagingQueueMessage `json:"job"`
+	Attempts   int                   `json:"attempts"`
+	Deadline   int64                 `json:"deadline"`
+}
@@ -13,6 +13,10 @@ type ManifestAsset struct {
 	CreativeId        string
 	MasterPlaylistUrl string
 	Source            string
+	// Transcoding profile to use instead of the default of the backend, if set
+	Profile string
+	// Output folder of the job that the new job replaces, if the creative is re-transcoded
+	ReplacedOutputFolder string
 }
 
 const DefaultTtl = 3600
@@ -31,6 +35,19 @@ type TranscodeInfo struct {
 	Source      string    `json:"source,omitempty"`
 	LastUpdate  int64     `json:"lastUpdate,omitempty"`
 	Error       string    `json:"error,omitempty"`
+	// Transcoding job of the creative, used to resolve callbacks without asking Encore
+	JobId        string `json:"jobId,omitempty"`
+	OutputFolder string `json:"outputFolder,omitempty"`
+	Profile      string `json:"profile,omitempty"`
+	// Output folder of the job that a re-transcode replaced, removed when the new job completes
+	ReplacedOutputFolder string `json:"replacedOutputFolder,omitempty"`
+	// Transcoding progress in percent and the last status reported by Encore
+	Progress     int    `json:"progress,omitempty"`
+	EncoreStatus string `json:"encoreStatus,omitempty"`
+	// Estimated completion time of the transcoding, in unix seconds
+	Eta int64 `json:"eta,omitempty"`
+	// Subdomain of the request that ingested the creative
+	Subdomain string `json:"subdomain,omitempty"`
 }
 
 func TranscodeInfoFromEncoreJob(job *EncoreJob, jitPackaging bool, assetServerUrl url.URL) (TranscodeInfo, error) {
@@ -58,12 +75,17 @@ func TranscodeInfoFromEncoreJob(job *EncoreJob, jitPackaging bool, assetServerUr
 		vidUrl = packageUrl.String()
 	}
 	tc := TranscodeInfo{
-		Url:         vidUrl,
-		AspectRatio: aspectRatio,
-		FrameRates:  job.GetFrameRates(),
-		Status:      jobStatus,
-		Source:      job.Inputs[0].Uri,
-		LastUpdate:  time.Now().Unix(),
+		Url:          vidUrl,
+		AspectRatio:  aspectRatio,
+		FrameRates:   job.GetFrameRates(),
+		Status:       jobStatus,
+		Source:       job.Inputs[0].Uri,
+		LastUpdate:   time.Now().Unix(),
+		JobId:        job.Id,
+		OutputFolder: job.OutputFolder,
+		Profile:      job.Profile,
+		Progress:     job.Progress,
+		EncoreStatus: job.Status,
 	}
 	if job.Message != "" {
 		tc.Error = job.Message
@@ -71,6 +93,30 @@ func TranscodeInfoFromEncoreJob(job *EncoreJob, jitPackaging bool, assetServerUr
 	return tc, nil
 }
 
+// UpdateProgress records a progress report and estimates when transcoding completes,
+// based on the progress made since the previous update.
+// If no progress was made, the previous estimate is kept.
+func (tc *TranscodeInfo) UpdateProgress(progress int, encoreStatus string, now time.Time) {
+	elapsed := now.Unix() - tc.LastUpdate
+	delta := progress - tc.Progress
+	if tc.LastUpdate > 0 && elapsed > 0 && delta > 0 && progress < 100 {
+		remaining := float64(100-progress) * float64(elapsed) / float64(delta)
+		tc.Eta = now.Unix() + int64(math.Ceil(remaining))
+	}
+	if progress >= 100 {
+		tc.Eta = 0
+	}
+	tc.Progress = progress
+	tc.EncoreStatus = encoreStatus
+	tc.LastUpdate = now.Unix()
+}
+
+type BlacklistEntry struct {
+	MediaUrl  string `json:"mediaUrl"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
 type EncoreJobProgress struct {
 	JobId      string `json:"jobId"`
 	ExternalId string `json:"externalId"`
@@ -3,6 +3,7 @@ package structure
 import (
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 )
@@ -21,6 +22,8 @@ func TestCreatePackagerUrl(t *testing.T) {
 func TestTranscodeInfoFromEncoreJob(t *testing.T) {
 	is := is.New(t)
 	testJob := EncoreJob{
+		Id:           "test-job-id",
+		Profile:      "program",
 		Status:       "SUCCESSFUL",
 		BaseName:     "test-asset",
 		OutputFolder: "assets/1234567890abcdef",
@@ -52,6 +55,9 @@ func TestTranscodeInfoFromEncoreJob(t *testing.T) {
 	is.Equal(res.FrameRates, []float64{25.0})
 	is.Equal(res.Status, "COMPLETED")
 	is.Equal(res.Url, "http://cdn.osaas.io/assets/1234567890abcdef/test-asset.m3u8")
+	is.Equal(res.JobId, "test-job-id")
+	is.Equal(res.OutputFolder, "assets/1234567890abcdef")
+	is.Equal(res.Profile, "program")
 }
 
 func TestGetTranscodeStatus(t *testing.T) {
@@ -145,3 +151,27 @@ func TestCalculateAspectRatio(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateProgress(t *testing.T) {
+	is := is.New(t)
+	start := time.Unix(1700000000, 0)
+	tc := TranscodeInfo{Status: "QUEUED", LastUpdate: start.Unix()}
+
+	tc.UpdateProgress(10, "IN_PROGRESS", start.Add(10*time.Second))
+	is.Equal(tc.Progress, 10)
+	is.Equal(tc.EncoreStatus, "IN_PROGRESS")
+	is.Equal(tc.Eta, start.Add(100*time.Second).Unix())
+
+	// No progress since the last update, keep the estimate
+	tc.UpdateProgress(10, "IN_PROGRESS", start.Add(20*time.Second))
+	is.Equal(tc.Eta, start.Add(100*time.Second).Unix())
+
+	// Faster than before
+	tc.UpdateProgress(50, "IN_PROGRESS", start.Add(30*time.Second))
+	is.Equal(tc.Eta, start.Add(43*time.Second).Unix())
+
+	tc.UpdateProgress(100, "SUCCESSFUL", start.Add(40*time.Second))
+	is.Equal(tc.Progress, 100)
+	is.Equal(tc.Eta, int64(0))
+	is.Equal(tc.LastUpdate, start.Add(40*time.Second).Unix())
+}
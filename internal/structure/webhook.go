@@ -0,0 +1,38 @@
+package structure
+
+// Creative lifecycle events, sent to registered webhooks
+const (
+	EventQueued      = "QUEUED"
+	EventInProgress  = "IN_PROGRESS"
+	EventPackaging   = "PACKAGING"
+	EventCompleted   = "COMPLETED"
+	EventFailed      = "FAILED"
+	EventBlacklisted = "BLACKLISTED"
+)
+
+// A webhook receives events for all creatives, or only for creatives
+// ingested through the given subdomain.
+type Webhook struct {
+	Url       string `json:"url"`
+	Subdomain string `json:"subdomain,omitempty"`
+}
+
+type CreativeEvent struct {
+	Event      string `json:"event"`
+	CreativeId string `json:"creativeId"`
+	Source     string `json:"source,omitempty"`
+	Url        string `json:"url,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Subdomain  string `json:"subdomain,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+	// The creative as listed by /jobs after the state change
+	Job *TranscodeInfo `json:"job,omitempty"`
+}
+
+// A pending delivery of an event to a webhook
+type WebhookDelivery struct {
+	Id       string        `json:"id"`
+	Url      string        `json:"url"`
+	Event    CreativeEvent `json:"event"`
+	Attempts int           `json:"attempts"`
+}
@@ -0,0 +1,542 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/storage"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/google/uuid"
+)
+
+const (
+	segmentDuration = 4
+	// Upper bound for a single ffmpeg run, ads are short
+	jobTimeout = 2 * time.Hour
+	// How long finished jobs are kept in memory for lookups
+	jobRetention = time.Hour
+	// Minimum progress change, in percent, before an update is reported
+	progressStep = 5
+)
+
+var _ Backend = (*FfmpegBackend)(nil)
+
+// Rendition is one step of the HLS ladder produced by the ffmpeg backend
+type Rendition struct {
+	Height       int
+	VideoBitrate string
+	AudioBitrate string
+}
+
+var DefaultLadder = []Rendition{
+	{Height: 1080, VideoBitrate: "5000k", AudioBitrate: "128k"},
+	{Height: 720, VideoBitrate: "3000k", AudioBitrate: "128k"},
+	{Height: 480, VideoBitrate: "1200k", AudioBitrate: "96k"},
+}
+
+// FfmpegBackend transcodes creatives to an HLS ladder with a local ffmpeg,
+// and uploads the result to the object store.
+// Progress is reported through the update handler, as there are no callbacks.
+type FfmpegBackend struct {
+	ffmpegPath   string
+	ffprobePath  string
+	objectStore  storage.ObjectStore
+	outputPrefix string
+	ladder       []Rendition
+	slots        chan struct{}
+	mutex        sync.Mutex
+	jobs         map[string]*ffmpegJob
+	onUpdate     func(JobUpdate) error
+}
+
+type ffmpegJob struct {
+	job      structure.EncoreJob
+	finished time.Time
+	// Stops the ffmpeg process, set while the job is running
+	cancel context.CancelFunc
+}
+
+// NewFfmpegBackend creates a backend running at most concurrency ffmpeg processes at once.
+// Output is written below outputPrefix in the object store.
+func NewFfmpegBackend(
+	ffmpegPath string,
+	ffprobePath string,
+	objectStore storage.ObjectStore,
+	outputPrefix string,
+	concurrency int,
+) *FfmpegBackend {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &FfmpegBackend{
+		ffmpegPath:   ffmpegPath,
+		ffprobePath:  ffprobePath,
+		objectStore:  objectStore,
+		outputPrefix: strings.Trim(outputPrefix, "/"),
+		ladder:       DefaultLadder,
+		slots:        make(chan struct{}, concurrency),
+		jobs:         map[string]*ffmpegJob{},
+	}
+}
+
+// SetUpdateHandler sets the function receiving job updates
+func (fb *FfmpegBackend) SetUpdateHandler(onUpdate func(JobUpdate) error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.onUpdate = onUpdate
+}
+
+// The only transcoding profile of the ffmpeg backend
+const ffmpegProfile = "ffmpeg"
+
+// Protocols ffmpeg and ffprobe may use to read the source, so that a source can not make them
+// read local files or other protocols, also not from a playlist
+const ffmpegProtocols = "http,https,tcp,tls"
+
+func (fb *FfmpegBackend) CreateJob(creative *structure.ManifestAsset) (structure.EncoreJob, error) {
+	if creative.Profile != "" && creative.Profile != ffmpegProfile {
+		return structure.EncoreJob{}, fmt.Errorf("%w %s, the ffmpeg backend only has %s",
+			ErrUnsupportedProfile, creative.Profile, ffmpegProfile)
+	}
+	source, err := url.Parse(creative.MasterPlaylistUrl)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		return structure.EncoreJob{}, fmt.Errorf("%w %s, the ffmpeg backend only reads http(s) sources",
+			ErrUnsupportedSource, creative.MasterPlaylistUrl)
+	}
+	id := uuid.New().String()
+	job := structure.EncoreJob{
+		Id:           id,
+		ExternalId:   creative.CreativeId,
+		Profile:      ffmpegProfile,
+		OutputFolder: path.Join(fb.outputPrefix, creative.CreativeId, id),
+		BaseName:     creative.CreativeId,
+		Status:       string(StatusQueued),
+		Inputs: []structure.EncoreInput{
+			{
+				Uri:       creative.MasterPlaylistUrl,
+				MediaType: "AudioVideo",
+			},
+		},
+	}
+	fb.mutex.Lock()
+	fb.pruneJobs(time.Now())
+	fb.jobs[id] = &ffmpegJob{job: job}
+	fb.mutex.Unlock()
+	return job, nil
+}
+
+// StartJob runs the job as soon as one of the ffmpeg slots is free
+func (fb *FfmpegBackend) StartJob(jobId string) error {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if _, ok := fb.jobs[jobId]; !ok {
+		return fmt.Errorf("ffmpeg job %s not found", jobId)
+	}
+	go fb.run(jobId)
+	return nil
+}
+
+func (fb *FfmpegBackend) GetJob(jobId string) (structure.EncoreJob, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	tracked, ok := fb.jobs[jobId]
+	if !ok {
+		return structure.EncoreJob{}, fmt.Errorf("ffmpeg job %s not found", jobId)
+	}
+	return tracked.job, nil
+}
+
+func (fb *FfmpegBackend) CancelJob(jobId string) error {
+	fb.mutex.Lock()
+	tracked, ok := fb.jobs[jobId]
+	if !ok {
+		fb.mutex.Unlock()
+		return fmt.Errorf("ffmpeg job %s not found", jobId)
+	}
+	if !tracked.finished.IsZero() {
+		fb.mutex.Unlock()
+		return nil
+	}
+	if tracked.cancel != nil {
+		tracked.cancel()
+	}
+	fb.mutex.Unlock()
+
+	logger.Info("Cancelled ffmpeg job", slog.String("jobId", jobId))
+	fb.update(jobId, func(j *structure.EncoreJob) {
+		j.Status = string(StatusCancelled)
+	})
+	return nil
+}
+
+// Drops finished jobs older than the retention, must be called with the mutex held
+func (fb *FfmpegBackend) pruneJobs(now time.Time) {
+	for id, tracked := range fb.jobs {
+		if !tracked.finished.IsZero() && now.Sub(tracked.finished) > jobRetention {
+			delete(fb.jobs, id)
+		}
+	}
+}
+
+func (fb *FfmpegBackend) run(jobId string) {
+	fb.slots <- struct{}{}
+	defer func() { <-fb.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+	fb.mutex.Lock()
+	tracked := fb.jobs[jobId]
+	if !tracked.finished.IsZero() {
+		// Cancelled while queued
+		fb.mutex.Unlock()
+		return
+	}
+	tracked.cancel = cancel
+	job := tracked.job
+	fb.mutex.Unlock()
+	fb.update(jobId, func(j *structure.EncoreJob) {
+		j.Status = string(StatusInProgress)
+	})
+
+	outputs, err := fb.transcode(ctx, jobId, job)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return // The cancellation has been reported already
+	}
+	if err != nil {
+		logger.Error("ffmpeg job failed",
+			slog.String("jobId", jobId),
+			slog.String("creativeId", job.ExternalId),
+			slog.String("error", err.Error()),
+		)
+		fb.update(jobId, func(j *structure.EncoreJob) {
+			j.Status = string(StatusFailed)
+			j.Message = err.Error()
+		})
+		return
+	}
+	fb.update(jobId, func(j *structure.EncoreJob) {
+		j.Status = string(StatusSuccessful)
+		j.Progress = 100
+		j.Outputs = outputs
+	})
+}
+
+// Applies the change to the job and reports it to the update handler
+func (fb *FfmpegBackend) update(jobId string, change func(*structure.EncoreJob)) {
+	fb.mutex.Lock()
+	tracked, ok := fb.jobs[jobId]
+	if !ok {
+		fb.mutex.Unlock()
+		return
+	}
+	if !tracked.finished.IsZero() {
+		// Don't change a job after it has finished, f.ex. with progress of a cancelled job
+		fb.mutex.Unlock()
+		return
+	}
+	change(&tracked.job)
+	status := NormalizeStatus(tracked.job.Status)
+	if status == StatusSuccessful || status == StatusFailed || status == StatusCancelled {
+		tracked.finished = time.Now()
+	}
+	job := tracked.job
+	onUpdate := fb.onUpdate
+	fb.mutex.Unlock()
+
+	if onUpdate == nil {
+		return
+	}
+	err := onUpdate(JobUpdate{
+		JobId:         job.Id,
+		CreativeId:    job.ExternalId,
+		Status:        status,
+		Progress:      job.Progress,
+		BackendStatus: job.Status,
+		Message:       job.Message,
+	})
+	if err != nil {
+		logger.Error("Failed to handle ffmpeg job update",
+			slog.String("jobId", job.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func (fb *FfmpegBackend) transcode(
+	ctx context.Context,
+	jobId string,
+	job structure.EncoreJob,
+) ([]structure.EncoreOutput, error) {
+	source := job.Inputs[0].Uri
+	probe, err := fb.probe(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	renditions := fb.renditionsFor(probe.height)
+
+	workDir, err := os.MkdirTemp("", "ad-normalizer-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	args := ffmpegArgs(source, workDir, job.BaseName, renditions, probe.hasAudio)
+	logger.Debug("Starting ffmpeg", slog.String("jobId", jobId), slog.Any("args", args))
+	cmd := exec.CommandContext(ctx, fb.ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ffmpeg progress: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	fb.readProgress(jobId, stdout, probe.duration)
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, lastLine(stderr.String()))
+	}
+
+	if err := fb.upload(workDir, job.OutputFolder); err != nil {
+		return nil, err
+	}
+	return outputsFor(renditions, probe), nil
+}
+
+type probeResult struct {
+	duration  float64
+	width     int
+	height    int
+	frameRate string
+	hasAudio  bool
+}
+
+func (fb *FfmpegBackend) probe(ctx context.Context, source string) (probeResult, error) {
+	result := probeResult{}
+	out, err := exec.CommandContext(
+		ctx,
+		fb.ffprobePath,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-protocol_whitelist", ffmpegProtocols,
+		source,
+	).Output()
+	if err != nil {
+		return result, fmt.Errorf("ffprobe failed for %s: %w", source, err)
+	}
+	probed := struct {
+		Streams []struct {
+			CodecType  string `json:"codec_type"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			RFrameRate string `json:"r_frame_rate"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}{}
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return result, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	for _, stream := range probed.Streams {
+		switch stream.CodecType {
+		case "video":
+			if result.height == 0 {
+				result.width = stream.Width
+				result.height = stream.Height
+				result.frameRate = stream.RFrameRate
+			}
+		case "audio":
+			result.hasAudio = true
+		}
+	}
+	if result.height == 0 {
+		return result, fmt.Errorf("no video stream found in %s", source)
+	}
+	result.duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	return result, nil
+}
+
+// Returns the renditions of the ladder that do not upscale the source.
+// Sources smaller than the whole ladder get the lowest rendition at the source height.
+func (fb *FfmpegBackend) renditionsFor(sourceHeight int) []Rendition {
+	renditions := make([]Rendition, 0, len(fb.ladder))
+	for _, r := range fb.ladder {
+		if r.Height <= sourceHeight {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		lowest := fb.ladder[len(fb.ladder)-1]
+		lowest.Height = sourceHeight - sourceHeight%2
+		renditions = append(renditions, lowest)
+	}
+	return renditions
+}
+
+func ffmpegArgs(source, workDir, baseName string, renditions []Rendition, hasAudio bool) []string {
+	args := []string{
+		"-hide_banner", "-y", "-nostats", "-progress", "pipe:1",
+		"-protocol_whitelist", ffmpegProtocols,
+		"-i", source,
+	}
+
+	var filter strings.Builder
+	filter.WriteString(fmt.Sprintf("[0:v]split=%d", len(renditions)))
+	for i := range renditions {
+		filter.WriteString(fmt.Sprintf("[v%d]", i))
+	}
+	for i, r := range renditions {
+		filter.WriteString(fmt.Sprintf(";[v%d]scale=-2:%d[v%dout]", i, r.Height, i))
+	}
+	args = append(args, "-filter_complex", filter.String())
+
+	streamMap := make([]string, 0, len(renditions))
+	for i, r := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), r.VideoBitrate,
+		)
+		if hasAudio {
+			args = append(args,
+				"-map", "0:a:0",
+				fmt.Sprintf("-c:a:%d", i), "aac",
+				fmt.Sprintf("-b:a:%d", i), r.AudioBitrate,
+			)
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d", i, i))
+		} else {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d", i))
+		}
+	}
+
+	return append(args,
+		"-preset", "veryfast",
+		// Align keyframes with the segment boundaries in all renditions
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentDuration),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(workDir, "stream_%v_%03d.ts"),
+		"-master_pl_name", baseName+".m3u8",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(workDir, "stream_%v.m3u8"),
+	)
+}
+
+// Reads the ffmpeg progress output until it is closed,
+// reporting the progress in steps to avoid flooding the store.
+func (fb *FfmpegBackend) readProgress(jobId string, progress io.Reader, duration float64) {
+	reported := 0
+	scanner := bufio.NewScanner(progress)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		// out_time_ms is in microseconds as well, kept for older ffmpeg versions
+		if !found || (key != "out_time_us" && key != "out_time_ms") || duration <= 0 {
+			continue
+		}
+		outTime, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		// 100 is reported once the output is uploaded
+		percent := min(int(float64(outTime)/(duration*1e6)*100), 99)
+		if percent-reported < progressStep {
+			continue
+		}
+		reported = percent
+		fb.update(jobId, func(j *structure.EncoreJob) {
+			j.Progress = percent
+		})
+	}
+}
+
+// Uploads all files in the work directory to the output folder
+func (fb *FfmpegBackend) upload(workDir, outputFolder string) error {
+	return filepath.WalkDir(workDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(workDir, filePath)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		key := path.Join(outputFolder, filepath.ToSlash(rel))
+		if err := fb.objectStore.Put(key, file, info.Size(), contentType(rel)); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+func contentType(fileName string) string {
+	switch filepath.Ext(fileName) {
+	case ".m3u8":
+		return "application/x-mpegURL"
+	case ".ts":
+		return "video/MP2T"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// Describes the produced renditions with the Encore output model
+func outputsFor(renditions []Rendition, probe probeResult) []structure.EncoreOutput {
+	outputs := make([]structure.EncoreOutput, 0, len(renditions))
+	for i, r := range renditions {
+		width := probe.width * r.Height / probe.height
+		output := structure.EncoreOutput{
+			MediaType: "Video",
+			Format:    "hls",
+			File:      fmt.Sprintf("stream_%d.m3u8", i),
+			VideoStreams: []structure.EncoreVideoStream{
+				{
+					Codec:     "h264",
+					Width:     width - width%2,
+					Height:    r.Height,
+					FrameRate: probe.frameRate,
+				},
+			},
+		}
+		if probe.hasAudio {
+			output.AudioStreams = []structure.EncoreAudioStream{
+				{Codec: "aac", Channels: 2},
+			}
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
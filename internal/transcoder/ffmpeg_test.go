@@ -0,0 +1,279 @@
+package transcoder
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+const fakeFfprobe = `#!/bin/sh
+cat <<EOF
+{"streams":[
+  {"codec_type":"video","width":1280,"height":720,"r_frame_rate":"25/1"},
+  {"codec_type":"audio"}
+],"format":{"duration":"10.0"}}
+EOF
+`
+
+// Writes a master playlist and a variant for each rendition to the output directory
+const fakeFfmpeg = `#!/bin/sh
+prev=""
+for arg in "$@"; do
+  if [ "$prev" = "-master_pl_name" ]; then master="$arg"; fi
+  prev="$arg"
+  out="$arg"
+done
+dir=$(dirname "$out")
+echo "out_time_us=5000000"
+echo "progress=continue"
+echo "out_time_us=10000000"
+echo "progress=end"
+echo "#EXTM3U" > "$dir/$master"
+echo "#EXTM3U" > "$dir/stream_0.m3u8"
+echo "segment" > "$dir/stream_0_000.ts"
+`
+
+const failingFfmpeg = `#!/bin/sh
+echo "Input could not be opened" >&2
+exit 1
+`
+
+// Runs until it is killed
+const slowFfmpeg = `#!/bin/sh
+exec sleep 30
+`
+
+type memoryObjectStore struct {
+	mutex   sync.Mutex
+	objects map[string]string
+}
+
+func (m *memoryObjectStore) Put(key string, body io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[key] = string(data)
+	return nil
+}
+
+func (m *memoryObjectStore) Url(key string) string {
+	return "memory://" + key
+}
+
+func writeScript(t *testing.T, name, content string) string {
+	t.Helper()
+	scriptPath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(scriptPath, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return scriptPath
+}
+
+func runFfmpegJob(t *testing.T, ffmpeg string) (*FfmpegBackend, *memoryObjectStore, structure.EncoreJob, []JobUpdate) {
+	t.Helper()
+	objectStore := &memoryObjectStore{objects: map[string]string{}}
+	backend := NewFfmpegBackend(
+		ffmpeg,
+		writeScript(t, "ffprobe", fakeFfprobe),
+		objectStore,
+		"/transcoded/",
+		1,
+	)
+	updates := make(chan JobUpdate, 10)
+	backend.SetUpdateHandler(func(update JobUpdate) error {
+		updates <- update
+		return nil
+	})
+	job, err := backend.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "https://example.com/creative.mp4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Created jobs only run once started
+	select {
+	case update := <-updates:
+		t.Fatalf("unexpected update %v before the job was started", update)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := backend.StartJob(job.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	received := []JobUpdate{}
+	for {
+		select {
+		case update := <-updates:
+			received = append(received, update)
+			if update.Status == StatusSuccessful || update.Status == StatusFailed {
+				return backend, objectStore, job, received
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the ffmpeg job")
+		}
+	}
+}
+
+func TestFfmpegCreateJob(t *testing.T) {
+	is := is.New(t)
+	backend, objectStore, job, updates := runFfmpegJob(t, writeScript(t, "ffmpeg", fakeFfmpeg))
+
+	is.Equal(job.ExternalId, "creative")
+	is.Equal(job.BaseName, "creative")
+	is.Equal(job.Status, "QUEUED")
+	is.True(strings.HasPrefix(job.OutputFolder, "transcoded/creative/"))
+
+	is.Equal(updates[0].Status, StatusInProgress)
+	is.Equal(updates[1].Progress, 50)
+	is.Equal(updates[2].Progress, 99)
+	last := updates[len(updates)-1]
+	is.Equal(last.Status, StatusSuccessful)
+	is.Equal(last.Progress, 100)
+	is.Equal(last.CreativeId, "creative")
+	is.Equal(last.JobId, job.Id)
+
+	is.Equal(objectStore.objects[job.OutputFolder+"/creative.m3u8"], "#EXTM3U\n")
+	is.Equal(objectStore.objects[job.OutputFolder+"/stream_0.m3u8"], "#EXTM3U\n")
+	is.Equal(objectStore.objects[job.OutputFolder+"/stream_0_000.ts"], "segment\n")
+
+	finished, err := backend.GetJob(job.Id)
+	is.NoErr(err)
+	is.Equal(finished.Status, "SUCCESSFUL")
+	// The 1080p rendition would upscale the 720p source
+	is.Equal(len(finished.Outputs), 2)
+	is.Equal(finished.Outputs[0].VideoStreams[0].Width, 1280)
+	is.Equal(finished.Outputs[0].VideoStreams[0].Height, 720)
+	is.Equal(finished.Outputs[1].VideoStreams[0].Width, 852)
+	is.Equal(finished.GetFrameRates(), []float64{25})
+
+	_, err = backend.GetJob("unknown")
+	is.True(err != nil)
+}
+
+func TestFfmpegJobFailed(t *testing.T) {
+	is := is.New(t)
+	backend, objectStore, job, updates := runFfmpegJob(t, writeScript(t, "ffmpeg", failingFfmpeg))
+
+	last := updates[len(updates)-1]
+	is.Equal(last.Status, StatusFailed)
+	is.True(strings.Contains(last.Message, "Input could not be opened"))
+	is.Equal(len(objectStore.objects), 0)
+
+	failed, err := backend.GetJob(job.Id)
+	is.NoErr(err)
+	is.Equal(failed.Status, "FAILED")
+}
+
+func TestFfmpegUnsupportedProfile(t *testing.T) {
+	is := is.New(t)
+	backend := NewFfmpegBackend("ffmpeg", "ffprobe", &memoryObjectStore{objects: map[string]string{}}, "transcoded", 1)
+	job, err := backend.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "https://example.com/creative.mp4",
+		Profile:           "ffmpeg",
+	})
+	is.NoErr(err)
+	is.Equal(job.Profile, "ffmpeg")
+	_, err = backend.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "creative",
+		MasterPlaylistUrl: "https://example.com/creative.mp4",
+		Profile:           "vertical",
+	})
+	is.True(errors.Is(err, ErrUnsupportedProfile))
+}
+
+func TestFfmpegUnsupportedSource(t *testing.T) {
+	is := is.New(t)
+	backend := NewFfmpegBackend("ffmpeg", "ffprobe", &memoryObjectStore{objects: map[string]string{}}, "transcoded", 1)
+	for _, source := range []string{"", "file:///etc/passwd", "/etc/passwd", "concat:a.mp4|b.mp4", "http:///ad.mp4"} {
+		_, err := backend.CreateJob(&structure.ManifestAsset{CreativeId: "creative", MasterPlaylistUrl: source})
+		is.True(errors.Is(err, ErrUnsupportedSource))
+	}
+}
+
+func TestFfmpegCancelJob(t *testing.T) {
+	is := is.New(t)
+	backend := NewFfmpegBackend(
+		writeScript(t, "ffmpeg", slowFfmpeg),
+		writeScript(t, "ffprobe", fakeFfprobe),
+		&memoryObjectStore{objects: map[string]string{}},
+		"transcoded",
+		1,
+	)
+	updates := make(chan JobUpdate, 10)
+	backend.SetUpdateHandler(func(update JobUpdate) error {
+		updates <- update
+		return nil
+	})
+	running, err := backend.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "running",
+		MasterPlaylistUrl: "https://example.com/running.mp4",
+	})
+	is.NoErr(err)
+	queued, err := backend.CreateJob(&structure.ManifestAsset{
+		CreativeId:        "queued",
+		MasterPlaylistUrl: "https://example.com/queued.mp4",
+	})
+	is.NoErr(err)
+	is.NoErr(backend.StartJob(running.Id))
+	is.NoErr(backend.StartJob(queued.Id))
+	is.True(backend.StartJob("unknown") != nil)
+	is.Equal((<-updates).Status, StatusInProgress)
+
+	// Only one job runs at a time, the second one is cancelled before it starts
+	is.NoErr(backend.CancelJob(queued.Id))
+	is.Equal((<-updates).Status, StatusCancelled)
+	is.NoErr(backend.CancelJob(running.Id))
+	update := <-updates
+	is.Equal(update.Status, StatusCancelled)
+	is.Equal(update.JobId, running.Id)
+
+	job, err := backend.GetJob(running.Id)
+	is.NoErr(err)
+	is.Equal(job.Status, "CANCELLED")
+	is.NoErr(backend.CancelJob(running.Id)) // already finished
+	is.True(backend.CancelJob("unknown") != nil)
+
+	select {
+	case update := <-updates:
+		t.Fatalf("unexpected update after cancellation: %+v", update)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRenditionsFor(t *testing.T) {
+	is := is.New(t)
+	backend := NewFfmpegBackend("ffmpeg", "ffprobe", nil, "", 1)
+	is.Equal(len(backend.renditionsFor(2160)), 3)
+	is.Equal(len(backend.renditionsFor(720)), 2)
+	small := backend.renditionsFor(361)
+	is.Equal(len(small), 1)
+	is.Equal(small[0].Height, 360)
+}
+
+func TestFfmpegArgs(t *testing.T) {
+	is := is.New(t)
+	args := strings.Join(ffmpegArgs("in.mp4", "/work", "creative", DefaultLadder[1:], true), " ")
+	is.True(strings.Contains(args, "[0:v]split=2[v0][v1];[v0]scale=-2:720[v0out];[v1]scale=-2:480[v1out]"))
+	is.True(strings.Contains(args, "-var_stream_map v:0,a:0 v:1,a:1"))
+	is.True(strings.Contains(args, "-master_pl_name creative.m3u8"))
+	// Local files and other protocols can not be read, also not from a playlist
+	is.True(strings.Contains(args, "-protocol_whitelist http,https,tcp,tls -i in.mp4"))
+	is.True(strings.HasSuffix(args, "/work/stream_%v.m3u8"))
+
+	args = strings.Join(ffmpegArgs("in.mp4", "/work", "creative", DefaultLadder[2:], false), " ")
+	is.True(strings.Contains(args, "-var_stream_map v:0"))
+	is.True(!strings.Contains(args, "0:a:0"))
+}
@@ -0,0 +1,82 @@
+package transcoder
+
+import (
+	"errors"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+)
+
+// ErrUnsupportedProfile is returned by CreateJob when the backend cannot transcode with the requested profile
+var ErrUnsupportedProfile = errors.New("unsupported transcoding profile")
+
+// ErrUnsupportedSource is returned by CreateJob when the backend cannot read the source of the creative
+var ErrUnsupportedSource = errors.New("unsupported source")
+
+// Backend creates and tracks transcoding jobs.
+// Jobs are described with the Encore job model, which all backends map their jobs to.
+type Backend interface {
+	// CreateJob creates a job for the creative, with the profile of the creative if it is set.
+	// Returns ErrUnsupportedProfile if the backend has no such profile,
+	// and ErrUnsupportedSource if it can not read the source.
+	CreateJob(creative *structure.ManifestAsset) (structure.EncoreJob, error)
+	// StartJob starts a created job. The caller stores the job in between, so that
+	// the updates of a job that fails right away find it.
+	StartJob(jobId string) error
+	GetJob(jobId string) (structure.EncoreJob, error)
+	// CancelJob stops a queued or running job. Cancelling a finished job is not an error.
+	CancelJob(jobId string) error
+}
+
+// Normalized status of a transcoding job, independent of the backend
+type JobStatus string
+
+const (
+	StatusQueued     JobStatus = "QUEUED"
+	StatusInProgress JobStatus = "IN_PROGRESS"
+	StatusSuccessful JobStatus = "SUCCESSFUL"
+	StatusFailed     JobStatus = "FAILED"
+	StatusCancelled  JobStatus = "CANCELLED"
+	StatusUnknown    JobStatus = "UNKNOWN"
+)
+
+// JobUpdate is a progress report for a transcoding job,
+// f.ex. from an Encore callback or from a local ffmpeg process.
+type JobUpdate struct {
+	JobId      string
+	CreativeId string
+	Status     JobStatus
+	// Progress in percent
+	Progress int
+	// Status reported by the backend, before normalization
+	BackendStatus string
+	Message       string
+}
+
+// NormalizeStatus maps a job status reported by a backend to the normalized status
+func NormalizeStatus(status string) JobStatus {
+	switch status {
+	case "NEW", "QUEUED":
+		return StatusQueued
+	case "IN_PROGRESS":
+		return StatusInProgress
+	case "SUCCESSFUL":
+		return StatusSuccessful
+	case "FAILED":
+		return StatusFailed
+	case "CANCELLED":
+		return StatusCancelled
+	default:
+		return StatusUnknown
+	}
+}
+
+// UpdateFromEncoreProgress converts an Encore progress callback to a job update
+func UpdateFromEncoreProgress(progress structure.EncoreJobProgress) JobUpdate {
+	return JobUpdate{
+		JobId:         progress.JobId,
+		CreativeId:    progress.ExternalId,
+		Status:        NormalizeStatus(progress.Status),
+		Progress:      progress.Progress,
+		BackendStatus: progress.Status,
+	}
+}
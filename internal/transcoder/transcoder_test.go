@@ -0,0 +1,39 @@
+package transcoder
+
+import (
+	"testing"
+
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/matryer/is"
+)
+
+func TestNormalizeStatus(t *testing.T) {
+	is := is.New(t)
+	cases := map[string]JobStatus{
+		"NEW":         StatusQueued,
+		"QUEUED":      StatusQueued,
+		"IN_PROGRESS": StatusInProgress,
+		"SUCCESSFUL":  StatusSuccessful,
+		"FAILED":      StatusFailed,
+		"CANCELLED":   StatusCancelled,
+		"SOMETHING":   StatusUnknown,
+	}
+	for status, expected := range cases {
+		is.Equal(NormalizeStatus(status), expected)
+	}
+}
+
+func TestUpdateFromEncoreProgress(t *testing.T) {
+	is := is.New(t)
+	update := UpdateFromEncoreProgress(structure.EncoreJobProgress{
+		JobId:      "test-job-id",
+		ExternalId: "creative",
+		Progress:   42,
+		Status:     "NEW",
+	})
+	is.Equal(update.JobId, "test-job-id")
+	is.Equal(update.CreativeId, "creative")
+	is.Equal(update.Progress, 42)
+	is.Equal(update.Status, StatusQueued)
+	is.Equal(update.BackendStatus, "NEW")
+}
@@ -50,6 +50,28 @@ func GetCreatives(
 	return creatives
 }
 
+// Whether GetCreatives can key the ad. Wrapper ads, ads without a linear media file,
+// and ads without a universal ad ID when keying by it can not be keyed.
+func CanKeyAd(ad *vmap.Ad, keyField string) bool {
+	if ad.InLine == nil || len(ad.InLine.Creatives) == 0 {
+		return false
+	}
+	for _, creative := range ad.InLine.Creatives {
+		if creative.Linear == nil {
+			return false
+		}
+	}
+	if GetBestMediaFileFromVastAd(ad).Text == "" {
+		return false
+	}
+	switch keyField {
+	case "resolution", "url":
+		return true
+	default:
+		return ad.InLine.Creatives[0].UniversalAdId != nil
+	}
+}
+
 func MakeCreatives(creativeUrls []string, keyRegext string) map[string]structure.ManifestAsset {
 	creatives := make(map[string]structure.ManifestAsset, len(creativeUrls))
 	for _, creativeUrl := range creativeUrls {
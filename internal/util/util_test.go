@@ -48,6 +48,25 @@ func TestGetCreatives(t *testing.T) {
 	}
 }
 
+func TestCanKeyAd(t *testing.T) {
+	is := is.New(t)
+	ad := defaultAd()
+	is.True(CanKeyAd(&ad, "url"))
+	is.True(CanKeyAd(&ad, "resolution"))
+	// Keying by the universal ad ID requires one
+	is.True(!CanKeyAd(&ad, "universalAdId"))
+	ad.InLine.Creatives[0].UniversalAdId = &vmap.UniversalAdId{Id: "AAA2FBBBB1232F1"}
+	is.True(CanKeyAd(&ad, "universalAdId"))
+
+	// Wrapper ads are decoded without InLine
+	wrapper := vmap.Ad{Id: "wrapper"}
+	is.True(!CanKeyAd(&wrapper, "url"))
+	noMedia := vmap.Ad{InLine: &vmap.InLine{Creatives: []vmap.Creative{{Linear: &vmap.Linear{}}}}}
+	is.True(!CanKeyAd(&noMedia, "url"))
+	nonLinear := vmap.Ad{InLine: &vmap.InLine{Creatives: []vmap.Creative{{}}}}
+	is.True(!CanKeyAd(&nonLinear, "url"))
+}
+
 func TestReplaceSubdomain(t *testing.T) {
 	is := is.New(t)
 	oldUrl, _ := url.Parse("http://old-subdomain.example.com/video1.mp4")
@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/logger"
+	"github.com/Eyevinn/ad-normalizer/internal/signature"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/google/uuid"
+)
+
+const (
+	SignatureHeader = "X-Signature"
+	EventHeader     = "X-Event-Type"
+	// Max number of deliveries sent per poll
+	batchSize       = 100
+	maxBackoff      = time.Hour
+	deliveryTimeout = 10 * time.Second
+	// Claimed deliveries are sent again after this time if they were neither sent nor rescheduled,
+	// f.ex. when the instance stopped. Long enough to send a whole batch.
+	claimTimeout = batchSize * deliveryTimeout
+	// How long the registered webhooks are cached. Webhooks registered through another
+	// instance are picked up after this time.
+	webhookCacheTtl = 10 * time.Second
+)
+
+// Notifier sends creative lifecycle events to registered webhooks.
+// Deliveries go through a persistent queue in the store and are retried
+// with exponential backoff until they succeed or run out of attempts.
+type Notifier struct {
+	store       store.Store
+	client      *http.Client
+	secret      string
+	maxAttempts int
+	backoff     time.Duration
+	// Webhooks from the configuration, in addition to the ones registered in the store
+	staticWebhooks []structure.Webhook
+	cacheMutex     sync.Mutex
+	cachedWebhooks []structure.Webhook
+	cachedAt       time.Time
+	now            func() time.Time
+}
+
+func NewNotifier(
+	store store.Store,
+	client *http.Client,
+	secret string,
+	maxAttempts int,
+	staticWebhooks []structure.Webhook,
+) *Notifier {
+	return &Notifier{
+		store:          store,
+		client:         client,
+		secret:         secret,
+		maxAttempts:    maxAttempts,
+		backoff:        10 * time.Second,
+		staticWebhooks: staticWebhooks,
+		now:            time.Now,
+	}
+}
+
+// InvalidateWebhooks makes the next event read the registered webhooks from the store,
+// f.ex. after a webhook was added or removed through this instance.
+func (n *Notifier) InvalidateWebhooks() {
+	n.cacheMutex.Lock()
+	defer n.cacheMutex.Unlock()
+	n.cachedWebhooks = nil
+	n.cachedAt = time.Time{}
+}
+
+// Returns the registered webhooks, reading them from the store at most once per webhookCacheTtl
+func (n *Notifier) registeredWebhooks() []structure.Webhook {
+	n.cacheMutex.Lock()
+	defer n.cacheMutex.Unlock()
+	now := n.now()
+	if !n.cachedAt.IsZero() && now.Sub(n.cachedAt) < webhookCacheTtl {
+		return n.cachedWebhooks
+	}
+	webhooks, err := n.store.GetWebhooks()
+	if err != nil {
+		// Keep the previous webhooks, and try again with the next event
+		logger.Error("failed to get webhooks", slog.String("error", err.Error()))
+		return n.cachedWebhooks
+	}
+	n.cachedWebhooks = webhooks
+	n.cachedAt = now
+	return webhooks
+}
+
+// Notify queues a delivery of the event to each webhook that matches the subdomain of the event
+func (n *Notifier) Notify(event structure.CreativeEvent) {
+	webhooks := n.registeredWebhooks()
+	now := time.Now()
+	for _, webhook := range slices.Concat(webhooks, n.staticWebhooks) {
+		if webhook.Subdomain != "" && webhook.Subdomain != event.Subdomain {
+			continue
+		}
+		delivery := structure.WebhookDelivery{
+			Id:    uuid.NewString(),
+			Url:   webhook.Url,
+			Event: event,
+		}
+		if err := n.store.EnqueueWebhookDelivery(delivery, now); err != nil {
+			logger.Error("failed to enqueue webhook delivery",
+				slog.String("error", err.Error()),
+				slog.String("url", webhook.Url),
+				slog.String("creativeId", event.CreativeId),
+			)
+		}
+	}
+}
+
+// Run delivers queued events until the context is cancelled
+func (n *Notifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.deliverDue(time.Now())
+		}
+	}
+}
+
+func (n *Notifier) deliverDue(now time.Time) {
+	deliveries, err := n.store.ClaimDueWebhookDeliveries(now, now.Add(claimTimeout), batchSize)
+	if err != nil {
+		logger.Error("failed to claim due webhook deliveries", slog.String("error", err.Error()))
+	}
+	for _, delivery := range deliveries {
+		err := n.deliver(delivery)
+		if err == nil {
+			n.remove(delivery)
+			continue
+		}
+		delivery.Attempts++
+		if delivery.Attempts >= n.maxAttempts {
+			logger.Error("giving up on webhook delivery",
+				slog.String("error", err.Error()),
+				slog.String("url", delivery.Url),
+				slog.String("creativeId", delivery.Event.CreativeId),
+				slog.String("event", delivery.Event.Event),
+				slog.Int("attempts", delivery.Attempts),
+			)
+			n.remove(delivery)
+			continue
+		}
+		retryAt := now.Add(n.retryDelay(delivery.Attempts))
+		logger.Warn("webhook delivery failed, retrying",
+			slog.String("error", err.Error()),
+			slog.String("url", delivery.Url),
+			slog.Int("attempts", delivery.Attempts),
+			slog.Time("retryAt", retryAt),
+		)
+		// Replaces the claimed delivery, which is sent again when its claim times out if this fails
+		if err := n.store.EnqueueWebhookDelivery(delivery, retryAt); err != nil {
+			logger.Error("failed to requeue webhook delivery",
+				slog.String("error", err.Error()),
+				slog.String("url", delivery.Url),
+			)
+		}
+	}
+}
+
+// Removes a claimed delivery from the queue. If this fails, it is sent again when its claim times out.
+func (n *Notifier) remove(delivery structure.WebhookDelivery) {
+	if err := n.store.RemoveWebhookDelivery(delivery.Id); err != nil {
+		logger.Error("failed to remove webhook delivery",
+			slog.String("error", err.Error()),
+			slog.String("url", delivery.Url),
+		)
+	}
+}
+
+// Doubles the delay for each failed attempt, up to maxBackoff
+func (n *Notifier) retryDelay(attempts int) time.Duration {
+	delay := n.backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+func (n *Notifier) deliver(delivery structure.WebhookDelivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "eyevinn/ad-normalizer")
+	req.Header.Set(EventHeader, delivery.Event.Event)
+	if n.secret != "" {
+		req.Header.Set(SignatureHeader, signature.Sign(n.secret, body))
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/ad-normalizer/internal/signature"
+	"github.com/Eyevinn/ad-normalizer/internal/store"
+	"github.com/Eyevinn/ad-normalizer/internal/structure"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/matryer/is"
+)
+
+type receiver struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	events   []structure.CreativeEvent
+	failures int // number of requests to fail before accepting
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	r := &receiver{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		body, _ := io.ReadAll(req.Body)
+		if !signature.Verify(secret, body, req.Header.Get(SignatureHeader)) {
+			t.Errorf("invalid signature for %s", string(body))
+		}
+		if r.failures > 0 {
+			r.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event structure.CreativeEvent
+		_ = json.Unmarshal(body, &event)
+		if req.Header.Get(EventHeader) != event.Event {
+			t.Errorf("event header %s does not match event %s", req.Header.Get(EventHeader), event.Event)
+		}
+		r.events = append(r.events, event)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return r
+}
+
+func setupNotifier(t *testing.T, staticWebhooks []structure.Webhook) (*Notifier, store.Store) {
+	mr := miniredis.RunT(t)
+	valkeyStore, err := store.NewValkeyStore("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNotifier(valkeyStore, &http.Client{}, "secret", 3, staticWebhooks), valkeyStore
+}
+
+func TestNotify(t *testing.T) {
+	is := is.New(t)
+	global := newReceiver(t, "secret")
+	defer global.server.Close()
+	tenant := newReceiver(t, "secret")
+	defer tenant.server.Close()
+	notifier, valkeyStore := setupNotifier(t, []structure.Webhook{{Url: global.server.URL}})
+	is.NoErr(valkeyStore.AddWebhook(structure.Webhook{Url: tenant.server.URL, Subdomain: "tenant"}))
+
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventQueued, CreativeId: "other", Subdomain: "other"})
+	notifier.Notify(structure.CreativeEvent{
+		Event:      structure.EventCompleted,
+		CreativeId: "creative",
+		Url:        "https://cdn.example.com/creative/index.m3u8",
+		Subdomain:  "tenant",
+	})
+	notifier.deliverDue(time.Now())
+
+	is.Equal(len(global.events), 2)
+	is.Equal(len(tenant.events), 1)
+	is.Equal(tenant.events[0].CreativeId, "creative")
+	is.Equal(tenant.events[0].Url, "https://cdn.example.com/creative/index.m3u8")
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	is := is.New(t)
+	hook := newReceiver(t, "secret")
+	defer hook.server.Close()
+	hook.failures = 1
+	notifier, _ := setupNotifier(t, []structure.Webhook{{Url: hook.server.URL}})
+
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventFailed, CreativeId: "creative"})
+	now := time.Now()
+	notifier.deliverDue(now)
+	is.Equal(len(hook.events), 0)
+	is.Equal(hook.failures, 0)
+
+	// Not retried before the backoff has passed
+	notifier.deliverDue(now.Add(5 * time.Second))
+	is.Equal(len(hook.events), 0)
+
+	notifier.deliverDue(now.Add(notifier.backoff))
+	is.Equal(len(hook.events), 1)
+	is.Equal(hook.events[0].Event, structure.EventFailed)
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	is := is.New(t)
+	hook := newReceiver(t, "secret")
+	defer hook.server.Close()
+	hook.failures = 10
+	notifier, valkeyStore := setupNotifier(t, []structure.Webhook{{Url: hook.server.URL}})
+
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventFailed, CreativeId: "creative"})
+	now := time.Now()
+	for range notifier.maxAttempts {
+		notifier.deliverDue(now)
+		now = now.Add(maxBackoff)
+	}
+	is.Equal(hook.failures, 10-notifier.maxAttempts)
+	pending, err := valkeyStore.ClaimDueWebhookDeliveries(now.Add(maxBackoff), now.Add(2*maxBackoff), 10)
+	is.NoErr(err)
+	is.Equal(len(pending), 0)
+}
+
+func TestClaimedDeliveryIsSentAfterClaimTimeout(t *testing.T) {
+	is := is.New(t)
+	hook := newReceiver(t, "secret")
+	defer hook.server.Close()
+	notifier, valkeyStore := setupNotifier(t, []structure.Webhook{{Url: hook.server.URL}})
+
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"})
+	now := time.Now()
+	// Claimed by an instance that stopped before sending it
+	claimed, err := valkeyStore.ClaimDueWebhookDeliveries(now, now.Add(claimTimeout), 10)
+	is.NoErr(err)
+	is.Equal(len(claimed), 1)
+	notifier.deliverDue(now)
+	is.Equal(len(hook.events), 0)
+
+	notifier.deliverDue(now.Add(claimTimeout))
+	is.Equal(len(hook.events), 1)
+	// Removed once sent
+	notifier.deliverDue(now.Add(2 * claimTimeout))
+	is.Equal(len(hook.events), 1)
+}
+
+func TestRetryDelay(t *testing.T) {
+	is := is.New(t)
+	notifier := NewNotifier(nil, nil, "", 10, nil)
+	is.Equal(notifier.retryDelay(1), 10*time.Second)
+	is.Equal(notifier.retryDelay(2), 20*time.Second)
+	is.Equal(notifier.retryDelay(4), 80*time.Second)
+	is.Equal(notifier.retryDelay(20), maxBackoff)
+}
+
+func TestWebhookCache(t *testing.T) {
+	is := is.New(t)
+	first := newReceiver(t, "secret")
+	defer first.server.Close()
+	second := newReceiver(t, "secret")
+	defer second.server.Close()
+	notifier, valkeyStore := setupNotifier(t, nil)
+	now := time.Now()
+	notifier.now = func() time.Time { return now }
+	is.NoErr(valkeyStore.AddWebhook(structure.Webhook{Url: first.server.URL}))
+
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventQueued, CreativeId: "creative"})
+	// Registered through another instance, not seen until the cache expires
+	is.NoErr(valkeyStore.AddWebhook(structure.Webhook{Url: second.server.URL}))
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventInProgress, CreativeId: "creative"})
+	now = now.Add(webhookCacheTtl)
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventCompleted, CreativeId: "creative"})
+	// Removed through this instance, not notified right away
+	is.NoErr(valkeyStore.RemoveWebhook(structure.Webhook{Url: first.server.URL}))
+	notifier.InvalidateWebhooks()
+	notifier.Notify(structure.CreativeEvent{Event: structure.EventBlacklisted, CreativeId: "creative"})
+	notifier.deliverDue(time.Now())
+
+	is.Equal(len(first.events), 3)
+	is.Equal(len(second.events), 2)
+	is.True(slices.ContainsFunc(second.events, func(event structure.CreativeEvent) bool {
+		return event.Event == structure.EventBlacklisted
+	}))
+}